@@ -4,7 +4,9 @@ import (
 	"fmt"
 	"math/big"
 	"os"
+	"strings"
 	"text/tabwriter"
+	"time"
 
 	"github.com/spf13/cobra"
 
@@ -16,8 +18,12 @@ import (
 const scanHistoryLen = 30
 
 var (
-	hostdbNumHosts int
-	hostdbVerbose  bool
+	hostdbActiveCount      int
+	hostdbActiveProfile    string
+	hostdbNumHosts         int
+	hostdbProfilesFallback bool
+	hostdbProfilesUnset    bool
+	hostdbVerbose          bool
 )
 
 var (
@@ -28,6 +34,15 @@ var (
 		Run:   wrap(hostdbcmd),
 	}
 
+	hostdbActiveCmd = &cobra.Command{
+		Use:   "active",
+		Short: "View the active hosts of a hostdb profile.",
+		Long: `View the active hosts of a hostdb profile, starting with the highest weighted
+host. Use --profile to select the profile, the default profile is used if none
+is provided, and --count to limit the number of hosts displayed.`,
+		Run: wrap(hostdbactivecmd),
+	}
+
 	hostdbViewCmd = &cobra.Command{
 		Use:   "view [pubkey]",
 		Short: "View the full information for a host.",
@@ -35,6 +50,26 @@ var (
 		Run:   wrap(hostdbviewcmd),
 	}
 
+	hostdbPersistInfoCmd = &cobra.Command{
+		Use:   "persist-info",
+		Short: "View information about the hostdb persistence file.",
+		Long: `View the header and version of the hostdb persistence file on disk. If the
+version matches the version used by siad, the block height, last consensus
+change and number of profiles stored in the file are shown as well. This helps
+diagnosing failed migrations.`,
+		Run: wrap(hostdbpersistinfocmd),
+	}
+
+	hostdbGeoRefreshCmd = &cobra.Command{
+		Use:   "geo-refresh",
+		Short: "Refresh the locations of all hosts.",
+		Long: `Download the geolocation database again and recompute the country of every
+host known to the hostdb. Hosts that can't be located keep their last known
+country. The refresh runs in the background while the hosts keep being
+scanned, siac displays its progress until it is finished.`,
+		Run: wrap(hostdbgeorefreshcmd),
+	}
+
 	hostdbProfilesCmd = &cobra.Command{
 		Use:   "profiles",
 		Short: "View and edit hostdb profiles.",
@@ -55,7 +90,8 @@ profile your file should be uploaded.
 performance. You can choose between "cold", "warm" and "hot". "cold"
 will pick cheap hosts with less performance while "hot" will pick 
 high-performance but more expensive hosts. "warm" is the default setting
-and makes a reasonable compromise between price and performance.
+and makes a reasonable compromise between price and performance. The aliases
+"cheap", "balanced" and "fast" can be used instead of "cold", "warm" and "hot".
 `,
 		Run: wrap(hostdbprofilesaddcmd),
 	}
@@ -66,19 +102,123 @@ and makes a reasonable compromise between price and performance.
 		Long: `Edit a hostdb profile to customize the way hosts are selected.
 
 Add to the command the [name] of the profile you want to edit and the
-[setting] ("storagetier", "addlocation" or "removelocation") you want to edit.
+[setting] ("storagetier", "addlocation", "removelocation", "addhost",
+"removehost", "pinhost", "unpinhost", "enforceipdiversity", "minage",
+"minstorage", "minbandwidth", "minhostmaxduration", "minscans",
+"maxsettingsage", "maxprice", "renewwindow", "note" or "enabled") you want to
+edit.
 
 For the [value] of "storagetier" you can choose between "cold", "warm" and 
 "hot". "cold" will pick cheap hosts with less performance while "hot" will
 pick high-performance but more expensive hosts. "warm" is the default setting
-and makes a reasonable compromise between price and performance.
+and makes a reasonable compromise between price and performance. The aliases
+"cheap", "balanced" and "fast" can be used instead of "cold", "warm" and "hot".
 
 For the [value] of "addlocation" or "removelocation" you can simply type down
 the according country or region (e.g. "germany" or "eu"). Siad will only form
 contracts with hosts in the whitelisted locations. If no location is provided
-at all siad will pick hosts from all over the world.
+at all siad will pick hosts from all over the world. The location refers to
+where the hosts' IP addresses are located, not to any legal or payout
+considerations. Use "note" to record those.
+
+For the [value] of "addhost" or "removehost" provide the public key of a host
+(e.g. "ed25519:<hex>"). Siad will never form contracts with blacklisted hosts
+under this profile.
+
+For the [value] of "pinhost" or "unpinhost" provide the public key of a host as
+well. If any hosts are pinned siad will only form contracts with the pinned
+hosts under this profile. A host cannot be both pinned and blacklisted.
+
+For the [value] of "enforceipdiversity" provide "true" or "false". If it is
+enabled siad will never pick two hosts from the same subnet under this profile.
+
+For the [value] of "minage" provide a number of blocks. Siad will only pick
+hosts that were first seen at least that many blocks ago under this profile.
+Use 0 to accept hosts of any age.
+
+For the [value] of "minstorage" provide a number of bytes. Siad will only pick
+hosts that announce at least that much remaining storage under this profile.
+Use 0 to accept nearly full hosts as well.
+
+For the [value] of "minbandwidth" provide a number of bytes per second. Siad
+will only pick hosts whose bandwidth was measured at least that high by their
+last successful scan under this profile, e.g. to keep slow hosts out of a hot
+profile. The measurement is a rough estimate. Use 0 to accept hosts of any
+bandwidth.
+
+For the [value] of "minhostmaxduration" provide a number of blocks. Siad will
+only pick hosts that accept contracts lasting at least that long under this
+profile. Set it to at least the allowance period plus the renew window so that
+contracts can cover the whole period. Use 0 to accept hosts of any maximum
+duration.
+
+For the [value] of "minscans" provide a number of scans. Siad will only pick
+hosts that have been scanned at least that often under this profile, so that a
+single lucky scan doesn't make a host eligible. The default of 1 only requires
+the last scan of a host to be successful.
+
+For the [value] of "maxsettingsage" provide a duration (e.g. "12h"). Siad will
+only pick hosts whose settings were fetched by a successful scan at most that
+long ago under this profile, so that contracts aren't formed at outdated
+prices. Hosts with older settings are picked again once they have been
+rescanned. Use 0 to accept settings of any age.
+
+For the [value] of "maxprice" provide a storage price in currency / TB / Month
+(e.g. "500SC"). Siad will only pick hosts that charge at most that much under
+this profile. Use 0 to accept hosts of any price. If the profile doesn't match
+any of the active hosts anymore a warning is printed.
+
+For the [value] of "renewwindow" provide a number of blocks. Siad will renew
+contracts with hosts of this profile that many blocks before they expire
+instead of using the renew window of the allowance, e.g. to renew contracts
+with hot hosts earlier to avoid gaps. It has to be less than the allowance
+period. Use 0 to use the renew window of the allowance.
+
+For the [value] of "note" provide a free text of at most 256 characters (e.g.
+"hosts for EU customers, pay in EUR"). The note annotates why the profile
+exists and is shown when listing the profiles, it doesn't affect the host
+selection. Use "" to remove the note.
+
+For the [value] of "enabled" provide "true" or "false". A disabled profile
+keeps its settings and hosts but siad doesn't pick any hosts from it until it
+is enabled again. An allowance cannot use a disabled profile. The default
+profile and the active profile cannot be disabled.
+
+Use the --unset flag without a [value] to reset "storagetier",
+"enforceipdiversity", "minage", "minstorage", "minbandwidth",
+"minhostmaxduration", "minscans", "maxsettingsage", "maxprice", "renewwindow",
+"note" or "enabled" to its default, e.g. to remove the maximum price.
 `,
-		Run: wrap(hostdbprofilesconfigcmd),
+		Run: hostdbprofilesconfigcmd,
+	}
+
+	hostdbProfilesBlacklistImportCmd = &cobra.Command{
+		Use:   "blacklist-import [name] [file]",
+		Short: "Blacklist the hosts listed in a file.",
+		Long: `Add the hosts listed in a file to the blacklist of a hostdb profile. The
+file lists one host public key (e.g. "ed25519:<hex>") per line. Blank lines and
+comments starting with "#" are ignored. Hosts that are already blacklisted are
+skipped. Nothing is blacklisted if any of the keys is malformed.`,
+		Run: wrap(hostdbprofilesblacklistimportcmd),
+	}
+
+	hostdbProfilesSetDefaultCmd = &cobra.Command{
+		Use:   "set-default [name]",
+		Short: "Set the active hostdb profile.",
+		Long: `Set the hostdb profile that is used whenever no profile is specified,
+e.g. when forming contracts for the allowance. The setting persists across
+restarts. Use "default" to go back to the default profile.`,
+		Run: wrap(hostdbprofilessetdefaultcmd),
+	}
+
+	hostdbProfilesDeleteCmd = &cobra.Command{
+		Use:   "delete [name]",
+		Short: "Delete a hostdb profile.",
+		Long: `Delete a hostdb profile. The "default" profile cannot be deleted.
+Deleting the active profile, which is used for the allowance, fails unless the
+--fallback flag is set, in which case the "default" profile becomes the active
+profile.`,
+		Run: wrap(hostdbprofilesdeletecmd),
 	}
 )
 
@@ -108,9 +248,10 @@ func hostdbcmd() {
 			return
 		}
 
-		// Strip down to the number of requested hosts.
+		// Strip down to the number of requested hosts. The active hosts
+		// start with the highest weighted one.
 		if hostdbNumHosts != 0 && hostdbNumHosts < len(info.Hosts) {
-			info.Hosts = info.Hosts[len(info.Hosts)-hostdbNumHosts:]
+			info.Hosts = info.Hosts[:hostdbNumHosts]
 		}
 
 		fmt.Println(len(info.Hosts), "Active Hosts:")
@@ -118,11 +259,11 @@ func hostdbcmd() {
 		fmt.Fprintln(w, "\t\tAddress\tPrice (per TB per Mo)")
 		for i, host := range info.Hosts {
 			price := host.StoragePrice.Mul(modules.BlockBytesPerMonthTerabyte)
-			fmt.Fprintf(w, "\t%v:\t%v\t%v\n", len(info.Hosts)-i, host.NetAddress, currencyUnits(price))
+			fmt.Fprintf(w, "\t%v:\t%v\t%v\n", i+1, host.NetAddress, currencyUnits(price))
 		}
 		w.Flush()
 	} else {
-		info, err := httpClient.HostDbAllGet()
+		info, err := httpClient.HostDbAllGet("")
 		if err != nil {
 			die("Could not fetch host list:", err)
 		}
@@ -255,7 +396,7 @@ func hostdbcmd() {
 		referenceScore := big.NewRat(1, 1)
 		if len(activeHosts) > 0 {
 			referenceIndex := len(activeHosts) / 5
-			hostInfo, err := httpClient.HostDbHostsGet(activeHosts[referenceIndex].PublicKey)
+			hostInfo, err := httpClient.HostDbHostsGet(activeHosts[referenceIndex].PublicKey, "")
 			if err != nil {
 				die("Could not fetch provided host:", err)
 			}
@@ -305,7 +446,7 @@ func hostdbcmd() {
 			}
 
 			// Grab the score information for the active hosts.
-			hostInfo, err := httpClient.HostDbHostsGet(host.PublicKey)
+			hostInfo, err := httpClient.HostDbHostsGet(host.PublicKey, "")
 			if err != nil {
 				die("Could not fetch provided host:", err)
 			}
@@ -322,7 +463,7 @@ func hostdbcmd() {
 func hostdbviewcmd(pubkey string) {
 	var publicKey types.SiaPublicKey
 	publicKey.LoadString(pubkey)
-	info, err := httpClient.HostDbHostsGet(publicKey)
+	info, err := httpClient.HostDbHostsGet(publicKey, "")
 	if err != nil {
 		die("Could not fetch provided host:", err)
 	}
@@ -332,6 +473,13 @@ func hostdbviewcmd(pubkey string) {
 	fmt.Println("  Public Key:", info.Entry.PublicKeyString)
 	fmt.Println("  Block First Seen:", info.Entry.FirstSeen)
 	fmt.Println("  Location:", info.Entry.Country)
+	if len(info.Entry.Tags) > 0 {
+		fmt.Println("  Tags:", strings.Join(info.Entry.Tags, ", "))
+	}
+	if info.Entry.Bandwidth > 0 {
+		fmt.Println("  Latency:", info.Entry.Latency)
+		fmt.Println("  Bandwidth:", filesizeUnits(int64(info.Entry.Bandwidth))+"/s")
+	}
 
 	fmt.Println("\n  Host Settings:")
 	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
@@ -376,6 +524,66 @@ func hostdbviewcmd(pubkey string) {
 	fmt.Println()
 }
 
+func hostdbpersistinfocmd() {
+	info, err := httpClient.HostDbPersistGet()
+	if err != nil {
+		die("Could not fetch hostdb persistence info:", err)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Header:\t%v\n", info.Header)
+	fmt.Fprintf(w, "Version:\t%v\n", info.Version)
+	fmt.Fprintf(w, "Block Height:\t%v\n", info.BlockHeight)
+	fmt.Fprintf(w, "Last Change:\t%x\n", info.LastChange[:])
+	fmt.Fprintf(w, "Profiles:\t%v\n", info.Profiles)
+	w.Flush()
+}
+
+// hostdbgeorefreshcmd starts a refresh of the host locations and displays its
+// progress until it is finished.
+func hostdbgeorefreshcmd() {
+	if err := httpClient.HostDbGeolocationRefreshPost(); err != nil {
+		die("Could not refresh the host locations:", err)
+	}
+	for {
+		status, err := httpClient.HostDbGeolocationRefreshGet()
+		if err != nil {
+			die("Could not fetch the progress of the refresh:", err)
+		}
+		fmt.Printf("\rLocating hosts... %v of %v done, %v changed    ", status.Processed, status.Hosts, status.Changed)
+		if !status.Running {
+			fmt.Println()
+			if status.Error != "" {
+				fmt.Println("The geolocation database could not be downloaded again, the hosts were located with the database in use:", status.Error)
+			}
+			fmt.Printf("Refreshed the locations of %v hosts, %v of them changed.\n", status.Hosts, status.Changed)
+			return
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// hostdbactivecmd displays the active hosts of a hostdb profile together with
+// their location and storage price.
+func hostdbactivecmd() {
+	info, err := httpClient.HostDbActiveProfileNGet(hostdbActiveProfile, hostdbActiveCount)
+	if err != nil {
+		die("Could not fetch active hosts:", err)
+	}
+	if len(info.Hosts) == 0 {
+		fmt.Println("No known active hosts")
+		return
+	}
+
+	fmt.Println(len(info.Hosts), "Active Hosts:")
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "\t\tAddress\tCountry\tPrice (per TB per Mo)")
+	for i, host := range info.Hosts {
+		price := host.StoragePrice.Mul(modules.BlockBytesPerMonthTerabyte)
+		fmt.Fprintf(w, "\t%v:\t%v\t%v\t%v\n", i+1, host.NetAddress, host.Country, currencyUnits(price))
+	}
+	w.Flush()
+}
+
 func hostdbprofilescmd() {
 	hdbp, err := httpClient.HostDbProfilesGet()
 	if err != nil {
@@ -388,8 +596,17 @@ func hostdbprofilescmd() {
 	Profile "%v":
 		Storage Tier:	%v
 		Host Location:	%v
-
 `, k, v.Storagetier, v.Location)
+		if v.RenewWindow > 0 {
+			fmt.Printf("\t\tRenew Window:\t%v blocks\n", v.RenewWindow)
+		}
+		if v.Note != "" {
+			fmt.Printf("\t\tNote:\t\t%v\n", v.Note)
+		}
+		if !v.Enabled {
+			fmt.Println("\t\tDisabled")
+		}
+		fmt.Println()
 	}
 }
 
@@ -401,10 +618,92 @@ func hostdbprofilesaddcmd(name, storagetier string) {
 	fmt.Println("Added hostdb profile", name)
 }
 
-func hostdbprofilesconfigcmd(name, setting, value string) {
-	err := httpClient.HostDbProfilesConfigPost(name, setting, value)
+func hostdbprofilesconfigcmd(cmd *cobra.Command, args []string) {
+	if hostdbProfilesUnset {
+		if len(args) != 2 {
+			cmd.UsageFunc()(cmd)
+			os.Exit(exitCodeUsage)
+		}
+		name, setting := args[0], args[1]
+		if _, err := httpClient.HostDbProfilesUnsetPost(name, setting); err != nil {
+			die("Could not unset hostdb profile setting:", err)
+		}
+		fmt.Printf("Setting %q of profile %q has been reset to its default.\n", setting, name)
+		return
+	}
+	if len(args) != 3 {
+		cmd.UsageFunc()(cmd)
+		os.Exit(exitCodeUsage)
+	}
+	name, setting, value := args[0], args[1], args[2]
+
+	// currency/TB/month (convert to hastings/byte/block)
+	if setting == "maxprice" {
+		hastings, err := parseCurrency(value)
+		if err != nil {
+			die("Could not parse "+setting+":", err)
+		}
+		i, _ := new(big.Int).SetString(hastings, 10)
+		value = types.NewCurrency(i).Div(modules.BlockBytesPerMonthTerabyte).String()
+	}
+	resp, err := httpClient.HostDbProfilesConfigPost(name, setting, value)
 	if err != nil {
 		die("Could not edit hostdb profile:", err)
 	}
 	fmt.Println("Profile \"" + name + "\" has been edited successfully.")
+	if resp.Warning != "" {
+		fmt.Println("Warning:", resp.Warning)
+	}
+}
+
+func hostdbprofilesblacklistimportcmd(name, filename string) {
+	file, err := os.Open(filename)
+	if err != nil {
+		die("Could not open blacklist file:", err)
+	}
+	keys, err := parseHostKeys(file)
+	file.Close()
+	if err != nil {
+		die("Could not read blacklist file:", err)
+	}
+	profile, err := httpClient.HostDbProfileGet(name)
+	if err != nil {
+		die("Could not get hostdb profile:", err)
+	}
+
+	blacklisted := make(map[string]struct{})
+	for _, pk := range profile.Blacklist {
+		blacklisted[pk.String()] = struct{}{}
+	}
+	added := 0
+	for _, pk := range keys {
+		if _, exists := blacklisted[pk.String()]; exists {
+			continue
+		}
+		if _, err := httpClient.HostDbProfilesConfigPost(name, "addhost", pk.String()); err != nil {
+			die(fmt.Sprintf("Could not blacklist host %v (%v hosts were blacklisted before):", pk.String(), added), err)
+		}
+		blacklisted[pk.String()] = struct{}{}
+		added++
+	}
+	fmt.Printf("Blacklisted %v hosts for profile \"%v\", %v were already blacklisted.\n", added, name, len(keys)-added)
+}
+
+func hostdbprofilessetdefaultcmd(name string) {
+	err := httpClient.HostDbProfilesSetDefaultPost(name)
+	if err != nil {
+		die("Could not set active hostdb profile:", err)
+	}
+	fmt.Println("Profile \"" + name + "\" is now the active profile.")
+}
+
+func hostdbprofilesdeletecmd(name string) {
+	resp, err := httpClient.HostDbProfilesDeletePost(name, hostdbProfilesFallback)
+	if err != nil {
+		die("Could not delete hostdb profile:", err)
+	}
+	fmt.Println("Profile \"" + name + "\" has been deleted.")
+	if resp.FellBack {
+		fmt.Println("Profile \"" + resp.ActiveProfile + "\" is now the active profile.")
+	}
 }
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// TestHostdbActiveCmdQuery tests that the --count and --profile flags of the
+// hostdb active command are mapped to the numhosts and profile query parameters
+// of the /hostdb/active endpoint.
+func TestHostdbActiveCmdQuery(t *testing.T) {
+	var query url.Values
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/hostdb/active" {
+			t.Errorf("unexpected request path %q", req.URL.Path)
+		}
+		query = req.URL.Query()
+		w.Write([]byte(`{"hosts":[]}`))
+	}))
+	defer srv.Close()
+
+	oldAddress, oldCount, oldProfile := httpClient.Address, hostdbActiveCount, hostdbActiveProfile
+	defer func() {
+		httpClient.Address, hostdbActiveCount, hostdbActiveProfile = oldAddress, oldCount, oldProfile
+	}()
+	httpClient.Address = strings.TrimPrefix(srv.URL, "http://")
+
+	tests := []struct {
+		count    int
+		profile  string
+		numhosts string
+		name     string
+	}{
+		{0, "", "", ""},
+		{5, "", "5", ""},
+		{0, "eu", "", "eu"},
+		{12, "Cheap", "12", "cheap"},
+	}
+	for _, test := range tests {
+		hostdbActiveCount, hostdbActiveProfile = test.count, test.profile
+		hostdbactivecmd()
+		if _, ok := query["numhosts"]; ok != (test.numhosts != "") || query.Get("numhosts") != test.numhosts {
+			t.Errorf("count %v: expected numhosts %q, got %q", test.count, test.numhosts, query.Get("numhosts"))
+		}
+		if _, ok := query["profile"]; ok != (test.name != "") || query.Get("profile") != test.name {
+			t.Errorf("profile %q: expected profile %q, got %q", test.profile, test.name, query.Get("profile"))
+		}
+	}
+}
@@ -95,13 +95,23 @@ func main() {
 	hostContractCmd.Flags().StringVarP(&hostContractOutputType, "type", "t", "value", "Select output type")
 
 	root.AddCommand(hostdbCmd)
+	hostdbCmd.AddCommand(hostdbActiveCmd)
 	hostdbCmd.AddCommand(hostdbViewCmd)
+	hostdbCmd.AddCommand(hostdbPersistInfoCmd)
+	hostdbCmd.AddCommand(hostdbGeoRefreshCmd)
 	hostdbCmd.AddCommand(hostdbProfilesCmd)
 	hostdbCmd.Flags().IntVarP(&hostdbNumHosts, "numhosts", "n", 0, "Number of hosts to display from the hostdb")
 	hostdbCmd.Flags().BoolVarP(&hostdbVerbose, "verbose", "v", false, "Display full hostdb information")
+	hostdbActiveCmd.Flags().IntVarP(&hostdbActiveCount, "count", "c", 0, "Number of active hosts to display, all if 0")
+	hostdbActiveCmd.Flags().StringVarP(&hostdbActiveProfile, "profile", "p", "", "Name of the hostdb profile to display the active hosts of")
 
 	hostdbProfilesCmd.AddCommand(hostdbProfilesAddCmd)
 	hostdbProfilesCmd.AddCommand(hostdbProfilesConfigCmd)
+	hostdbProfilesCmd.AddCommand(hostdbProfilesBlacklistImportCmd)
+	hostdbProfilesCmd.AddCommand(hostdbProfilesSetDefaultCmd)
+	hostdbProfilesCmd.AddCommand(hostdbProfilesDeleteCmd)
+	hostdbProfilesDeleteCmd.Flags().BoolVarP(&hostdbProfilesFallback, "fallback", "f", false, "Fall back to the default profile if the profile is active")
+	hostdbProfilesConfigCmd.Flags().BoolVarP(&hostdbProfilesUnset, "unset", "u", false, "Reset the setting to its default instead of providing a value")
 
 	root.AddCommand(minerCmd)
 	minerCmd.AddCommand(minerStartCmd, minerStopCmd)
@@ -1,16 +1,45 @@
 package main
 
 import (
+	"bufio"
 	"errors"
 	"fmt"
+	"io"
 	"math"
 	"math/big"
+	"regexp"
 	"strings"
 
 	"github.com/pachisi456/sia-hostdb-profiles/types"
 )
 
-var errUnableToParseSize = errors.New("unable to parse size")
+var (
+	errUnableToParseSize = errors.New("unable to parse size")
+
+	// errMalformedAmount is returned by parseCurrency if the numeric part of
+	// an amount can't be parsed.
+	errMalformedAmount = errors.New("malformed amount")
+
+	// errMissingUnits is returned by parseCurrency if an amount has no or an
+	// unknown unit.
+	errMissingUnits = errors.New("amount is missing units; run 'wallet --help' for a list of units")
+
+	// errNegativeAmount is returned by parseCurrency if an amount is negative.
+	errNegativeAmount = errors.New("amount must not be negative")
+
+	// errNonIntegerHastings is returned by parseCurrency if an amount does not
+	// convert to a whole number of hastings.
+	errNonIntegerHastings = errors.New("non-integer number of hastings")
+
+	// errMalformedHostKey is returned by parseHostKeys if a line doesn't
+	// contain a valid host public key.
+	errMalformedHostKey = errors.New("malformed host public key")
+
+	// amountRegexp matches a non-negative decimal number with an optional
+	// exponent. The exponent is limited to three digits so that a typo can't
+	// cause a huge allocation.
+	amountRegexp = regexp.MustCompile(`^(\d+\.?\d*|\.\d+)([eE][+-]?\d{1,3})?$`)
+)
 
 // filesize returns a string that displays a filesize in human-readable units.
 func filesizeUnits(size int64) string {
@@ -130,15 +159,18 @@ func currencyUnits(c types.Currency) string {
 	return fmt.Sprintf("%.4g %s", res, unit)
 }
 
-// parseCurrency converts a siacoin amount to base units.
+// parseCurrency converts a siacoin amount to base units. The amount may be
+// separated from its unit by whitespace and may use scientific notation, e.g.
+// "1.5e3 SC". Negative amounts and amounts that do not result in an integer
+// number of hastings are rejected.
 func parseCurrency(amount string) (string, error) {
+	amount = strings.TrimSpace(amount)
 	units := []string{"pS", "nS", "uS", "mS", "SC", "KS", "MS", "GS", "TS"}
 	for i, unit := range units {
 		if strings.HasSuffix(amount, unit) {
-			// scan into big.Rat
-			r, ok := new(big.Rat).SetString(strings.TrimSuffix(amount, unit))
-			if !ok {
-				return "", errors.New("malformed amount")
+			r, err := parseAmount(strings.TrimSuffix(amount, unit))
+			if err != nil {
+				return "", err
 			}
 			// convert units
 			exp := 24 + 3*(int64(i)-4)
@@ -146,17 +178,42 @@ func parseCurrency(amount string) (string, error) {
 			r.Mul(r, new(big.Rat).SetInt(mag))
 			// r must be an integer at this point
 			if !r.IsInt() {
-				return "", errors.New("non-integer number of hastings")
+				return "", errNonIntegerHastings
 			}
 			return r.RatString(), nil
 		}
 	}
 	// check for hastings separately
 	if strings.HasSuffix(amount, "H") {
-		return strings.TrimSuffix(amount, "H"), nil
+		r, err := parseAmount(strings.TrimSuffix(amount, "H"))
+		if err != nil {
+			return "", err
+		}
+		if !r.IsInt() {
+			return "", errNonIntegerHastings
+		}
+		return r.RatString(), nil
 	}
 
-	return "", errors.New("amount is missing units; run 'wallet --help' for a list of units")
+	return "", errMissingUnits
+}
+
+// parseAmount parses the numeric part of a currency amount into a big.Rat.
+// Only plain decimal numbers with an optional exponent are accepted; big.Rat
+// would otherwise also accept fractions and hex, octal or binary numbers.
+func parseAmount(amount string) (*big.Rat, error) {
+	amount = strings.TrimSpace(amount)
+	if strings.HasPrefix(amount, "-") {
+		return nil, errNegativeAmount
+	}
+	if !amountRegexp.MatchString(amount) {
+		return nil, errMalformedAmount
+	}
+	r, ok := new(big.Rat).SetString(amount)
+	if !ok {
+		return nil, errMalformedAmount
+	}
+	return r, nil
 }
 
 // yesNo returns "Yes" if b is true, and "No" if b is false.
@@ -166,3 +223,28 @@ func yesNo(b bool) string {
 	}
 	return "No"
 }
+
+// parseHostKeys parses a newline-delimited list of host public keys, e.g.
+// "ed25519:<hex>". Blank lines and everything following a '#' are ignored. The
+// line number of the first malformed key is reported.
+func parseHostKeys(r io.Reader) ([]types.SiaPublicKey, error) {
+	var keys []types.SiaPublicKey
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		s := scanner.Text()
+		if i := strings.IndexByte(s, '#'); i >= 0 {
+			s = s[:i]
+		}
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		var spk types.SiaPublicKey
+		spk.LoadString(s)
+		if len(spk.Key) == 0 {
+			return nil, fmt.Errorf("%w on line %v: %q", errMalformedHostKey, line, s)
+		}
+		keys = append(keys, spk)
+	}
+	return keys, scanner.Err()
+}
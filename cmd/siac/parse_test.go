@@ -1,7 +1,9 @@
 package main
 
 import (
+	"errors"
 	"math/big"
+	"strings"
 	"testing"
 
 	"github.com/pachisi456/sia-hostdb-profiles/types"
@@ -122,3 +124,88 @@ func TestCurrencyUnits(t *testing.T) {
 		}
 	}
 }
+
+func TestParseCurrency(t *testing.T) {
+	tests := []struct {
+		in, out string
+		err     error
+	}{
+		{"1H", "1", nil},
+		{"1pS", "1000000000000", nil},
+		{"1nS", "1000000000000000", nil},
+		{"1uS", "1000000000000000000", nil},
+		{"1mS", "1000000000000000000000", nil},
+		{"1SC", "1000000000000000000000000", nil},
+		{"1KS", "1000000000000000000000000000", nil},
+		{"1MS", "1000000000000000000000000000000", nil},
+		{"1GS", "1000000000000000000000000000000000", nil},
+		{"1TS", "1000000000000000000000000000000000000", nil},
+		{"1.5SC", "1500000000000000000000000", nil},
+		{".5SC", "500000000000000000000000", nil},
+		{"1 SC", "1000000000000000000000000", nil},
+		{" 1\tSC ", "1000000000000000000000000", nil},
+		{"100 H", "100", nil},
+		{"1e3H", "1000", nil},
+		{"1e3SC", "1000000000000000000000000000", nil},
+		{"1.5E-3 SC", "1500000000000000000000", nil},
+		{"2.5e+2 pS", "250000000000000", nil},
+		{"0SC", "0", nil},
+		{"-1SC", "", errNegativeAmount},
+		{"-1 H", "", errNegativeAmount},
+		{"- 1SC", "", errNegativeAmount},
+		{"1.5H", "", errNonIntegerHastings},
+		{"1e-1H", "", errNonIntegerHastings},
+		{"1e-13pS", "", errNonIntegerHastings},
+		{"1 000 SC", "", errMalformedAmount},
+		{"1/2SC", "", errMalformedAmount},
+		{"0x10SC", "", errMalformedAmount},
+		{"1e1000000SC", "", errMalformedAmount},
+		{"SC", "", errMalformedAmount},
+		{"H", "", errMalformedAmount},
+		{"oneSC", "", errMalformedAmount},
+		{"1", "", errMissingUnits},
+		{"1 S C", "", errMissingUnits},
+		{"1sc", "", errMissingUnits},
+		{"", "", errMissingUnits},
+	}
+	for _, test := range tests {
+		res, err := parseCurrency(test.in)
+		if res != test.out || err != test.err {
+			t.Errorf("parseCurrency(%q): expected %v %v, got %v %v", test.in, test.out, test.err, res, err)
+		}
+	}
+}
+
+// TestParseHostKeys checks that host public keys are parsed from a list
+// containing comments and blank lines, and that malformed keys are reported
+// with their line number.
+func TestParseHostKeys(t *testing.T) {
+	key1 := "ed25519:" + strings.Repeat("ab", 32)
+	key2 := "ed25519:" + strings.Repeat("cd", 32)
+	list := "# hosts that lost data\n" +
+		"\n" +
+		key1 + "\n" +
+		"   \t\n" +
+		"  " + key2 + "  # flaky since May\n" +
+		"#" + key1 + "\n"
+	keys, err := parseHostKeys(strings.NewReader(list))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys[0].String() != key1 || keys[1].String() != key2 {
+		t.Fatal("wrong keys:", keys)
+	}
+
+	// An empty list is fine.
+	if keys, err := parseHostKeys(strings.NewReader("# nothing yet\n\n")); err != nil || len(keys) != 0 {
+		t.Fatal("expected no keys, got", keys, err)
+	}
+
+	// Malformed keys are reported with their line number.
+	for _, bad := range []string{"notakey", "ed25519:xyz", "ed25519:"} {
+		_, err := parseHostKeys(strings.NewReader("# comment\n" + key1 + "\n\n" + bad + "\n"))
+		if !errors.Is(err, errMalformedHostKey) || !strings.Contains(err.Error(), "line 4") {
+			t.Errorf("%q: expected a malformed key on line 4, got %v", bad, err)
+		}
+	}
+}
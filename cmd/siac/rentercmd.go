@@ -400,7 +400,7 @@ func rentercontractsviewcmd(cid string) {
 
 	for _, rc := range rc.Contracts {
 		if rc.ID.String() == cid {
-			hostInfo, err := httpClient.HostDbHostsGet(rc.HostPublicKey)
+			hostInfo, err := httpClient.HostDbHostsGet(rc.HostPublicKey, "")
 			if err != nil {
 				die("Could not fetch details of host: ", err)
 			}
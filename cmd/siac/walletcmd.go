@@ -316,7 +316,7 @@ func walletloadseedcmd() {
 	if err != nil {
 		die("Reading password failed:", err)
 	}
-	err = httpClient.WalletSeedPost(seed, password)
+	err = httpClient.WalletSeedPost(seed, "english", password)
 	if err != nil {
 		die("Could not add seed:", err)
 	}
@@ -457,7 +457,7 @@ func walletsweepcmd() {
 		die("Reading seed failed:", err)
 	}
 
-	swept, err := httpClient.WalletSweepPost(seed)
+	swept, err := httpClient.WalletSweepPost(seed, "english")
 	if err != nil {
 		die("Could not sweep seed:", err)
 	}
@@ -23,6 +23,10 @@ var ProdDependencies = new(ProductionDependencies)
 // dependencies can be created to inject certain behavior during testing.
 type (
 	Dependencies interface {
+		// Clock provides the current time and timers. Custom clocks allow
+		// tests to control the passing of time.
+		Clock
+
 		// AtLeastOne will return a value that is at least one. In production,
 		// the value should always be one. This function is used to test the
 		// idempotency of actions, so during testing sometimes the value
@@ -41,8 +45,9 @@ type (
 		Destruct()
 
 		// DialTimeout tries to create a tcp connection to the specified
-		// address with a certain timeout.
-		DialTimeout(NetAddress, time.Duration) (net.Conn, error)
+		// address with a certain timeout. The dial is aborted once the
+		// cancel channel is closed.
+		DialTimeout(NetAddress, time.Duration, <-chan struct{}) (net.Conn, error)
 
 		// Disrupt can be inserted in the code as a way to inject problems,
 		// such as a network call that take 10 minutes or a disk write that
@@ -97,6 +102,16 @@ type (
 		WriteFile(string, []byte, os.FileMode) error
 	}
 
+	// Clock abstracts the passing of time.
+	Clock interface {
+		// After waits for the duration to elapse and then sends the current
+		// time on the returned channel.
+		After(time.Duration) <-chan time.Time
+
+		// Now returns the current time.
+		Now() time.Time
+	}
+
 	// File implements all of the methods that can be called on an os.File.
 	File interface {
 		io.ReadWriteCloser
@@ -153,6 +168,12 @@ func (pf *ProductionFile) Close() error {
 	return pf.File.Close()
 }
 
+// After waits for the duration to elapse and then sends the current time on
+// the returned channel.
+func (*ProductionDependencies) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
 // AtLeastOne will return a value that is equal to 1 if debugging is disabled.
 // If debugging is enabled, a higher value may be returned.
 func (*ProductionDependencies) AtLeastOne() uint64 {
@@ -208,9 +229,13 @@ func (pd *ProductionDependencies) Destruct() {
 }
 
 // DialTimeout creates a tcp connection to a certain address with the specified
-// timeout.
-func (*ProductionDependencies) DialTimeout(addr NetAddress, timeout time.Duration) (net.Conn, error) {
-	return net.DialTimeout("tcp", string(addr), timeout)
+// timeout. The dial is aborted once the cancel channel is closed.
+func (*ProductionDependencies) DialTimeout(addr NetAddress, timeout time.Duration, cancel <-chan struct{}) (net.Conn, error) {
+	dialer := &net.Dialer{
+		Cancel:  cancel,
+		Timeout: timeout,
+	}
+	return dialer.Dial("tcp", string(addr))
 }
 
 // Disrupt can be used to inject specific behavior into a module by overwriting
@@ -327,6 +352,11 @@ func (pd *ProductionDependencies) RenameFile(s1 string, s2 string) error {
 	return os.Rename(s1, s2)
 }
 
+// Now returns the current time.
+func (*ProductionDependencies) Now() time.Time {
+	return time.Now()
+}
+
 // Sleep blocks the calling thread for a certain duration.
 func (*ProductionDependencies) Sleep(d time.Duration) {
 	time.Sleep(d)
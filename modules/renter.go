@@ -44,6 +44,16 @@ type Allowance struct {
 	Hosts       uint64            `json:"hosts"`
 	Period      types.BlockHeight `json:"period"`
 	RenewWindow types.BlockHeight `json:"renewwindow"`
+
+	// MaxHostsPerCountry caps the number of contracts formed with hosts in a
+	// single country. Zero means no cap.
+	MaxHostsPerCountry uint64 `json:"maxhostspercountry"`
+
+	// ProfileWeights spreads the contracts across several hostdb profiles. It
+	// maps the names of the profiles to their share of the contracts, relative
+	// to the other profiles. If it is empty all contracts are formed with
+	// hosts of the active profile.
+	ProfileWeights map[string]uint64 `json:"profileweights"`
 }
 
 // ContractUtility contains metrics internal to the contractor that reflect the
@@ -101,6 +111,11 @@ type HostDBEntry struct {
 	Country string `json:"country"`
 	EUhost  bool   `json:"euhost"`
 
+	// IPNets are the subnets of the IP addresses the host's address resolved
+	// to when it was last scanned. They are used to avoid selecting several
+	// hosts of the same subnet.
+	IPNets []string `json:"ipnets"`
+
 	// FirstSeen is the last block height at which this host was announced.
 	FirstSeen types.BlockHeight `json:"firstseen"`
 
@@ -118,17 +133,77 @@ type HostDBEntry struct {
 
 	LastHistoricUpdate types.BlockHeight
 
+	// Latency is the time it took to connect to the host and Bandwidth the
+	// approximate throughput in bytes per second at which the host sent its
+	// settings, both measured by the last successful scan. Bandwidth is zero
+	// if the host has never been measured.
+	Latency   time.Duration `json:"latency"`
+	Bandwidth uint64        `json:"bandwidth"`
+
+	// Tags annotate the host, e.g. "flaky" or "known-good". They are set by
+	// the user and don't affect the host selection.
+	Tags []string `json:"tags"`
+
 	// The public key of the host, stored separately to minimize risk of certain
 	// MitM based vulnerabilities.
 	PublicKey types.SiaPublicKey `json:"publickey"`
 }
 
+// LastScanSuccessful returns true if the most recent scan of the host was
+// successful, i.e. if the host is considered to be online.
+func (entry HostDBEntry) LastScanSuccessful() bool {
+	return len(entry.ScanHistory) > 0 && entry.ScanHistory[len(entry.ScanHistory)-1].Success
+}
+
+// MeasuredUptime returns the total time the host was measured to be online and
+// offline, including the compressed historic values. Each scan counts for the
+// time until the next scan. Scans that are out of order are ignored.
+func (entry HostDBEntry) MeasuredUptime() (uptime, downtime time.Duration) {
+	uptime, downtime = entry.HistoricUptime, entry.HistoricDowntime
+	if len(entry.ScanHistory) == 0 {
+		return
+	}
+	recentTime := entry.ScanHistory[0].Timestamp
+	recentSuccess := entry.ScanHistory[0].Success
+	for _, scan := range entry.ScanHistory[1:] {
+		if recentTime.After(scan.Timestamp) {
+			continue
+		}
+		if recentSuccess {
+			uptime += scan.Timestamp.Sub(recentTime)
+		} else {
+			downtime += scan.Timestamp.Sub(recentTime)
+		}
+		recentTime = scan.Timestamp
+		recentSuccess = scan.Success
+	}
+	return
+}
+
+// Uptime returns the fraction of the measured time the host was online, see
+// MeasuredUptime. If no time has been measured yet 0 is returned.
+func (entry HostDBEntry) Uptime() float64 {
+	uptime, downtime := entry.MeasuredUptime()
+	if uptime+downtime == 0 {
+		return 0
+	}
+	return float64(uptime) / float64(uptime+downtime)
+}
+
 // HostDBScan represents a single scan event.
 type HostDBScan struct {
 	Timestamp time.Time `json:"timestamp"`
 	Success   bool      `json:"success"`
 }
 
+// WeightedHostDBEntry is a HostDBEntry together with the weight it has in the
+// host tree of a hostdb profile and the storage tier of that profile.
+type WeightedHostDBEntry struct {
+	HostDBEntry
+	Weight      types.Currency `json:"weight"`
+	Storagetier string         `json:"storagetier"`
+}
+
 // HostScoreBreakdown provides a piece-by-piece explanation of why a host has
 // the score that they do.
 //
@@ -151,6 +226,113 @@ type HostScoreBreakdown struct {
 	VersionAdjustment          float64 `json:"versionadjustment"`
 }
 
+// HostDBMetrics is a snapshot of the health of the hostdb, intended for
+// monitoring.
+type HostDBMetrics struct {
+	TotalHosts           int            `json:"totalhosts"`
+	ActiveHosts          int            `json:"activehosts"`
+	StaleHosts           int            `json:"stalehosts"`
+	TreeSizes            map[string]int `json:"treesizes"`
+	InitialScanComplete  bool           `json:"initialscancomplete"`
+	ScanningThreads      int            `json:"scanningthreads"`
+	GeolocationAvailable bool           `json:"geolocationavailable"`
+
+	// QueuedScans is the number of hosts waiting to be scanned and
+	// PendingScans additionally includes the scans that are in progress. A
+	// growing backlog indicates that scanning isn't keeping up.
+	QueuedScans  int `json:"queuedscans"`
+	PendingScans int `json:"pendingscans"`
+}
+
+// HostDBPersistInfo describes the hostdb persistence file on disk, intended
+// for diagnosing failed migrations. BlockHeight, LastChange and Profiles are
+// only set if the file's metadata matches the current persist version.
+type HostDBPersistInfo struct {
+	Header      string            `json:"header"`
+	Version     string            `json:"version"`
+	BlockHeight types.BlockHeight `json:"blockheight"`
+	LastChange  ConsensusChangeID `json:"lastchange"`
+	Profiles    int               `json:"profiles"`
+}
+
+// HostDBGeolocationRefresh is the progress of a refresh of the locations of all
+// hosts known to the hostdb. Hosts is the number of hosts to locate, Processed
+// the number of hosts located so far and Changed the number of hosts whose
+// location changed. Error is set if the geolocation database couldn't be
+// downloaded again, the hosts are located with the database in use then.
+type HostDBGeolocationRefresh struct {
+	Running   bool      `json:"running"`
+	Started   time.Time `json:"started"`
+	Finished  time.Time `json:"finished"`
+	Hosts     int       `json:"hosts"`
+	Processed int       `json:"processed"`
+	Changed   int       `json:"changed"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// HostDBProfileFilters are the effective criteria a hostdb profile applies when
+// selecting hosts, resolved from its storage tier and its settings.
+type HostDBProfileFilters struct {
+	Storagetier string `json:"storagetier"`
+
+	// The factors by which the respective prices of a host are weighed when
+	// calculating its weight. Prices below MinTotalPrice don't give a host an
+	// advantage anymore.
+	ContractPriceMultiplier uint64         `json:"contractpricemultiplier"`
+	UploadPriceMultiplier   uint64         `json:"uploadpricemultiplier"`
+	DownloadPriceMultiplier uint64         `json:"downloadpricemultiplier"`
+	MinTotalPrice           types.Currency `json:"mintotalprice"`
+
+	// RemainingStorageExponent is the exponent the storage remaining
+	// adjustment of a host is raised to. Values above 1 penalize nearly full
+	// hosts more.
+	RemainingStorageExponent float64 `json:"remainingstorageexponent"`
+
+	// Locations are the locations hosts are accepted from. If AnyLocation is
+	// true hosts from all locations are accepted, as long as their location is
+	// known.
+	Locations   []string `json:"locations"`
+	AnyLocation bool     `json:"anylocation"`
+
+	// BlacklistedHosts are never selected. If PinnedHosts is not empty only
+	// these hosts are selected.
+	BlacklistedHosts []types.SiaPublicKey `json:"blacklistedhosts"`
+	PinnedHosts      []types.SiaPublicKey `json:"pinnedhosts"`
+
+	// EnforceIPDiversity is true if hosts sharing a subnet are never selected
+	// together.
+	EnforceIPDiversity bool `json:"enforceipdiversity"`
+
+	// MinAge is the number of blocks since a host was first seen that need to
+	// have passed before it is selected.
+	MinAge types.BlockHeight `json:"minage"`
+
+	// MinStorage is the number of bytes a host needs to have remaining to be
+	// selected.
+	MinStorage uint64 `json:"minstorage"`
+
+	// MinBandwidth is the bandwidth in bytes per second a host needs to have
+	// been measured at to be selected. Zero means no minimum.
+	MinBandwidth uint64 `json:"minbandwidth"`
+
+	// MinHostMaxDuration is the shortest maximum contract duration in blocks
+	// a host needs to accept to be selected.
+	MinHostMaxDuration types.BlockHeight `json:"minhostmaxduration"`
+
+	// MinScans is the number of scans a host needs to have in its scan
+	// history to be selected. Values below 1 only require the last scan to be
+	// successful.
+	MinScans int `json:"minscans"`
+
+	// MaxSettingsAge is the longest time since the settings of a host were
+	// last fetched for the host to be selected. Zero means no limit.
+	MaxSettingsAge time.Duration `json:"maxsettingsage"`
+
+	// MaxPrice is the highest storage price in hastings per byte per block a
+	// host may charge to be selected. Zero means no limit.
+	MaxPrice types.Currency `json:"maxprice"`
+}
+
 // RenterPriceEstimation contains a bunch of files estimating the costs of
 // various operations on the network.
 type RenterPriceEstimation struct {
@@ -295,9 +477,85 @@ type Renter interface {
 	// sorted by preference.
 	ActiveHosts(string) []HostDBEntry
 
+	// ActiveHostsN provides at most n of the hosts that the renter is
+	// selecting, sorted by preference.
+	ActiveHostsN(string, int) []HostDBEntry
+
+	// ActiveHostCounts returns the number of active hosts of every hostdb
+	// profile, keyed by profile name.
+	ActiveHostCounts() (map[string]int, error)
+
+	// RescanHost queues an immediate scan of the host with the provided
+	// public key.
+	RescanHost(types.SiaPublicKey) error
+
+	// SetHostTags sets the tags annotating the host with the provided public
+	// key. An empty list removes all tags.
+	SetHostTags(types.SiaPublicKey, []string) error
+
+	// InjectHost adds a host with the provided net address to the hostdb
+	// without an announcement, optionally forcing its country. It is only
+	// available while the scan loop of the hostdb is disabled.
+	InjectHost(addr NetAddress, country string, eu bool) (HostDBEntry, error)
+
+	// HostDBMetrics returns a snapshot of the health of the hostdb.
+	HostDBMetrics() HostDBMetrics
+
+	// HostDBPersistInfo returns information about the hostdb persistence
+	// file on disk.
+	HostDBPersistInfo() (HostDBPersistInfo, error)
+
+	// RefreshHostDBGeolocation downloads the geolocation database again and
+	// recomputes the location of every host in the background.
+	RefreshHostDBGeolocation() error
+
+	// HostDBGeolocationRefresh returns the progress of the last refresh of
+	// the host locations.
+	HostDBGeolocationRefresh() HostDBGeolocationRefresh
+
+	// ActiveHostDBProfile returns the name of the hostdb profile that is used
+	// if no profile is specified.
+	ActiveHostDBProfile() string
+
+	// SetActiveHostDBProfile sets the hostdb profile that is used if no
+	// profile is specified.
+	SetActiveHostDBProfile(name string) error
+
+	// DeleteHostDBProfile deletes the hostdb profile with the provided name.
+	// If the profile is the active profile the deletion fails unless fallback
+	// is set, in which case the active profile falls back to the default
+	// profile. The returned bool reports whether the fallback happened.
+	DeleteHostDBProfile(name string, fallback bool) (bool, error)
+
+	// HostDBProfile returns the hostdb profile with the provided name.
+	HostDBProfile(name string) (hostdbprofile.HostDBProfile, error)
+
+	// HostDBProfileFilters returns the effective filters the hostdb profile
+	// with the provided name applies when selecting hosts.
+	HostDBProfileFilters(name string) (HostDBProfileFilters, error)
+
+	// ValidateHostDBProfile checks the proposed hostdb profile settings,
+	// e.g. "tier=cold;locations=germany,eu", without creating or modifying
+	// any profile. If they are valid the number of active hosts a profile
+	// with these settings would select from is returned.
+	ValidateHostDBProfile(profile string) (int, error)
+
+	// RandomHostsWithWeights returns a set of random hosts of the provided
+	// hostdb profile together with their weights, ordered by descending
+	// weight. Hosts sharing an address with a host of the address blacklist
+	// are not returned. If preferUncontracted is set, hosts the renter has
+	// active contracts with are only returned if there are too few other
+	// hosts.
+	RandomHostsWithWeights(profile string, n int, blacklist, addressBlacklist []types.SiaPublicKey, preferUncontracted bool) ([]WeightedHostDBEntry, error)
+
 	// AddHostDBProfile adds a new hostdb profile.
 	AddHostDBProfiles(string, string) error
 
+	// AddHostDBProfilesBatch adds all of the described hostdb profiles
+	// together with their host trees. Either all of them are added or, if
+	// any of them is invalid, none of them.
+	AddHostDBProfilesBatch(specs []hostdbprofile.ProfileSpec) error
+
 	// AllHosts returns the full list of hosts known to the renter.
 	AllHosts(string) []HostDBEntry
 
@@ -306,7 +564,9 @@ type Renter interface {
 
 	// ConfigHostDBProfiles updates the provided setting of the hostdb profile with the
 	// provided name to the provided value. All parameters are checked for validity.
-	ConfigHostDBProfiles(name, setting, value string) (err error)
+	// A non-empty warning is returned if the profile doesn't match any of the
+	// active hosts anymore.
+	ConfigHostDBProfiles(name, setting, value string) (warning string, err error)
 
 	// Contracts returns the contracts formed by the renter.
 	Contracts() []RenterContract
@@ -353,6 +613,11 @@ type Renter interface {
 	// storage and data operations.
 	PriceEstimation() RenterPriceEstimation
 
+	// ProfilePriceEstimation estimates the cost in siacoins of performing
+	// various storage and data operations using the hosts of the provided
+	// hostdb profile.
+	ProfilePriceEstimation(profile string) (RenterPriceEstimation, error)
+
 	// RenameFile changes the path of a file.
 	RenameFile(path, newPath string) error
 
@@ -361,8 +626,13 @@ type Renter interface {
 	EstimateHostScore(entry HostDBEntry, hostdbprofile string) HostScoreBreakdown
 
 	// ScoreBreakdown will return the score for a host db entry using the
-	// hostdb's weighting algorithm.
-	ScoreBreakdown(entry HostDBEntry, hostdbprofile string) HostScoreBreakdown
+	// hostdb's weighting algorithm, failing if the hostdb profile doesn't
+	// exist.
+	ScoreBreakdown(entry HostDBEntry, hostdbprofile string) (HostScoreBreakdown, error)
+
+	// HostWeight returns the weight the host db entry receives in the host
+	// tree of the provided hostdb profile.
+	HostWeight(entry HostDBEntry, hostdbprofile string) types.Currency
 
 	// Settings returns the Renter's current settings.
 	Settings() RenterSettings
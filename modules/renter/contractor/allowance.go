@@ -2,9 +2,12 @@ package contractor
 
 import (
 	"errors"
+	"fmt"
 	"reflect"
+	"sort"
 
 	"github.com/pachisi456/sia-hostdb-profiles/modules"
+	"github.com/pachisi456/sia-hostdb-profiles/types"
 )
 
 var (
@@ -13,6 +16,11 @@ var (
 	errAllowanceWindowSize = errors.New("renew window must be less than period")
 	errAllowanceZeroPeriod = errors.New("period must be non-zero")
 
+	errAllowanceProfileDisabled       = errors.New("hostdb profile is disabled, enable it or remove it from the allowance")
+	errAllowanceProfileWindowSize     = errors.New("hostdb profile renew window must be less than period")
+	errAllowanceProfileWeightTooSmall = errors.New("hostdb profile weight is too small to form a single contract with the profile")
+	errAllowanceZeroProfileWeight     = errors.New("hostdb profile weights must be non-zero")
+
 	// ErrAllowanceZeroWindow is returned when the caller requests a
 	// zero-length renewal window. This will happen if the caller sets the
 	// period to 1 block, since RenewWindow := period / 2.
@@ -56,6 +64,12 @@ func (c *Contractor) SetAllowance(a modules.Allowance) error {
 		return ErrAllowanceZeroWindow
 	} else if a.RenewWindow >= a.Period {
 		return errAllowanceWindowSize
+	} else if err := validateProfileWeights(a); err != nil {
+		return err
+	} else if err := c.checkProfilesEnabled(a); err != nil {
+		return err
+	} else if err := c.checkProfileRenewWindows(a); err != nil {
+		return err
 	} else if !c.cs.Synced() {
 		return errAllowanceNotSynced
 	}
@@ -138,3 +152,94 @@ func (c *Contractor) managedCancelAllowance() error {
 	}
 	return nil
 }
+
+// validateProfileWeights checks that every hostdb profile the allowance spreads
+// its contracts across gets a share of at least one contract.
+func validateProfileWeights(a modules.Allowance) error {
+	var total types.Currency
+	for name, weight := range a.ProfileWeights {
+		if weight == 0 {
+			return fmt.Errorf("%w: %q", errAllowanceZeroProfileWeight, name)
+		}
+		total = total.Add(types.NewCurrency64(weight))
+	}
+	for name, weight := range a.ProfileWeights {
+		if types.NewCurrency64(a.Hosts).Mul64(weight).Cmp(total) < 0 {
+			return fmt.Errorf("%w: %q", errAllowanceProfileWeightTooSmall, name)
+		}
+	}
+	return nil
+}
+
+// checkProfilesEnabled checks that every hostdb profile the allowance spreads
+// its contracts across exists and is enabled.
+func (c *Contractor) checkProfilesEnabled(a modules.Allowance) error {
+	for name := range a.ProfileWeights {
+		profile, err := c.hdb.Profile(name)
+		if err != nil {
+			return err
+		}
+		if !profile.Enabled {
+			return fmt.Errorf("%w: %q", errAllowanceProfileDisabled, name)
+		}
+	}
+	return nil
+}
+
+// checkProfileRenewWindows checks that the renew windows of the hostdb profiles
+// the allowance forms contracts with are shorter than the allowance period. If
+// the allowance doesn't weight any profiles, the active profile is checked.
+func (c *Contractor) checkProfileRenewWindows(a modules.Allowance) error {
+	names := []string{c.hdb.ActiveProfile()}
+	if len(a.ProfileWeights) > 0 {
+		names = names[:0]
+		for name := range a.ProfileWeights {
+			names = append(names, name)
+		}
+	}
+	for _, name := range names {
+		profile, err := c.hdb.Profile(name)
+		if err != nil {
+			return err
+		}
+		if profile.RenewWindow >= a.Period {
+			return fmt.Errorf("%w: %q", errAllowanceProfileWindowSize, name)
+		}
+	}
+	return nil
+}
+
+// profileContracts returns the number of contracts the allowance asks for with
+// hosts of each of its weighted hostdb profiles. The hosts are split
+// proportionally to the weights, the contracts left over by rounding go to the
+// profiles with the largest remainders.
+func profileContracts(a modules.Allowance) map[string]int {
+	names := make([]string, 0, len(a.ProfileWeights))
+	var total types.Currency
+	for name, weight := range a.ProfileWeights {
+		names = append(names, name)
+		total = total.Add(types.NewCurrency64(weight))
+	}
+	if total.IsZero() {
+		return nil
+	}
+	sort.Strings(names)
+
+	contracts := make(map[string]int, len(names))
+	remainders := make(map[string]types.Currency, len(names))
+	assigned := uint64(0)
+	for _, name := range names {
+		share := types.NewCurrency64(a.Hosts).Mul64(a.ProfileWeights[name])
+		n := share.Div(total)
+		contracts[name] = int(n.Big().Uint64())
+		remainders[name] = share.Sub(n.Mul(total))
+		assigned += n.Big().Uint64()
+	}
+	sort.SliceStable(names, func(i, j int) bool {
+		return remainders[names[i]].Cmp(remainders[names[j]]) > 0
+	})
+	for _, name := range names[:a.Hosts-assigned] {
+		contracts[name]++
+	}
+	return contracts
+}
@@ -63,6 +63,11 @@ type Contractor struct {
 	contracts    *proto.ContractSet
 	oldContracts map[types.FileContractID]modules.RenterContract
 	renewedIDs   map[types.FileContractID]types.FileContractID
+
+	// cappedProfiles holds the number of hosts available to each hostdb
+	// profile whose contract target had to be capped, so that the cap is
+	// only logged when it changes.
+	cappedProfiles map[string]int
 }
 
 // readlockResolveID returns the ID of the most recent renewal of id.
@@ -225,13 +230,14 @@ func NewCustomContractor(cs consensusSet, w wallet, tp transactionPool, hdb host
 
 		interruptMaintenance: make(chan struct{}),
 
-		contracts:    contractSet,
-		downloaders:  make(map[types.FileContractID]*hostDownloader),
-		editors:      make(map[types.FileContractID]*hostEditor),
-		oldContracts: make(map[types.FileContractID]modules.RenterContract),
-		renewedIDs:   make(map[types.FileContractID]types.FileContractID),
-		renewing:     make(map[types.FileContractID]bool),
-		revising:     make(map[types.FileContractID]bool),
+		cappedProfiles: make(map[string]int),
+		contracts:      contractSet,
+		downloaders:    make(map[types.FileContractID]*hostDownloader),
+		editors:        make(map[types.FileContractID]*hostEditor),
+		oldContracts:   make(map[types.FileContractID]modules.RenterContract),
+		renewedIDs:     make(map[types.FileContractID]types.FileContractID),
+		renewing:       make(map[types.FileContractID]bool),
+		revising:       make(map[types.FileContractID]bool),
 	}
 
 	// Close the contract set and logger upon shutdown.
@@ -8,9 +8,11 @@ import (
 	"errors"
 	"fmt"
 	"math/big"
+	"sort"
 
 	"github.com/pachisi456/sia-hostdb-profiles/build"
 	"github.com/pachisi456/sia-hostdb-profiles/modules"
+	"github.com/pachisi456/sia-hostdb-profiles/modules/renter/hostdb/hostdbprofile"
 	"github.com/pachisi456/sia-hostdb-profiles/modules/renter/proto"
 	"github.com/pachisi456/sia-hostdb-profiles/types"
 )
@@ -20,6 +22,7 @@ var (
 	// than the amount necessary to store at least one sector
 	ErrInsufficientAllowance = errors.New("allowance is not large enough to cover fees of contract creation")
 	errTooExpensive          = errors.New("host price was too high")
+	errNoUsableProfile       = errors.New("none of the hostdb profiles of the allowance can select hosts")
 )
 
 // contractEndHeight returns the height at which the Contractor's contracts
@@ -66,36 +69,37 @@ func (c *Contractor) managedInterruptContractMaintenance() {
 // figures out whether the contract is useful for uploading, and whehter the
 // contract should be renewed.
 func (c *Contractor) managedMarkContractsUtility() error {
-	// Pull a new set of hosts from the hostdb that could be used as a new set
-	// to match the allowance. The lowest scoring host of these new hosts will
-	// be used as a baseline for determining whether our existing contracts are
-	// worthwhile.
-	c.mu.RLock()
-	hostCount := int(c.allowance.Hosts)
-	c.mu.RUnlock()
-	//TODO pachisi456: add support for multiple profiles / trees
-	hosts, err := c.hdb.RandomHosts("default", hostCount+randomHostsBufferForScore, nil)
-	if err != nil {
-		return err
-	}
-
-	// Find the minimum score that a host is allowed to have to be considered
-	// good for upload.
-	var minScore types.Currency
-	if len(hosts) > 0 {
-		//TODO pachisi456: add support for multiple profiles / trees
-		lowestScore := c.hdb.ScoreBreakdown(hosts[0], "default").Score
-		for i := 1; i < len(hosts); i++ {
-			score := c.hdb.ScoreBreakdown(hosts[i], "default").Score
-			if score.Cmp(lowestScore) < 0 {
-				lowestScore = score
-			}
+	// Pull a new set of hosts from the hostdb for each hostdb profile that
+	// could be used as a new set to match the allowance. The lowest scoring
+	// host of these new hosts will be used as a baseline for determining
+	// whether our existing contracts are worthwhile. A profile that was
+	// disabled after the allowance was set is skipped, its hosts are only kept
+	// if they are good for another profile of the allowance. Any other error
+	// aborts the marking, as the utility of the contracts can't be judged.
+	minScores := make(map[string]types.Currency)
+	for profile, hostCount := range c.managedProfileContracts() {
+		hosts, err := c.hdb.RandomHosts(profile, hostCount+randomHostsBufferForScore, nil)
+		if errors.Is(err, hostdbprofile.ErrProfileDisabled) {
+			c.log.Printf("WARN: skipping disabled hostdb profile %q when marking contract utility", profile)
+			continue
+		} else if err != nil {
+			return err
 		}
-		// Set the minimum acceptable score to a factor of the lowest score.
-		minScore = lowestScore.Div(scoreLeeway)
+
+		// Find the minimum score that a host is allowed to have to be
+		// considered good for upload.
+		minScore, err := c.managedMinScore(hosts, profile)
+		if err != nil {
+			return err
+		}
+		minScores[profile] = minScore
+	}
+	if len(minScores) == 0 {
+		return errNoUsableProfile
 	}
 
 	// Update utility fields for each contract.
+	windows := c.managedRenewWindows()
 	for _, contract := range c.contracts.ViewAll() {
 		utility := func() (u modules.ContractUtility) {
 			// Start the contract in good standing.
@@ -109,17 +113,10 @@ func (c *Contractor) managedMarkContractsUtility() error {
 				u.GoodForRenew = false
 				return
 			}
-			// Contract has no utility if the score is poor.
-			//TODO pachisi456: add support for multiple profiles / trees
-			if !minScore.IsZero() && c.hdb.ScoreBreakdown(host, "default").Score.Cmp(minScore) < 0 {
-				u.GoodForUpload = false
-				u.GoodForRenew = false
-				return
-			}
-			// Contract has no utility if the host is located outside of the locations specified
-			// in the renter's hostdb profile.
-			//TODO pachisi456: add support for multiple profiles / trees
-			if c.hdb.ScoreBreakdown(host, "default").Blacklisted {
+			// Contract has no utility if the score is poor or the host is
+			// located outside of the locations specified in the renter's
+			// hostdb profiles.
+			if len(c.hostProfiles(host, minScores)) == 0 {
 				u.GoodForUpload = false
 				u.GoodForRenew = false
 				return
@@ -134,7 +131,7 @@ func (c *Contractor) managedMarkContractsUtility() error {
 			// extra values while we have the mutex)
 			c.mu.RLock()
 			blockHeight := c.blockHeight
-			renewWindow := c.allowance.RenewWindow
+			renewWindow := windows.window(contract.ID, c.allowance.RenewWindow)
 			_, renewedPreviously := c.renewedIDs[contract.ID]
 			c.mu.RUnlock()
 			if renewedPreviously {
@@ -163,6 +160,24 @@ func (c *Contractor) managedMarkContractsUtility() error {
 	return nil
 }
 
+// managedMinScore returns the minimum score a host is allowed to have to be
+// considered good for upload with the provided hostdb profile, a factor of the
+// lowest score of the provided hosts. It is zero if there are no hosts.
+func (c *Contractor) managedMinScore(hosts []modules.HostDBEntry, profile string) (types.Currency, error) {
+	var lowestScore types.Currency
+	for i, host := range hosts {
+		sb, err := c.hdb.ScoreBreakdown(host, profile)
+		if err != nil {
+			return types.ZeroCurrency, err
+		}
+		if i == 0 || sb.Score.Cmp(lowestScore) < 0 {
+			lowestScore = sb.Score
+		}
+	}
+	// Set the minimum acceptable score to a factor of the lowest score.
+	return lowestScore.Div(scoreLeeway), nil
+}
+
 // managedNewContract negotiates an initial file contract with the specified
 // host, saves it, and returns it.
 func (c *Contractor) managedNewContract(host modules.HostDBEntry, contractFunding types.Currency, endHeight types.BlockHeight) (modules.RenterContract, error) {
@@ -318,13 +333,15 @@ func (c *Contractor) threadedContractMaintenance() {
 	// The actions inside this RLock are complex enough to merit wrapping them
 	// in a function where we can defer the unlock.
 	type renewal struct {
-		id     types.FileContractID
-		amount types.Currency
+		id        types.FileContractID
+		amount    types.Currency
+		endHeight types.BlockHeight
 	}
 	var endHeight types.BlockHeight
 	var fundsAvailable types.Currency
 	var renewSet []renewal
 	refreshSet := make(map[types.FileContractID]struct{})
+	windows := c.managedRenewWindows()
 	func() {
 		c.mu.RLock()
 		defer c.mu.RUnlock()
@@ -344,7 +361,7 @@ func (c *Contractor) threadedContractMaintenance() {
 
 			// Check if the contract is expiring. The funds in the contract are
 			// handled differently based on this information.
-			if c.blockHeight+c.allowance.RenewWindow >= contract.EndHeight {
+			if c.blockHeight+windows.window(contract.ID, c.allowance.RenewWindow) >= contract.EndHeight {
 				// The contract is expiring. Some of the funds are locked down
 				// to renew the contract, and then the remaining funds can be
 				// allocated to 'availableFunds'.
@@ -383,7 +400,7 @@ func (c *Contractor) threadedContractMaintenance() {
 			if !ok || !utility.GoodForRenew {
 				continue
 			}
-			if c.blockHeight+c.allowance.RenewWindow >= contract.EndHeight {
+			if c.blockHeight+windows.window(contract.ID, c.allowance.RenewWindow) >= contract.EndHeight {
 				// This contract needs to be renewed because it is going to
 				// expire soon. First step is to calculate how much money should
 				// be used in the renewal, based on how much of the contract
@@ -415,11 +432,21 @@ func (c *Contractor) threadedContractMaintenance() {
 					c.log.Println("WARN: performing a limited renew due to low allowance")
 				}
 
+				// A contract whose hostdb profile renews it earlier than the
+				// allowance is renewed before the current period ends. Extend
+				// it to the end of the next period instead, as if it had been
+				// renewed within the allowance's renew window.
+				renewEndHeight := endHeight
+				if renewEndHeight <= contract.EndHeight {
+					renewEndHeight += c.allowance.Period - c.allowance.RenewWindow
+				}
+
 				// The contract needs to be renewed because it is going to
 				// expire soon, and we need to refresh the time.
 				renewSet = append(renewSet, renewal{
-					id:     contract.ID,
-					amount: renewAmount,
+					id:        contract.ID,
+					amount:    renewAmount,
+					endHeight: renewEndHeight,
 				})
 			} else {
 				// Check if the contract has exhausted its funding and requires
@@ -448,8 +475,9 @@ func (c *Contractor) threadedContractMaintenance() {
 					if refreshAmount.Cmp(fundsAvailable) < 0 {
 						refreshSet[contract.ID] = struct{}{}
 						renewSet = append(renewSet, renewal{
-							id:     contract.ID,
-							amount: refreshAmount,
+							id:        contract.ID,
+							amount:    refreshAmount,
+							endHeight: endHeight,
 						})
 					} else {
 						c.log.Println("WARN: cannot refresh empty contract due to low allowance.")
@@ -511,7 +539,7 @@ func (c *Contractor) threadedContractMaintenance() {
 			}
 			// Perform the actual renew. If the renew fails, return the
 			// contract.
-			newContract, err := c.managedRenew(oldContract, amount, endHeight)
+			newContract, err := c.managedRenew(oldContract, amount, renewal.endHeight)
 			if err != nil {
 				c.log.Printf("WARN: failed to renew contract %v: %v\n", id, err)
 				c.contracts.Return(oldContract)
@@ -605,61 +633,257 @@ func (c *Contractor) threadedContractMaintenance() {
 		exclude = append(exclude, contract.HostPublicKey)
 	}
 	initialContractFunds := c.allowance.Funds.Div64(c.allowance.Hosts).Div64(3)
+	maxHostsPerCountry := c.allowance.MaxHostsPerCountry
 	c.mu.RUnlock()
-	//TODO pachisi456: add support for multiple profiles / trees
-	hosts, err := c.hdb.RandomHosts("default", neededContracts*2+randomHostsBufferForScore, exclude)
-	if err != nil {
-		c.log.Println("WARN: not forming new contracts:", err)
-		return
+	countryContracts := c.managedContractsPerCountry()
+	// Spread the new contracts across the hostdb profiles of the allowance,
+	// filling up the profiles in alphabetical order.
+	missing := c.managedMissingProfileContracts()
+	profiles := make([]string, 0, len(missing))
+	for profile := range missing {
+		profiles = append(profiles, profile)
+	}
+	sort.Strings(profiles)
+	for _, profile := range profiles {
+		needed := missing[profile]
+		if needed <= 0 {
+			continue
+		}
+		hosts, err := c.hdb.RandomHosts(profile, needed*2+randomHostsBufferForScore, exclude)
+		if err != nil {
+			c.log.Printf("WARN: not forming new contracts with hosts of hostdb profile %q: %v", profile, err)
+			continue
+		}
+
+		// Form contracts with the hosts one at a time, until we have enough
+		// contracts.
+		for _, host := range hosts {
+			// Determine if we have enough money to form a new contract.
+			if fundsAvailable.Cmp(initialContractFunds) < 0 {
+				c.log.Println("WARN: need to form new contracts, but unable to because of a low allowance")
+				return
+			}
+			// Skip the host if the allowance's cap on contracts within its
+			// country has been reached.
+			if maxHostsPerCountry > 0 && host.Country != "" && countryContracts[host.Country] >= maxHostsPerCountry {
+				continue
+			}
+
+			// Attempt forming a contract with this host.
+			newContract, err := c.managedNewContract(host, initialContractFunds, endHeight)
+			if err != nil {
+				c.log.Printf("Attempted to form a contract with %v, but negotiation failed: %v\n", host.NetAddress, err)
+				continue
+			}
+
+			// Add this contract to the contractor and save.
+			c.mu.Lock()
+			err = c.updateContractUtility(newContract.ID, modules.ContractUtility{
+				GoodForUpload: true,
+				GoodForRenew:  true,
+			})
+			if err != nil {
+				c.log.Println("Failed to update the contract utilities", err)
+				return
+			}
+			err = c.saveSync()
+			c.mu.Unlock()
+			if err != nil {
+				c.log.Println("Unable to save the contractor:", err)
+			}
+			if host.Country != "" {
+				countryContracts[host.Country]++
+			}
+			// Don't select the host again for another profile.
+			exclude = append(exclude, host.PublicKey)
+
+			// Quit the loop if we've replaced all needed contracts.
+			needed--
+			neededContracts--
+			if neededContracts <= 0 {
+				return
+			} else if needed <= 0 {
+				break
+			}
+
+			// Soft sleep before making the next contract.
+			select {
+			case <-c.tg.StopChan():
+				return
+			case <-c.interruptMaintenance:
+				return
+			default:
+			}
+		}
 	}
+}
 
-	// Form contracts with the hosts one at a time, until we have enough
-	// contracts.
-	for _, host := range hosts {
-		// Determine if we have enough money to form a new contract.
-		if fundsAvailable.Cmp(initialContractFunds) < 0 {
-			c.log.Println("WARN: need to form new contracts, but unable to because of a low allowance")
-			break
+// managedProfileContracts returns the number of contracts the allowance asks
+// for with hosts of each hostdb profile. If the allowance doesn't weight any
+// profiles, all contracts are formed with hosts of the active profile. The
+// contracts of a profile are capped at the number of hosts the profile can
+// select from, otherwise the contractor would keep looking for hosts that
+// don't exist.
+func (c *Contractor) managedProfileContracts() map[string]int {
+	c.mu.RLock()
+	allowance := c.allowance
+	c.mu.RUnlock()
+	var contracts map[string]int
+	if len(allowance.ProfileWeights) == 0 {
+		contracts = map[string]int{c.hdb.ActiveProfile(): int(allowance.Hosts)}
+	} else {
+		contracts = profileContracts(allowance)
+	}
+	// A weighted profile may have been deleted or replaced after the
+	// allowance was set, its contracts are not formed.
+	for profile := range contracts {
+		if _, err := c.hdb.Profile(profile); err != nil {
+			c.log.Printf("WARN: skipping hostdb profile %q of the allowance: %v", profile, err)
+			delete(contracts, profile)
 		}
+	}
 
-		// Attempt forming a contract with this host.
-		newContract, err := c.managedNewContract(host, initialContractFunds, endHeight)
-		if err != nil {
-			c.log.Printf("Attempted to form a contract with %v, but negotiation failed: %v\n", host.NetAddress, err)
+	// Count the hosts without holding the lock, as it requires walking all
+	// hosts of each profile. The hosts can't be counted before the initial
+	// scan of the hostdb has completed, contracts aren't formed before that
+	// anyway.
+	selectable := make(map[string]int, len(contracts))
+	for profile := range contracts {
+		if available, err := c.hdb.SelectableHosts(profile); err == nil {
+			selectable[profile] = available
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for profile, n := range contracts {
+		available, counted := selectable[profile]
+		if !counted || n <= available {
+			delete(c.cappedProfiles, profile)
 			continue
 		}
+		if capped, exists := c.cappedProfiles[profile]; !exists || capped != available {
+			c.log.Printf("WARN: the allowance asks for %v contracts with hosts of hostdb profile %q, but only %v hosts are available, forming %v contracts", n, profile, available, available)
+			c.cappedProfiles[profile] = available
+		}
+		contracts[profile] = available
+	}
+	return contracts
+}
 
-		// Add this contract to the contractor and save.
-		c.mu.Lock()
-		err = c.updateContractUtility(newContract.ID, modules.ContractUtility{
-			GoodForUpload: true,
-			GoodForRenew:  true,
-		})
-		if err != nil {
-			c.log.Println("Failed to update the contract utilities", err)
-			return
+// hostProfiles returns the hostdb profiles out of minScores that the host is
+// selectable with, i.e. the profiles that don't blacklist the host and that
+// score the host at least at their minimum score.
+func (c *Contractor) hostProfiles(host modules.HostDBEntry, minScores map[string]types.Currency) []string {
+	var profiles []string
+	for profile, minScore := range minScores {
+		sb, err := c.hdb.ScoreBreakdown(host, profile)
+		if err != nil || sb.Blacklisted || (!minScore.IsZero() && sb.Score.Cmp(minScore) < 0) {
+			continue
 		}
-		err = c.saveSync()
-		c.mu.Unlock()
-		if err != nil {
-			c.log.Println("Unable to save the contractor:", err)
+		profiles = append(profiles, profile)
+	}
+	return profiles
+}
+
+// managedMissingProfileContracts returns the number of contracts that are
+// missing for each hostdb profile to reach the contracts the allowance asks
+// for. Each contract that is good for uploading counts towards the one of its
+// host's profiles that is missing the most contracts.
+func (c *Contractor) managedMissingProfileContracts() map[string]int {
+	missing := c.managedProfileContracts()
+	allProfiles := make(map[string]types.Currency, len(missing))
+	for profile := range missing {
+		allProfiles[profile] = types.ZeroCurrency
+	}
+	for _, contract := range c.contracts.ViewAll() {
+		c.mu.RLock()
+		cu, ok := c.readlockContractUtility(contract.ID)
+		c.mu.RUnlock()
+		if !ok || !cu.GoodForUpload {
+			continue
 		}
+		host, exists := c.hdb.Host(contract.HostPublicKey)
+		if !exists {
+			continue
+		}
+		best := ""
+		for _, profile := range c.hostProfiles(host, allProfiles) {
+			if best == "" || missing[profile] > missing[best] || (missing[profile] == missing[best] && profile < best) {
+				best = profile
+			}
+		}
+		if best != "" {
+			missing[best]--
+		}
+	}
+	return missing
+}
+
+// renewWindows maps contracts to the renew window of their hostdb profile if it
+// overrides the renew window of the allowance.
+type renewWindows map[types.FileContractID]types.BlockHeight
+
+// window returns the renew window of the contract with the provided id or the
+// fallback if its hostdb profile doesn't override the renew window.
+func (rw renewWindows) window(id types.FileContractID, fallback types.BlockHeight) types.BlockHeight {
+	if w, ok := rw[id]; ok {
+		return w
+	}
+	return fallback
+}
 
-		// Quit the loop if we've replaced all needed contracts.
-		neededContracts--
-		if neededContracts <= 0 {
-			break
+// managedRenewWindows returns the renew windows of the contracts whose hosts
+// are selectable with a hostdb profile of the allowance that overrides the
+// allowance's renew window. If a host is selectable with several of these
+// profiles its contract is renewed within the largest of their windows.
+// Windows that aren't shorter than the allowance period are ignored.
+func (c *Contractor) managedRenewWindows() renewWindows {
+	c.mu.RLock()
+	allowance := c.allowance
+	c.mu.RUnlock()
+
+	overrides := make(map[string]types.BlockHeight)
+	profiles := make(map[string]types.Currency)
+	for name := range c.managedProfileContracts() {
+		profile, err := c.hdb.Profile(name)
+		if err != nil || profile.RenewWindow == 0 || profile.RenewWindow >= allowance.Period {
+			continue
 		}
+		overrides[name] = profile.RenewWindow
+		profiles[name] = types.ZeroCurrency
+	}
+	windows := make(renewWindows)
+	if len(overrides) == 0 {
+		return windows
+	}
+	for _, contract := range c.contracts.ViewAll() {
+		host, exists := c.hdb.Host(contract.HostPublicKey)
+		if !exists {
+			continue
+		}
+		for _, profile := range c.hostProfiles(host, profiles) {
+			if w, ok := windows[contract.ID]; !ok || overrides[profile] > w {
+				windows[contract.ID] = overrides[profile]
+			}
+		}
+	}
+	return windows
+}
 
-		// Soft sleep before making the next contract.
-		select {
-		case <-c.tg.StopChan():
-			return
-		case <-c.interruptMaintenance:
-			return
-		default:
+// managedContractsPerCountry returns the number of contracts with hosts in each
+// country, using the locations cached in the hostdb. Hosts of unknown location
+// are not counted.
+func (c *Contractor) managedContractsPerCountry() map[string]uint64 {
+	countries := make(map[string]uint64)
+	for _, contract := range c.contracts.ViewAll() {
+		host, exists := c.hdb.Host(contract.HostPublicKey)
+		if !exists || host.Country == "" {
+			continue
 		}
+		countries[host.Country]++
 	}
+	return countries
 }
 
 // updateContractUtility is a helper function that acquires a contract, updates
@@ -4,6 +4,7 @@ import (
 	"path/filepath"
 
 	"github.com/pachisi456/sia-hostdb-profiles/modules"
+	"github.com/pachisi456/sia-hostdb-profiles/modules/renter/hostdb/hostdbprofile"
 	"github.com/pachisi456/sia-hostdb-profiles/persist"
 	"github.com/pachisi456/sia-hostdb-profiles/types"
 )
@@ -48,13 +49,16 @@ type (
 	}
 
 	hostDB interface {
+		ActiveProfile() string
 		AllHosts(string) []modules.HostDBEntry
 		ActiveHosts(string) []modules.HostDBEntry
 		Host(types.SiaPublicKey) (modules.HostDBEntry, bool)
 		IncrementSuccessfulInteractions(key types.SiaPublicKey)
 		IncrementFailedInteractions(key types.SiaPublicKey)
+		Profile(string) (hostdbprofile.HostDBProfile, error)
 		RandomHosts(tree string, n int, exclude []types.SiaPublicKey) ([]modules.HostDBEntry, error)
-		ScoreBreakdown(modules.HostDBEntry, string) modules.HostScoreBreakdown
+		ScoreBreakdown(modules.HostDBEntry, string) (modules.HostScoreBreakdown, error)
+		SelectableHosts(string) (int, error)
 	}
 
 	persister interface {
@@ -0,0 +1,116 @@
+package hostdb
+
+import (
+	"time"
+
+	"github.com/pachisi456/sia-hostdb-profiles/modules"
+	"github.com/pachisi456/sia-hostdb-profiles/modules/renter/hostdb/hostdbprofile"
+	"github.com/pachisi456/sia-hostdb-profiles/modules/renter/hostdb/hosttree"
+)
+
+// candidateCacheEntry holds the candidate set of a hostdb profile, i.e. the
+// public keys of all hosts of its tree that are neither blacklisted nor, if the
+// profile is pinned to a set of hosts, unpinned. The random draw itself is
+// never cached, only the set the draw is made from.
+type candidateCacheEntry struct {
+	candidates map[string]struct{}
+	expires    time.Time
+	membership uint64
+}
+
+// candidateFilter matches the hosts of a candidate set.
+type candidateFilter struct {
+	candidates map[string]struct{}
+}
+
+// Matches returns true if the host is part of the candidate set.
+func (cf candidateFilter) Matches(entry modules.HostDBEntry) bool {
+	_, exists := cf.candidates[string(entry.PublicKey.Key)]
+	return exists
+}
+
+// Name implements hosttree.HostFilter.
+func (cf candidateFilter) Name() string {
+	return "candidates"
+}
+
+// cachedCandidates returns the cached candidate set of the tree with the
+// provided name, if there is one that is neither expired nor stale.
+func (hdb *HostDB) cachedCandidates(tree string) (map[string]struct{}, bool) {
+	hdb.candidateCacheMu.Lock()
+	defer hdb.candidateCacheMu.Unlock()
+	entry, exists := hdb.candidateCache[tree]
+	if !exists || !hdb.deps.Now().Before(entry.expires) || entry.membership != hdb.hostTrees.Membership() {
+		return nil, false
+	}
+	return entry.candidates, true
+}
+
+// managedInvalidateCandidates drops the cached candidate set of the tree with
+// the provided name. It is called whenever the hostdb profile of the tree
+// changes.
+func (hdb *HostDB) managedInvalidateCandidates(tree string) {
+	hdb.candidateCacheMu.Lock()
+	defer hdb.candidateCacheMu.Unlock()
+	delete(hdb.candidateCache, tree)
+}
+
+// managedProfileCandidates returns a filter matching the candidate set of the
+// provided hostdb profile, or nil if the profile may select every host of its
+// tree because it neither blacklists nor pins any hosts. Computing the
+// candidate set requires walking the whole tree, so it is cached for
+// candidateCacheTTL or until hosts are added to or removed from the trees.
+// Weight updates don't change the candidate set and leave the cache intact.
+func (hdb *HostDB) managedProfileCandidates(tree string, profile hostdbprofile.HostDBProfile) hosttree.HostFilter {
+	if len(profile.Blacklist) == 0 && len(profile.Whitelist) == 0 {
+		return nil
+	}
+
+	// Selection decisions are logged while computing the candidate set, so
+	// the cache is bypassed if they should be logged.
+	logSelection := hdb.deps.Disrupt("logSelectionDecisions")
+	if !logSelection {
+		if candidates, ok := hdb.cachedCandidates(tree); ok {
+			return candidateFilter{candidates: candidates}
+		}
+	}
+
+	// Fetch the membership before walking the tree, so a change during the
+	// walk results in a stale cache entry rather than an incorrect one.
+	membership := hdb.hostTrees.Membership()
+	blacklisted := make(map[string]struct{})
+	for _, pk := range profile.Blacklist {
+		blacklisted[string(pk.Key)] = struct{}{}
+	}
+	pinned := make(map[string]struct{})
+	for _, pk := range profile.Whitelist {
+		pinned[string(pk.Key)] = struct{}{}
+	}
+	candidates := make(map[string]struct{})
+	for _, host := range hdb.hostTrees.All(tree) {
+		reason := ""
+		if _, exists := blacklisted[string(host.PublicKey.Key)]; exists {
+			reason = "blacklist"
+		} else if _, exists := pinned[string(host.PublicKey.Key)]; len(pinned) > 0 && !exists {
+			reason = "not pinned"
+		}
+		if reason == "" {
+			candidates[string(host.PublicKey.Key)] = struct{}{}
+		} else if logSelection {
+			hdb.logEvent(logEntry{Level: logLevelInfo, Message: "host filtered", Host: host.PublicKey.String(), Profile: tree, Reason: reason},
+				"Selection: host %v in profile %q filtered: %v", host.PublicKey.String(), tree, reason)
+		}
+	}
+
+	hdb.candidateCacheMu.Lock()
+	defer hdb.candidateCacheMu.Unlock()
+	if hdb.candidateCache == nil {
+		hdb.candidateCache = make(map[string]candidateCacheEntry)
+	}
+	hdb.candidateCache[tree] = candidateCacheEntry{
+		candidates: candidates,
+		expires:    hdb.deps.Now().Add(candidateCacheTTL),
+		membership: membership,
+	}
+	return candidateFilter{candidates: candidates}
+}
@@ -0,0 +1,128 @@
+package hostdb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pachisi456/sia-hostdb-profiles/modules"
+)
+
+// TestProfileCandidatesInvalidation checks that the cached candidate set of a
+// hostdb profile survives weight updates, but is invalidated if a host is
+// inserted, if the profile is configured and once it expires.
+func TestProfileCandidatesInvalidation(t *testing.T) {
+	hdb, err := newProfileHostDB(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	deps := &fakeClockDeps{now: time.Now()}
+	hdb.deps = deps
+	hdb.initialScanComplete = true
+
+	pinned := makeHostDBEntry()
+	pinned.Country = "Germany"
+	other := makeHostDBEntry()
+	other.Country = "Germany"
+	for _, entry := range []modules.HostDBEntry{pinned, other} {
+		if err := hdb.hostTrees.Insert(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := hdb.ConfigHostDBProfile("default", "pinhost", pinned.PublicKey.String()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Selecting hosts fills the cache.
+	if _, err := hdb.RandomHosts("default", 2, nil); err != nil {
+		t.Fatal(err)
+	}
+	candidates, ok := hdb.cachedCandidates("default")
+	if _, exists := candidates[string(pinned.PublicKey.Key)]; !ok || len(candidates) != 1 || !exists {
+		t.Fatal("expected only the pinned host to be cached as candidate, got", candidates, ok)
+	}
+
+	// Updating the weight of a host, as every scan does, keeps the cache.
+	other.RemainingStorage++
+	if err := hdb.hostTrees.Modify(other); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := hdb.cachedCandidates("default"); !ok {
+		t.Fatal("cache was invalidated by a weight update")
+	}
+
+	// A host inserted after the cache was filled invalidates it and must not
+	// be selected, as it is not pinned.
+	inserted := makeHostDBEntry()
+	inserted.Country = "Germany"
+	if err := hdb.hostTrees.Insert(inserted); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := hdb.cachedCandidates("default"); ok {
+		t.Fatal("cache was not invalidated by inserting a host")
+	}
+	for i := 0; i < 25; i++ {
+		hosts, err := hdb.RandomHosts("default", 3, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(hosts) != 1 || hosts[0].PublicKey.String() != pinned.PublicKey.String() {
+			t.Fatal("expected only the pinned host to be selected, got", hosts)
+		}
+	}
+
+	// Configuring the profile invalidates the cache.
+	if _, err := hdb.ConfigHostDBProfile("default", "addhost", other.PublicKey.String()); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := hdb.cachedCandidates("default"); ok {
+		t.Fatal("cache was not invalidated by configuring the profile")
+	}
+	if _, err := hdb.ConfigHostDBProfile("default", "unpinhost", pinned.PublicKey.String()); err != nil {
+		t.Fatal(err)
+	}
+	hosts, err := hdb.RandomHosts("default", 3, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hosts) != 2 {
+		t.Fatal("expected the pinned and the inserted host to be selected, got", hosts)
+	}
+
+	// The cache expires after candidateCacheTTL.
+	if _, ok := hdb.cachedCandidates("default"); !ok {
+		t.Fatal("cache was not filled")
+	}
+	deps.advance(candidateCacheTTL)
+	if _, ok := hdb.cachedCandidates("default"); ok {
+		t.Fatal("cache did not expire")
+	}
+}
+
+// BenchmarkRandomHostsPinned benchmarks selecting hosts from a profile that is
+// pinned to a set of hosts, which requires filtering all hosts of the tree.
+func BenchmarkRandomHostsPinned(b *testing.B) {
+	hdb, err := newProfileHostDB(b.Name())
+	if err != nil {
+		b.Fatal(err)
+	}
+	hdb.initialScanComplete = true
+	for i := 0; i < 1000; i++ {
+		entry := makeHostDBEntry()
+		entry.Country = "Germany"
+		if err := hdb.hostTrees.Insert(entry); err != nil {
+			b.Fatal(err)
+		}
+		if i%10 == 0 {
+			if err := hdb.hostdbProfiles.ConfigHostDBProfiles("default", "pinhost", entry.PublicKey.String()); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := hdb.RandomHosts("default", 50, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
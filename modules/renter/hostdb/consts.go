@@ -7,6 +7,24 @@ import (
 )
 
 const (
+	// averageContractPriceSampleSize is the number of hosts sampled by
+	// AverageContractPrice.
+	averageContractPriceSampleSize = 32
+
+	// candidateCacheTTL is the amount of time the hosts a hostdb profile may
+	// select from are cached for. The cache is invalidated earlier if hosts
+	// are added to or removed from the host trees or the profile changes.
+	candidateCacheTTL = 30 * time.Second
+
+	// geolocationDownloadAttempts is the number of times the download of the
+	// geolocation database is attempted before the hostdb starts without
+	// geolocation.
+	geolocationDownloadAttempts = 3
+
+	// saveAttempts is the number of times saving changes to the hostdb
+	// profiles is attempted before the error is returned to the caller.
+	saveAttempts = 3
+
 	// historicInteractionDecay defines the decay of the HistoricSuccessfulInteractions
 	// and HistoricFailedInteractions after every block for a host entry.
 	historicInteractionDecay = 0.9995
@@ -15,17 +33,20 @@ const (
 	// interactions required before decay is applied.
 	historicInteractionDecayLimit = 500
 
-	// hostRequestTimeout indicates how long a host has to respond to a dial.
-	hostRequestTimeout = 2 * time.Minute
-
-	// hostScanDeadline indicates how long a host has to complete an entire
-	// scan.
-	hostScanDeadline = 4 * time.Minute
+	// maxGeolocationAge is the default age of the geolocation database after
+	// which it is refreshed when the hostdb starts. MaxMind publishes a new
+	// GeoLite2 database every week.
+	maxGeolocationAge = 30 * 24 * time.Hour
 
 	// maxHostDowntime specifies the maximum amount of time that a host is
 	// allowed to be offline while still being in the hostdb.
 	maxHostDowntime = 10 * 24 * time.Hour
 
+	// maxHostTags is the maximum number of tags a host can be annotated with
+	// and maxHostTagLen the maximum number of characters of a single tag.
+	maxHostTags   = 16
+	maxHostTagLen = 64
+
 	// maxSettingsLen indicates how long in bytes the host settings field is
 	// allowed to be before being ignored as a DoS attempt.
 	maxSettingsLen = 10e3
@@ -45,6 +66,15 @@ const (
 	// minScansForSpeedup successful scans.
 	scanSpeedupMedianMultiplier = 5
 
+	// recentFailureHalfLife is the amount of time after which the weight
+	// penalty of a failed scan has halved.
+	recentFailureHalfLife = 12 * time.Hour
+
+	// recentFailurePenalty is the fraction of a host's weight that is taken
+	// away right after a failed scan. The penalty halves with every successful
+	// scan after the failure and every recentFailureHalfLife.
+	recentFailurePenalty = 0.5
+
 	// recentInteractionWeightLimit caps the number of recent interactions as a
 	// percentage of the historic interactions, to be certain that a large
 	// amount of activity in a short period of time does not overwhelm the
@@ -61,6 +91,11 @@ const (
 	// scanCheckInterval is the interval used when waiting for the scanList to
 	// empty itself and for waiting on the consensus set to be synced.
 	scanCheckInterval = time.Second
+
+	// scanTimeout is the default amount of time a host has to complete an
+	// entire scan, including the dial. Hosts that exceed it are recorded as
+	// offline.
+	scanTimeout = 5 * time.Second
 )
 
 var (
@@ -97,4 +132,41 @@ var (
 		Dev:      time.Minute * 3,
 		Testing:  time.Second * 1,
 	}).(time.Duration)
+
+	// staleScanAge is the age of the last scan after which a host is
+	// considered stale. It spans several scan cycles, so a host is only stale
+	// if it missed a number of scans in a row.
+	staleScanAge = build.Select(build.Var{
+		Standard: time.Hour * 48,
+		Dev:      time.Hour,
+		Testing:  time.Second * 30,
+	}).(time.Duration)
+)
+
+var (
+	// geolocationDownloadBackoff is the amount of time the hostdb waits
+	// before retrying a failed download of the geolocation database. It is
+	// doubled after every failed attempt.
+	geolocationDownloadBackoff = build.Select(build.Var{
+		Standard: time.Second * 10,
+		Dev:      time.Second * 2,
+		Testing:  time.Millisecond * 100,
+	}).(time.Duration)
+
+	// saveBackoff is the amount of time the hostdb waits before retrying a
+	// failed save of the hostdb profiles. It is doubled after every failed
+	// attempt.
+	saveBackoff = build.Select(build.Var{
+		Standard: time.Millisecond * 250,
+		Dev:      time.Millisecond * 100,
+		Testing:  time.Millisecond * 10,
+	}).(time.Duration)
+
+	// geolocationDownloadTimeout is the amount of time a single download of
+	// the geolocation database may take.
+	geolocationDownloadTimeout = build.Select(build.Var{
+		Standard: time.Minute * 2,
+		Dev:      time.Second * 30,
+		Testing:  time.Second,
+	}).(time.Duration)
 )
@@ -0,0 +1,97 @@
+package hostdb
+
+import (
+	"sort"
+	"time"
+
+	"github.com/pachisi456/sia-hostdb-profiles/modules"
+	"github.com/pachisi456/sia-hostdb-profiles/types"
+)
+
+// lastSeenOnline returns the timestamp of the most recent successful scan of
+// the host, or the zero time if no scan of the host ever succeeded.
+func lastSeenOnline(entry modules.HostDBEntry) time.Time {
+	for i := len(entry.ScanHistory) - 1; i >= 0; i-- {
+		if entry.ScanHistory[i].Success {
+			return entry.ScanHistory[i].Timestamp
+		}
+	}
+	return time.Time{}
+}
+
+// SetProtectedHosts sets the function the hostdb uses to learn which hosts
+// must never be evicted, i.e. the hosts the renter has contracts with.
+func (hdb *HostDB) SetProtectedHosts(fn func() []types.SiaPublicKey) {
+	hdb.mu.Lock()
+	defer hdb.mu.Unlock()
+	hdb.protectedHosts = fn
+}
+
+// managedProtectedHosts returns the public keys of the protected hosts. They
+// are fetched without holding the lock, as the contractor calls into the
+// hostdb while holding its own lock.
+func (hdb *HostDB) managedProtectedHosts() []types.SiaPublicKey {
+	hdb.mu.RLock()
+	protectedHosts := hdb.protectedHosts
+	hdb.mu.RUnlock()
+	if protectedHosts == nil {
+		return nil
+	}
+	return protectedHosts()
+}
+
+// managedEvictHosts removes hosts from the hostdb until it holds no more than
+// the maximum number of hosts of the scan settings. Offline hosts are evicted
+// first, starting with the ones that have been offline the longest, followed
+// by the lowest weighted online hosts. Protected hosts are never evicted, so
+// the hostdb may remain above its maximum size. Hosts are removed from all
+// host trees at once.
+func (hdb *HostDB) managedEvictHosts() (evicted int) {
+	hdb.mu.RLock()
+	maxHosts := hdb.scanSettings.MaxHosts
+	hdb.mu.RUnlock()
+	if maxHosts <= 0 {
+		return 0
+	}
+	// All returns the hosts sorted by ascending weight.
+	hosts := hdb.hostTrees.All("default")
+	excess := len(hosts) - maxHosts
+	if excess <= 0 {
+		return 0
+	}
+
+	protected := make(map[string]struct{})
+	for _, pk := range hdb.managedProtectedHosts() {
+		protected[string(pk.Key)] = struct{}{}
+	}
+
+	// Order the hosts by eviction priority. The sort is stable, so hosts that
+	// are equally long offline or online remain sorted by weight.
+	sort.SliceStable(hosts, func(i, j int) bool {
+		iOnline, jOnline := hosts[i].LastScanSuccessful(), hosts[j].LastScanSuccessful()
+		if iOnline != jOnline {
+			return !iOnline
+		}
+		if iOnline {
+			return false
+		}
+		return lastSeenOnline(hosts[i]).Before(lastSeenOnline(hosts[j]))
+	})
+	for _, host := range hosts {
+		if evicted == excess {
+			break
+		}
+		if _, exists := protected[string(host.PublicKey.Key)]; exists {
+			continue
+		}
+		if err := hdb.hostTrees.Remove(host.PublicKey); err != nil {
+			hdb.log.Println("ERROR: unable to evict host from the hostdb:", err)
+			continue
+		}
+		evicted++
+	}
+	if evicted < excess {
+		hdb.log.Printf("WARN: hostdb holds %v hosts more than its maximum of %v, all of them are protected", excess-evicted, maxHosts)
+	}
+	return evicted
+}
@@ -0,0 +1,78 @@
+package hostdb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pachisi456/sia-hostdb-profiles/modules"
+	"github.com/pachisi456/sia-hostdb-profiles/types"
+)
+
+// TestEvictHosts checks that hosts exceeding the maximum size of the hostdb
+// are evicted from all trees, longest offline first, and that protected hosts
+// are never evicted.
+func TestEvictHosts(t *testing.T) {
+	hdb, err := newProfileHostDB(t.Name(), "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdb.scanSettings.MaxHosts = 3
+
+	// Insert three online hosts, two offline hosts, one of them offline for
+	// longer, and a contracted host which has been offline the longest.
+	var hosts []modules.HostDBEntry
+	for i := 0; i < 3; i++ {
+		hosts = append(hosts, makeHostDBEntry())
+	}
+	offline := makeHostDBEntry()
+	offline.ScanHistory = append(modules.HostDBScans{{Timestamp: time.Now().Add(-time.Hour), Success: true}}, modules.HostDBScan{Timestamp: time.Now(), Success: false})
+	longOffline := makeHostDBEntry()
+	longOffline.ScanHistory[0].Success = false
+	contracted := makeHostDBEntry()
+	contracted.ScanHistory[0].Success = false
+	contracted.ScanHistory[0].Timestamp = time.Now().Add(-24 * time.Hour)
+	hosts = append(hosts, offline, longOffline, contracted)
+	for _, host := range hosts {
+		host.Country = "Germany"
+		if err := hdb.hostTrees.Insert(host); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hdb.SetProtectedHosts(func() []types.SiaPublicKey {
+		return []types.SiaPublicKey{contracted.PublicKey}
+	})
+
+	if evicted := hdb.managedEvictHosts(); evicted != 3 {
+		t.Fatal("expected 3 hosts to be evicted, got", evicted)
+	}
+	for name, size := range hdb.hostTrees.Sizes() {
+		if size != 3 {
+			t.Errorf("expected tree %v to hold 3 hosts, got %v", name, size)
+		}
+	}
+	if _, exists := hdb.Host(contracted.PublicKey); !exists {
+		t.Fatal("contracted host was evicted")
+	}
+	for _, host := range []modules.HostDBEntry{offline, longOffline} {
+		if _, exists := hdb.Host(host.PublicKey); exists {
+			t.Error("offline host was not evicted:", host.PublicKey.String())
+		}
+	}
+
+	// Once the hostdb holds only protected hosts beyond its maximum, no more
+	// hosts are evicted.
+	hdb.scanSettings.MaxHosts = 1
+	hdb.SetProtectedHosts(func() (pks []types.SiaPublicKey) {
+		for _, host := range hdb.hostTrees.All("default") {
+			pks = append(pks, host.PublicKey)
+		}
+		return pks
+	})
+	if evicted := hdb.managedEvictHosts(); evicted != 0 {
+		t.Fatal("expected no protected host to be evicted, got", evicted)
+	}
+	hdb.scanSettings.MaxHosts = 0
+	if evicted := hdb.managedEvictHosts(); evicted != 0 {
+		t.Fatal("expected no host to be evicted without a maximum, got", evicted)
+	}
+}
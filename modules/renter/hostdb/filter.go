@@ -0,0 +1,237 @@
+package hostdb
+
+import (
+	"strings"
+	"time"
+
+	"github.com/pachisi456/sia-hostdb-profiles/modules"
+	"github.com/pachisi456/sia-hostdb-profiles/modules/renter/hostdb/hostdbprofile"
+	"github.com/pachisi456/sia-hostdb-profiles/modules/renter/hostdb/hosttree"
+	"github.com/pachisi456/sia-hostdb-profiles/types"
+)
+
+// locationFilter matches hosts that are located in one of the locations of a
+// hostdb profile. Hosts without location information never match.
+type locationFilter struct {
+	locations []string
+}
+
+// Matches returns true if the host's country is accepted by the filter or the
+// filter doesn't specify any location.
+func (lf locationFilter) Matches(entry modules.HostDBEntry) bool {
+	if entry.Country == "" {
+		return false
+	}
+	// Accept hosts from all locations if no location is specified.
+	if len(lf.locations) == 0 {
+		return true
+	}
+	for _, l := range lf.locations {
+		if l == "eu" && entry.EUhost {
+			return true
+		}
+		if l == strings.ToLower(entry.Country) {
+			return true
+		}
+	}
+	return false
+}
+
+// Name implements hosttree.HostFilter.
+func (lf locationFilter) Name() string {
+	return "location"
+}
+
+// minAgeFilter matches hosts that were first seen at least minAge blocks
+// before the provided block height.
+type minAgeFilter struct {
+	minAge types.BlockHeight
+	height types.BlockHeight
+}
+
+// Matches returns true if the host is at least as old as the filter requires.
+func (maf minAgeFilter) Matches(entry modules.HostDBEntry) bool {
+	// COMPATv1.1.0
+	//
+	// FirstSeen is clamped to the block height when the hosts are loaded, a
+	// host first seen after the current height is treated as brand new.
+	var age types.BlockHeight
+	if maf.height >= entry.FirstSeen {
+		age = maf.height - entry.FirstSeen
+	}
+	return age >= maf.minAge
+}
+
+// Name implements hosttree.HostFilter.
+func (maf minAgeFilter) Name() string {
+	return "minage"
+}
+
+// minStorageFilter matches hosts that have at least minStorage bytes of
+// storage remaining.
+type minStorageFilter struct {
+	minStorage uint64
+}
+
+// Matches returns true if the host has enough storage remaining.
+func (msf minStorageFilter) Matches(entry modules.HostDBEntry) bool {
+	return entry.RemainingStorage >= msf.minStorage
+}
+
+// Name implements hosttree.HostFilter.
+func (msf minStorageFilter) Name() string {
+	return "minstorage"
+}
+
+// minBandwidthFilter matches hosts that have been measured at a bandwidth of at
+// least minBandwidth bytes per second.
+type minBandwidthFilter struct {
+	minBandwidth uint64
+}
+
+// Matches returns true if the host's measured bandwidth is high enough. Hosts
+// that have never been measured don't match.
+func (mbf minBandwidthFilter) Matches(entry modules.HostDBEntry) bool {
+	return entry.Bandwidth >= mbf.minBandwidth
+}
+
+// Name implements hosttree.HostFilter.
+func (mbf minBandwidthFilter) Name() string {
+	return "minbandwidth"
+}
+
+// minMaxDurationFilter matches hosts that accept contracts lasting at least
+// minDuration blocks.
+type minMaxDurationFilter struct {
+	minDuration types.BlockHeight
+}
+
+// Matches returns true if the host's maximum contract duration is long enough.
+func (mmdf minMaxDurationFilter) Matches(entry modules.HostDBEntry) bool {
+	return entry.MaxDuration >= mmdf.minDuration
+}
+
+// Name implements hosttree.HostFilter.
+func (mmdf minMaxDurationFilter) Name() string {
+	return "minhostmaxduration"
+}
+
+// minScansFilter matches hosts that have been scanned at least minScans times.
+type minScansFilter struct {
+	minScans int
+}
+
+// Matches returns true if the host's scan history is long enough.
+func (msf minScansFilter) Matches(entry modules.HostDBEntry) bool {
+	return len(entry.ScanHistory) >= msf.minScans
+}
+
+// Name implements hosttree.HostFilter.
+func (msf minScansFilter) Name() string {
+	return "minscans"
+}
+
+// settingsAgeFilter matches hosts whose settings were fetched after cutoff.
+type settingsAgeFilter struct {
+	cutoff time.Time
+}
+
+// Matches returns true if the last successful scan of the host, which fetched
+// its settings, happened after the cutoff. Hosts that have never been scanned
+// successfully don't match.
+func (saf settingsAgeFilter) Matches(entry modules.HostDBEntry) bool {
+	for i := len(entry.ScanHistory) - 1; i >= 0; i-- {
+		if entry.ScanHistory[i].Success {
+			return entry.ScanHistory[i].Timestamp.After(saf.cutoff)
+		}
+	}
+	return false
+}
+
+// Name implements hosttree.HostFilter.
+func (saf settingsAgeFilter) Name() string {
+	return "maxsettingsage"
+}
+
+// maxPriceFilter matches hosts whose storage price doesn't exceed maxPrice.
+type maxPriceFilter struct {
+	maxPrice types.Currency
+}
+
+// Matches returns true if the host's storage price is low enough.
+func (mpf maxPriceFilter) Matches(entry modules.HostDBEntry) bool {
+	return entry.StoragePrice.Cmp(mpf.maxPrice) <= 0
+}
+
+// Name implements hosttree.HostFilter.
+func (mpf maxPriceFilter) Name() string {
+	return "maxprice"
+}
+
+// staleScanFilter matches hosts that have been scanned after cutoff.
+type staleScanFilter struct {
+	cutoff time.Time
+}
+
+// Matches returns true if the last scan of the host happened after the
+// cutoff. Hosts that have never been scanned don't match.
+func (ssf staleScanFilter) Matches(entry modules.HostDBEntry) bool {
+	if len(entry.ScanHistory) == 0 {
+		return false
+	}
+	return entry.ScanHistory[len(entry.ScanHistory)-1].Timestamp.After(ssf.cutoff)
+}
+
+// Name implements hosttree.HostFilter.
+func (ssf staleScanFilter) Name() string {
+	return "stale"
+}
+
+// profileFilters returns the filters a host has to match to be selected for
+// the provided hostdb profile at the provided block height. Apart from the
+// maximum price, prices only affect the weight of a host.
+func (hdb *HostDB) profileFilters(profile hostdbprofile.HostDBProfile, height types.BlockHeight) []hosttree.HostFilter {
+	var filters []hosttree.HostFilter
+	if profile.MinAge > 0 {
+		filters = append(filters, minAgeFilter{minAge: profile.MinAge, height: height})
+	}
+	if profile.MinStorage > 0 {
+		filters = append(filters, minStorageFilter{minStorage: profile.MinStorage})
+	}
+	if profile.MinBandwidth > 0 {
+		filters = append(filters, minBandwidthFilter{minBandwidth: profile.MinBandwidth})
+	}
+	if profile.MinHostMaxDuration > 0 {
+		filters = append(filters, minMaxDurationFilter{minDuration: profile.MinHostMaxDuration})
+	}
+	if profile.MinScans > 1 {
+		filters = append(filters, minScansFilter{minScans: profile.MinScans})
+	}
+	if profile.MaxSettingsAge > 0 {
+		filters = append(filters, settingsAgeFilter{cutoff: hdb.deps.Now().Add(-profile.MaxSettingsAge)})
+	}
+	if !profile.MaxPrice.IsZero() {
+		filters = append(filters, maxPriceFilter{maxPrice: profile.MaxPrice})
+	}
+	if hdb.scanSettings.ExcludeStaleHosts {
+		filters = append(filters, staleScanFilter{cutoff: hdb.deps.Now().Add(-hdb.scanSettings.StaleScanAge)})
+	}
+	// Hosts have no location information if geolocation is disabled, accept
+	// all of them.
+	if !hdb.geolocationDisabled {
+		filters = append(filters, locationFilter{locations: profile.Location})
+	}
+	return filters
+}
+
+// treeFilters returns the filters deciding which hosts are kept in the host
+// tree of the provided hostdb profile. Only the locations of a profile are
+// used, as they rarely change for a host. The default tree always holds all
+// known hosts since it is used for lookups and persistence, and the selection
+// still applies all of the profileFilters.
+func (hdb *HostDB) treeFilters(name string, profile hostdbprofile.HostDBProfile) []hosttree.HostFilter {
+	if name == "default" || hdb.geolocationDisabled || len(profile.Location) == 0 {
+		return nil
+	}
+	return []hosttree.HostFilter{locationFilter{locations: profile.Location}}
+}
@@ -0,0 +1,440 @@
+package hostdb
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/pachisi456/sia-hostdb-profiles/build"
+	"github.com/pachisi456/sia-hostdb-profiles/modules"
+	"github.com/pachisi456/sia-hostdb-profiles/types"
+)
+
+// TestLocationFilter probes the Matches method of the locationFilter.
+func TestLocationFilter(t *testing.T) {
+	tests := []struct {
+		locations []string
+		country   string
+		eu        bool
+		matches   bool
+	}{
+		{nil, "Germany", true, true},
+		{nil, "", false, false},
+		{[]string{"germany"}, "Germany", true, true},
+		{[]string{"germany"}, "France", true, false},
+		{[]string{"eu"}, "France", true, true},
+		{[]string{"eu"}, "China", false, false},
+		{[]string{"china", "germany"}, "China", false, true},
+		{[]string{"germany"}, "", false, false},
+	}
+	for _, test := range tests {
+		entry := modules.HostDBEntry{Country: test.country, EUhost: test.eu}
+		if matches := (locationFilter{locations: test.locations}).Matches(entry); matches != test.matches {
+			t.Errorf("locations %v, country %q: expected %v, got %v", test.locations, test.country, test.matches, matches)
+		}
+	}
+}
+
+// TestMinAgeFilter probes the Matches method of the minAgeFilter.
+func TestMinAgeFilter(t *testing.T) {
+	tests := []struct {
+		minAge    types.BlockHeight
+		height    types.BlockHeight
+		firstSeen types.BlockHeight
+		matches   bool
+	}{
+		{0, 100, 100, true},
+		{10, 100, 100, false},
+		{10, 100, 91, false},
+		{10, 100, 90, true},
+		{10, 100, 0, true},
+		// A host first seen after the current height counts as brand new.
+		{10, 100, 150, false},
+		{0, 100, 150, true},
+	}
+	for _, test := range tests {
+		entry := modules.HostDBEntry{FirstSeen: test.firstSeen}
+		filter := minAgeFilter{minAge: test.minAge, height: test.height}
+		if matches := filter.Matches(entry); matches != test.matches {
+			t.Errorf("minage %v, height %v, first seen %v: expected %v, got %v", test.minAge, test.height, test.firstSeen, test.matches, matches)
+		}
+	}
+}
+
+// TestMinAgeSelection checks that a hostdb profile with a minimum age only
+// selects hosts that were seen long enough ago.
+func TestMinAgeSelection(t *testing.T) {
+	hdb, err := newProfileHostDB(t.Name(), "cautious")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdb.initialScanComplete = true
+	hdb.blockHeight = 1000
+
+	fresh := makeHostDBEntry()
+	fresh.Country = "Germany"
+	fresh.FirstSeen = 995
+	old := makeHostDBEntry()
+	old.Country = "Germany"
+	old.FirstSeen = 100
+	if err := hdb.hostTrees.InsertBatch([]modules.HostDBEntry{fresh, old}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := hdb.ConfigHostDBProfile("cautious", "minage", "144"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		hosts, err := hdb.RandomHosts("cautious", 2, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(hosts) != 1 || hosts[0].PublicKey.String() != old.PublicKey.String() {
+			t.Fatal("expected only the old host to be selected, got", hosts)
+		}
+	}
+	if !scoreBreakdown(t, hdb, fresh, "cautious").Blacklisted {
+		t.Error("fresh host should be reported as filtered")
+	}
+
+	// The default profile has no minimum age.
+	hosts, err := hdb.RandomHosts("default", 2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hosts) != 2 {
+		t.Fatal("expected default profile to select both hosts, got", len(hosts))
+	}
+}
+
+// TestMinStorageSelection checks that nearly full hosts are de-prioritized by
+// hot profiles and excluded by profiles with a minimum remaining storage.
+func TestMinStorageSelection(t *testing.T) {
+	hdb, err := newProfileHostDB(t.Name(), "roomy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := hdb.hostdbProfiles.AddHostDBProfile("streaming", "hot"); err != nil {
+		t.Fatal(err)
+	}
+	hdb.initialScanComplete = true
+
+	// Insert hosts at varying capacity.
+	var hosts []modules.HostDBEntry
+	for _, remaining := range []uint64{250 * requiredStorage, 50 * requiredStorage, requiredStorage / 2} {
+		host := makeHostDBEntry()
+		host.Country = "Germany"
+		host.RemainingStorage = remaining
+		host.Version = build.Version
+		host.StoragePrice = types.NewCurrency64(1000).Mul(types.SiacoinPrecision)
+		host.Collateral = types.NewCurrency64(1000).Mul(types.SiacoinPrecision)
+		hosts = append(hosts, host)
+	}
+	if err := hdb.hostTrees.InsertBatch(hosts); err != nil {
+		t.Fatal(err)
+	}
+	empty, half, full := hosts[0], hosts[1], hosts[2]
+
+	// Fuller hosts weigh less, and more so for a hot profile than for a cold
+	// one.
+	for _, profile := range []string{"roomy", "streaming"} {
+		if hdb.calculateHostWeight(half, profile).Cmp(hdb.calculateHostWeight(empty, profile)) >= 0 {
+			t.Errorf("%v: half full host should weigh less than an empty one", profile)
+		}
+		if hdb.calculateHostWeight(full, profile).Cmp(hdb.calculateHostWeight(half, profile)) >= 0 {
+			t.Errorf("%v: full host should weigh less than a half full one", profile)
+		}
+	}
+	coldPenalty := scoreBreakdown(t, hdb, full, "roomy").StorageRemainingAdjustment
+	hotPenalty := scoreBreakdown(t, hdb, full, "streaming").StorageRemainingAdjustment
+	if hotPenalty >= coldPenalty {
+		t.Errorf("expected a harsher storage penalty for the hot profile, got %v (hot) and %v (cold)", hotPenalty, coldPenalty)
+	}
+
+	// With a minimum remaining storage the full host is never selected.
+	if _, err := hdb.ConfigHostDBProfile("roomy", "minstorage", strconv.FormatUint(requiredStorage, 10)); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		selected, err := hdb.RandomHosts("roomy", 3, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(selected) != 2 {
+			t.Fatal("expected 2 hosts to be selected, got", len(selected))
+		}
+		for _, host := range selected {
+			if host.PublicKey.String() == full.PublicKey.String() {
+				t.Fatal("full host was selected")
+			}
+		}
+	}
+	if !scoreBreakdown(t, hdb, full, "roomy").Blacklisted {
+		t.Error("full host should be reported as filtered")
+	}
+}
+
+// TestMaxPriceWarning checks that configuring a maximum price below the prices
+// of all active hosts results in a warning rather than an error.
+func TestMaxPriceWarning(t *testing.T) {
+	hdb, err := newProfileHostDB(t.Name(), "frugal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdb.initialScanComplete = true
+
+	// Insert hosts charging the market price.
+	marketPrice := types.SiacoinPrecision.Mul64(1000).Div(modules.BlockBytesPerMonthTerabyte)
+	var hosts []modules.HostDBEntry
+	for i := 0; i < 3; i++ {
+		host := makeHostDBEntry()
+		host.Country = "Germany"
+		host.StoragePrice = marketPrice
+		hosts = append(hosts, host)
+	}
+	if err := hdb.hostTrees.InsertBatch(hosts); err != nil {
+		t.Fatal(err)
+	}
+
+	// A maximum price at the market price doesn't filter any host.
+	warning, err := hdb.ConfigHostDBProfile("frugal", "maxprice", marketPrice.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if warning != "" {
+		t.Fatal("unexpected warning:", warning)
+	}
+
+	// A sub-market maximum price is applied but results in a warning.
+	subMarket := marketPrice.Div64(2)
+	warning, err = hdb.ConfigHostDBProfile("frugal", "maxprice", subMarket.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if warning == "" {
+		t.Fatal("expected a warning for a sub-market maximum price")
+	}
+	if !hdb.HostDBProfile("frugal").MaxPrice.Equals(subMarket) {
+		t.Fatal("maximum price was not applied")
+	}
+	selected, err := hdb.RandomHosts("frugal", 3, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(selected) != 0 {
+		t.Fatal("expected no hosts to be selected, got", len(selected))
+	}
+}
+
+// TestMinHostMaxDurationSelection checks that profiles requiring a minimum
+// contract duration exclude hosts with a shorter maximum duration.
+func TestMinHostMaxDurationSelection(t *testing.T) {
+	hdb, err := newProfileHostDB(t.Name(), "longterm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdb.initialScanComplete = true
+
+	// Insert hosts with varying maximum durations.
+	var hosts []modules.HostDBEntry
+	for _, maxDuration := range []types.BlockHeight{144, 4320, 25920} {
+		host := makeHostDBEntry()
+		host.Country = "Germany"
+		host.MaxDuration = maxDuration
+		hosts = append(hosts, host)
+	}
+	if err := hdb.hostTrees.InsertBatch(hosts); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without a minimum all hosts are selected.
+	selected, err := hdb.RandomHosts("longterm", 3, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(selected) != 3 {
+		t.Fatal("expected all hosts to be selected, got", len(selected))
+	}
+
+	// Require the duration of a period plus renew window.
+	if _, err := hdb.ConfigHostDBProfile("longterm", "minhostmaxduration", "-1"); err == nil {
+		t.Fatal("expected a negative minimum duration to be rejected")
+	}
+	if _, err := hdb.ConfigHostDBProfile("longterm", "minhostmaxduration", "6000"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		selected, err := hdb.RandomHosts("longterm", 3, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(selected) != 1 || selected[0].PublicKey.String() != hosts[2].PublicKey.String() {
+			t.Fatal("expected only the host with the longest maximum duration to be selected, got", len(selected))
+		}
+	}
+	if !scoreBreakdown(t, hdb, hosts[0], "longterm").Blacklisted {
+		t.Error("short duration host should be reported as filtered")
+	}
+	if filters, err := hdb.EffectiveFilters("longterm"); err != nil || filters.MinHostMaxDuration != 6000 {
+		t.Errorf("expected the minimum duration in the effective filters, got %v (%v)", filters.MinHostMaxDuration, err)
+	}
+}
+
+// TestMinScansSelection checks that profiles requiring a minimum number of
+// scans exclude hosts with a shorter scan history.
+func TestMinScansSelection(t *testing.T) {
+	hdb, err := newProfileHostDB(t.Name(), "reliable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdb.initialScanComplete = true
+
+	// Insert a host with a single successful scan and one with three.
+	fresh, seasoned := makeHostDBEntry(), makeHostDBEntry()
+	fresh.Country, seasoned.Country = "Germany", "Germany"
+	for i := 0; i < 2; i++ {
+		seasoned.ScanHistory = append(seasoned.ScanHistory, modules.HostDBScan{
+			Timestamp: seasoned.ScanHistory[len(seasoned.ScanHistory)-1].Timestamp.Add(time.Hour),
+			Success:   true,
+		})
+	}
+	if err := hdb.hostTrees.InsertBatch([]modules.HostDBEntry{fresh, seasoned}); err != nil {
+		t.Fatal(err)
+	}
+
+	// By default a single successful scan is enough.
+	selected, err := hdb.RandomHosts("reliable", 2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(selected) != 2 {
+		t.Fatal("expected both hosts to be selected, got", len(selected))
+	}
+
+	if _, err := hdb.ConfigHostDBProfile("reliable", "minscans", "3"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		selected, err := hdb.RandomHosts("reliable", 2, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(selected) != 1 || selected[0].PublicKey.String() != seasoned.PublicKey.String() {
+			t.Fatal("expected only the host with enough scans to be selected, got", len(selected))
+		}
+	}
+	if !scoreBreakdown(t, hdb, fresh, "reliable").Blacklisted {
+		t.Error("host with too few scans should be reported as filtered")
+	}
+	if filters, err := hdb.EffectiveFilters("reliable"); err != nil || filters.MinScans != 3 {
+		t.Errorf("expected the minimum number of scans in the effective filters, got %v (%v)", filters.MinScans, err)
+	}
+}
+
+// TestUnsetMaxPrice checks that unsetting the maximum price of a profile makes
+// the expensive hosts selectable again.
+func TestUnsetMaxPrice(t *testing.T) {
+	hdb, err := newProfileHostDB(t.Name(), "frugal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdb.initialScanComplete = true
+
+	// Insert a cheap and an expensive host.
+	cheapPrice := types.SiacoinPrecision.Mul64(100).Div(modules.BlockBytesPerMonthTerabyte)
+	var hosts []modules.HostDBEntry
+	for _, price := range []types.Currency{cheapPrice, cheapPrice.Mul64(10)} {
+		host := makeHostDBEntry()
+		host.Country = "Germany"
+		host.StoragePrice = price
+		hosts = append(hosts, host)
+	}
+	if err := hdb.hostTrees.InsertBatch(hosts); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := hdb.ConfigHostDBProfile("frugal", "maxprice", cheapPrice.String()); err != nil {
+		t.Fatal(err)
+	}
+	selected, err := hdb.RandomHosts("frugal", 2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(selected) != 1 || selected[0].PublicKey.String() != hosts[0].PublicKey.String() {
+		t.Fatal("expected only the cheap host to be selected, got", len(selected))
+	}
+
+	if _, err := hdb.ConfigHostDBProfile("frugal", "unset", "maxprice"); err != nil {
+		t.Fatal(err)
+	}
+	if !hdb.HostDBProfile("frugal").MaxPrice.IsZero() {
+		t.Fatal("maximum price was not unset")
+	}
+	selected, err = hdb.RandomHosts("frugal", 2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(selected) != 2 {
+		t.Fatal("expected the expensive host to be selected again, got", len(selected))
+	}
+}
+
+// TestMaxSettingsAgeSelection checks that profiles with a maximum settings age
+// exclude hosts whose settings were fetched too long ago until they are
+// rescanned.
+func TestMaxSettingsAgeSelection(t *testing.T) {
+	hdb, err := newProfileHostDB(t.Name(), "fresh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdb.initialScanComplete = true
+	if _, err := hdb.ConfigHostDBProfile("fresh", "maxsettingsage", "1h"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Insert a host that was scanned just now and one whose last successful
+	// scan was two hours ago, followed by a failed scan.
+	recent, old := makeHostDBEntry(), makeHostDBEntry()
+	recent.Country, old.Country = "Germany", "Germany"
+	old.ScanHistory = modules.HostDBScans{
+		{Timestamp: time.Now().Add(-2 * time.Hour), Success: true},
+		{Timestamp: time.Now().Add(-time.Minute), Success: false},
+	}
+	if err := hdb.hostTrees.InsertBatch([]modules.HostDBEntry{recent, old}); err != nil {
+		t.Fatal(err)
+	}
+	if !scoreBreakdown(t, hdb, old, "fresh").Blacklisted {
+		t.Error("host with old settings should be reported as filtered")
+	}
+	if scoreBreakdown(t, hdb, old, "default").Blacklisted {
+		t.Error("host with old settings should not be filtered without a maximum settings age")
+	}
+	for i := 0; i < 10; i++ {
+		selected, err := hdb.RandomHosts("fresh", 2, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(selected) != 1 || selected[0].PublicKey.String() != recent.PublicKey.String() {
+			t.Fatal("expected only the host with recent settings to be selected, got", len(selected))
+		}
+	}
+
+	// Once the host has been rescanned it is selected again.
+	hdb.mu.Lock()
+	hdb.updateEntry(old, nil)
+	hdb.mu.Unlock()
+	rescanned, _ := hdb.hostTrees.Select(old.PublicKey)
+	if scoreBreakdown(t, hdb, rescanned, "fresh").Blacklisted {
+		t.Fatal("rescanned host should not be filtered")
+	}
+	selected, err := hdb.RandomHosts("fresh", 2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(selected) != 2 {
+		t.Fatal("expected both hosts to be selected after the rescan, got", len(selected))
+	}
+	if filters, err := hdb.EffectiveFilters("fresh"); err != nil || filters.MaxSettingsAge != time.Hour {
+		t.Errorf("expected the maximum settings age in the effective filters, got %v (%v)", filters.MaxSettingsAge, err)
+	}
+}
@@ -5,10 +5,14 @@
 package hostdb
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"net"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"sync"
 	"time"
 
@@ -31,6 +35,15 @@ var (
 	ErrInitialScanIncomplete = errors.New("initial hostdb scan is not yet completed")
 	errNilCS                 = errors.New("cannot create hostdb with nil consensus set")
 	errNilGateway            = errors.New("cannot create hostdb with nil gateway")
+	errProfileInUse          = errors.New("hostdb profile is the active profile used for the allowance")
+	errProfileDisabled       = hostdbprofile.ErrProfileDisabled
+	errGeolocationDisabled   = errors.New("geolocation is disabled, hosts cannot be selected by location")
+	errUnknownHost           = errors.New("host is not known to the hostdb")
+	errInvalidHostTag        = errors.New("host tags must be 1 to 64 characters without commas or control characters")
+	errTooManyHostTags       = errors.New("a host can be annotated with at most 16 tags")
+	errScanSleepRange        = errors.New("maximum scan sleep must be greater than minimum scan sleep")
+	errRefreshInProgress     = errors.New("the host locations are already being refreshed")
+	errNoGeolocationSource   = errors.New("no geolocation database is available to locate hosts")
 )
 
 // Directory and file for ip information database.
@@ -38,6 +51,102 @@ var (
 const geolocationDir = "GeoLite2-Country_20180501"
 const geolocationFile = "GeoLite2-Country.mmdb"
 
+// geolocationTmpFile is the file the compressed geolocation database is
+// downloaded to before it is unpacked.
+const geolocationTmpFile = "GeoLite2-Country.tar.gz.tmp"
+
+// geolocationRefreshDir is the directory a refreshed geolocation database is
+// unpacked into before it replaces the database in use.
+const geolocationRefreshDir = "GeoLite2-Country.refresh"
+
+// geolocationURL is the address the geolocation database is downloaded from if
+// it can't be found in the persist directory.
+var geolocationURL = "http://geolite.maxmind.com/download/geoip/database/GeoLite2-Country.tar.gz"
+
+// ScanSettings configure how often and how concurrently the hostdb scans hosts
+// and how often it saves to disk. Zero values are replaced by the defaults.
+type ScanSettings struct {
+	// ScanningThreads is the maximum number of threads probing hosts at the
+	// same time.
+	ScanningThreads int
+
+	// MinScanSleep and MaxScanSleep bound the random amount of time the hostdb
+	// sleeps between two scans of its hosts.
+	MinScanSleep time.Duration
+	MaxScanSleep time.Duration
+
+	// SaveFrequency defines how frequently the hostdb saves to disk.
+	SaveFrequency time.Duration
+
+	// StaleScanAge is the age of the last scan after which a host is reported
+	// as stale. If ExcludeStaleHosts is set, stale hosts are not selected.
+	StaleScanAge      time.Duration
+	ExcludeStaleHosts bool
+
+	// MaxHosts is the maximum number of hosts the hostdb retains. Excess
+	// hosts are evicted before each save. Zero means no limit.
+	MaxHosts int
+
+	// ScanTimeout is the amount of time a host has to connect and respond to
+	// the settings RPC before the scan is recorded as a failure.
+	ScanTimeout time.Duration
+
+	// JSONLog makes the hostdb log its selection, scan and save events as
+	// JSON objects, one per line, instead of plain text so that they can be
+	// parsed by log aggregation systems.
+	JSONLog bool
+
+	// MaxGeolocationAge is the age of the geolocation database, measured from
+	// the time it was built, after which it is refreshed in the background
+	// when the hostdb starts.
+	MaxGeolocationAge time.Duration
+}
+
+// DefaultScanSettings returns the scan settings used if none are provided.
+func DefaultScanSettings() ScanSettings {
+	return ScanSettings{
+		ScanningThreads: maxScanningThreads,
+		MinScanSleep:    minScanSleep,
+		MaxScanSleep:    maxScanSleep,
+		SaveFrequency:   saveFrequency,
+		StaleScanAge:    staleScanAge,
+		ScanTimeout:     scanTimeout,
+
+		MaxGeolocationAge: maxGeolocationAge,
+	}
+}
+
+// withDefaults returns a copy of the scan settings with all zero values
+// replaced by the defaults.
+func (ss ScanSettings) withDefaults() (ScanSettings, error) {
+	def := DefaultScanSettings()
+	if ss.ScanningThreads <= 0 {
+		ss.ScanningThreads = def.ScanningThreads
+	}
+	if ss.MinScanSleep <= 0 {
+		ss.MinScanSleep = def.MinScanSleep
+	}
+	if ss.MaxScanSleep <= 0 {
+		ss.MaxScanSleep = def.MaxScanSleep
+	}
+	if ss.SaveFrequency <= 0 {
+		ss.SaveFrequency = def.SaveFrequency
+	}
+	if ss.StaleScanAge <= 0 {
+		ss.StaleScanAge = def.StaleScanAge
+	}
+	if ss.ScanTimeout <= 0 {
+		ss.ScanTimeout = def.ScanTimeout
+	}
+	if ss.MaxGeolocationAge <= 0 {
+		ss.MaxGeolocationAge = def.MaxGeolocationAge
+	}
+	if ss.MaxScanSleep <= ss.MinScanSleep {
+		return ScanSettings{}, errScanSleepRange
+	}
+	return ss, nil
+}
+
 // The HostDB is a database of potential hosts. It assigns a weight to each
 // host based on their hosting parameters, and then can select hosts at random
 // for uploading files.
@@ -51,23 +160,55 @@ type HostDB struct {
 	persistDir string
 	tg         siasync.ThreadGroup
 
-	// database with ip information to determine host location
-	ipdb *geoip2.Reader
+	// database with ip information to determine host location. If
+	// geolocation is disabled or the dependencies provide their own geo-IP
+	// source it is never downloaded and stays nil. geolocate looks up the
+	// location of an IP address and is nil if no geo-IP source is available.
+	// The database can be replaced by a refresh, ipdbMu protects it.
+	ipdb                *geoip2.Reader
+	ipdbMu              sync.RWMutex
+	geolocate           func(net.IP) (country string, eu bool, err error)
+	geolocationDisabled bool
+
+	// geolocationRefresh is the progress of the last refresh of the host
+	// locations, it is protected by mu. refreshMu makes sure that only one
+	// refresh of the geolocation database runs at a time.
+	geolocationRefresh modules.HostDBGeolocationRefresh
+	refreshMu          sync.Mutex
+
+	// scanSettings configure the scanning threads and the save loop.
+	scanSettings ScanSettings
+
+	// protectedHosts returns the hosts that must never be evicted from the
+	// hostdb. It is set by the renter and may be nil.
+	protectedHosts func() []types.SiaPublicKey
 
 	// hostdbProfiles is the collection of all hostdb profiles the renter created to
 	// customize the host selection.
-	hostdbProfiles hostdbprofile.HostDBProfiles
+	hostdbProfiles *hostdbprofile.HostDBProfiles
+
+	// activeProfile is the name of the hostdb profile that is used if no
+	// profile is specified, e.g. by the contractor. Empty means "default".
+	activeProfile string
 
 	// hostTrees contains a HostTree for each HostDBProfile. The trees are necessary
 	// for selecting weighted hosts at random.
 	hostTrees hosttree.HostTrees
 
+	// candidateCache caches the hosts each hostdb profile may select from,
+	// mapped by the name of the profile. It is protected by its own
+	// mutex as it is only accessed during host selection.
+	candidateCache   map[string]candidateCacheEntry
+	candidateCacheMu sync.Mutex
+
 	// the scanPool is a set of hosts that need to be scanned. There are a
 	// handful of goroutines constantly waiting on the channel for hosts to
 	// scan. The scan map is used to prevent duplicates from entering the scan
-	// pool.
+	// pool. Hosts in the priority scan list, e.g. the hosts the renter has
+	// contracts with, are scanned before the hosts in the scan list.
 	initialScanComplete  bool
 	initialScanLatencies []time.Duration
+	priorityScanList     []modules.HostDBEntry
 	scanList             []modules.HostDBEntry
 	scanMap              map[string]struct{}
 	scanWait             bool
@@ -94,6 +235,43 @@ func New(g modules.Gateway, cs modules.ConsensusSet, persistDir string) (*HostDB
 // persistence data, spawns the HostDB's scanning threads, and subscribes it to
 // the consensusSet.
 func NewCustomHostDB(g modules.Gateway, cs modules.ConsensusSet, persistDir string, deps modules.Dependencies) (*HostDB, error) {
+	return NewCustomHostDBWithDefaultProfile(g, cs, persistDir, deps, "warm", nil)
+}
+
+// NewCustomHostDBWithDefaultProfile creates a HostDB like NewCustomHostDB, but
+// initializes the default hostdb profile with the provided storage tier and
+// locations. The default profile is only used if no profiles have been
+// persisted yet, i.e. on first boot.
+func NewCustomHostDBWithDefaultProfile(g modules.Gateway, cs modules.ConsensusSet, persistDir string, deps modules.Dependencies, storagetier string, locations []string) (*HostDB, error) {
+	return newCustomHostDB(g, cs, persistDir, deps, storagetier, locations, DefaultScanSettings(), true)
+}
+
+// NewCustomHostDBWithScanSettings creates a HostDB like NewCustomHostDB, but
+// scans hosts and saves to disk according to the provided scan settings.
+func NewCustomHostDBWithScanSettings(g modules.Gateway, cs modules.ConsensusSet, persistDir string, deps modules.Dependencies, scanSettings ScanSettings) (*HostDB, error) {
+	return newCustomHostDB(g, cs, persistDir, deps, "warm", nil, scanSettings, true)
+}
+
+// NewCustomHostDBWithoutGeolocation creates a HostDB like NewCustomHostDB, but
+// with geolocation disabled. The geolocation database is not downloaded, which
+// avoids the request to its provider, and hosts cannot be selected by location.
+func NewCustomHostDBWithoutGeolocation(g modules.Gateway, cs modules.ConsensusSet, persistDir string, deps modules.Dependencies) (*HostDB, error) {
+	return newCustomHostDB(g, cs, persistDir, deps, "warm", nil, DefaultScanSettings(), false)
+}
+
+// newCustomHostDB creates a HostDB using the provided dependencies, default
+// hostdb profile and scan settings. The geolocation database is only loaded if
+// geolocation is true.
+func newCustomHostDB(g modules.Gateway, cs modules.ConsensusSet, persistDir string, deps modules.Dependencies, storagetier string, locations []string, scanSettings ScanSettings, geolocation bool) (*HostDB, error) {
+	hdbProfiles, err := hostdbprofile.NewHostDBProfilesWithDefault(storagetier, locations)
+	if err != nil {
+		return nil, err
+	}
+	scanSettings, err = scanSettings.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+
 	// Create the HostDB object.
 	hdb := &HostDB{
 		cs:         cs,
@@ -101,7 +279,9 @@ func NewCustomHostDB(g modules.Gateway, cs modules.ConsensusSet, persistDir stri
 		gateway:    g,
 		persistDir: persistDir,
 
-		hostdbProfiles: hostdbprofile.NewHostDBProfiles(),
+		geolocationDisabled: !geolocation,
+		hostdbProfiles:      hdbProfiles,
+		scanSettings:        scanSettings,
 
 		scanMap: make(map[string]struct{}),
 	}
@@ -112,7 +292,7 @@ func NewCustomHostDB(g modules.Gateway, cs modules.ConsensusSet, persistDir stri
 	hdb.mu.Unlock()
 
 	// Create the persist directory if it does not yet exist.
-	err := os.MkdirAll(persistDir, 0700)
+	err = os.MkdirAll(persistDir, 0700)
 	if err != nil {
 		return nil, err
 	}
@@ -130,27 +310,39 @@ func NewCustomHostDB(g modules.Gateway, cs modules.ConsensusSet, persistDir stri
 		}
 	})
 
-	// Load the ip information database to determine host location (country).
-	db, err := geoip2.Open(filepath.Join(persistDir, geolocationDir, geolocationFile))
-	if err != nil {
-		// Get the geolocation database.
-		resp, err := http.Get("http://geolite.maxmind.com/download/geoip/database/GeoLite2-Country.tar.gz")
+	// Load the ip information database to determine host location (country),
+	// unless geolocation is disabled or the dependencies bring their own
+	// geo-IP source.
+	if geolocator, ok := deps.(ipGeolocator); geolocation && ok {
+		hdb.geolocate = geolocator.GeolocateIP
+	} else if geolocation {
+		downloaded := false
+		db, err := geoip2.Open(filepath.Join(persistDir, geolocationDir, geolocationFile))
 		if err != nil {
-			hdb.log.Print(err)
-		}
-		// Untar the database.
-		r := io.Reader(resp.Body)
-		err = Untar(persistDir, r)
-		if err != nil {
-			hdb.log.Print(err)
+			// Get the geolocation database.
+			if err := hdb.managedDownloadGeolocationDB(geolocationURL, persistDir); err != nil {
+				hdb.log.Println("Unable to download the geolocation database:", err)
+			}
+			downloaded = true
+			db, err = geoip2.Open(filepath.Join(persistDir, geolocationDir, geolocationFile))
+			if err != nil {
+				hdb.log.Print(err)
+			}
 		}
-		err = nil
-		db, err = geoip2.Open(filepath.Join(persistDir, geolocationDir, geolocationFile))
-		if err != nil {
-			hdb.log.Print(err)
+		if db != nil {
+			hdb.ipdb = db
+			hdb.geolocate = hdb.locateGeoLite2
+
+			// Refresh a database that has been on disk for too long. A
+			// database that was just downloaded is as fresh as it gets.
+			built := geolocationBuildTime(db)
+			hdb.log.Println("Loaded the geolocation database built on", built.Format("2006-01-02"))
+			if age := hdb.deps.Now().Sub(built); !downloaded && age > scanSettings.MaxGeolocationAge {
+				hdb.log.Printf("The geolocation database is %v old, refreshing it in the background", age.Round(time.Hour))
+				go hdb.threadedRefreshGeolocationDB()
+			}
 		}
 	}
-	hdb.ipdb = db
 
 	// Load the prior persistence structures.
 	hdb.mu.Lock()
@@ -162,13 +354,15 @@ func NewCustomHostDB(g modules.Gateway, cs modules.ConsensusSet, persistDir stri
 
 	// Load the host trees, one tree for each hostdb profile.
 	hdb.loadHostTrees(allHosts)
+	hdb.reconcileProfilesAndTrees()
 
 	hdb.tg.AfterStop(func() {
 		hdb.mu.Lock()
 		err := hdb.saveSync()
 		hdb.mu.Unlock()
 		if err != nil {
-			hdb.log.Println("Unable to save the hostdb:", err)
+			hdb.logEvent(logEntry{Level: logLevelError, Message: "unable to save the hostdb", Reason: err.Error()},
+				"Unable to save the hostdb: %v", err)
 		}
 	})
 
@@ -221,25 +415,72 @@ func NewCustomHostDB(g modules.Gateway, cs modules.ConsensusSet, persistDir stri
 	return hdb, nil
 }
 
-// ActiveHosts returns a list of hosts that are currently online, sorted by
-// weight. tree specifies the host tree the hosts should be pulled from.
+// ActiveHosts returns a list of hosts that are currently online, starting with
+// the highest weighted one. Hosts of equal weight are sorted by public key.
+// tree specifies the host tree the hosts should be pulled from.
 func (hdb *HostDB) ActiveHosts(tree string) (activeHosts []modules.HostDBEntry) {
+	// All returns the hosts sorted by ascending weight, walk it backwards.
 	allHosts := hdb.hostTrees.All(tree)
-	for _, entry := range allHosts {
-		if len(entry.ScanHistory) == 0 {
+	for i := len(allHosts) - 1; i >= 0; i-- {
+		entry := allHosts[i]
+		if !entry.LastScanSuccessful() {
 			continue
 		}
-		if !entry.ScanHistory[len(entry.ScanHistory)-1].Success {
+		if !entry.AcceptingContracts {
+			continue
+		}
+		activeHosts = append(activeHosts, entry)
+	}
+	return activeHosts
+}
+
+// ActiveHostsN returns at most n of the hosts that are currently online, i.e.
+// the n highest weighted active hosts, in the same order as ActiveHosts. tree
+// specifies the host tree the hosts should be pulled from.
+func (hdb *HostDB) ActiveHostsN(tree string, n int) (activeHosts []modules.HostDBEntry) {
+	if n <= 0 {
+		return nil
+	}
+	// All returns the hosts sorted by ascending weight, walk it backwards.
+	allHosts := hdb.hostTrees.All(tree)
+	for i := len(allHosts) - 1; i >= 0; i-- {
+		entry := allHosts[i]
+		if !entry.LastScanSuccessful() {
 			continue
 		}
 		if !entry.AcceptingContracts {
 			continue
 		}
 		activeHosts = append(activeHosts, entry)
+		if len(activeHosts) == n {
+			break
+		}
 	}
 	return activeHosts
 }
 
+// ActiveHostCounts returns the number of active hosts in the host tree of each
+// enabled hostdb profile, keyed by profile name. The counts are meaningless until the
+// initial scan has completed, in which case ErrInitialScanIncomplete is
+// returned.
+func (hdb *HostDB) ActiveHostCounts() (map[string]int, error) {
+	hdb.mu.RLock()
+	initialScanComplete := hdb.initialScanComplete
+	hdb.mu.RUnlock()
+	if !initialScanComplete {
+		return nil, ErrInitialScanIncomplete
+	}
+
+	counts := make(map[string]int)
+	for _, name := range hdb.hostdbProfiles.Names() {
+		if profile, err := hdb.hostdbProfiles.Profile(name); err != nil || !profile.Enabled {
+			continue
+		}
+		counts[name] = len(hdb.ActiveHosts(name))
+	}
+	return counts, nil
+}
+
 // AddHostDBProfile adds a new hostdb profile to HostDBProfiles.
 func (hdb *HostDB) AddHostDBProfiles(name string, storagetier string) (err error) {
 	// add profile
@@ -248,27 +489,102 @@ func (hdb *HostDB) AddHostDBProfiles(name string, storagetier string) (err error
 		return err
 	}
 
+	// add a host tree for the new profile
+	err = hdb.hostTrees.AddHostTree(name, hdb.newProfileHostTree(name))
+	if err != nil {
+		return err
+	}
+	hdb.mu.RLock()
+	hdb.hostdbProfiles.SetLastUpdated(name, hdb.blockHeight)
+	hdb.mu.RUnlock()
+
 	// save to persistence data
-	hdb.mu.Lock()
-	err = hdb.saveSync()
-	hdb.mu.Unlock()
+	err = hdb.managedSaveSyncRetry()
 	if err != nil {
-		hdb.log.Println("Unable to save the hostdb profile:", err)
+		hdb.logEvent(logEntry{Level: logLevelError, Message: "unable to save the hostdb profile", Profile: name, Reason: err.Error()},
+			"Unable to save the hostdb profile: %v", err)
 	}
 	return
 }
 
+// AddHostDBProfilesBatch adds all of the described hostdb profiles together
+// with their host trees. Either all of the profiles are added or, if any of
+// them is invalid, none of them.
+func (hdb *HostDB) AddHostDBProfilesBatch(specs []hostdbprofile.ProfileSpec) error {
+	if hdb.geolocationDisabled {
+		for _, spec := range specs {
+			if len(spec.Locations) > 0 {
+				return errGeolocationDisabled
+			}
+		}
+	}
+
+	// add profiles
+	if err := hdb.hostdbProfiles.AddHostDBProfiles(specs); err != nil {
+		return err
+	}
+
+	// add a host tree for each new profile, roll back all of the profiles
+	// if that fails
+	for i, spec := range specs {
+		err := hdb.hostTrees.AddHostTree(spec.Name, hdb.newProfileHostTree(spec.Name))
+		if err == nil {
+			continue
+		}
+		for _, added := range specs[:i] {
+			hdb.hostTrees.RemoveHostTree(added.Name)
+		}
+		for _, added := range specs {
+			hdb.hostdbProfiles.DeleteHostDBProfile(added.Name)
+		}
+		return err
+	}
+	hdb.mu.RLock()
+	for _, spec := range specs {
+		hdb.hostdbProfiles.SetLastUpdated(spec.Name, hdb.blockHeight)
+	}
+	hdb.mu.RUnlock()
+
+	// save to persistence data
+	err := hdb.managedSaveSyncRetry()
+	if err != nil {
+		hdb.logEvent(logEntry{Level: logLevelError, Message: "unable to save the hostdb profiles", Reason: err.Error()},
+			"Unable to save the hostdb profiles: %v", err)
+	}
+	return err
+}
+
 // AllHosts returns all of the hosts of the specified host tree, including the
 // inactive ones.
 func (hdb *HostDB) AllHosts(tree string) (allHosts []modules.HostDBEntry) {
 	return hdb.hostTrees.All(tree)
 }
 
-// AverageContractPrice returns the average price of a host.
-func (hdb *HostDB) AverageContractPrice(tree string) (totalPrice types.Currency) {
-	sampleSize := 32
-	//TODO pachisi456: add support for multiple profiles / trees
-	hosts := hdb.hostTrees.SelectRandom(tree, sampleSize, nil)
+// AverageContractPrice returns the average price of a host, estimated from a
+// sample of averageContractPriceSampleSize hosts.
+func (hdb *HostDB) AverageContractPrice(tree string) types.Currency {
+	return hdb.AverageContractPriceSampled(tree, averageContractPriceSampleSize)
+}
+
+// AverageContractPriceSampled returns the average price of a host, estimated
+// from a random sample of sampleSize hosts of the tree. Larger samples give a
+// tighter estimate on large trees. The sample is capped at the size of the tree.
+func (hdb *HostDB) AverageContractPriceSampled(tree string, sampleSize int) (totalPrice types.Currency) {
+	if size := hdb.hostTrees.Sizes()[tree]; sampleSize > size {
+		sampleSize = size
+	}
+	if sampleSize <= 0 {
+		return totalPrice
+	}
+	profile, err := hdb.hostdbProfiles.Profile(tree)
+	if err != nil {
+		return totalPrice
+	}
+	hdb.mu.RLock()
+	height := hdb.blockHeight
+	hdb.mu.RUnlock()
+	filters := hdb.profileFilters(profile, height)
+	hosts := hdb.hostTrees.SelectRandom(tree, sampleSize, nil, filters...)
 	if len(hosts) == 0 {
 		return totalPrice
 	}
@@ -296,89 +612,873 @@ func (hdb *HostDB) Host(spk types.SiaPublicKey) (modules.HostDBEntry, bool) {
 	return host, exists
 }
 
-// HostDBProfiles returns the map of all set hostdb profiles.
+// HostDBProfiles returns a copy of all set hostdb profiles, mapped by their
+// names.
 func (hdb *HostDB) HostDBProfiles() (hdbp map[string]*hostdbprofile.HostDBProfile) {
 	return hdb.hostdbProfiles.HostDBProfiles()
 }
 
-// HostDBProfile returns the hostdb profile with the given name.
+// ActiveProfile returns the name of the hostdb profile that is used if no
+// profile is specified, e.g. by the contractor.
+func (hdb *HostDB) ActiveProfile() string {
+	hdb.mu.RLock()
+	defer hdb.mu.RUnlock()
+	if hdb.activeProfile == "" {
+		return "default"
+	}
+	return hdb.activeProfile
+}
+
+// SetActiveProfile sets the hostdb profile that is used if no profile is
+// specified. The profile has to exist and be enabled.
+func (hdb *HostDB) SetActiveProfile(name string) error {
+	profile, err := hdb.hostdbProfiles.Profile(name)
+	if err != nil {
+		return err
+	}
+	if !profile.Enabled {
+		return fmt.Errorf("%w: %q", errProfileDisabled, name)
+	}
+	hdb.mu.Lock()
+	defer hdb.mu.Unlock()
+	hdb.activeProfile = name
+	return hdb.saveSync()
+}
+
+// DeleteHostDBProfile deletes the hostdb profile with the provided name along
+// with its host tree. If the profile is the active profile, i.e. the one the
+// allowance forms contracts with, the deletion fails unless fallback is set, in
+// which case the active profile falls back to the default profile. The
+// returned bool reports whether that fallback happened.
+func (hdb *HostDB) DeleteHostDBProfile(name string, fallback bool) (fellBack bool, err error) {
+	hdb.mu.Lock()
+	inUse := name != "default" && name == hdb.activeProfile
+	if inUse && !fallback {
+		hdb.mu.Unlock()
+		return false, fmt.Errorf("%w: %q", errProfileInUse, name)
+	}
+	if err := hdb.hostdbProfiles.DeleteHostDBProfile(name); err != nil {
+		hdb.mu.Unlock()
+		return false, err
+	}
+	if err := hdb.hostTrees.RemoveHostTree(name); err != nil {
+		hdb.log.Println("WARN: hostdb profile without host tree deleted:", name)
+	}
+	if inUse {
+		hdb.log.Printf("Active hostdb profile %q deleted, falling back to the default profile", name)
+		hdb.activeProfile = ""
+	}
+	hdb.mu.Unlock()
+	hdb.managedInvalidateCandidates(name)
+	return inUse, hdb.managedSaveSyncRetry()
+}
+
+// ReplaceHostDBProfiles replaces all hostdb profiles with the provided ones,
+// e.g. when importing them, and rebuilds the host trees to match the new
+// profiles. The profiles are validated before any of them is replaced and the
+// default profile is added if it is missing. If the active profile isn't part
+// of the new profiles or is disabled by them, the active profile falls back to
+// the default profile. The new trees are built before the profiles are
+// replaced, and profiles and trees are swapped together, so host selection
+// never sees a profile without its matching tree.
+func (hdb *HostDB) ReplaceHostDBProfiles(profiles map[string]*hostdbprofile.HostDBProfile) error {
+	if hdb.geolocationDisabled {
+		for _, profile := range profiles {
+			if profile != nil && len(profile.Location) > 0 {
+				return errGeolocationDisabled
+			}
+		}
+	}
+	staged := hostdbprofile.NewHostDBProfiles()
+	if err := staged.ReplaceAll(profiles); err != nil {
+		return err
+	}
+	replacement := staged.HostDBProfiles()
+
+	// Build the trees of the new profiles off-lock. Until they are swapped in
+	// the hosts are weighed according to the new profiles, afterwards
+	// according to the current profiles like in every other tree.
+	var swapped bool
+	hosts := hdb.hostTrees.All("default")
+	trees := make(map[string]*hosttree.HostTree, len(replacement))
+	for name, profile := range replacement {
+		profile := *profile
+		wf := func(entry modules.HostDBEntry, name string) types.Currency {
+			if swapped {
+				return hdb.calculateHostWeight(entry, name)
+			}
+			return hdb.calculateProfileHostWeight(entry, name, profile)
+		}
+		tree := hosttree.NewHostTree(hdb.recoverWeight(wf), name, hdb.treeFilters(name, profile)...)
+		for _, host := range hosts {
+			if err := tree.Insert(host); err != nil {
+				hdb.log.Debugln("ERROR: could not insert host into new host tree:", host.NetAddress)
+			}
+		}
+		trees[name] = tree
+	}
+
+	hdb.mu.Lock()
+	if err := hdb.hostdbProfiles.ReplaceAll(replacement); err != nil {
+		hdb.mu.Unlock()
+		return err
+	}
+	swapped = true
+	for name, tree := range trees {
+		hdb.hostTrees.AddOrReplaceHostTree(name, tree)
+		hdb.hostdbProfiles.SetLastUpdated(name, hdb.blockHeight)
+	}
+	for _, name := range hdb.hostTrees.Names() {
+		if _, exists := trees[name]; !exists {
+			hdb.hostTrees.RemoveHostTree(name)
+		}
+	}
+	if hdb.activeProfile != "" {
+		if profile, err := hdb.hostdbProfiles.Profile(hdb.activeProfile); err != nil || !profile.Enabled {
+			hdb.log.Printf("Active hostdb profile %q replaced, falling back to the default profile", hdb.activeProfile)
+			hdb.activeProfile = ""
+		}
+	}
+	hdb.mu.Unlock()
+	hdb.candidateCacheMu.Lock()
+	hdb.candidateCache = nil
+	hdb.candidateCacheMu.Unlock()
+
+	err := hdb.managedSaveSyncRetry()
+	if err != nil {
+		hdb.logEvent(logEntry{Level: logLevelError, Message: "unable to save the hostdb profiles", Reason: err.Error()},
+			"Unable to save the hostdb profiles: %v", err)
+	}
+	return err
+}
+
+// DedupeProfiles returns the names of all hostdb profiles that have the same
+// settings as another profile and are thus backed by identical host trees. The
+// duplicates are only reported, it is up to the user to delete them.
+func (hdb *HostDB) DedupeProfiles() ([]string, error) {
+	if err := hdb.hostdbProfiles.Validate(); err != nil {
+		return nil, err
+	}
+	return hdb.hostdbProfiles.Duplicates(), nil
+}
+
+// HostDBProfile returns the hostdb profile with the given name, or the zero
+// profile if no such profile exists.
 func (hdb *HostDB) HostDBProfile(name string) hostdbprofile.HostDBProfile {
 	return hdb.hostdbProfiles.GetProfile(name)
 }
 
+// Profile returns the hostdb profile with the given name, failing if no such
+// profile exists.
+func (hdb *HostDB) Profile(name string) (hostdbprofile.HostDBProfile, error) {
+	return hdb.hostdbProfiles.Profile(name)
+}
+
 // ConfigHostDBProfiles updates the provided setting of the hostdb profile with the provided
-// name to the provided value.
-func (hdb *HostDB) ConfigHostDBProfile(name, setting, value string) (err error) {
+// name to the provided value. The setting "unset" resets the setting provided
+// as value to its default. Profiles cannot be configured before the initial
+// host scan has completed, as the affected host tree may not be complete yet.
+// If the profile no longer matches any of the active hosts a warning is
+// returned. The setting is applied nonetheless. The active profile cannot be
+// disabled.
+func (hdb *HostDB) ConfigHostDBProfile(name, setting, value string) (warning string, err error) {
+	hdb.mu.RLock()
+	initialScanComplete := hdb.initialScanComplete
+	activeProfile := hdb.activeProfile
+	hdb.mu.RUnlock()
+	if !initialScanComplete {
+		return "", ErrInitialScanIncomplete
+	}
+	if setting == "addlocation" && hdb.geolocationDisabled {
+		return "", errGeolocationDisabled
+	}
+	if setting == "enabled" && name == activeProfile {
+		if enabled, err := strconv.ParseBool(value); err == nil && !enabled {
+			return "", fmt.Errorf("%w: %q", errProfileInUse, name)
+		}
+	}
+
 	// change setting
 	err = hdb.hostdbProfiles.ConfigHostDBProfiles(name, setting, value)
 	if err != nil {
-		return err
+		return "", err
+	}
+	hdb.managedInvalidateCandidates(name)
+
+	// The note, the renew window and whether the profile is enabled don't
+	// affect the host selection, all other settings require the profile's host
+	// tree to be rebuilt so the new setting takes effect. The tree of a
+	// disabled profile is kept up to date so that it can be enabled again
+	// right away.
+	if !rebuildFree(setting, value) {
+		err = hdb.rebuildTree(name)
+		if err != nil {
+			return "", err
+		}
+
+		// warn if the settings of the profile conflict in a way that no host
+		// can be selected anymore
+		if active := len(hdb.ActiveHosts("default")); active > 0 && hdb.selectableHosts(name) == 0 {
+			warning = fmt.Sprintf("hostdb profile %q matches none of the %v active hosts, no hosts will be selected", name, active)
+		}
 	}
 
 	// save to persist data
-	hdb.mu.Lock()
-	hdb.saveSync()
-	hdb.mu.Unlock()
-	return
+	if err := hdb.managedSaveSyncRetry(); err != nil {
+		hdb.logEvent(logEntry{Level: logLevelError, Message: "unable to save the hostdb profile", Profile: name, Reason: err.Error()},
+			"Unable to save the hostdb profile: %v", err)
+		return "", err
+	}
+	return warning, nil
 }
 
-// loadHostTrees loads one host tree for each hostdb profile.
-// The host tree is used to manage hosts and query them at random.
-func (hdb *HostDB) loadHostTrees(allHosts []modules.HostDBEntry) (err error) {
-	hdbp := hdb.hostdbProfiles.HostDBProfiles()
-	for name := range hdbp {
-		newTree := hosttree.NewHostTree(hdb.calculateHostWeight, name)
-		for _, host := range allHosts {
-			// COMPATv1.1.0
-			//
-			// The host did not always track its block height correctly, meaning
-			// that previously the FirstSeen values and the blockHeight values
-			// could get out of sync.
-			if hdb.blockHeight < host.FirstSeen {
-				host.FirstSeen = hdb.blockHeight
-			}
+// rebuildFree returns true if changing the provided setting of a hostdb
+// profile to the provided value doesn't require the profile's host tree to be
+// rebuilt.
+func rebuildFree(setting, value string) bool {
+	if setting == "unset" {
+		setting = value
+	}
+	return setting == "note" || setting == "enabled" || setting == "renewwindow"
+}
 
-			err := newTree.Insert(host)
-			if err != nil {
-				hdb.log.Debugln("ERROR: could not insert host while loading:", host.NetAddress)
+// ValidateHostDBProfile checks the proposed hostdb profile settings, given in
+// the representation returned by HostDBProfile.String, without creating or
+// modifying any profile. If they are valid the number of active hosts a
+// profile with these settings would select from is returned. The count is
+// meaningless until the initial scan has completed, in which case
+// ErrInitialScanIncomplete is returned.
+func (hdb *HostDB) ValidateHostDBProfile(profile string) (int, error) {
+	hdb.mu.RLock()
+	initialScanComplete := hdb.initialScanComplete
+	hdb.mu.RUnlock()
+	if !initialScanComplete {
+		return 0, ErrInitialScanIncomplete
+	}
+	hdbp, err := hostdbprofile.ParseHostDBProfile(profile)
+	if err != nil {
+		return 0, err
+	}
+	if len(hdbp.Location) > 0 && hdb.geolocationDisabled {
+		return 0, errGeolocationDisabled
+	}
+	return hdb.matchingHosts("default", hdbp), nil
+}
+
+// SelectableHosts returns the number of active hosts the hostdb profile with
+// the provided name can select from, i.e. the hosts passing all of its
+// filters, its blacklist and its whitelist. The count is meaningless until the
+// initial scan has completed, in which case ErrInitialScanIncomplete is
+// returned.
+func (hdb *HostDB) SelectableHosts(name string) (int, error) {
+	hdb.mu.RLock()
+	initialScanComplete := hdb.initialScanComplete
+	hdb.mu.RUnlock()
+	if !initialScanComplete {
+		return 0, ErrInitialScanIncomplete
+	}
+	if _, err := hdb.hostdbProfiles.Profile(name); err != nil {
+		return 0, err
+	}
+	return hdb.selectableHosts(name), nil
+}
+
+// selectableHosts returns the number of active hosts in the host tree of the
+// hostdb profile with the provided name that pass all of the profile's
+// filters, its blacklist and, if any hosts are pinned, its whitelist. The
+// candidate cache is bypassed so that it is only filled by actual selections.
+// A profile that doesn't exist can't select any host.
+func (hdb *HostDB) selectableHosts(name string) int {
+	profile, err := hdb.hostdbProfiles.Profile(name)
+	if err != nil {
+		return 0
+	}
+	return hdb.matchingHosts(name, profile)
+}
+
+// matchingHosts returns the number of active hosts in the provided host tree
+// that pass all of the filters of the provided hostdb profile, its blacklist
+// and, if any hosts are pinned, its whitelist. If the profile enforces IP
+// diversity, hosts sharing a subnet with an already counted host and hosts
+// with an unknown subnet are not counted, as they can't be selected together.
+func (hdb *HostDB) matchingHosts(tree string, profile hostdbprofile.HostDBProfile) (n int) {
+	hdb.mu.RLock()
+	height := hdb.blockHeight
+	hdb.mu.RUnlock()
+	filters := hdb.profileFilters(profile, height)
+	blacklisted := make(map[string]struct{})
+	for _, pk := range profile.Blacklist {
+		blacklisted[string(pk.Key)] = struct{}{}
+	}
+	pinned := make(map[string]struct{})
+	for _, pk := range profile.Whitelist {
+		pinned[string(pk.Key)] = struct{}{}
+	}
+	usedSubnets := make(map[string]struct{})
+HOSTS:
+	for _, entry := range hdb.ActiveHosts(tree) {
+		if _, exists := blacklisted[string(entry.PublicKey.Key)]; exists {
+			continue
+		}
+		if _, exists := pinned[string(entry.PublicKey.Key)]; len(pinned) > 0 && !exists {
+			continue
+		}
+		for _, filter := range filters {
+			if !filter.Matches(entry) {
+				continue HOSTS
 			}
 		}
-		err := hdb.hostTrees.AddHostTree(name, *newTree)
-
-		// Make sure that all hosts have gone through the initial scanning.
-		// A new iteration over the tree is necessary as queueScan() which is
-		// called below needs a loaded and written back to the variable host tree.
-		for _, host := range hdb.hostTrees.All(name) {
-			if len(host.ScanHistory) < 2 {
-				hdb.mu.Lock()
-				hdb.queueScan(host)
-				hdb.mu.Unlock()
+		if profile.EnforceIPDiversity {
+			subnets := hostSubnets(entry)
+			if len(subnets) == 0 {
+				continue
+			}
+			for _, subnet := range subnets {
+				if _, exists := usedSubnets[subnet]; exists {
+					continue HOSTS
+				}
+			}
+			for _, subnet := range subnets {
+				usedSubnets[subnet] = struct{}{}
 			}
 		}
+		n++
+	}
+	return n
+}
 
-		hdb.mu.Lock()
-		err = hdb.saveSync()
-		hdb.mu.Unlock()
+// rebuildTree recreates the host tree of the hostdb profile with the provided
+// name from all hosts known to the hostdb, so that the current settings of the
+// profile are applied to every host.
+func (hdb *HostDB) rebuildTree(name string) error {
+	if _, err := hdb.hostdbProfiles.Profile(name); err != nil {
+		return err
+	}
+	hdb.hostTrees.AddOrReplaceHostTree(name, hdb.newProfileHostTree(name))
+	hdb.mu.RLock()
+	defer hdb.mu.RUnlock()
+	return hdb.hostdbProfiles.SetLastUpdated(name, hdb.blockHeight)
+}
+
+// reconcileProfilesAndTrees makes sure that there is exactly one host tree for
+// each hostdb profile. Missing trees are created from the hosts of the default
+// tree and trees without a profile are removed.
+func (hdb *HostDB) reconcileProfilesAndTrees() {
+	profiles := make(map[string]struct{})
+	for _, name := range hdb.hostdbProfiles.Names() {
+		profiles[name] = struct{}{}
+	}
+	trees := make(map[string]struct{})
+	for _, name := range hdb.hostTrees.Names() {
+		trees[name] = struct{}{}
+		if _, exists := profiles[name]; exists {
+			continue
+		}
+		hdb.log.Println("WARN: removing host tree without hostdb profile:", name)
+		if err := hdb.hostTrees.RemoveHostTree(name); err != nil {
+			hdb.log.Println("ERROR: could not remove host tree:", name, err)
+		}
+	}
+	for name := range profiles {
+		if _, exists := trees[name]; exists {
+			continue
+		}
+		hdb.log.Println("WARN: creating missing host tree of hostdb profile:", name)
+		if err := hdb.rebuildTree(name); err != nil {
+			hdb.log.Println("ERROR: could not create host tree:", name, err)
+		}
+	}
+}
+
+// newProfileHostTree returns a new host tree for the hostdb profile with the
+// provided name which contains all hosts known to the hostdb that match the
+// tree filters of the profile.
+func (hdb *HostDB) newProfileHostTree(name string) *hosttree.HostTree {
+	var filters []hosttree.HostFilter
+	if profile, err := hdb.hostdbProfiles.Profile(name); err == nil {
+		filters = hdb.treeFilters(name, profile)
+	}
+	tree := hosttree.NewHostTree(hdb.recoverWeight(hdb.calculateHostWeight), name, filters...)
+	for _, host := range hdb.hostTrees.All("default") {
+		err := tree.Insert(host)
 		if err != nil {
-			hdb.log.Println("Unable to save the host tree:", err)
+			hdb.log.Debugln("ERROR: could not insert host into new host tree:", host.NetAddress)
 		}
 	}
+	return tree
+}
+
+// loadHostTrees loads one host tree for each hostdb profile.
+// The host tree is used to manage hosts and query them at random.
+func (hdb *HostDB) loadHostTrees(allHosts []modules.HostDBEntry) (err error) {
+	for i := range allHosts {
+		// COMPATv1.1.0
+		//
+		// The host did not always track its block height correctly, meaning
+		// that previously the FirstSeen values and the blockHeight values
+		// could get out of sync.
+		if hdb.blockHeight < allHosts[i].FirstSeen {
+			allHosts[i].FirstSeen = hdb.blockHeight
+		}
+	}
+
+	// Add an empty tree for each hostdb profile, then fill all trees at once.
+	var names []string
+	for name, profile := range hdb.hostdbProfiles.HostDBProfiles() {
+		newTree := hosttree.NewHostTree(hdb.recoverWeight(hdb.calculateHostWeight), name, hdb.treeFilters(name, *profile)...)
+		if err := hdb.hostTrees.AddHostTree(name, newTree); err != nil {
+			hdb.log.Println("ERROR: could not add host tree while loading:", name, err)
+			continue
+		}
+		names = append(names, name)
+	}
+	if err := hdb.hostTrees.InsertBatch(allHosts); err != nil {
+		hdb.log.Debugln("ERROR: could not insert hosts while loading:", err)
+	}
+	for _, name := range names {
+		hdb.hostdbProfiles.SetLastUpdated(name, hdb.blockHeight)
+	}
+
+	// Make sure that all hosts have gone through the initial scanning. The
+	// default tree contains all hosts.
+	for _, host := range hdb.hostTrees.All("default") {
+		if len(host.ScanHistory) < 2 {
+			hdb.mu.Lock()
+			hdb.queueScan(host)
+			hdb.mu.Unlock()
+		}
+	}
+
+	// Save once all trees are loaded, the persist data is taken from the
+	// default tree.
+	hdb.mu.Lock()
+	saveErr := hdb.saveSync()
+	hdb.mu.Unlock()
+	if saveErr != nil {
+		hdb.logEvent(logEntry{Level: logLevelError, Message: "unable to save the host trees", Reason: saveErr.Error()},
+			"Unable to save the host trees: %v", saveErr)
+	}
 	return
 }
 
+// Metrics returns a snapshot of the health of the hostdb. The hostdb's lock is
+// only held briefly so that the scan loop is not blocked.
+func (hdb *HostDB) Metrics() modules.HostDBMetrics {
+	hdb.mu.RLock()
+	metrics := modules.HostDBMetrics{
+		InitialScanComplete:  hdb.initialScanComplete,
+		ScanningThreads:      hdb.scanningThreads,
+		GeolocationAvailable: hdb.geolocate != nil,
+		QueuedScans:          hdb.queuedScans(),
+		PendingScans:         len(hdb.scanMap),
+	}
+	hdb.mu.RUnlock()
+
+	metrics.TreeSizes = hdb.hostTrees.Sizes()
+	metrics.TotalHosts = metrics.TreeSizes["default"]
+	metrics.ActiveHosts = len(hdb.ActiveHosts("default"))
+	metrics.StaleHosts = len(hdb.StaleHosts(hdb.scanSettings.StaleScanAge))
+	return metrics
+}
+
+// HostsMembership returns a number that changes whenever a host is inserted
+// into or removed from the hostdb or a host tree is replaced. Scans that only
+// update the settings of known hosts don't change it. It allows callers to
+// cache data derived from the set of hosts.
+func (hdb *HostDB) HostsMembership() uint64 {
+	return hdb.hostTrees.Membership()
+}
+
+// StaleHosts returns the hosts whose last scan is older than maxAge. Such hosts
+// may have gone offline without the hostdb noticing. Hosts that have never
+// been scanned are queued for their first scan and not considered stale.
+func (hdb *HostDB) StaleHosts(maxAge time.Duration) (stale []types.SiaPublicKey) {
+	filter := staleScanFilter{cutoff: hdb.deps.Now().Add(-maxAge)}
+	for _, entry := range hdb.hostTrees.All("default") {
+		if len(entry.ScanHistory) > 0 && !filter.Matches(entry) {
+			stale = append(stale, entry.PublicKey)
+		}
+	}
+	return stale
+}
+
+// RescanHost queues an immediate scan of the host with the provided public
+// key. It returns without waiting for the scan to complete.
+func (hdb *HostDB) RescanHost(spk types.SiaPublicKey) error {
+	host, exists := hdb.hostTrees.Select(spk)
+	if !exists {
+		return errUnknownHost
+	}
+	hdb.mu.Lock()
+	hdb.queueScan(host)
+	hdb.mu.Unlock()
+	return nil
+}
+
 // RandomHosts implements the HostDB interface's RandomHosts() method. It takes
 // the tree from which the hosts should be picked, a number of hosts to return,
-// and a slice of public keys to exclude, and returns a slice of entries.
+// and a slice of public keys to exclude, and returns a slice of entries. No
+// hosts are selected from a disabled profile.
 func (hdb *HostDB) RandomHosts(tree string, n int, excludeKeys []types.SiaPublicKey) ([]modules.HostDBEntry, error) {
 	hdb.mu.RLock()
 	initialScanComplete := hdb.initialScanComplete
+	height := hdb.blockHeight
 	hdb.mu.RUnlock()
 	if !initialScanComplete {
 		return []modules.HostDBEntry{}, ErrInitialScanIncomplete
 	}
-	return hdb.hostTrees.SelectRandom(tree, n, excludeKeys), nil
+
+	// Only select from the candidate set of the hostdb profile, which leaves
+	// out its blacklisted and unpinned hosts.
+	profile, err := hdb.hostdbProfiles.Profile(tree)
+	if err != nil {
+		return []modules.HostDBEntry{}, err
+	}
+	if !profile.Enabled {
+		return []modules.HostDBEntry{}, fmt.Errorf("%w: %q", errProfileDisabled, tree)
+	}
+	filters := hdb.profileFilters(profile, height)
+	if candidates := hdb.managedProfileCandidates(tree, profile); candidates != nil {
+		filters = append(filters, candidates)
+	}
+	if profile.EnforceIPDiversity {
+		return hdb.selectDiverseHosts(tree, n, excludeKeys, filters), nil
+	}
+	return hdb.hostTrees.SelectRandom(tree, n, excludeKeys, filters...), nil
+}
+
+// RandomHostsPenalized works like RandomHosts, but the hosts of penalized are
+// only selected if not enough other hosts are available. It is used to prefer
+// hosts the renter doesn't have contracts with yet, so that new contracts are
+// spread across fresh hosts, without failing the selection if there are too
+// few of them.
+func (hdb *HostDB) RandomHostsPenalized(tree string, n int, exclude, penalized []types.SiaPublicKey) ([]modules.HostDBEntry, error) {
+	ignore := append([]types.SiaPublicKey(nil), exclude...)
+	hosts, err := hdb.RandomHosts(tree, n, append(ignore, penalized...))
+	if err != nil || len(hosts) >= n || len(penalized) == 0 {
+		return hosts, err
+	}
+
+	// Fill up the selection with penalized hosts.
+	for _, host := range hosts {
+		ignore = append(ignore, host.PublicKey)
+	}
+	fallback, err := hdb.RandomHosts(tree, n-len(hosts), ignore)
+	if err != nil {
+		return nil, err
+	}
+	return append(hosts, fallback...), nil
 }
 
+// RandomHostsWithWeights works like RandomHosts, but returns the hosts together
+// with their weights in the tree, ordered by descending weight. Hosts that share
+// an address with one of the hosts of addressBlacklist are not returned, the
+// hosts of penalized only if not enough other hosts are available.
+func (hdb *HostDB) RandomHostsWithWeights(tree string, n int, blacklist, addressBlacklist, penalized []types.SiaPublicKey) ([]modules.WeightedHostDBEntry, error) {
+	exclude := append([]types.SiaPublicKey(nil), blacklist...)
+	if len(addressBlacklist) > 0 {
+		addresses := make(map[string]struct{})
+		for _, pk := range addressBlacklist {
+			if host, exists := hdb.hostTrees.Select(pk); exists {
+				addresses[host.NetAddress.Host()] = struct{}{}
+			}
+		}
+		for _, host := range hdb.hostTrees.All(tree) {
+			if _, exists := addresses[host.NetAddress.Host()]; exists {
+				exclude = append(exclude, host.PublicKey)
+			}
+		}
+	}
+	hosts, err := hdb.RandomHostsPenalized(tree, n, exclude, penalized)
+	if err != nil {
+		return nil, err
+	}
+
+	profile, err := hdb.hostdbProfiles.Profile(tree)
+	if err != nil {
+		return nil, err
+	}
+	weightedHosts := make([]modules.WeightedHostDBEntry, 0, len(hosts))
+	hdb.mu.RLock()
+	for _, host := range hosts {
+		weight := hdb.calculateHostWeight(host, tree)
+		weightedHosts = append(weightedHosts, modules.WeightedHostDBEntry{
+			HostDBEntry: host,
+			Weight:      weight,
+			Storagetier: profile.Storagetier,
+		})
+	}
+	hdb.mu.RUnlock()
+	sort.SliceStable(weightedHosts, func(i, j int) bool {
+		return weightedHosts[i].Weight.Cmp(weightedHosts[j].Weight) > 0
+	})
+	return weightedHosts, nil
+}
+
+// managedDownloadGeolocationDB downloads the compressed geolocation database
+// from url and unpacks it into the directory dst. Every attempt times out
+// after geolocationDownloadTimeout and failed attempts are retried with an
+// increasing backoff. The download is cancelled if the hostdb is stopped, and
+// the partially downloaded file is removed.
+func (hdb *HostDB) managedDownloadGeolocationDB(url, dst string) error {
+	if err := hdb.tg.Add(); err != nil {
+		return err
+	}
+	defer hdb.tg.Done()
+
+	// Cancel the download as soon as the hostdb is stopped.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-hdb.tg.StopChan():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	client := &http.Client{Timeout: geolocationDownloadTimeout}
+	backoff := geolocationDownloadBackoff
+	var err error
+	for attempt := 1; attempt <= geolocationDownloadAttempts; attempt++ {
+		err = hdb.downloadGeolocationDB(ctx, client, url, dst)
+		if err == nil || attempt == geolocationDownloadAttempts || ctx.Err() != nil {
+			break
+		}
+		hdb.log.Printf("Downloading the geolocation database failed (attempt %v of %v): %v", attempt, geolocationDownloadAttempts, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+	return err
+}
+
+// downloadGeolocationDB makes a single attempt at downloading the geolocation
+// database from url using the provided client and unpacking it into the
+// directory dst.
+func (hdb *HostDB) downloadGeolocationDB(ctx context.Context, client *http.Client, url, dst string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected response status: %v", resp.Status)
+	}
+
+	// Download into a temporary file which is always removed afterwards, so
+	// that an interrupted download doesn't leave anything behind.
+	tmpPath := filepath.Join(hdb.persistDir, geolocationTmpFile)
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		f.Close()
+		os.Remove(tmpPath)
+	}()
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		return err
+	}
+
+	// Untar the database, removing any partially unpacked files on failure.
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := Untar(dst, f); err != nil {
+		os.RemoveAll(filepath.Join(dst, geolocationDir))
+		return err
+	}
+	return nil
+}
+
+// threadedRefreshGeolocationDB refreshes an outdated geolocation database in
+// the background.
+func (hdb *HostDB) threadedRefreshGeolocationDB() {
+	if err := hdb.tg.Add(); err != nil {
+		return
+	}
+	defer hdb.tg.Done()
+	if err := hdb.managedRefreshGeolocationDB(); err != nil {
+		hdb.log.Println("Unable to refresh the geolocation database:", err)
+	}
+}
+
+// managedRefreshGeolocationDB downloads a fresh copy of the geolocation
+// database and replaces the database in use with it. The fresh database is
+// unpacked into a separate directory first, so that the memory mapped
+// database in use is never overwritten while it is read. Once it has been
+// swapped in, it is moved to where it is loaded from after a restart.
+func (hdb *HostDB) managedRefreshGeolocationDB() error {
+	hdb.refreshMu.Lock()
+	defer hdb.refreshMu.Unlock()
+
+	refreshDir := filepath.Join(hdb.persistDir, geolocationRefreshDir)
+	defer os.RemoveAll(refreshDir)
+	if err := os.MkdirAll(refreshDir, 0700); err != nil {
+		return err
+	}
+	if err := hdb.managedDownloadGeolocationDB(geolocationURL, refreshDir); err != nil {
+		return err
+	}
+	db, err := geoip2.Open(filepath.Join(refreshDir, geolocationDir, geolocationFile))
+	if err != nil {
+		return err
+	}
+
+	hdb.ipdbMu.Lock()
+	old := hdb.ipdb
+	hdb.ipdb = db
+	hdb.ipdbMu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	hdb.log.Println("Refreshed the geolocation database, built on", geolocationBuildTime(db).Format("2006-01-02"))
+
+	err = os.RemoveAll(filepath.Join(hdb.persistDir, geolocationDir))
+	if err == nil {
+		err = os.Rename(filepath.Join(refreshDir, geolocationDir), filepath.Join(hdb.persistDir, geolocationDir))
+	}
+	if err != nil {
+		hdb.log.Println("WARN: unable to replace the geolocation database on disk:", err)
+	}
+	return nil
+}
+
+// RefreshGeolocation downloads the geolocation database again and recomputes
+// the location of every host known to the hostdb. It returns once the refresh
+// has been started, its progress is reported by GeolocationRefresh. If the
+// dependencies of the hostdb bring their own geo-IP source nothing is
+// downloaded and only the locations are recomputed.
+func (hdb *HostDB) RefreshGeolocation() error {
+	if hdb.geolocationDisabled {
+		return errGeolocationDisabled
+	}
+	if _, ok := hdb.deps.(locationResolver); !ok && hdb.geolocate == nil {
+		return errNoGeolocationSource
+	}
+	hdb.mu.Lock()
+	defer hdb.mu.Unlock()
+	if hdb.geolocationRefresh.Running {
+		return errRefreshInProgress
+	}
+	if err := hdb.tg.Add(); err != nil {
+		return err
+	}
+	hdb.geolocationRefresh = modules.HostDBGeolocationRefresh{
+		Running: true,
+		Started: hdb.deps.Now(),
+	}
+	go hdb.threadedRefreshGeolocation()
+	return nil
+}
+
+// GeolocationRefresh returns the progress of the last refresh of the host
+// locations.
+func (hdb *HostDB) GeolocationRefresh() modules.HostDBGeolocationRefresh {
+	hdb.mu.RLock()
+	defer hdb.mu.RUnlock()
+	return hdb.geolocationRefresh
+}
+
+// threadedRefreshGeolocation refreshes the geolocation database, if it is in
+// use, and recomputes the location of every host. The hosts are located one
+// at a time without holding the lock of the hostdb, so that the scan loop
+// keeps running while the hosts are resolved.
+func (hdb *HostDB) threadedRefreshGeolocation() {
+	defer hdb.tg.Done()
+
+	var refreshErr error
+	hdb.ipdbMu.RLock()
+	download := hdb.ipdb != nil
+	hdb.ipdbMu.RUnlock()
+	if download {
+		if refreshErr = hdb.managedRefreshGeolocationDB(); refreshErr != nil {
+			hdb.log.Println("Unable to refresh the geolocation database, locating the hosts with the database in use:", refreshErr)
+		}
+	}
+
+	hosts := hdb.hostTrees.All("default")
+	hdb.mu.Lock()
+	hdb.geolocationRefresh.Hosts = len(hosts)
+	hdb.mu.Unlock()
+	for _, host := range hosts {
+		select {
+		case <-hdb.tg.StopChan():
+			return
+		default:
+		}
+		changed := hdb.managedRelocateHost(host)
+		hdb.mu.Lock()
+		hdb.geolocationRefresh.Processed++
+		if changed {
+			hdb.geolocationRefresh.Changed++
+		}
+		hdb.mu.Unlock()
+	}
+
+	hdb.mu.Lock()
+	hdb.geolocationRefresh.Running = false
+	hdb.geolocationRefresh.Finished = hdb.deps.Now()
+	if refreshErr != nil {
+		hdb.geolocationRefresh.Error = refreshErr.Error()
+	}
+	changed := hdb.geolocationRefresh.Changed
+	hdb.mu.Unlock()
+	hdb.log.Printf("Refreshed the locations of %v hosts, %v of them changed", len(hosts), changed)
+	if changed == 0 {
+		return
+	}
+	if err := hdb.managedSaveSyncRetry(); err != nil {
+		hdb.logEvent(logEntry{Level: logLevelError, Message: "unable to save the refreshed host locations", Reason: err.Error()},
+			"Unable to save the refreshed host locations: %v", err)
+	}
+}
+
+// managedRelocateHost recomputes the location of the provided host and updates
+// it in the host trees if it changed. A host that can't be located keeps its
+// last known location. The host is only updated if it hasn't been removed or
+// reannounced from another address while it was located. The return value
+// reports whether the location of the host changed.
+func (hdb *HostDB) managedRelocateHost(host modules.HostDBEntry) bool {
+	located := host
+	located.Country = ""
+	located.EUhost = false
+	hdb.updateHostLocation(&located)
+	if located.Country == "" {
+		return false
+	}
+
+	hdb.mu.Lock()
+	defer hdb.mu.Unlock()
+	current, exists := hdb.hostTrees.Select(host.PublicKey)
+	if !exists || current.NetAddress != host.NetAddress {
+		return false
+	}
+	if current.Country == located.Country && current.EUhost == located.EUhost {
+		return false
+	}
+	current.Country = located.Country
+	current.EUhost = located.EUhost
+	if err := hdb.hostTrees.Modify(current); err != nil {
+		hdb.log.Println("ERROR: unable to update the location of host:", current.PublicKey, err)
+		return false
+	}
+	return true
+}
+
+// geolocationBuildTime returns the time the provided geolocation database was
+// built at.
+func geolocationBuildTime(db *geoip2.Reader) time.Time {
+	return time.Unix(int64(db.Metadata().BuildEpoch), 0).UTC()
+}
 
 // Untar takes a destination path and a reader; a tar reader loops over the tarfile
 // creating the file structure at 'dst' along the way, and writing any files
@@ -1,10 +1,23 @@
 package hostdb
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -14,6 +27,7 @@ import (
 	"github.com/pachisi456/sia-hostdb-profiles/modules/consensus"
 	"github.com/pachisi456/sia-hostdb-profiles/modules/gateway"
 	"github.com/pachisi456/sia-hostdb-profiles/modules/miner"
+	"github.com/pachisi456/sia-hostdb-profiles/modules/renter/hostdb/hostdbprofile"
 	"github.com/pachisi456/sia-hostdb-profiles/modules/renter/hostdb/hosttree"
 	"github.com/pachisi456/sia-hostdb-profiles/modules/transactionpool"
 	"github.com/pachisi456/sia-hostdb-profiles/modules/wallet"
@@ -39,12 +53,54 @@ type hdbTester struct {
 // dependencies or scanning threads. It is only intended for use in unit tests.
 func bareHostDB() *HostDB {
 	hdb := &HostDB{
-		log: persist.NewLogger(ioutil.Discard),
+		deps:           modules.ProdDependencies,
+		log:            persist.NewLogger(ioutil.Discard),
+		hostdbProfiles: hostdbprofile.NewHostDBProfiles(),
+		hostTrees:      hosttree.NewHostTrees(),
 	}
-	hdb.hostTrees = hosttree.NewHostTree(hdb.calculateHostWeight)
+	hdb.hostTrees.AddHostTree("default", hosttree.NewHostTree(hdb.calculateHostWeight, "default"))
 	return hdb
 }
 
+// newProfileHostDB returns a HostDB without consensus set, gateway or scanning
+// threads, which has a host tree for the default profile and for each of the
+// provided cold storage profiles. It is only intended for use in unit tests.
+func newProfileHostDB(name string, profiles ...string) (*HostDB, error) {
+	persistDir := build.TempDir("HostDB", name)
+	if err := os.MkdirAll(persistDir, 0700); err != nil {
+		return nil, err
+	}
+	hdb := &HostDB{
+		deps:           modules.ProdDependencies,
+		log:            persist.NewLogger(ioutil.Discard),
+		persistDir:     persistDir,
+		hostdbProfiles: hostdbprofile.NewHostDBProfiles(),
+		hostTrees:      hosttree.NewHostTrees(),
+		scanMap:        make(map[string]struct{}),
+		scanSettings:   DefaultScanSettings(),
+	}
+	for _, profile := range profiles {
+		if err := hdb.hostdbProfiles.AddHostDBProfile(profile, "cold"); err != nil {
+			return nil, err
+		}
+	}
+	if err := hdb.loadHostTrees(nil); err != nil {
+		return nil, err
+	}
+	return hdb, nil
+}
+
+// scoreBreakdown returns the score breakdown of the provided host in the
+// provided hostdb profile, failing the test if the profile doesn't exist.
+func scoreBreakdown(t *testing.T, hdb *HostDB, entry modules.HostDBEntry, profile string) modules.HostScoreBreakdown {
+	t.Helper()
+	sb, err := hdb.ScoreBreakdown(entry, profile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sb
+}
+
 // makeHostDBEntry makes a new host entry with a random public key
 func makeHostDBEntry() modules.HostDBEntry {
 	dbe := modules.HostDBEntry{}
@@ -71,130 +127,1528 @@ func newHDBTesterDeps(name string, deps modules.Dependencies) (*hdbTester, error
 	if testing.Short() {
 		panic("should not be calling newHDBTester during short tests")
 	}
-	testDir := build.TempDir("HostDB", name)
+	testDir := build.TempDir("HostDB", name)
+
+	g, err := gateway.New("localhost:0", false, filepath.Join(testDir, modules.GatewayDir))
+	if err != nil {
+		return nil, err
+	}
+	cs, err := consensus.New(g, false, filepath.Join(testDir, modules.ConsensusDir))
+	if err != nil {
+		return nil, err
+	}
+	tp, err := transactionpool.New(cs, g, filepath.Join(testDir, modules.TransactionPoolDir))
+	if err != nil {
+		return nil, err
+	}
+	w, err := wallet.New(cs, tp, filepath.Join(testDir, modules.WalletDir))
+	if err != nil {
+		return nil, err
+	}
+	m, err := miner.New(cs, tp, w, filepath.Join(testDir, modules.MinerDir))
+	if err != nil {
+		return nil, err
+	}
+	hdb, err := NewCustomHostDB(g, cs, filepath.Join(testDir, modules.RenterDir), deps)
+	if err != nil {
+		return nil, err
+	}
+
+	hdbt := &hdbTester{
+		cs:      cs,
+		gateway: g,
+		miner:   m,
+		tpool:   tp,
+		wallet:  w,
+
+		hdb: hdb,
+
+		persistDir: testDir,
+	}
+
+	err = hdbt.initWallet()
+	if err != nil {
+		return nil, err
+	}
+
+	return hdbt, nil
+}
+
+// initWallet creates a wallet key, then initializes and unlocks the wallet.
+func (hdbt *hdbTester) initWallet() error {
+	hdbt.walletKey = crypto.GenerateTwofishKey()
+	_, err := hdbt.wallet.Encrypt(hdbt.walletKey)
+	if err != nil {
+		return err
+	}
+	err = hdbt.wallet.Unlock(hdbt.walletKey)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// TestAverageContractPrice tests the AverageContractPrice method, which also depends on the
+// randomHosts method.
+func TestAverageContractPrice(t *testing.T) {
+	hdb := bareHostDB()
+
+	// empty
+	if avg := hdb.AverageContractPrice("default"); !avg.IsZero() {
+		t.Error("average of empty hostdb should be zero:", avg)
+	}
+
+	// with one host
+	h1 := makeHostDBEntry()
+	h1.Country = "Germany"
+	h1.ContractPrice = types.NewCurrency64(100)
+	hdb.hostTrees.Insert(h1)
+	if avg := hdb.AverageContractPrice("default"); avg.Cmp(h1.ContractPrice) != 0 {
+		t.Error("average of one host should be that host's price:", avg)
+	}
+
+	// with two hosts
+	h2 := makeHostDBEntry()
+	h2.Country = "Germany"
+	h2.ContractPrice = types.NewCurrency64(300)
+	hdb.hostTrees.Insert(h2)
+	if avg := hdb.AverageContractPrice("default"); avg.Cmp64(200) != 0 {
+		t.Error("average of two hosts should be their sum/2:", avg)
+	}
+}
+
+// TestAverageContractPriceSampled checks that the average contract price
+// converges to the true average with larger samples.
+func TestAverageContractPriceSampled(t *testing.T) {
+	hdb, err := newProfileHostDB(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Weigh all hosts equally so that the sample is unbiased.
+	hdb.hostTrees.AddOrReplaceHostTree("default", hosttree.NewHostTree(func(modules.HostDBEntry, string) types.Currency {
+		return types.NewCurrency64(1)
+	}, "default"))
+
+	if avg := hdb.AverageContractPriceSampled("default", 10); !avg.IsZero() {
+		t.Fatal("average of empty tree should be zero:", avg)
+	}
+
+	// Insert hosts with contract prices 1 to 100, averaging 50.5.
+	nHosts := 100
+	for i := 1; i <= nHosts; i++ {
+		host := makeHostDBEntry()
+		host.Country = "Germany"
+		host.ContractPrice = types.NewCurrency64(uint64(i) * 1e6)
+		if err := hdb.hostTrees.Insert(host); err != nil {
+			t.Fatal(err)
+		}
+	}
+	trueAvg := types.NewCurrency64(505e5)
+
+	// Sampling the whole tree, or more, gives the exact average.
+	for _, sampleSize := range []int{nHosts, 10 * nHosts} {
+		if avg := hdb.AverageContractPriceSampled("default", sampleSize); !avg.Equals(trueAvg) {
+			t.Errorf("sample size %v: expected %v, got %v", sampleSize, trueAvg, avg)
+		}
+	}
+	if avg := hdb.AverageContractPriceSampled("default", 0); !avg.IsZero() {
+		t.Error("average of an empty sample should be zero:", avg)
+	}
+
+	// Larger samples deviate less from the true average.
+	deviation := func(sampleSize int) uint64 {
+		var total uint64
+		for i := 0; i < 50; i++ {
+			avg := hdb.AverageContractPriceSampled("default", sampleSize)
+			var diff types.Currency
+			if avg.Cmp(trueAvg) > 0 {
+				diff = avg.Sub(trueAvg)
+			} else {
+				diff = trueAvg.Sub(avg)
+			}
+			total += diff.Big().Uint64()
+		}
+		return total
+	}
+	if small, large := deviation(5), deviation(90); large >= small {
+		t.Errorf("expected a sample of 90 to deviate less than a sample of 5, got %v and %v", large, small)
+	}
+}
+
+// TestNew tests the New function.
+func TestNew(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	testDir := build.TempDir("HostDB", t.Name())
+	g, err := gateway.New("localhost:0", false, filepath.Join(testDir, modules.GatewayDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs, err := consensus.New(g, false, filepath.Join(testDir, modules.ConsensusDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Vanilla HDB, nothing should go wrong.
+	hdbName := filepath.Join(testDir, modules.RenterDir)
+	_, err = New(g, cs, hdbName+"1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nil gateway.
+	_, err = New(nil, cs, hdbName+"2")
+	if err != errNilGateway {
+		t.Fatalf("expected %v, got %v", errNilGateway, err)
+	}
+	// Nil consensus set.
+	_, err = New(g, nil, hdbName+"3")
+	if err != errNilCS {
+		t.Fatalf("expected %v, got %v", errNilCS, err)
+	}
+	// Bad persistDir.
+	_, err = New(g, cs, "")
+	if !os.IsNotExist(err) {
+		t.Fatalf("expected invalid directory, got %v", err)
+	}
+}
+
+// TestNewCustomHostDBWithDefaultProfile tests that the default hostdb profile
+// can be configured when constructing the hostdb.
+func TestNewCustomHostDBWithDefaultProfile(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	testDir := build.TempDir("HostDB", t.Name())
+	g, err := gateway.New("localhost:0", false, filepath.Join(testDir, modules.GatewayDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs, err := consensus.New(g, false, filepath.Join(testDir, modules.ConsensusDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hdb, err := NewCustomHostDBWithDefaultProfile(g, cs, filepath.Join(testDir, modules.RenterDir), modules.ProdDependencies, "cold", []string{"germany"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	def := hdb.HostDBProfile("default")
+	if def.Storagetier != "cold" {
+		t.Error("default profile has wrong storage tier:", def.Storagetier)
+	}
+	if len(def.Location) != 1 || def.Location[0] != "germany" {
+		t.Error("default profile has wrong locations:", def.Location)
+	}
+
+	// An invalid storage tier should be rejected.
+	_, err = NewCustomHostDBWithDefaultProfile(g, cs, filepath.Join(testDir, modules.RenterDir+"2"), modules.ProdDependencies, "lukewarm", nil)
+	if err == nil {
+		t.Fatal("expected invalid storage tier to be rejected")
+	}
+}
+
+// TestActiveHostsN tests that ActiveHostsN returns the highest weighted subset
+// of the active hosts.
+func TestActiveHostsN(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	hdbt, err := newHDBTesterDeps(t.Name(), &disableScanLoopDeps{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Insert active hosts with varying prices and thus varying weights, as well
+	// as an offline host which should never be returned.
+	nEntries := 20
+	for i := 0; i < nEntries; i++ {
+		entry := makeHostDBEntry()
+		entry.Version = build.Version
+		entry.RemainingStorage = 250e3
+		entry.StoragePrice = types.NewCurrency64(uint64(10 * (i + 1))).Mul(types.SiacoinPrecision).Div64(4032).Div64(1e9)
+		if err := hdbt.hdb.hostTrees.Insert(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	offline := makeHostDBEntry()
+	offline.ScanHistory[0].Success = false
+	if err := hdbt.hdb.hostTrees.Insert(offline); err != nil {
+		t.Fatal(err)
+	}
+
+	n := 5
+	hosts := hdbt.hdb.ActiveHostsN("default", n)
+	if len(hosts) != n {
+		t.Fatalf("expected %v hosts, got %v", n, len(hosts))
+	}
+
+	// Every returned host must weigh at least as much as every host that was
+	// not returned.
+	weight := func(entry modules.HostDBEntry) types.Currency {
+		return hdbt.hdb.calculateHostWeight(entry, "default")
+	}
+	returned := make(map[string]struct{})
+	minWeight := weight(hosts[0])
+	for _, host := range hosts {
+		returned[string(host.PublicKey.Key)] = struct{}{}
+		if w := weight(host); w.Cmp(minWeight) < 0 {
+			minWeight = w
+		}
+	}
+	if _, exists := returned[string(offline.PublicKey.Key)]; exists {
+		t.Error("ActiveHostsN returned an offline host")
+	}
+	for _, host := range hdbt.hdb.ActiveHosts("default") {
+		if _, exists := returned[string(host.PublicKey.Key)]; exists {
+			continue
+		}
+		if weight(host).Cmp(minWeight) > 0 {
+			t.Error("ActiveHostsN did not return the highest weighted hosts")
+		}
+	}
+
+	// Asking for more hosts than there are should return all active hosts.
+	if hosts := hdbt.hdb.ActiveHostsN("default", 2*nEntries); len(hosts) != nEntries {
+		t.Errorf("expected %v hosts, got %v", nEntries, len(hosts))
+	}
+	if hosts := hdbt.hdb.ActiveHostsN("default", 0); len(hosts) != 0 {
+		t.Error("expected no hosts, got", len(hosts))
+	}
+}
+
+// TestActiveHostsOrder checks that ActiveHosts and ActiveHostsN return the
+// hosts in the same order, starting with the highest weighted host, and that
+// hosts of equal weight don't change their order between calls.
+func TestActiveHostsOrder(t *testing.T) {
+	hdb, err := newProfileHostDB(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Insert hosts with two different prices, so that there are hosts of
+	// different as well as of equal weight.
+	nEntries := 10
+	for i := 0; i < nEntries; i++ {
+		entry := makeHostDBEntry()
+		entry.Version = build.Version
+		entry.RemainingStorage = 250e3
+		entry.StoragePrice = types.NewCurrency64(uint64(100 * (i%2 + 1))).Mul(types.SiacoinPrecision).Div64(4032).Div64(1e9)
+		if err := hdb.hostTrees.Insert(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	hosts := hdb.ActiveHosts("default")
+	if len(hosts) != nEntries {
+		t.Fatalf("expected %v hosts, got %v", nEntries, len(hosts))
+	}
+	for i := 1; i < len(hosts); i++ {
+		prev, cur := hdb.calculateHostWeight(hosts[i-1], "default"), hdb.calculateHostWeight(hosts[i], "default")
+		if prev.Cmp(cur) < 0 {
+			t.Fatal("hosts are not sorted by descending weight")
+		}
+	}
+	for i := 0; i < 10; i++ {
+		if !reflect.DeepEqual(hdb.ActiveHosts("default"), hosts) {
+			t.Fatal("order of ActiveHosts changed between calls")
+		}
+		if !reflect.DeepEqual(hdb.ActiveHostsN("default", nEntries), hosts) {
+			t.Fatal("ActiveHostsN and ActiveHosts returned different orders")
+		}
+	}
+}
+
+// TestConfigHostDBProfileInitialScan tests that hostdb profiles cannot be
+// configured before the initial host scan has completed.
+func TestConfigHostDBProfileInitialScan(t *testing.T) {
+	hdb, err := newProfileHostDB(t.Name(), "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The initial scan has not completed yet.
+	_, err = hdb.ConfigHostDBProfile("archive", "addlocation", "germany")
+	if err != ErrInitialScanIncomplete {
+		t.Fatalf("expected %v, got %v", ErrInitialScanIncomplete, err)
+	}
+	if len(hdb.HostDBProfile("archive").Location) != 0 {
+		t.Fatal("profile was configured before the initial scan completed")
+	}
+
+	// Complete the initial scan, configuring should now succeed.
+	hdb.mu.Lock()
+	hdb.initialScanComplete = true
+	hdb.mu.Unlock()
+	_, err = hdb.ConfigHostDBProfile("archive", "addlocation", "germany")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loc := hdb.HostDBProfile("archive").Location; len(loc) != 1 || loc[0] != "germany" {
+		t.Fatal("profile was not configured:", loc)
+	}
+}
+
+// TestRandomHostsProfileBlacklist tests that hosts blacklisted by a hostdb
+// profile are never returned by RandomHosts.
+func TestRandomHostsProfileBlacklist(t *testing.T) {
+	hdb, err := newProfileHostDB(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdb.initialScanComplete = true
+
+	// Insert a cheap host, which is the top-weighted pick, and a number of
+	// more expensive hosts.
+	top := makeHostDBEntry()
+	top.Country = "Germany"
+	top.Version = build.Version
+	top.RemainingStorage = 250e3
+	top.StoragePrice = types.NewCurrency64(5).Mul(types.SiacoinPrecision).Div64(4032).Div64(1e9)
+	if err := hdb.hostTrees.Insert(top); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		entry := makeHostDBEntry()
+		entry.Country = "Germany"
+		entry.Version = build.Version
+		entry.RemainingStorage = 250e3
+		entry.StoragePrice = types.NewCurrency64(300).Mul(types.SiacoinPrecision).Div64(4032).Div64(1e9)
+		if err := hdb.hostTrees.Insert(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if hosts := hdb.ActiveHostsN("default", 1); len(hosts) != 1 || hosts[0].PublicKey.String() != top.PublicKey.String() {
+		t.Fatal("expected the cheap host to be the top-weighted pick")
+	}
+
+	if _, err := hdb.ConfigHostDBProfile("default", "addhost", top.PublicKey.String()); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 25; i++ {
+		hosts, err := hdb.RandomHosts("default", 6, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(hosts) != 5 {
+			t.Fatalf("expected 5 hosts, got %v", len(hosts))
+		}
+		for _, host := range hosts {
+			if host.PublicKey.String() == top.PublicKey.String() {
+				t.Fatal("RandomHosts returned a blacklisted host")
+			}
+		}
+	}
+}
+
+// TestRandomHostsProfileWhitelist tests that only the hosts pinned to a hostdb
+// profile are returned by RandomHosts.
+func TestRandomHostsProfileWhitelist(t *testing.T) {
+	hdb, err := newProfileHostDB(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdb.initialScanComplete = true
+
+	var entries []modules.HostDBEntry
+	for i := 0; i < 10; i++ {
+		entry := makeHostDBEntry()
+		entry.Country = "Germany"
+		if err := hdb.hostTrees.Insert(entry); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, entry)
+	}
+
+	// Pin two hosts.
+	pinned := make(map[string]struct{})
+	for _, entry := range entries[:2] {
+		if _, err := hdb.ConfigHostDBProfile("default", "pinhost", entry.PublicKey.String()); err != nil {
+			t.Fatal(err)
+		}
+		pinned[entry.PublicKey.String()] = struct{}{}
+	}
+	for i := 0; i < 25; i++ {
+		hosts, err := hdb.RandomHosts("default", len(entries), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(hosts) != len(pinned) {
+			t.Fatalf("expected %v hosts, got %v", len(pinned), len(hosts))
+		}
+		for _, host := range hosts {
+			if _, exists := pinned[host.PublicKey.String()]; !exists {
+				t.Fatal("RandomHosts returned a host that is not pinned")
+			}
+		}
+	}
+}
+
+// TestScanSettingsDefaults tests that zero values in the scan settings are
+// replaced by the defaults and that invalid settings are rejected.
+func TestScanSettingsDefaults(t *testing.T) {
+	ss, err := ScanSettings{ScanningThreads: 1}.withDefaults()
+	if err != nil {
+		t.Fatal(err)
+	}
+	def := DefaultScanSettings()
+	if ss.ScanningThreads != 1 || ss.MinScanSleep != def.MinScanSleep ||
+		ss.MaxScanSleep != def.MaxScanSleep || ss.SaveFrequency != def.SaveFrequency {
+		t.Fatal("zero values were not replaced by the defaults:", ss)
+	}
+	_, err = ScanSettings{MinScanSleep: time.Minute, MaxScanSleep: time.Second}.withDefaults()
+	if err != errScanSleepRange {
+		t.Fatalf("expected %v, got %v", errScanSleepRange, err)
+	}
+}
+
+// TestScanReducedThreads tests that the hostdb still completes scanning all
+// hosts when constructed with a reduced number of scanning threads.
+func TestScanReducedThreads(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	testDir := build.TempDir("HostDB", t.Name())
+	g, err := gateway.New("localhost:0", false, filepath.Join(testDir, modules.GatewayDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs, err := consensus.New(g, false, filepath.Join(testDir, modules.ConsensusDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdb, err := NewCustomHostDBWithScanSettings(g, cs, filepath.Join(testDir, modules.RenterDir), &disableScanLoopDeps{}, ScanSettings{ScanningThreads: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hdb.scanSettings.ScanningThreads != 1 {
+		t.Fatal("scanning threads were not set:", hdb.scanSettings.ScanningThreads)
+	}
+
+	// Queue a number of hosts for scanning.
+	hdb.mu.Lock()
+	for i := 0; i < 10; i++ {
+		entry := makeHostDBEntry()
+		if err := hdb.hostTrees.Insert(entry); err != nil {
+			t.Fatal(err)
+		}
+		hdb.queueScan(entry)
+	}
+	hdb.mu.Unlock()
+
+	// Wait for the scan list to drain. The scan pool may spin up one thread
+	// more than configured to avoid deadlocks.
+	err = build.Retry(100, 100*time.Millisecond, func() error {
+		hdb.mu.Lock()
+		defer hdb.mu.Unlock()
+		if hdb.scanningThreads > hdb.scanSettings.ScanningThreads+1 {
+			t.Fatal("too many scanning threads:", hdb.scanningThreads)
+		}
+		if len(hdb.scanList) != 0 || hdb.scanWait {
+			return errors.New("hosts are still being scanned")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestMetrics tests that the hostdb metrics report the hosts of the hostdb.
+func TestMetrics(t *testing.T) {
+	hdb, err := newProfileHostDB(t.Name(), "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Insert active hosts and a host that is offline.
+	for i := 0; i < 5; i++ {
+		if err := hdb.hostTrees.Insert(makeHostDBEntry()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	offline := makeHostDBEntry()
+	offline.ScanHistory[0].Success = false
+	if err := hdb.hostTrees.Insert(offline); err != nil {
+		t.Fatal(err)
+	}
+
+	metrics := hdb.Metrics()
+	if metrics.ActiveHosts != len(hdb.ActiveHosts("default")) {
+		t.Errorf("expected %v active hosts, got %v", len(hdb.ActiveHosts("default")), metrics.ActiveHosts)
+	}
+	if metrics.ActiveHosts != 5 || metrics.TotalHosts != 6 {
+		t.Errorf("expected 5 active and 6 total hosts, got %v and %v", metrics.ActiveHosts, metrics.TotalHosts)
+	}
+	if len(metrics.TreeSizes) != 2 || metrics.TreeSizes["default"] != 6 || metrics.TreeSizes["archive"] != 6 {
+		t.Error("wrong tree sizes:", metrics.TreeSizes)
+	}
+	if metrics.InitialScanComplete || metrics.GeolocationAvailable {
+		t.Error("unexpected metrics:", metrics)
+	}
+}
+
+// TestActiveHostCounts checks that the active hosts of every hostdb profile are
+// counted, and only once the initial scan has completed.
+func TestActiveHostCounts(t *testing.T) {
+	hdb, err := newProfileHostDB(t.Name(), "archive", "backup", "cold")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := hdb.hostTrees.Insert(makeHostDBEntry()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	offline := makeHostDBEntry()
+	offline.ScanHistory[0].Success = false
+	if err := hdb.hostTrees.Insert(offline); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := hdb.ActiveHostCounts(); !errors.Is(err, ErrInitialScanIncomplete) {
+		t.Fatal("expected ErrInitialScanIncomplete, got", err)
+	}
+	hdb.initialScanComplete = true
+	counts, err := hdb.ActiveHostCounts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(counts) != 4 {
+		t.Fatal("expected counts for 4 profiles, got", counts)
+	}
+	for _, name := range []string{"default", "archive", "backup", "cold"} {
+		if counts[name] != 3 {
+			t.Errorf("expected 3 active hosts for profile %v, got %v", name, counts[name])
+		}
+	}
+}
+
+// TestDisableProfile checks that no hosts are selected from a disabled hostdb
+// profile while its settings and host tree are kept, and that the active
+// profile cannot be disabled.
+func TestDisableProfile(t *testing.T) {
+	hdb, err := newProfileHostDB(t.Name(), "archive", "backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdb.initialScanComplete = true
+	for i := 0; i < 3; i++ {
+		host := makeHostDBEntry()
+		host.Country = "Germany"
+		if err := hdb.hostTrees.Insert(host); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := hdb.ConfigHostDBProfile("archive", "enabled", "false"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The profile keeps its settings and hosts but no hosts are selected.
+	if _, err := hdb.RandomHosts("archive", 3, nil); !errors.Is(err, errProfileDisabled) {
+		t.Fatal("expected selection from a disabled profile to fail, got", err)
+	}
+	if profile := hdb.HostDBProfile("archive"); profile.Storagetier != "cold" {
+		t.Error("disabled profile lost its settings:", profile.Storagetier)
+	}
+	if active := len(hdb.ActiveHosts("archive")); active != 3 {
+		t.Error("expected the host tree of the disabled profile to be kept, got", active)
+	}
+	counts, err := hdb.ActiveHostCounts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := counts["archive"]; exists || len(counts) != 2 {
+		t.Error("expected the disabled profile to be skipped by the host counts, got", counts)
+	}
+	if err := hdb.SetActiveProfile("archive"); !errors.Is(err, errProfileDisabled) {
+		t.Fatal("expected a disabled profile not to become the active profile, got", err)
+	}
+
+	// Once enabled again hosts are selected right away.
+	if _, err := hdb.ConfigHostDBProfile("archive", "unset", "enabled"); err != nil {
+		t.Fatal(err)
+	}
+	if selected, err := hdb.RandomHosts("archive", 3, nil); err != nil || len(selected) != 3 {
+		t.Fatalf("expected 3 hosts to be selected after enabling the profile, got %v (%v)", len(selected), err)
+	}
+
+	// The active profile cannot be disabled.
+	if err := hdb.SetActiveProfile("backup"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := hdb.ConfigHostDBProfile("backup", "enabled", "false"); !errors.Is(err, errProfileInUse) {
+		t.Fatal("expected disabling the active profile to fail, got", err)
+	}
+	if !hdb.HostDBProfile("backup").Enabled {
+		t.Fatal("active profile was disabled")
+	}
+}
+
+// TestValidateHostDBProfile checks that proposed hostdb profile settings are
+// validated and matched against the active hosts without creating a profile.
+func TestValidateHostDBProfile(t *testing.T) {
+	hdb, err := newProfileHostDB(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := hdb.ValidateHostDBProfile("tier=cold;locations="); !errors.Is(err, ErrInitialScanIncomplete) {
+		t.Fatal("expected ErrInitialScanIncomplete, got", err)
+	}
+	hdb.initialScanComplete = true
+	for i, country := range []string{"Germany", "Germany", "China"} {
+		host := makeHostDBEntry()
+		host.Country = country
+		host.StoragePrice = types.NewCurrency64(uint64(i + 1))
+		if err := hdb.hostTrees.Insert(host); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		profile string
+		hosts   int
+	}{
+		{"tier=cold;locations=", 3},
+		{"tier=hot;locations=germany", 2},
+		{"tier=warm;locations=germany;maxprice=1", 1},
+		{"tier=warm;locations=russia", 0},
+	}
+	for _, test := range tests {
+		hosts, err := hdb.ValidateHostDBProfile(test.profile)
+		if err != nil {
+			t.Fatalf("%v: %v", test.profile, err)
+		}
+		if hosts != test.hosts {
+			t.Errorf("%v: expected %v matching hosts, got %v", test.profile, test.hosts, hosts)
+		}
+	}
+	if _, err := hdb.ValidateHostDBProfile("tier=lukewarm;locations="); err == nil || !strings.Contains(err.Error(), "no such storage tier") {
+		t.Fatal("expected an invalid storage tier to be rejected, got", err)
+	}
+
+	// Nothing was created or modified.
+	if profiles := hdb.HostDBProfiles(); len(profiles) != 1 || profiles["default"].Storagetier != "warm" {
+		t.Fatal("expected only the unmodified default profile, got", profiles)
+	}
+}
+
+// TestHostWeight checks that the weights reported by HostWeight match the
+// order of the hosts returned by ActiveHosts.
+func TestHostWeight(t *testing.T) {
+	hdb, err := newProfileHostDB(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Insert two hosts that only differ in their storage price.
+	var hosts []modules.HostDBEntry
+	for _, price := range []uint64{1000, 100} {
+		host := makeHostDBEntry()
+		host.Country = "Germany"
+		host.RemainingStorage = 250 * requiredStorage
+		host.Version = build.Version
+		host.StoragePrice = types.SiacoinPrecision.Mul64(price).Div(modules.BlockBytesPerMonthTerabyte)
+		hosts = append(hosts, host)
+	}
+	if err := hdb.hostTrees.InsertBatch(hosts); err != nil {
+		t.Fatal(err)
+	}
+	expensive, cheap := hosts[0], hosts[1]
+
+	// ActiveHosts returns the hosts sorted by descending weight.
+	active := hdb.ActiveHosts("default")
+	if len(active) != 2 {
+		t.Fatal("expected 2 active hosts, got", len(active))
+	}
+	if active[0].PublicKey.String() != cheap.PublicKey.String() || active[1].PublicKey.String() != expensive.PublicKey.String() {
+		t.Fatal("expected the expensive host to be weighted lower than the cheap host")
+	}
+	high, low := hdb.HostWeight(active[0], "default"), hdb.HostWeight(active[1], "default")
+	if low.Cmp(high) >= 0 {
+		t.Fatalf("expected weight %v of the expensive host to be lower than weight %v of the cheap host", low, high)
+	}
+}
+
+// TestHostDBProfilesCopy checks that HostDBProfiles returns a copy of the
+// profiles that can be read and modified while the profiles are configured
+// concurrently.
+func TestHostDBProfilesCopy(t *testing.T) {
+	hdb, err := newProfileHostDB(t.Name(), "eu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdb.initialScanComplete = true
+
+	// Modifying the returned map or profiles must not affect the hostdb.
+	profiles := hdb.HostDBProfiles()
+	profiles["eu"].Storagetier = "hot"
+	profiles["eu"].Location = append(profiles["eu"].Location, "germany")
+	delete(profiles, "default")
+	if p := hdb.HostDBProfile("eu"); p.Storagetier != "cold" || len(p.Location) != 0 {
+		t.Fatal("modifying the returned profile changed the hostdb profile:", p)
+	}
+	if _, err := hdb.Profile("default"); err != nil {
+		t.Fatal("deleting from the returned map removed the default profile:", err)
+	}
+
+	// Read the profiles while they are configured. Run with -race to catch
+	// unsynchronized accesses.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 25; j++ {
+				if _, exists := hdb.HostDBProfiles()["eu"]; !exists {
+					t.Error("profile eu is missing")
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 25; i++ {
+		if _, err := hdb.ConfigHostDBProfile("eu", "note", fmt.Sprint(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+	if note := hdb.HostDBProfile("eu").Note; note != "24" {
+		t.Fatalf("expected note %q, got %q", "24", note)
+	}
+}
+
+// TestMetricsScanBacklog checks that the metrics report the number of queued
+// and pending scans.
+func TestMetricsScanBacklog(t *testing.T) {
+	hdb, err := newProfileHostDB(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdb.deps = &disableScanLoopDeps{}
+
+	// Pretend that a scan is in progress so that queueing a scan doesn't spawn
+	// a scanning thread that would drain the backlog.
+	hosts := make([]modules.HostDBEntry, 5)
+	hdb.mu.Lock()
+	hdb.scanWait = true
+	for i := range hosts {
+		hosts[i] = makeHostDBEntry()
+		hdb.queueScan(hosts[i])
+	}
+	// Queueing a host that is already queued doesn't grow the backlog.
+	hdb.queueScan(hosts[0])
+	hdb.mu.Unlock()
+
+	metrics := hdb.Metrics()
+	if metrics.QueuedScans != len(hosts) || metrics.PendingScans != len(hosts) {
+		t.Errorf("expected %v queued and pending scans, got %v and %v", len(hosts), metrics.QueuedScans, metrics.PendingScans)
+	}
+	if metrics.ScanningThreads != 0 {
+		t.Error("expected no scanning threads, got", metrics.ScanningThreads)
+	}
+}
+
+// TestStaleHosts checks that hosts whose last scan is too old are reported as
+// stale and are only excluded from selection if the scan settings ask for it.
+func TestStaleHosts(t *testing.T) {
+	hdb, err := newProfileHostDB(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdb.initialScanComplete = true
+
+	// Insert a freshly scanned host and a host whose last scan is old.
+	fresh := makeHostDBEntry()
+	fresh.Country = "Germany"
+	stale := makeHostDBEntry()
+	stale.Country = "Germany"
+	stale.ScanHistory[0].Timestamp = time.Now().Add(-2 * hdb.scanSettings.StaleScanAge)
+	unscanned := makeHostDBEntry()
+	unscanned.ScanHistory = nil
+	for _, entry := range []modules.HostDBEntry{fresh, stale, unscanned} {
+		if err := hdb.hostTrees.Insert(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	staleHosts := hdb.StaleHosts(hdb.scanSettings.StaleScanAge)
+	if len(staleHosts) != 1 || staleHosts[0].String() != stale.PublicKey.String() {
+		t.Fatal("expected only the stale host to be reported, got", staleHosts)
+	}
+	if n := hdb.Metrics().StaleHosts; n != 1 {
+		t.Error("expected the metrics to report 1 stale host, got", n)
+	}
+	if n := len(hdb.StaleHosts(3 * hdb.scanSettings.StaleScanAge)); n != 0 {
+		t.Error("expected no stale hosts for a larger maximum age, got", n)
+	}
+
+	// By default stale hosts can still be selected.
+	hosts, err := hdb.RandomHosts("default", 2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hosts) != 2 {
+		t.Fatal("expected both hosts to be selected, got", len(hosts))
+	}
+
+	// Excluding stale hosts leaves only the fresh host.
+	hdb.scanSettings.ExcludeStaleHosts = true
+	hosts, err = hdb.RandomHosts("default", 2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hosts) != 1 || hosts[0].PublicKey.String() != fresh.PublicKey.String() {
+		t.Fatal("expected only the fresh host to be selected, got", hosts)
+	}
+}
+
+// TestNewCustomHostDBWithoutGeolocation checks that a hostdb with geolocation
+// disabled doesn't download the geolocation database and rejects locations.
+func TestNewCustomHostDBWithoutGeolocation(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	// Serve the geolocation database from a server counting the requests.
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer srv.Close()
+	defer func(url string) {
+		geolocationURL = url
+	}(geolocationURL)
+	geolocationURL = srv.URL
+
+	testDir := build.TempDir("HostDB", t.Name())
+	g, err := gateway.New("localhost:0", false, filepath.Join(testDir, modules.GatewayDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	cs, err := consensus.New(g, false, filepath.Join(testDir, modules.ConsensusDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cs.Close()
+	hdb, err := NewCustomHostDBWithoutGeolocation(g, cs, filepath.Join(testDir, modules.RenterDir), &quitAfterLoadDeps{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hdb.Close()
+
+	if n := atomic.LoadInt32(&requests); n != 0 {
+		t.Fatal("expected no request for the geolocation database, got", n)
+	}
+	if hdb.ipdb != nil || hdb.Metrics().GeolocationAvailable {
+		t.Fatal("expected no geolocation database")
+	}
+
+	// Locations can't be used, but hosts without a location are selected.
+	hdb.initialScanComplete = true
+	if _, err := hdb.ConfigHostDBProfile("default", "addlocation", "germany"); !errors.Is(err, errGeolocationDisabled) {
+		t.Fatal("expected errGeolocationDisabled, got", err)
+	}
+	if err := hdb.hostTrees.Insert(makeHostDBEntry()); err != nil {
+		t.Fatal(err)
+	}
+	hosts, err := hdb.RandomHosts("default", 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hosts) != 1 {
+		t.Fatal("expected host without location to be selected, got", len(hosts), "hosts")
+	}
+}
+
+// geolocatorDeps locates IP addresses through a stub geolocation function
+// instead of the geolocation database.
+type geolocatorDeps struct {
+	quitAfterLoadDeps
+	countries map[string]string
+}
+
+// GeolocateIP implements the ipGeolocator interface.
+func (d *geolocatorDeps) GeolocateIP(ip net.IP) (string, bool, error) {
+	country, ok := d.countries[ip.String()]
+	if !ok {
+		return "", false, errors.New("no location for " + ip.String())
+	}
+	return country, country == "Germany", nil
+}
+
+// TestNewCustomHostDBGeolocator checks that dependencies implementing
+// ipGeolocator replace the geolocation database.
+func TestNewCustomHostDBGeolocator(t *testing.T) {
+	// Serve the geolocation database from a server counting the requests.
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer srv.Close()
+	defer func(url string) {
+		geolocationURL = url
+	}(geolocationURL)
+	geolocationURL = srv.URL
+
+	deps := &geolocatorDeps{countries: map[string]string{
+		"127.0.0.1": "Germany",
+		"127.0.0.2": "China",
+	}}
+	hdb, err := newCustomHostDB(onlineGateway{}, nil, build.TempDir("HostDB", t.Name()), deps, "warm", nil, ScanSettings{}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hdb.Close()
+
+	if n := atomic.LoadInt32(&requests); n != 0 {
+		t.Fatal("expected no request for the geolocation database, got", n)
+	}
+	if hdb.ipdb != nil || !hdb.Metrics().GeolocationAvailable {
+		t.Fatal("expected geolocation through the dependencies only")
+	}
+
+	// Hosts are located by the stub, a failed lookup keeps the known location.
+	entry := makeHostDBEntry()
+	for _, test := range []struct {
+		addr    modules.NetAddress
+		country string
+		eu      bool
+	}{
+		{"127.0.0.1:9982", "Germany", true},
+		{"127.0.0.2:9982", "China", false},
+		{"127.0.0.3:9982", "China", false},
+	} {
+		entry.NetAddress = test.addr
+		hdb.updateHostLocationLocal(&entry)
+		if entry.Country != test.country || entry.EUhost != test.eu {
+			t.Errorf("%v: expected location %v (eu: %v), got %v (eu: %v)", test.addr, test.country, test.eu, entry.Country, entry.EUhost)
+		}
+	}
+}
+
+// TestNewCustomHostDBHungGeolocation checks that a hung geolocation database
+// server doesn't stall the startup of the hostdb. The download is retried a
+// limited number of times before the hostdb starts without geolocation.
+func TestNewCustomHostDBHungGeolocation(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	// Create a server that never responds until the request is cancelled.
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		<-req.Context().Done()
+	}))
+	defer srv.Close()
+	defer func(url string) {
+		geolocationURL = url
+	}(geolocationURL)
+	geolocationURL = srv.URL
+
+	testDir := build.TempDir("HostDB", t.Name())
+	g, err := gateway.New("localhost:0", false, filepath.Join(testDir, modules.GatewayDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	cs, err := consensus.New(g, false, filepath.Join(testDir, modules.ConsensusDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cs.Close()
+
+	// Every attempt times out, followed by a doubling backoff.
+	maxStartup := geolocationDownloadAttempts*geolocationDownloadTimeout + geolocationDownloadBackoff<<geolocationDownloadAttempts + 10*time.Second
+	start := time.Now()
+	hdb, err := NewCustomHostDB(g, cs, filepath.Join(testDir, modules.RenterDir), &quitAfterLoadDeps{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hdb.Close()
+	if elapsed := time.Since(start); elapsed > maxStartup {
+		t.Fatalf("startup took %v, expected at most %v", elapsed, maxStartup)
+	}
+
+	if n := atomic.LoadInt32(&requests); n != geolocationDownloadAttempts {
+		t.Fatalf("expected %v download attempts, got %v", geolocationDownloadAttempts, n)
+	}
+	if hdb.ipdb != nil || hdb.Metrics().GeolocationAvailable {
+		t.Fatal("expected no geolocation database")
+	}
+}
+
+// TestRandomHostsPenalized checks that penalized hosts, e.g. the hosts the
+// renter already has contracts with, are only selected if there are too few
+// other hosts.
+func TestRandomHostsPenalized(t *testing.T) {
+	hdb, err := newProfileHostDB(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdb.initialScanComplete = true
+	var contracted []types.SiaPublicKey
+	fresh := make(map[string]struct{})
+	for i := 0; i < 6; i++ {
+		entry := makeHostDBEntry()
+		entry.Country = "Germany"
+		if err := hdb.hostTrees.Insert(entry); err != nil {
+			t.Fatal(err)
+		}
+		if i < 4 {
+			contracted = append(contracted, entry.PublicKey)
+		} else {
+			fresh[entry.PublicKey.String()] = struct{}{}
+		}
+	}
+
+	// The uncontracted hosts are preferred while enough are available.
+	for i := 0; i < 10; i++ {
+		hosts, err := hdb.RandomHostsPenalized("default", 2, nil, contracted)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(hosts) != 2 {
+			t.Fatal("expected 2 hosts, got", len(hosts))
+		}
+		for _, host := range hosts {
+			if _, exists := fresh[host.PublicKey.String()]; !exists {
+				t.Fatal("contracted host selected although uncontracted hosts are available")
+			}
+		}
+	}
+
+	// Otherwise the selection is filled up with contracted hosts, but never
+	// with excluded ones.
+	hosts, err := hdb.RandomHostsPenalized("default", 10, contracted[:1], contracted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hosts) != 5 {
+		t.Fatal("expected 5 hosts, got", len(hosts))
+	}
+	for i, host := range hosts {
+		if _, exists := fresh[host.PublicKey.String()]; exists != (i < 2) {
+			t.Fatal("expected the uncontracted hosts to be selected first")
+		}
+		if host.PublicKey.String() == contracted[0].String() {
+			t.Fatal("excluded host was selected")
+		}
+	}
+}
+
+// TestRandomHostsUnknownProfile checks that selecting or scoring hosts with a
+// profile that doesn't exist returns an error instead of panicking.
+func TestRandomHostsUnknownProfile(t *testing.T) {
+	hdb, err := newProfileHostDB(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdb.initialScanComplete = true
+	entry := makeHostDBEntry()
+	entry.Country = "Germany"
+	if err := hdb.hostTrees.Insert(entry); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := hdb.RandomHosts("missing", 1, nil); err == nil {
+		t.Fatal("expected an error selecting from an unknown profile")
+	}
+	if _, err := hdb.RandomHostsWithWeights("missing", 1, nil, nil, nil); err == nil {
+		t.Fatal("expected an error selecting weighted hosts from an unknown profile")
+	}
+	if _, err := hdb.ScoreBreakdown(entry, "missing"); err == nil {
+		t.Fatal("expected an error scoring a host in an unknown profile")
+	}
+	if n := hdb.selectableHosts("missing"); n != 0 {
+		t.Fatal("expected no selectable hosts for an unknown profile, got", n)
+	}
+	if price := hdb.AverageContractPrice("missing"); !price.IsZero() {
+		t.Fatal("expected no average price for an unknown profile, got", price)
+	}
+}
+
+// TestRandomHostsWithWeights checks that the weighted random hosts are ordered
+// by descending weight and that hosts sharing an address with a host of the
+// address blacklist are excluded.
+func TestRandomHostsWithWeights(t *testing.T) {
+	hdb, err := newProfileHostDB(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdb.initialScanComplete = true
+
+	// Insert hosts with varying prices and thus varying weights.
+	var entries []modules.HostDBEntry
+	for i := 0; i < 10; i++ {
+		entry := makeHostDBEntry()
+		entry.Country = "Germany"
+		entry.Version = build.Version
+		entry.RemainingStorage = 250e3
+		entry.NetAddress = modules.NetAddress(fmt.Sprintf("host%d.example.com:9982", i))
+		entry.StoragePrice = types.NewCurrency64(uint64(10 * (i + 1))).Mul(types.SiacoinPrecision).Div64(4032).Div64(1e9)
+		if err := hdb.hostTrees.Insert(entry); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, entry)
+	}
+
+	hosts, err := hdb.RandomHostsWithWeights("default", len(entries), nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hosts) != len(entries) {
+		t.Fatalf("expected %v hosts, got %v", len(entries), len(hosts))
+	}
+	for i, host := range hosts {
+		if host.Storagetier != "warm" {
+			t.Error("wrong storage tier:", host.Storagetier)
+		}
+		if i > 0 && hosts[i-1].Weight.Cmp(host.Weight) < 0 {
+			t.Fatalf("weights are not non-increasing at %v: %v < %v", i, hosts[i-1].Weight, host.Weight)
+		}
+	}
+	if hosts[0].PublicKey.String() != entries[0].PublicKey.String() {
+		t.Error("expected the cheapest host to have the highest weight")
+	}
+
+	// A host sharing the address of a host of the address blacklist is
+	// excluded as well.
+	twin := makeHostDBEntry()
+	twin.Country = "Germany"
+	twin.NetAddress = "host0.example.com:9983"
+	if err := hdb.hostTrees.Insert(twin); err != nil {
+		t.Fatal(err)
+	}
+	hosts, err = hdb.RandomHostsWithWeights("default", len(entries)+1, nil, []types.SiaPublicKey{entries[0].PublicKey}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hosts) != len(entries)-1 {
+		t.Fatalf("expected %v hosts, got %v", len(entries)-1, len(hosts))
+	}
+	for _, host := range hosts {
+		if host.NetAddress.Host() == "host0.example.com" {
+			t.Fatal("host sharing a blacklisted address was returned")
+		}
+	}
+}
+
+// TestRebuildTree checks that narrowing the location of a hostdb profile
+// rebuilds its host tree so that hosts from other locations are no longer
+// selected.
+func TestRebuildTree(t *testing.T) {
+	hdb, err := newProfileHostDB(t.Name(), "narrow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdb.initialScanComplete = true
+	for _, country := range []string{"Germany", "Germany", "China"} {
+		entry := makeHostDBEntry()
+		entry.Country = country
+		if err := hdb.hostTrees.Insert(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hosts, err := hdb.RandomHosts("narrow", 10, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hosts) != 3 {
+		t.Fatal("expected 3 hosts before narrowing the location, got", len(hosts))
+	}
+
+	if _, err := hdb.ConfigHostDBProfile("narrow", "addlocation", "germany"); err != nil {
+		t.Fatal(err)
+	}
+	hosts, err = hdb.RandomHosts("narrow", 10, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hosts) != 2 {
+		t.Fatal("expected 2 hosts after narrowing the location, got", len(hosts))
+	}
+	for _, host := range hosts {
+		if host.Country != "Germany" {
+			t.Error("host from wrong location selected:", host.Country)
+		}
+	}
+
+	// The default profile is not affected.
+	hosts, err = hdb.RandomHosts("default", 10, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hosts) != 3 {
+		t.Fatal("expected default profile to still select 3 hosts, got", len(hosts))
+	}
+
+	if err := hdb.rebuildTree("missing"); err == nil {
+		t.Fatal("expected error rebuilding the tree of an unknown profile")
+	}
+}
+
+// TestAddHostDBProfilesBatch checks that a batch of hostdb profiles is added
+// together with the host trees of the profiles, and that a batch with an
+// invalid entry adds none of its profiles.
+func TestAddHostDBProfilesBatch(t *testing.T) {
+	hdb, err := newProfileHostDB(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, country := range []string{"Germany", "China"} {
+		entry := makeHostDBEntry()
+		entry.Country = country
+		if err := hdb.hostTrees.Insert(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A batch with an unknown location adds nothing.
+	err = hdb.AddHostDBProfilesBatch([]hostdbprofile.ProfileSpec{
+		{Name: "archive", Storagetier: "cold"},
+		{Name: "german", Storagetier: "warm", Locations: []string{"germany"}},
+		{Name: "atlantis", Storagetier: "hot", Locations: []string{"atlantis"}},
+	})
+	if err == nil {
+		t.Fatal("expected the batch with an invalid location to be rejected")
+	}
+	if n := hdb.hostdbProfiles.Len(); n != 1 {
+		t.Fatal("expected only the default profile after the rejected batch, got", hdb.hostdbProfiles.Names())
+	}
+	if names := hdb.hostTrees.Names(); len(names) != 1 {
+		t.Fatal("expected only the default tree after the rejected batch, got", names)
+	}
+
+	// Duplicate names within a batch are rejected as well.
+	err = hdb.AddHostDBProfilesBatch([]hostdbprofile.ProfileSpec{
+		{Name: "archive", Storagetier: "cold"},
+		{Name: "archive", Storagetier: "hot"},
+	})
+	if err == nil || hdb.hostdbProfiles.Len() != 1 {
+		t.Fatal("expected the batch with duplicate names to be rejected, got", err)
+	}
+
+	// A valid batch adds all profiles and their trees.
+	err = hdb.AddHostDBProfilesBatch([]hostdbprofile.ProfileSpec{
+		{Name: "archive", Storagetier: "cheap"},
+		{Name: "german", Storagetier: "warm", Locations: []string{"germany"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st := hdb.HostDBProfile("archive").Storagetier; st != "cold" {
+		t.Fatal("expected the archive profile to be cold, got", st)
+	}
+	if hosts := hdb.AllHosts("archive"); len(hosts) != 2 {
+		t.Fatal("expected 2 hosts in the archive tree, got", len(hosts))
+	}
+	if hosts := hdb.AllHosts("german"); len(hosts) != 1 || hosts[0].Country != "Germany" {
+		t.Fatal("expected only the German host in the german tree, got", hosts)
+	}
+}
+
+// TestReplaceHostDBProfiles checks that replacing all hostdb profiles rebuilds
+// the host trees to match the new profiles and resets an active profile that
+// was replaced.
+func TestReplaceHostDBProfiles(t *testing.T) {
+	hdb, err := newProfileHostDB(t.Name(), "archive", "german")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdb.initialScanComplete = true
+	for _, country := range []string{"Germany", "China"} {
+		entry := makeHostDBEntry()
+		entry.Country = country
+		if err := hdb.hostTrees.Insert(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := hdb.ConfigHostDBProfile("german", "addlocation", "germany"); err != nil {
+		t.Fatal(err)
+	}
+	if err := hdb.SetActiveProfile("archive"); err != nil {
+		t.Fatal(err)
+	}
 
-	g, err := gateway.New("localhost:0", false, filepath.Join(testDir, modules.GatewayDir))
+	// Replace the profiles, keeping the name of the German profile but
+	// restricting it to China, and dropping the archive profile.
+	err = hdb.ReplaceHostDBProfiles(map[string]*hostdbprofile.HostDBProfile{
+		"german":  {Storagetier: "warm", Location: []string{"china"}, Enabled: true},
+		"chinese": {Storagetier: "hot", Location: []string{"china"}, Enabled: true},
+	})
 	if err != nil {
-		return nil, err
+		t.Fatal(err)
 	}
-	cs, err := consensus.New(g, false, filepath.Join(testDir, modules.ConsensusDir))
-	if err != nil {
-		return nil, err
+
+	// There should be exactly one tree for each profile, matching the new
+	// settings of the profile.
+	if names, trees := hdb.hostdbProfiles.Names(), hdb.hostTrees.Names(); !reflect.DeepEqual(names, trees) {
+		t.Fatalf("profiles %v and trees %v don't match", names, trees)
 	}
-	tp, err := transactionpool.New(cs, g, filepath.Join(testDir, modules.TransactionPoolDir))
-	if err != nil {
-		return nil, err
+	if names := hdb.hostdbProfiles.Names(); !reflect.DeepEqual(names, []string{"chinese", "default", "german"}) {
+		t.Fatal("expected the new profiles and the default profile, got", names)
 	}
-	w, err := wallet.New(cs, tp, filepath.Join(testDir, modules.WalletDir))
-	if err != nil {
-		return nil, err
+	for _, name := range []string{"chinese", "german"} {
+		if hosts := hdb.AllHosts(name); len(hosts) != 1 || hosts[0].Country != "China" {
+			t.Fatalf("expected only the Chinese host in the %v tree, got %v", name, hosts)
+		}
 	}
-	m, err := miner.New(cs, tp, w, filepath.Join(testDir, modules.MinerDir))
-	if err != nil {
-		return nil, err
+	if hosts := hdb.AllHosts("default"); len(hosts) != 2 {
+		t.Fatal("expected 2 hosts in the default tree, got", len(hosts))
 	}
-	hdb, err := NewCustomHostDB(g, cs, filepath.Join(testDir, modules.RenterDir), deps)
-	if err != nil {
-		return nil, err
+	if active := hdb.ActiveProfile(); active != "default" {
+		t.Fatal("expected the active profile to fall back to the default profile, got", active)
 	}
 
-	hdbt := &hdbTester{
-		cs:      cs,
-		gateway: g,
-		miner:   m,
-		tpool:   tp,
-		wallet:  w,
-
-		hdb: hdb,
-
-		persistDir: testDir,
+	// Invalid profiles are rejected without touching the profiles or trees.
+	err = hdb.ReplaceHostDBProfiles(map[string]*hostdbprofile.HostDBProfile{
+		"atlantis": {Storagetier: "warm", Location: []string{"atlantis"}, Enabled: true},
+	})
+	if err == nil {
+		t.Fatal("expected the invalid profiles to be rejected")
+	}
+	if trees := hdb.hostTrees.Names(); !reflect.DeepEqual(trees, []string{"chinese", "default", "german"}) {
+		t.Fatal("expected the trees to be untouched, got", trees)
 	}
+}
 
-	err = hdbt.initWallet()
+// TestEffectiveFilters compares the effective filters of a cold hostdb profile
+// to those of a hot one.
+func TestEffectiveFilters(t *testing.T) {
+	hdb, err := newProfileHostDB(t.Name(), "archive")
 	if err != nil {
-		return nil, err
+		t.Fatal(err)
+	}
+	if err := hdb.hostdbProfiles.AddHostDBProfile("streaming", "hot"); err != nil {
+		t.Fatal(err)
+	}
+	if err := hdb.hostdbProfiles.ConfigHostDBProfiles("streaming", "addlocation", "germany"); err != nil {
+		t.Fatal(err)
 	}
 
-	return hdbt, nil
-}
-
-// initWallet creates a wallet key, then initializes and unlocks the wallet.
-func (hdbt *hdbTester) initWallet() error {
-	hdbt.walletKey = crypto.GenerateTwofishKey()
-	_, err := hdbt.wallet.Encrypt(hdbt.walletKey)
+	cold, err := hdb.EffectiveFilters("archive")
 	if err != nil {
-		return err
+		t.Fatal(err)
 	}
-	err = hdbt.wallet.Unlock(hdbt.walletKey)
+	hot, err := hdb.EffectiveFilters("streaming")
 	if err != nil {
-		return err
+		t.Fatal(err)
 	}
-	return nil
-}
-
-// TestAverageContractPrice tests the AverageContractPrice method, which also depends on the
-// randomHosts method.
-func TestAverageContractPrice(t *testing.T) {
-	hdb := bareHostDB()
-
-	// empty
-	if avg := hdb.AverageContractPrice(); !avg.IsZero() {
-		t.Error("average of empty hostdb should be zero:", avg)
+	if cold.Storagetier != "cold" || hot.Storagetier != "hot" {
+		t.Fatal("wrong storage tiers:", cold.Storagetier, hot.Storagetier)
 	}
-
-	// with one host
-	h1 := makeHostDBEntry()
-	h1.ContractPrice = types.NewCurrency64(100)
-	hdb.hostTrees.Insert(h1)
-	if avg := hdb.AverageContractPrice(); avg.Cmp(h1.ContractPrice) != 0 {
-		t.Error("average of one host should be that host's price:", avg)
+	// Cold profiles prefer cheap storage, hot profiles cheap bandwidth.
+	if cold.ContractPriceMultiplier <= hot.ContractPriceMultiplier {
+		t.Error("cold profile should weigh contract prices more than a hot one")
+	}
+	if hot.UploadPriceMultiplier <= cold.UploadPriceMultiplier || hot.DownloadPriceMultiplier <= cold.DownloadPriceMultiplier {
+		t.Error("hot profile should weigh bandwidth prices more than a cold one")
+	}
+	if !cold.MinTotalPrice.Equals(hot.MinTotalPrice) {
+		t.Error("minimum total price should not depend on the storage tier")
+	}
+	if !cold.AnyLocation || hot.AnyLocation || len(hot.Locations) != 1 || hot.Locations[0] != "germany" {
+		t.Error("wrong locations:", cold.Locations, hot.Locations)
 	}
 
-	// with two hosts
-	h2 := makeHostDBEntry()
-	h2.ContractPrice = types.NewCurrency64(300)
-	hdb.hostTrees.Insert(h2)
-	if avg := hdb.AverageContractPrice(); avg.Cmp64(200) != 0 {
-		t.Error("average of two hosts should be their sum/2:", avg)
+	// Querying the filters must not modify the profile.
+	hot.Locations[0] = "china"
+	if hdb.HostDBProfile("streaming").Location[0] != "germany" {
+		t.Error("modifying the effective filters modified the profile")
+	}
+	if _, err := hdb.EffectiveFilters("missing"); err == nil {
+		t.Error("expected error for unknown profile")
 	}
 }
 
-// TestNew tests the New function.
-func TestNew(t *testing.T) {
-	if testing.Short() {
-		t.SkipNow()
-	}
-	testDir := build.TempDir("HostDB", t.Name())
-	g, err := gateway.New("localhost:0", false, filepath.Join(testDir, modules.GatewayDir))
+// TestScoreBreakdownStoragetiers checks that the score breakdown of a host
+// reflects the storage tier of the hostdb profile it is computed for.
+func TestScoreBreakdownStoragetiers(t *testing.T) {
+	hdb, err := newProfileHostDB(t.Name(), "archive")
 	if err != nil {
 		t.Fatal(err)
 	}
-	cs, err := consensus.New(g, false, filepath.Join(testDir, modules.ConsensusDir))
-	if err != nil {
+	if err := hdb.hostdbProfiles.AddHostDBProfile("streaming", "hot"); err != nil {
 		t.Fatal(err)
 	}
 
-	// Vanilla HDB, nothing should go wrong.
-	hdbName := filepath.Join(testDir, modules.RenterDir)
-	_, err = New(g, cs, hdbName+"1")
-	if err != nil {
+	// A host with cheap storage but expensive bandwidth should rank higher for
+	// a cold profile than for a hot one.
+	entry := makeHostDBEntry()
+	entry.Country = "Germany"
+	entry.Version = build.Version
+	entry.RemainingStorage = 250e3
+	entry.StoragePrice = types.NewCurrency64(1).Mul(types.SiacoinPrecision).Div64(4032).Div64(1e9)
+	entry.UploadBandwidthPrice = types.NewCurrency64(1000).Mul(types.SiacoinPrecision).Div64(1e12)
+	entry.DownloadBandwidthPrice = types.NewCurrency64(1000).Mul(types.SiacoinPrecision).Div64(1e12)
+
+	cold := scoreBreakdown(t, hdb, entry, "archive")
+	hot := scoreBreakdown(t, hdb, entry, "streaming")
+	if cold.PriceAdjustment <= hot.PriceAdjustment {
+		t.Errorf("expected a higher price adjustment for the cold profile, got %v (cold) and %v (hot)", cold.PriceAdjustment, hot.PriceAdjustment)
+	}
+	if cold.Score.Cmp(hot.Score) <= 0 {
+		t.Errorf("expected a higher score for the cold profile, got %v (cold) and %v (hot)", cold.Score, hot.Score)
+	}
+	// The adjustments that don't depend on the profile are the same.
+	if cold.CollateralAdjustment != hot.CollateralAdjustment || cold.StorageRemainingAdjustment != hot.StorageRemainingAdjustment ||
+		cold.VersionAdjustment != hot.VersionAdjustment || cold.UptimeAdjustment != hot.UptimeAdjustment {
+		t.Error("profile independent adjustments differ:", cold, hot)
+	}
+}
+
+// TestDownloadGeolocationDBStop tests that stopping the hostdb cancels an
+// in-flight download of the geolocation database without leaving the partially
+// downloaded file behind.
+func TestDownloadGeolocationDBStop(t *testing.T) {
+	// Create a server that sends part of the database and then stalls until
+	// the request is cancelled.
+	started := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write(make([]byte, 1<<10))
+		w.(http.Flusher).Flush()
+		close(started)
+		<-req.Context().Done()
+	}))
+	defer srv.Close()
+
+	persistDir := build.TempDir("HostDB", t.Name())
+	if err := os.MkdirAll(persistDir, 0700); err != nil {
 		t.Fatal(err)
 	}
+	hdb := &HostDB{persistDir: persistDir}
 
-	// Nil gateway.
-	_, err = New(nil, cs, hdbName+"2")
-	if err != errNilGateway {
-		t.Fatalf("expected %v, got %v", errNilGateway, err)
+	errChan := make(chan error)
+	go func() {
+		errChan <- hdb.managedDownloadGeolocationDB(srv.URL, persistDir)
+	}()
+	<-started
+
+	// Stopping the hostdb should interrupt the download.
+	stopped := make(chan error)
+	go func() {
+		stopped <- hdb.tg.Stop()
+	}()
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("hostdb did not stop while downloading the geolocation database")
 	}
-	// Nil consensus set.
-	_, err = New(g, nil, hdbName+"3")
-	if err != errNilCS {
-		t.Fatalf("expected %v, got %v", errNilCS, err)
+	if err := <-errChan; err == nil {
+		t.Fatal("expected the interrupted download to fail")
 	}
-	// Bad persistDir.
-	_, err = New(g, cs, "")
-	if !os.IsNotExist(err) {
-		t.Fatalf("expected invalid directory, got %v", err)
+	if _, err := os.Stat(filepath.Join(persistDir, geolocationTmpFile)); !os.IsNotExist(err) {
+		t.Fatal("expected partial download to be removed:", err)
+	}
+	if _, err := os.Stat(filepath.Join(persistDir, geolocationDir)); !os.IsNotExist(err) {
+		t.Fatal("expected no geolocation database to be unpacked:", err)
 	}
 }
 
@@ -211,6 +1665,156 @@ func (*disableScanLoopDeps) Disrupt(s string) bool {
 	return false
 }
 
+// logSelectionDeps enables logging of the selection decisions.
+type logSelectionDeps struct {
+	modules.ProductionDependencies
+}
+
+// Disrupt returns true for the logSelectionDecisions codebreak.
+func (*logSelectionDeps) Disrupt(s string) bool {
+	return s == "logSelectionDecisions"
+}
+
+// TestLogSelectionDecisions checks that the reasons for filtering hosts are
+// logged if enabled, and only then.
+func TestLogSelectionDecisions(t *testing.T) {
+	hdb, err := newProfileHostDB(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdb.initialScanComplete = true
+	var buf bytes.Buffer
+	hdb.log = persist.NewLogger(&buf)
+
+	// A host without a location is filtered by location, a blacklisted one by
+	// the blacklist of the profile and one without storage by the minimum
+	// storage of the profile.
+	unlocated := makeHostDBEntry()
+	unlocated.RemainingStorage = 1
+	blacklisted := makeHostDBEntry()
+	blacklisted.Country = "Germany"
+	if err := hdb.hostdbProfiles.ConfigHostDBProfiles("default", "addhost", blacklisted.PublicKey.String()); err != nil {
+		t.Fatal(err)
+	}
+	small := makeHostDBEntry()
+	small.Country = "Germany"
+	if err := hdb.hostdbProfiles.ConfigHostDBProfiles("default", "minstorage", "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing is logged by default.
+	if err := hdb.hostTrees.Insert(unlocated); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := hdb.RandomHosts("default", 2, nil); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(buf.String(), "Selection:") {
+		t.Fatal("selection decisions were logged by default:", buf.String())
+	}
+
+	hdb.deps = &logSelectionDeps{}
+	if err := hdb.hostTrees.Insert(blacklisted); err != nil {
+		t.Fatal(err)
+	}
+	if err := hdb.hostTrees.Insert(small); err != nil {
+		t.Fatal(err)
+	}
+	if err := hdb.hostTrees.Modify(unlocated); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := hdb.RandomHosts("default", 2, nil); err != nil {
+		t.Fatal(err)
+	}
+	logs := buf.String()
+	if !strings.Contains(logs, unlocated.PublicKey.String()+` in profile "default": weight`) || !strings.Contains(logs, "filtered: location") {
+		t.Error("location filter not logged:", logs)
+	}
+	if !strings.Contains(logs, blacklisted.PublicKey.String()+` in profile "default" filtered: blacklist`) {
+		t.Error("blacklist filter not logged:", logs)
+	}
+	for _, line := range strings.Split(logs, "\n") {
+		if strings.Contains(line, small.PublicKey.String()) && !strings.HasSuffix(line, "filtered: minstorage") {
+			t.Error("minimum storage filter not logged:", line)
+		}
+	}
+	if !strings.Contains(logs, small.PublicKey.String()) {
+		t.Error("host without storage not logged:", logs)
+	}
+}
+
+// TestJSONLog checks that the selection and save events are logged as JSON
+// objects with the expected fields if JSON logging is enabled.
+func TestJSONLog(t *testing.T) {
+	hdb, err := newProfileHostDB(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdb.initialScanComplete = true
+	hdb.scanSettings.JSONLog = true
+	var buf bytes.Buffer
+	hdb.log = persist.NewLogger(&buf)
+
+	// entries returns the JSON entries logged so far.
+	entries := func() (entries []logEntry) {
+		for _, line := range strings.Split(buf.String(), "\n") {
+			if !strings.HasPrefix(line, "{") {
+				continue
+			}
+			var entry logEntry
+			if err := json.Unmarshal([]byte(line), &entry); err != nil {
+				t.Fatalf("invalid JSON log line %q: %v", line, err)
+			}
+			entries = append(entries, entry)
+		}
+		return entries
+	}
+
+	// Filtering a blacklisted host is logged with the host, profile and
+	// reason.
+	blacklisted := makeHostDBEntry()
+	blacklisted.Country = "Germany"
+	if err := hdb.hostdbProfiles.ConfigHostDBProfiles("default", "addhost", blacklisted.PublicKey.String()); err != nil {
+		t.Fatal(err)
+	}
+	if err := hdb.hostTrees.Insert(blacklisted); err != nil {
+		t.Fatal(err)
+	}
+	hdb.deps = &logSelectionDeps{}
+	if _, err := hdb.RandomHosts("default", 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, entry := range entries() {
+		if entry.Host == blacklisted.PublicKey.String() && entry.Reason == "blacklist" {
+			found = entry.Level == logLevelInfo && entry.Message == "host filtered" && entry.Profile == "default" && !entry.Time.IsZero()
+		}
+	}
+	if !found {
+		t.Fatal("blacklist filter not logged as JSON:", buf.String())
+	}
+	if strings.Contains(buf.String(), "Selection:") {
+		t.Fatal("plain text selection decisions logged:", buf.String())
+	}
+
+	// A failed save is logged with the profile and the error.
+	deps := &failingSaveDeps{}
+	deps.fail(saveAttempts)
+	hdb.deps = deps
+	if err := hdb.AddHostDBProfiles("archive", "cold"); !errors.Is(err, errSaveFailed) {
+		t.Fatal("expected errSaveFailed, got", err)
+	}
+	found = false
+	for _, entry := range entries() {
+		if entry.Level == logLevelError && entry.Profile == "archive" && entry.Reason == errSaveFailed.Error() {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatal("failed save not logged as JSON:", buf.String())
+	}
+}
+
 // TestRandomHosts tests the hostdb's exported RandomHosts method.
 func TestRandomHosts(t *testing.T) {
 	if testing.Short() {
@@ -225,6 +1829,7 @@ func TestRandomHosts(t *testing.T) {
 	nEntries := int(1e3)
 	for i := 0; i < nEntries; i++ {
 		entry := makeHostDBEntry()
+		entry.Country = "Germany"
 		entries[string(entry.PublicKey.Key)] = entry
 		err := hdbt.hdb.hostTrees.Insert(entry)
 		if err != nil {
@@ -234,7 +1839,7 @@ func TestRandomHosts(t *testing.T) {
 
 	// Check that all hosts can be queried.
 	for i := 0; i < 25; i++ {
-		hosts, err := hdbt.hdb.RandomHosts(nEntries, nil)
+		hosts, err := hdbt.hdb.RandomHosts("default", nEntries, nil)
 		if err != nil {
 			t.Fatal("Failed to get hosts", err)
 		}
@@ -257,7 +1862,7 @@ func TestRandomHosts(t *testing.T) {
 
 	// Base case, fill out a map exposing hosts from a single RH query.
 	dupCheck1 := make(map[string]modules.HostDBEntry)
-	hosts, err := hdbt.hdb.RandomHosts(nEntries/2, nil)
+	hosts, err := hdbt.hdb.RandomHosts("default", nEntries/2, nil)
 	if err != nil {
 		t.Fatal("Failed to get hosts", err)
 	}
@@ -281,7 +1886,7 @@ func TestRandomHosts(t *testing.T) {
 	for i := 0; i < 10; i++ {
 		dupCheck2 := make(map[string]modules.HostDBEntry)
 		var overlap, disjoint bool
-		hosts, err = hdbt.hdb.RandomHosts(nEntries/2, nil)
+		hosts, err = hdbt.hdb.RandomHosts("default", nEntries/2, nil)
 		if err != nil {
 			t.Fatal("Failed to get hosts", err)
 		}
@@ -315,7 +1920,7 @@ func TestRandomHosts(t *testing.T) {
 	// Try exclude list by excluding every host except for the last one, and
 	// doing a random select.
 	for i := 0; i < 25; i++ {
-		hosts, err := hdbt.hdb.RandomHosts(nEntries, nil)
+		hosts, err := hdbt.hdb.RandomHosts("default", nEntries, nil)
 		if err != nil {
 			t.Fatal("Failed to get hosts", err)
 		}
@@ -323,7 +1928,7 @@ func TestRandomHosts(t *testing.T) {
 		for j := 1; j < len(hosts); j++ {
 			exclude = append(exclude, hosts[j].PublicKey)
 		}
-		rand, err := hdbt.hdb.RandomHosts(1, exclude)
+		rand, err := hdbt.hdb.RandomHosts("default", 1, exclude)
 		if err != nil {
 			t.Fatal("Failed to get hosts", err)
 		}
@@ -335,7 +1940,7 @@ func TestRandomHosts(t *testing.T) {
 		}
 
 		// Try again but request more hosts than are available.
-		rand, err = hdbt.hdb.RandomHosts(5, exclude)
+		rand, err = hdbt.hdb.RandomHosts("default", 5, exclude)
 		if err != nil {
 			t.Fatal("Failed to get hosts", err)
 		}
@@ -357,7 +1962,7 @@ func TestRandomHosts(t *testing.T) {
 
 		// Select only 20 hosts.
 		dupCheck := make(map[string]struct{})
-		rand, err = hdbt.hdb.RandomHosts(20, exclude)
+		rand, err = hdbt.hdb.RandomHosts("default", 20, exclude)
 		if err != nil {
 			t.Fatal("Failed to get hosts", err)
 		}
@@ -378,7 +1983,7 @@ func TestRandomHosts(t *testing.T) {
 
 		// Select exactly 50 hosts.
 		dupCheck = make(map[string]struct{})
-		rand, err = hdbt.hdb.RandomHosts(50, exclude)
+		rand, err = hdbt.hdb.RandomHosts("default", 50, exclude)
 		if err != nil {
 			t.Fatal("Failed to get hosts", err)
 		}
@@ -399,7 +2004,7 @@ func TestRandomHosts(t *testing.T) {
 
 		// Select 100 hosts.
 		dupCheck = make(map[string]struct{})
-		rand, err = hdbt.hdb.RandomHosts(100, exclude)
+		rand, err = hdbt.hdb.RandomHosts("default", 100, exclude)
 		if err != nil {
 			t.Fatal("Failed to get hosts", err)
 		}
@@ -583,3 +2188,218 @@ func TestUpdateHistoricInteractions(t *testing.T) {
 			host.HistoricFailedInteractions, host.HistoricSuccessfulInteractions)
 	}
 }
+
+// mmdbString encodes s as a MaxMind DB UTF-8 string.
+func mmdbString(s string) []byte {
+	return append([]byte{2<<5 | byte(len(s))}, s...)
+}
+
+// mmdbUint encodes v as a MaxMind DB unsigned integer of the provided type
+// and size.
+func mmdbUint(typ byte, size int, v uint64) []byte {
+	b := []byte{typ<<5 | byte(size)}
+	for i := size - 1; i >= 0; i-- {
+		b = append(b, byte(v>>(8*uint(i))))
+	}
+	return b
+}
+
+// makeGeolocationDB returns a minimal, empty geolocation database that was
+// built at the provided time.
+func makeGeolocationDB(built time.Time) []byte {
+	// A search tree with a single node whose records point to no data,
+	// followed by the data section separator.
+	db := append([]byte{0, 0, 1, 0, 0, 1}, make([]byte, 16)...)
+	db = append(db, "\xab\xcd\xefMaxMind.com"...)
+	db = append(db, 7<<5|6)
+	db = append(db, mmdbString("binary_format_major_version")...)
+	db = append(db, mmdbUint(5, 2, 2)...)
+	db = append(db, mmdbString("database_type")...)
+	db = append(db, mmdbString("GeoLite2-Country")...)
+	db = append(db, mmdbString("build_epoch")...)
+	db = append(db, mmdbUint(6, 4, uint64(built.Unix()))...)
+	db = append(db, mmdbString("ip_version")...)
+	db = append(db, mmdbUint(5, 2, 4)...)
+	db = append(db, mmdbString("node_count")...)
+	db = append(db, mmdbUint(6, 4, 1)...)
+	db = append(db, mmdbString("record_size")...)
+	db = append(db, mmdbUint(5, 2, 24)...)
+	return db
+}
+
+// makeGeolocationArchive returns the compressed archive the geolocation
+// database is distributed in.
+func makeGeolocationArchive(db []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	gzw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gzw)
+	if err := tw.WriteHeader(&tar.Header{Name: geolocationDir, Typeflag: tar.TypeDir, Mode: 0755}); err != nil {
+		return nil, err
+	}
+	hdr := &tar.Header{Name: filepath.Join(geolocationDir, geolocationFile), Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(db))}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return nil, err
+	}
+	if _, err := tw.Write(db); err != nil {
+		return nil, err
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gzw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// TestRefreshGeolocationDB checks that an outdated geolocation database is
+// refreshed in the background when the hostdb starts, and that an up to date
+// one is not.
+func TestRefreshGeolocationDB(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	// Serve a fresh geolocation database from a server counting the requests.
+	fresh := time.Now().Add(-24 * time.Hour).Truncate(time.Second)
+	archive, err := makeGeolocationArchive(makeGeolocationDB(fresh))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Write(archive)
+	}))
+	defer srv.Close()
+	defer func(url string) {
+		geolocationURL = url
+	}(geolocationURL)
+	geolocationURL = srv.URL
+
+	// Start the hostdb with a database built two years ago.
+	persistDir := build.TempDir("HostDB", t.Name())
+	if err := os.MkdirAll(filepath.Join(persistDir, geolocationDir), 0700); err != nil {
+		t.Fatal(err)
+	}
+	old := fresh.AddDate(-2, 0, 0)
+	if err := ioutil.WriteFile(filepath.Join(persistDir, geolocationDir, geolocationFile), makeGeolocationDB(old), 0600); err != nil {
+		t.Fatal(err)
+	}
+	hdb, err := newCustomHostDB(onlineGateway{}, nil, persistDir, &quitAfterLoadDeps{}, "warm", nil, ScanSettings{}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The database should be replaced by the fresh one.
+	err = build.Retry(100, 50*time.Millisecond, func() error {
+		hdb.ipdbMu.RLock()
+		built := geolocationBuildTime(hdb.ipdb)
+		hdb.ipdbMu.RUnlock()
+		if !built.Equal(fresh) {
+			return fmt.Errorf("expected database built on %v, got %v", fresh, built)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Fatal("expected one request for the geolocation database, got", n)
+	}
+	if err := hdb.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The fresh database is loaded after a restart and isn't refreshed again.
+	hdb, err = newCustomHostDB(onlineGateway{}, nil, persistDir, &quitAfterLoadDeps{}, "warm", nil, ScanSettings{}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hdb.Close()
+	if built := geolocationBuildTime(hdb.ipdb); !built.Equal(fresh) {
+		t.Fatal("expected the refreshed database to be loaded, got one built on", built)
+	}
+	if _, err := os.Stat(filepath.Join(persistDir, geolocationRefreshDir)); !os.IsNotExist(err) {
+		t.Fatal("expected the refresh directory to be removed, got", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Fatal("expected no further request for the geolocation database, got", n)
+	}
+}
+
+// TestRefreshGeolocation checks that refreshing the geolocation recomputes the
+// location of every host, moving the hosts between the host trees of profiles
+// restricted to locations, and that hosts which can't be located keep their
+// last known location.
+func TestRefreshGeolocation(t *testing.T) {
+	hdb, err := newProfileHostDB(t.Name(), "german")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdb.initialScanComplete = true
+	if _, err := hdb.ConfigHostDBProfile("german", "addlocation", "germany"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Add hosts whose locations are outdated.
+	moved := makeHostDBEntry()
+	moved.NetAddress = "127.0.0.1:9982"
+	moved.Country = "China"
+	unchanged := makeHostDBEntry()
+	unchanged.NetAddress = "127.0.0.2:9982"
+	unchanged.Country = "Germany"
+	unchanged.EUhost = true
+	unknown := makeHostDBEntry()
+	unknown.NetAddress = "127.0.0.3:9982"
+	unknown.Country = "Germany"
+	unknown.EUhost = true
+	for _, host := range []modules.HostDBEntry{moved, unchanged, unknown} {
+		if err := hdb.hostTrees.Insert(host); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hdb.deps = &locationDeps{locations: map[modules.NetAddress]string{
+		moved.NetAddress:     "Germany",
+		unchanged.NetAddress: "Germany",
+	}}
+
+	if err := hdb.RefreshGeolocation(); err != nil {
+		t.Fatal(err)
+	}
+	var status modules.HostDBGeolocationRefresh
+	err = build.Retry(100, 10*time.Millisecond, func() error {
+		status = hdb.GeolocationRefresh()
+		if status.Running {
+			return errors.New("refresh is still running")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Hosts != 3 || status.Processed != 3 || status.Changed != 1 || status.Error != "" {
+		t.Fatalf("unexpected progress of the refresh: %+v", status)
+	}
+	if status.Finished.Before(status.Started) {
+		t.Fatal("refresh finished before it started:", status.Started, status.Finished)
+	}
+
+	// The moved host is recomputed and now selected by the German profile,
+	// the host that can't be located keeps its location.
+	if host, _ := hdb.hostTrees.Select(moved.PublicKey); host.Country != "Germany" || !host.EUhost {
+		t.Fatal("expected the location of the moved host to be recomputed, got", host.Country, host.EUhost)
+	}
+	if host, _ := hdb.hostTrees.Select(unknown.PublicKey); host.Country != "Germany" || !host.EUhost {
+		t.Fatal("expected the host that can't be located to keep its location, got", host.Country, host.EUhost)
+	}
+	if n := len(hdb.hostTrees.All("german")); n != 3 {
+		t.Fatal("expected all hosts in the tree of the German profile, got", n)
+	}
+
+	// Geolocation can't be refreshed if it is disabled.
+	hdb.geolocationDisabled = true
+	if err := hdb.RefreshGeolocation(); !errors.Is(err, errGeolocationDisabled) {
+		t.Fatal("expected errGeolocationDisabled, got", err)
+	}
+}
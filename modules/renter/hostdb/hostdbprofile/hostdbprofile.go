@@ -1,5 +1,22 @@
 package hostdbprofile
 
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/pachisi456/sia-hostdb-profiles/types"
+)
+
+// maxNoteLen is the maximum number of characters of the note of a hostdb
+// profile.
+const maxNoteLen = 256
+
 var (
 	// storagetiers is an array of all possible storage tiers that the user can
 	// choose between when creating a new hostdb profile. Depending on the
@@ -8,6 +25,14 @@ var (
 	// Warm is balanced between hot and cold and thus the default setting.
 	storagetiers = []string{"cold", "warm", "hot"}
 
+	// storagetierAliases maps alternative names of the storage tiers to the
+	// canonical storage tier names which are stored in the hostdb profiles.
+	storagetierAliases = map[string]string{
+		"cheap":    "cold",
+		"balanced": "warm",
+		"fast":     "hot",
+	}
+
 	// locations is the list of possible locations the user can restrict their hostdb
 	// profile to. Siad will then only form contracts with hosts in those locations
 	// (according to ip address)
@@ -18,8 +43,95 @@ var (
 // HostDBProfile is a hostdb profile for customizable settings concerning the
 // selection of hosts.
 type HostDBProfile struct {
-	Storagetier string   `json:"storagetier"`
-	Location    []string `json:"location"`
+	Storagetier string `json:"storagetier"`
+
+	// Location restricts the selection to hosts whose IP address is located
+	// in one of the locations. It describes the network location of the hosts
+	// only and has no bearing on legal or payout considerations, those can be
+	// recorded in the Note.
+	Location []string `json:"location"`
+
+	// Blacklist contains the public keys of hosts that should never be
+	// selected for this profile, regardless of their location or weight.
+	Blacklist []types.SiaPublicKey `json:"blacklist"`
+
+	// Whitelist contains the public keys of hosts the profile is pinned to.
+	// If it is not empty only these hosts are selected for this profile.
+	Whitelist []types.SiaPublicKey `json:"whitelist"`
+
+	// EnforceIPDiversity prevents hosts that share a subnet from being
+	// selected together for this profile.
+	EnforceIPDiversity bool `json:"enforceipdiversity"`
+
+	// MinAge is the number of blocks that need to have passed since a host
+	// was first seen before it is selected for this profile.
+	MinAge types.BlockHeight `json:"minage"`
+
+	// MinStorage is the number of bytes a host needs to have remaining to be
+	// selected for this profile.
+	MinStorage uint64 `json:"minstorage"`
+
+	// MinBandwidth is the bandwidth in bytes per second a host needs to have
+	// been measured at by its last successful scan to be selected for this
+	// profile, e.g. for a performance-oriented hot profile. Hosts that have
+	// never been measured are not selected. Zero means no minimum.
+	MinBandwidth uint64 `json:"minbandwidth"`
+
+	// MinHostMaxDuration is the shortest maximum contract duration in blocks
+	// a host needs to accept to be selected for this profile. It should cover
+	// the allowance period plus the renew window. Zero means no minimum.
+	MinHostMaxDuration types.BlockHeight `json:"minhostmaxduration"`
+
+	// MinScans is the number of scans a host needs to have in its scan
+	// history to be selected for this profile, so that a single successful
+	// scan doesn't make a host selectable. Values below 1 are treated as 1,
+	// the default, which only requires the last scan to be successful.
+	MinScans int `json:"minscans"`
+
+	// MaxSettingsAge is the longest time that may have passed since the
+	// settings of a host were last fetched by a successful scan for the host
+	// to be selected for this profile. Hosts with older settings are only
+	// selected again once they have been rescanned. Zero means no limit.
+	MaxSettingsAge time.Duration `json:"maxsettingsage"`
+
+	// MaxPrice is the highest storage price in hastings per byte per block a
+	// host may charge to be selected for this profile. Zero means no limit.
+	MaxPrice types.Currency `json:"maxprice"`
+
+	// RenewWindow is the number of blocks before their end that contracts
+	// formed under this profile are renewed. It overrides the renew window of
+	// the allowance, e.g. so that contracts with hot hosts are renewed early
+	// enough to avoid gaps. Zero means the allowance's renew window is used.
+	// It does not affect the host selection.
+	RenewWindow types.BlockHeight `json:"renewwindow"`
+
+	// LastUpdated is the block height at which the host tree of the profile
+	// was last brought up to date. After a long downtime it can be used to
+	// decide whether the profile's tree needs rescanning before being trusted.
+	LastUpdated types.BlockHeight `json:"lastupdated"`
+
+	// Note is a free text annotation of the profile, e.g. why it exists or
+	// which legal or payout considerations it was created for. It does not
+	// affect the host selection.
+	Note string `json:"note"`
+
+	// Enabled reports whether the profile is used. A disabled profile keeps
+	// its settings and host tree but is skipped by the allowance and by
+	// aggregate endpoints until it is enabled again. The default profile is
+	// always enabled.
+	Enabled bool `json:"enabled"`
+}
+
+// UnmarshalJSON implements json.Unmarshaler. Profiles persisted before
+// profiles could be disabled have no enabled field and are enabled.
+func (hdbp *HostDBProfile) UnmarshalJSON(b []byte) error {
+	type profile HostDBProfile
+	p := profile{Enabled: true}
+	if err := json.Unmarshal(b, &p); err != nil {
+		return err
+	}
+	*hdbp = HostDBProfile(p)
+	return nil
 }
 
 // configHostDBProfile updates the provided setting of a hostdb profile to the provided value.
@@ -27,30 +139,33 @@ type HostDBProfile struct {
 func (hdbp *HostDBProfile) configHostDBProfile(setting, value string) (err error) {
 	switch setting {
 	case "storagetier":
+		value = normalizeStoragetier(value)
 		// check if provided storage tier is not set already
 		if hdbp.Storagetier == value {
-			return errStoragetierAlreadySet
+			return fmt.Errorf("%w: %q", errStoragetierAlreadySet, value)
 		}
 		// check if provided storage tier is valid
 		if valid := storagetierValid(value); !valid {
-			return errNoSuchStorageTier
+			return fmt.Errorf("%w: %q", errNoSuchStorageTier, value)
 		}
 		// adjust the storage tier
 		hdbp.Storagetier = value
 	case "addlocation":
+		value = normalizeLocation(value)
 		// check if location is already set
 		for _, l := range hdbp.Location {
 			if l == value {
-				return errLocationAlreadySet
+				return fmt.Errorf("%w: %q", errLocationAlreadySet, value)
 			}
 		}
 		// check if provided location is valid
 		if valid := locationValid(value); !valid {
-			return errNoSuchLocation
+			return fmt.Errorf("%w: %q", errNoSuchLocation, value)
 		}
 		// add location
 		hdbp.Location = append(hdbp.Location, value)
 	case "removelocation":
+		value = normalizeLocation(value)
 		// check if and at what index the provided location is set
 		index := -1
 		for i, location := range hdbp.Location {
@@ -62,14 +177,374 @@ func (hdbp *HostDBProfile) configHostDBProfile(setting, value string) (err error
 
 		// return error if location not found
 		if index < 0 {
-			return errLocationNotSet
+			return fmt.Errorf("%w: %q", errLocationNotSet, value)
 		}
 
 		// delete the location
 		hdbp.Location = append(hdbp.Location[:index], hdbp.Location[index+1:]...)
+	case "addhost":
+		spk, err := parseHostKey(value)
+		if err != nil {
+			return err
+		}
+		// check if host is already blacklisted or pinned
+		if hostIndex(hdbp.Blacklist, spk) >= 0 {
+			return fmt.Errorf("%w: %q", errHostAlreadyBlacklisted, value)
+		}
+		if hostIndex(hdbp.Whitelist, spk) >= 0 {
+			return fmt.Errorf("%w: %q", errHostPinned, value)
+		}
+		// add host
+		hdbp.Blacklist = append(hdbp.Blacklist, spk)
+	case "removehost":
+		spk, err := parseHostKey(value)
+		if err != nil {
+			return err
+		}
+		// return error if host is not blacklisted
+		index := hostIndex(hdbp.Blacklist, spk)
+		if index < 0 {
+			return fmt.Errorf("%w: %q", errHostNotBlacklisted, value)
+		}
+
+		// delete the host
+		hdbp.Blacklist = append(hdbp.Blacklist[:index], hdbp.Blacklist[index+1:]...)
+	case "pinhost":
+		spk, err := parseHostKey(value)
+		if err != nil {
+			return err
+		}
+		// check if host is already pinned or blacklisted
+		if hostIndex(hdbp.Whitelist, spk) >= 0 {
+			return fmt.Errorf("%w: %q", errHostAlreadyPinned, value)
+		}
+		if hostIndex(hdbp.Blacklist, spk) >= 0 {
+			return fmt.Errorf("%w: %q", errHostBlacklisted, value)
+		}
+		// pin host
+		hdbp.Whitelist = append(hdbp.Whitelist, spk)
+	case "unpinhost":
+		spk, err := parseHostKey(value)
+		if err != nil {
+			return err
+		}
+		// return error if host is not pinned
+		index := hostIndex(hdbp.Whitelist, spk)
+		if index < 0 {
+			return fmt.Errorf("%w: %q", errHostNotPinned, value)
+		}
+
+		// unpin the host
+		hdbp.Whitelist = append(hdbp.Whitelist[:index], hdbp.Whitelist[index+1:]...)
+	case "enforceipdiversity":
+		enforce, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%w: %q", errInvalidBool, value)
+		}
+		hdbp.EnforceIPDiversity = enforce
+	case "minage":
+		minAge, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%w: %q", errInvalidMinAge, value)
+		}
+		hdbp.MinAge = types.BlockHeight(minAge)
+	case "minstorage":
+		minStorage, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%w: %q", errInvalidMinStorage, value)
+		}
+		hdbp.MinStorage = minStorage
+	case "minbandwidth":
+		minBandwidth, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%w: %q", errInvalidMinBandwidth, value)
+		}
+		hdbp.MinBandwidth = minBandwidth
+	case "minhostmaxduration":
+		minDuration, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%w: %q", errInvalidMinDuration, value)
+		}
+		hdbp.MinHostMaxDuration = types.BlockHeight(minDuration)
+	case "minscans":
+		minScans, err := strconv.Atoi(value)
+		if err != nil || minScans < 0 {
+			return fmt.Errorf("%w: %q", errInvalidMinScans, value)
+		}
+		hdbp.MinScans = minScans
+	case "maxsettingsage":
+		maxAge, err := time.ParseDuration(value)
+		if err != nil || maxAge < 0 {
+			return fmt.Errorf("%w: %q", errInvalidMaxSettingsAge, value)
+		}
+		hdbp.MaxSettingsAge = maxAge
+	case "maxprice":
+		var maxPrice types.Currency
+		if _, err := fmt.Sscan(value, &maxPrice); err != nil {
+			return fmt.Errorf("%w: %q", errInvalidMaxPrice, value)
+		}
+		hdbp.MaxPrice = maxPrice
+	case "renewwindow":
+		renewWindow, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%w: %q", errInvalidRenewWindow, value)
+		}
+		hdbp.RenewWindow = types.BlockHeight(renewWindow)
+	case "note":
+		// an empty value removes the note
+		if !noteValid(value) {
+			return fmt.Errorf("%w: %q", errInvalidNote, value)
+		}
+		hdbp.Note = value
+	case "enabled":
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%w: %q", errInvalidBool, value)
+		}
+		hdbp.Enabled = enabled
+	case "unset":
+		// the value names the setting that is reset to its default
+		return hdbp.unsetSetting(value)
 	default:
-		return errNoSuchSetting
+		return fmt.Errorf("%w: %q", errNoSuchSetting, setting)
 	}
 
 	return
 }
+
+// unsetSetting resets the provided single-valued setting of the hostdb profile
+// to its default. Settings holding a list, like the locations or the
+// blacklist, are edited value by value and cannot be unset.
+func (hdbp *HostDBProfile) unsetSetting(setting string) error {
+	switch setting {
+	case "storagetier":
+		hdbp.Storagetier = "warm"
+	case "enforceipdiversity":
+		hdbp.EnforceIPDiversity = false
+	case "minage":
+		hdbp.MinAge = 0
+	case "minstorage":
+		hdbp.MinStorage = 0
+	case "minbandwidth":
+		hdbp.MinBandwidth = 0
+	case "minhostmaxduration":
+		hdbp.MinHostMaxDuration = 0
+	case "minscans":
+		hdbp.MinScans = 0
+	case "maxsettingsage":
+		hdbp.MaxSettingsAge = 0
+	case "maxprice":
+		hdbp.MaxPrice = types.ZeroCurrency
+	case "renewwindow":
+		hdbp.RenewWindow = 0
+	case "note":
+		hdbp.Note = ""
+	case "enabled":
+		hdbp.Enabled = true
+	default:
+		return fmt.Errorf("%w: %q", errNotUnsettable, setting)
+	}
+	return nil
+}
+
+// settingsKey returns a string uniquely identifying the settings of the hostdb
+// profile. Two profiles with the same settings, regardless of the order of
+// their locations, their renew windows or whether they are enabled, have the
+// same key.
+func (hdbp *HostDBProfile) settingsKey() string {
+	if hdbp == nil {
+		return ""
+	}
+	locations := append([]string(nil), hdbp.Location...)
+	sort.Strings(locations)
+	keys := func(pks []types.SiaPublicKey) string {
+		var hosts []string
+		for _, pk := range pks {
+			hosts = append(hosts, pk.String())
+		}
+		sort.Strings(hosts)
+		return strings.Join(hosts, ",")
+	}
+	return hdbp.Storagetier + "|" + strings.Join(locations, ",") + "|" + keys(hdbp.Blacklist) + "|" + keys(hdbp.Whitelist) +
+		"|" + strconv.FormatBool(hdbp.EnforceIPDiversity) + "|" + strconv.FormatUint(uint64(hdbp.MinAge), 10) +
+		"|" + strconv.FormatUint(hdbp.MinStorage, 10) + "|" + strconv.FormatUint(hdbp.MinBandwidth, 10) +
+		"|" + strconv.FormatUint(uint64(hdbp.MinHostMaxDuration), 10) +
+		"|" + strconv.Itoa(hdbp.minScans()) + "|" + hdbp.MaxSettingsAge.String() + "|" + hdbp.MaxPrice.String()
+}
+
+// minScans returns the number of scans a host needs to have to be selected for
+// the profile, which is at least 1.
+func (hdbp *HostDBProfile) minScans() int {
+	if hdbp.MinScans < 1 {
+		return 1
+	}
+	return hdbp.MinScans
+}
+
+// clone returns a deep copy of the hostdb profile that shares no memory with
+// the original.
+func (hdbp *HostDBProfile) clone() *HostDBProfile {
+	c := *hdbp
+	if hdbp.Location != nil {
+		c.Location = append([]string{}, hdbp.Location...)
+	}
+	c.Blacklist = cloneHostKeys(hdbp.Blacklist)
+	c.Whitelist = cloneHostKeys(hdbp.Whitelist)
+	c.MaxPrice = types.NewCurrency(hdbp.MaxPrice.Big())
+	return &c
+}
+
+// cloneHostKeys returns a deep copy of the provided public keys.
+func cloneHostKeys(keys []types.SiaPublicKey) []types.SiaPublicKey {
+	if keys == nil {
+		return nil
+	}
+	c := make([]types.SiaPublicKey, len(keys))
+	for i, spk := range keys {
+		c[i] = types.SiaPublicKey{
+			Algorithm: spk.Algorithm,
+			Key:       append([]byte(nil), spk.Key...),
+		}
+	}
+	return c
+}
+
+// hostIndex returns the index of the provided public key in keys or -1 if it
+// is not contained.
+func hostIndex(keys []types.SiaPublicKey, spk types.SiaPublicKey) int {
+	for i, pk := range keys {
+		if pk.String() == spk.String() {
+			return i
+		}
+	}
+	return -1
+}
+
+// noteValid is a helper function that returns true if the provided note is
+// valid UTF-8 of at most maxNoteLen characters without control characters.
+func noteValid(note string) bool {
+	if !utf8.ValidString(note) || utf8.RuneCountInString(note) > maxNoteLen {
+		return false
+	}
+	return strings.IndexFunc(note, unicode.IsControl) < 0
+}
+
+// parseHostKey parses the string representation of a host's public key, e.g.
+// "ed25519:<hex>".
+func parseHostKey(s string) (types.SiaPublicKey, error) {
+	var spk types.SiaPublicKey
+	spk.LoadString(s)
+	if len(spk.Key) == 0 {
+		return types.SiaPublicKey{}, fmt.Errorf("%w: %q", errInvalidHostKey, s)
+	}
+	return spk, nil
+}
+
+// String returns a compact, human-editable representation of the hostdb
+// profile's settings, e.g. "tier=cold;locations=germany,eu". Blacklisted and
+// pinned hosts, IP diversity, the minimum host age, the minimum remaining
+// storage, the minimum bandwidth, the minimum number of scans, the maximum
+// settings age, the maximum price and the renew window are only included if
+// they are set, a disabled profile is marked with "enabled=false". The note is
+// not part of the settings and never included. The representation can be
+// parsed with ParseHostDBProfile.
+func (hdbp *HostDBProfile) String() string {
+	keys := func(pks []types.SiaPublicKey) string {
+		var hosts []string
+		for _, pk := range pks {
+			hosts = append(hosts, pk.String())
+		}
+		return strings.Join(hosts, ",")
+	}
+	s := "tier=" + hdbp.Storagetier + ";locations=" + strings.Join(hdbp.Location, ",")
+	if len(hdbp.Blacklist) > 0 {
+		s += ";blacklist=" + keys(hdbp.Blacklist)
+	}
+	if len(hdbp.Whitelist) > 0 {
+		s += ";whitelist=" + keys(hdbp.Whitelist)
+	}
+	if hdbp.EnforceIPDiversity {
+		s += ";enforceipdiversity=true"
+	}
+	if hdbp.MinAge > 0 {
+		s += ";minage=" + strconv.FormatUint(uint64(hdbp.MinAge), 10)
+	}
+	if hdbp.MinStorage > 0 {
+		s += ";minstorage=" + strconv.FormatUint(hdbp.MinStorage, 10)
+	}
+	if hdbp.MinBandwidth > 0 {
+		s += ";minbandwidth=" + strconv.FormatUint(hdbp.MinBandwidth, 10)
+	}
+	if hdbp.MinHostMaxDuration > 0 {
+		s += ";minhostmaxduration=" + strconv.FormatUint(uint64(hdbp.MinHostMaxDuration), 10)
+	}
+	if hdbp.MinScans > 1 {
+		s += ";minscans=" + strconv.Itoa(hdbp.MinScans)
+	}
+	if hdbp.MaxSettingsAge > 0 {
+		s += ";maxsettingsage=" + hdbp.MaxSettingsAge.String()
+	}
+	if !hdbp.MaxPrice.IsZero() {
+		s += ";maxprice=" + hdbp.MaxPrice.String()
+	}
+	if hdbp.RenewWindow > 0 {
+		s += ";renewwindow=" + strconv.FormatUint(uint64(hdbp.RenewWindow), 10)
+	}
+	if !hdbp.Enabled {
+		s += ";enabled=false"
+	}
+	return s
+}
+
+// ParseHostDBProfile parses a hostdb profile from the representation returned
+// by String. All settings are checked for validity. The profile is enabled
+// unless the representation says otherwise.
+func ParseHostDBProfile(s string) (HostDBProfile, error) {
+	hdbp := HostDBProfile{Enabled: true}
+	tierSet := false
+	for _, field := range strings.Split(strings.TrimSpace(s), ";") {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			return HostDBProfile{}, fmt.Errorf("%w: %q", errMalformedProfile, field)
+		}
+		key, value := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+
+		// the setting used to add a single value of the field
+		var setting string
+		switch key {
+		case "tier":
+			value = normalizeStoragetier(value)
+			if !storagetierValid(value) {
+				return HostDBProfile{}, fmt.Errorf("%w: %q", errNoSuchStorageTier, value)
+			}
+			hdbp.Storagetier = value
+			tierSet = true
+			continue
+		case "locations":
+			setting = "addlocation"
+		case "blacklist":
+			setting = "addhost"
+		case "whitelist":
+			setting = "pinhost"
+		case "enforceipdiversity", "minage", "minstorage", "minbandwidth", "minhostmaxduration", "minscans", "maxsettingsage", "maxprice", "renewwindow", "enabled":
+			if err := hdbp.configHostDBProfile(key, value); err != nil {
+				return HostDBProfile{}, err
+			}
+			continue
+		default:
+			return HostDBProfile{}, fmt.Errorf("%w: %q", errNoSuchSetting, key)
+		}
+		if value == "" {
+			continue
+		}
+		for _, v := range strings.Split(value, ",") {
+			if err := hdbp.configHostDBProfile(setting, strings.TrimSpace(v)); err != nil {
+				return HostDBProfile{}, err
+			}
+		}
+	}
+	if !tierSet {
+		return HostDBProfile{}, fmt.Errorf("%w: missing tier", errMalformedProfile)
+	}
+	return hdbp, nil
+}
@@ -0,0 +1,118 @@
+package hostdbprofile
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pachisi456/sia-hostdb-profiles/types"
+)
+
+// TestHostDBProfileStringRoundTrip checks that a hostdb profile survives being
+// converted to its text representation and parsed again.
+func TestHostDBProfileStringRoundTrip(t *testing.T) {
+	var host types.SiaPublicKey
+	host.LoadString("ed25519:" + strings.Repeat("ab", 32))
+
+	profiles := []HostDBProfile{
+		{Storagetier: "warm"},
+		{Storagetier: "cold", Location: []string{"germany", "united states"}},
+		{Storagetier: "hot", Location: []string{"eu"}, Blacklist: []types.SiaPublicKey{host}},
+		{Storagetier: "hot", Whitelist: []types.SiaPublicKey{host}},
+		{Storagetier: "warm", EnforceIPDiversity: true},
+		{Storagetier: "cold", Location: []string{"eu"}, MinAge: 4320},
+		{Storagetier: "hot", MinStorage: 1e12},
+		{Storagetier: "hot", MinBandwidth: 5e6},
+		{Storagetier: "warm", MinHostMaxDuration: 12960},
+		{Storagetier: "hot", MinScans: 3},
+		{Storagetier: "warm", MaxSettingsAge: 90 * time.Minute},
+		{Storagetier: "cold", MaxPrice: types.NewCurrency64(1e12)},
+		{Storagetier: "hot", RenewWindow: 1008},
+		{Storagetier: "hot", Location: []string{"eu"}, Enabled: true},
+	}
+	for _, profile := range profiles {
+		s := profile.String()
+		parsed, err := ParseHostDBProfile(s)
+		if err != nil {
+			t.Fatalf("%v: %v", s, err)
+		}
+		if !reflect.DeepEqual(parsed, profile) {
+			t.Errorf("%v: profile changed during round trip: %+v", s, parsed)
+		}
+	}
+
+	// An empty locations list is printed and parsed.
+	if s := (&HostDBProfile{Storagetier: "warm", Enabled: true}).String(); s != "tier=warm;locations=" {
+		t.Error("unexpected representation of a profile without locations:", s)
+	}
+}
+
+// TestParseHostDBProfileInvalid checks that invalid text representations of
+// hostdb profiles are rejected.
+func TestParseHostDBProfileInvalid(t *testing.T) {
+	tests := []struct {
+		s   string
+		err error
+	}{
+		{"tier=lukewarm;locations=", errNoSuchStorageTier},
+		{"tier=cold;locations=atlantis", errNoSuchLocation},
+		{"tier=cold;locations=eu,eu", errLocationAlreadySet},
+		{"tier=cold;color=blue", errNoSuchSetting},
+		{"tier=cold;blacklist=notakey", errInvalidHostKey},
+		{"tier=cold;minage=-1", errInvalidMinAge},
+		{"tier=cold;minage=old", errInvalidMinAge},
+		{"tier=cold;minstorage=1TB", errInvalidMinStorage},
+		{"tier=cold;minbandwidth=-1", errInvalidMinBandwidth},
+		{"tier=cold;minbandwidth=fast", errInvalidMinBandwidth},
+		{"tier=cold;minhostmaxduration=-1", errInvalidMinDuration},
+		{"tier=cold;minhostmaxduration=long", errInvalidMinDuration},
+		{"tier=cold;minscans=-1", errInvalidMinScans},
+		{"tier=cold;minscans=many", errInvalidMinScans},
+		{"tier=cold;maxsettingsage=-1h", errInvalidMaxSettingsAge},
+		{"tier=cold;maxsettingsage=12", errInvalidMaxSettingsAge},
+		{"tier=cold;maxprice=-5", errInvalidMaxPrice},
+		{"tier=cold;maxprice=cheap", errInvalidMaxPrice},
+		{"tier=cold;renewwindow=-1", errInvalidRenewWindow},
+		{"tier=cold;renewwindow=soon", errInvalidRenewWindow},
+		{"tier=cold;enabled=maybe", errInvalidBool},
+		{"locations=eu", errMalformedProfile},
+		{"tier", errMalformedProfile},
+		{"", errMalformedProfile},
+	}
+	for _, test := range tests {
+		if _, err := ParseHostDBProfile(test.s); !errors.Is(err, test.err) {
+			t.Errorf("%q: expected %v, got %v", test.s, test.err, err)
+		}
+	}
+}
+
+// TestHostDBProfileUnmarshalEnabled checks that hostdb profiles persisted
+// before profiles could be disabled are enabled when loaded.
+func TestHostDBProfileUnmarshalEnabled(t *testing.T) {
+	var profile HostDBProfile
+	if err := json.Unmarshal([]byte(`{"storagetier":"cold","location":["eu"]}`), &profile); err != nil {
+		t.Fatal(err)
+	}
+	if !profile.Enabled || profile.Storagetier != "cold" || len(profile.Location) != 1 {
+		t.Fatalf("unexpected profile: %+v", profile)
+	}
+
+	if err := json.Unmarshal([]byte(`{"storagetier":"cold","enabled":false}`), &profile); err != nil {
+		t.Fatal(err)
+	}
+	if profile.Enabled {
+		t.Fatal("expected the profile to be disabled")
+	}
+
+	// A parsed profile is enabled unless it says otherwise.
+	parsed, err := ParseHostDBProfile("tier=warm;locations=")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !parsed.Enabled {
+		t.Fatal("expected the parsed profile to be enabled")
+	}
+}
@@ -2,21 +2,59 @@ package hostdbprofile
 
 import (
 	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+
+	"github.com/pachisi456/sia-hostdb-profiles/types"
 )
 
+// ErrProfileDisabled is returned when hosts are selected from a disabled
+// hostdb profile.
+var ErrProfileDisabled = errors.New("hostdb profile is disabled, enable it to select hosts from it")
+
 var (
-	errHostdbProfileExists = errors.New("hostdb profile with provided name already exists")
-	errLocationNotSet      = errors.New("provided location cannot be removed as it is not set")
-	errLocationAlreadySet  = errors.New("provided location is already set")
-	errNoSuchHostdbProfile = errors.New("hostdb profile with provided name does not exist")
-	errNoSuchLocation      = errors.New("provided location not recognized")
-	errNoSuchSetting       = errors.New("provided setting not recognized")
-	errNoSuchStorageTier   = errors.New("no such storage tier, see `siac hostdb profiles add " +
+	errHostAlreadyBlacklisted = errors.New("provided host is already blacklisted")
+	errHostAlreadyPinned      = errors.New("provided host is already pinned")
+	errHostBlacklisted        = errors.New("provided host cannot be pinned as it is blacklisted")
+	errHostNotPinned          = errors.New("provided host cannot be unpinned as it is not pinned")
+	errHostPinned             = errors.New("provided host cannot be blacklisted as it is pinned")
+	errHostNotBlacklisted     = errors.New("provided host cannot be removed as it is not blacklisted")
+	errDeleteDefaultProfile   = errors.New("the default hostdb profile cannot be deleted")
+	errDisableDefaultProfile  = errors.New("the default hostdb profile cannot be disabled")
+	errHostdbProfileExists    = errors.New("hostdb profile with provided name already exists")
+	errInvalidBool            = errors.New("provided value must be either true or false")
+	errInvalidHostKey         = errors.New("provided host public key could not be parsed")
+	errInvalidMaxPrice        = errors.New("provided maximum price must be a non-negative number of hastings per byte per block")
+	errInvalidMinBandwidth    = errors.New("provided minimum bandwidth must be a non-negative number of bytes per second")
+	errInvalidMaxSettingsAge  = errors.New("provided maximum settings age must be a non-negative duration, e.g. \"12h\"")
+	errInvalidMinAge          = errors.New("provided minimum age must be a non-negative number of blocks")
+	errInvalidMinDuration     = errors.New("provided minimum contract duration must be a non-negative number of blocks")
+	errInvalidMinScans        = errors.New("provided minimum number of scans must be a non-negative integer")
+	errInvalidMinStorage      = errors.New("provided minimum storage must be a non-negative number of bytes")
+	errInvalidNote            = errors.New("provided note must be at most 256 characters without control characters")
+	errInvalidRenewWindow     = errors.New("provided renew window must be a non-negative number of blocks")
+	errMalformedProfile       = errors.New("hostdb profile could not be parsed, expected e.g. \"tier=cold;locations=germany,eu\"")
+	errLocationNotSet         = errors.New("provided location cannot be removed as it is not set")
+	errLocationAlreadySet     = errors.New("provided location is already set")
+	errNoSuchHostdbProfile    = errors.New("hostdb profile with provided name does not exist")
+	errNoSuchLocation         = errors.New("provided location not recognized")
+	errNoSuchSetting          = errors.New("provided setting not recognized")
+	errNoSuchStorageTier      = errors.New("no such storage tier, see `siac hostdb profiles add " +
 		"-h` for possible storage tiers")
+	errNotUnsettable         = errors.New("provided setting cannot be unset, only single-valued settings can be reset")
 	errStoragetierAlreadySet = errors.New("provided storage tier is already set")
 )
 
+// ProfileSpec describes a hostdb profile to be added by AddHostDBProfiles.
+type ProfileSpec struct {
+	Name        string   `json:"name"`
+	Storagetier string   `json:"storagetier"`
+	Locations   []string `json:"locations"`
+}
+
 // HostDBProfiles is the collection of all hostdb profiles the renter created to
 // customize the host selection. The profiles are mapped by the name given by the user.
 type HostDBProfiles struct {
@@ -25,18 +63,43 @@ type HostDBProfiles struct {
 }
 
 // NewHostDBProfiles creates a new HostDBProfiles object and initializes it with the
-// default hostdb profile.
-func NewHostDBProfiles() HostDBProfiles {
+// default hostdb profile. The object holds a mutex and must not be copied.
+func NewHostDBProfiles() *HostDBProfiles {
 	hdbp := make(map[string]*HostDBProfile)
 	hdbp["default"] = &HostDBProfile{
 		Storagetier: "warm",
 		Location:    nil,
+		Enabled:     true,
 	}
-	return HostDBProfiles{
+	return &HostDBProfiles{
 		profiles: hdbp,
 	}
 }
 
+// NewHostDBProfilesWithDefault creates a new HostDBProfiles object whose default
+// hostdb profile uses the provided storage tier and locations.
+func NewHostDBProfilesWithDefault(storagetier string, locations []string) (*HostDBProfiles, error) {
+	storagetier = normalizeStoragetier(storagetier)
+	if !storagetierValid(storagetier) {
+		return nil, fmt.Errorf("%w: %q", errNoSuchStorageTier, storagetier)
+	}
+	profile := &HostDBProfile{
+		Storagetier: storagetier,
+		Location:    nil,
+		Enabled:     true,
+	}
+	for _, l := range locations {
+		if err := profile.configHostDBProfile("addlocation", l); err != nil {
+			return nil, err
+		}
+	}
+	hdbp := make(map[string]*HostDBProfile)
+	hdbp["default"] = profile
+	return &HostDBProfiles{
+		profiles: hdbp,
+	}, nil
+}
+
 // AddHostDBProfile adds a new hostdb profile to HostDBProfiles.
 func (hdbp *HostDBProfiles) AddHostDBProfile(name, storagetier string) (err error) {
 	hdbp.mu.Lock()
@@ -44,54 +107,358 @@ func (hdbp *HostDBProfiles) AddHostDBProfile(name, storagetier string) (err erro
 
 	// check if hostdb profile with that name already exists
 	if _, exists := hdbp.profiles[name]; exists {
-		return errHostdbProfileExists
+		return fmt.Errorf("%w: %q", errHostdbProfileExists, name)
 	}
 
 	// check if provided storage tier is valid
+	storagetier = normalizeStoragetier(storagetier)
 	if valid := storagetierValid(storagetier); !valid {
-		return errNoSuchStorageTier
+		return fmt.Errorf("%w: %q", errNoSuchStorageTier, storagetier)
 	}
 
 	// add new hostdb profile
 	hdbp.profiles[name] = &HostDBProfile{
 		Storagetier: storagetier,
 		Location:    nil,
+		Enabled:     true,
 	}
 	return
 }
 
+// AddHostDBProfiles adds all of the described hostdb profiles at once. All of
+// them are validated before any is added, if one of them is invalid or named
+// like an existing or another new profile none of them is added.
+func (hdbp *HostDBProfiles) AddHostDBProfiles(specs []ProfileSpec) error {
+	hdbp.mu.Lock()
+	defer hdbp.mu.Unlock()
+
+	profiles := make(map[string]*HostDBProfile, len(specs))
+	for _, spec := range specs {
+		if _, exists := hdbp.profiles[spec.Name]; exists {
+			return fmt.Errorf("%w: %q", errHostdbProfileExists, spec.Name)
+		}
+		if _, exists := profiles[spec.Name]; exists {
+			return fmt.Errorf("%w: %q", errHostdbProfileExists, spec.Name)
+		}
+		storagetier := normalizeStoragetier(spec.Storagetier)
+		if !storagetierValid(storagetier) {
+			return fmt.Errorf("%w: %q", errNoSuchStorageTier, storagetier)
+		}
+		profile := &HostDBProfile{
+			Storagetier: storagetier,
+			Location:    nil,
+			Enabled:     true,
+		}
+		for _, l := range spec.Locations {
+			if err := profile.configHostDBProfile("addlocation", l); err != nil {
+				return err
+			}
+		}
+		profiles[spec.Name] = profile
+	}
+
+	// all profiles are valid, add them
+	for name, profile := range profiles {
+		hdbp.profiles[name] = profile
+	}
+	return nil
+}
+
 // ConfigHostDBProfiles updates the provided setting of the hostdb profile with the provided
-// name to the provided value.
+// name to the provided value. The default profile cannot be disabled.
 func (hdbp *HostDBProfiles) ConfigHostDBProfiles(name, setting, value string) (err error) {
 	hdbp.mu.Lock()
 	defer hdbp.mu.Unlock()
 
 	// check if profile exists
 	if _, exists := hdbp.profiles[name]; !exists {
-		return errNoSuchHostdbProfile
+		return fmt.Errorf("%w: %q", errNoSuchHostdbProfile, name)
+	}
+	if name == "default" && setting == "enabled" {
+		if enabled, err := strconv.ParseBool(value); err == nil && !enabled {
+			return errDisableDefaultProfile
+		}
 	}
 
 	return hdbp.profiles[name].configHostDBProfile(setting, value)
 }
 
-// getProfile returns the hostdb profile with the given name.
+// DeleteHostDBProfile removes the hostdb profile with the provided name. The
+// default profile cannot be deleted.
+func (hdbp *HostDBProfiles) DeleteHostDBProfile(name string) error {
+	hdbp.mu.Lock()
+	defer hdbp.mu.Unlock()
+
+	if name == "default" {
+		return errDeleteDefaultProfile
+	}
+	if _, exists := hdbp.profiles[name]; !exists {
+		return fmt.Errorf("%w: %q", errNoSuchHostdbProfile, name)
+	}
+	delete(hdbp.profiles, name)
+	return nil
+}
+
+// GetProfile returns a copy of the hostdb profile with the given name. If no
+// such profile exists the zero profile is returned, use Profile to tell the
+// two cases apart.
 func (hdbp *HostDBProfiles) GetProfile(name string) HostDBProfile {
+	profile, _ := hdbp.Profile(name)
+	return profile
+}
+
+// Profile returns a copy of the hostdb profile with the given name or an error
+// if no such profile exists.
+func (hdbp *HostDBProfiles) Profile(name string) (HostDBProfile, error) {
 	hdbp.mu.Lock()
 	defer hdbp.mu.Unlock()
-	return *hdbp.profiles[name]
+	profile, exists := hdbp.profiles[name]
+	if !exists {
+		return HostDBProfile{}, fmt.Errorf("%w: %q", errNoSuchHostdbProfile, name)
+	}
+	return *profile.clone(), nil
 }
 
-// HostDBProfiles returns the array of set hostdb profiles.
+// HostDBProfiles returns a deep copy of the set hostdb profiles, mapped by
+// their names. Modifying the returned profiles does not affect the hostdb
+// profiles.
 func (hdbp *HostDBProfiles) HostDBProfiles() map[string]*HostDBProfile {
 	hdbp.mu.Lock()
 	defer hdbp.mu.Unlock()
-	return hdbp.profiles
+	return cloneProfiles(hdbp.profiles)
 }
 
-// SetHostDBProfiles sets the hostdb profiles to the profiles passed to the function (from persist data)
+// Len returns the number of set hostdb profiles.
+func (hdbp *HostDBProfiles) Len() int {
+	hdbp.mu.Lock()
+	defer hdbp.mu.Unlock()
+	return len(hdbp.profiles)
+}
+
+// Names returns the sorted names of all set hostdb profiles.
+func (hdbp *HostDBProfiles) Names() []string {
+	hdbp.mu.Lock()
+	defer hdbp.mu.Unlock()
+	names := make([]string, 0, len(hdbp.profiles))
+	for name := range hdbp.profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// SetHostDBProfiles sets the hostdb profiles to a deep copy of the profiles
+// passed to the function (from persist data).
 func (hdbp *HostDBProfiles) SetHostDBProfiles(profiles map[string]*HostDBProfile) {
-	hdbp.profiles = profiles
-	return
+	hdbp.mu.Lock()
+	defer hdbp.mu.Unlock()
+	hdbp.profiles = cloneProfiles(profiles)
+}
+
+// SetLastUpdated sets the block height at which the host tree of the hostdb
+// profile with the provided name was last updated.
+func (hdbp *HostDBProfiles) SetLastUpdated(name string, height types.BlockHeight) error {
+	hdbp.mu.Lock()
+	defer hdbp.mu.Unlock()
+	profile, exists := hdbp.profiles[name]
+	if !exists {
+		return fmt.Errorf("%w: %q", errNoSuchHostdbProfile, name)
+	}
+	profile.LastUpdated = height
+	return nil
+}
+
+// SetAllLastUpdated sets the block height at which the host trees of all
+// hostdb profiles were last updated.
+func (hdbp *HostDBProfiles) SetAllLastUpdated(height types.BlockHeight) {
+	hdbp.mu.Lock()
+	defer hdbp.mu.Unlock()
+	for _, profile := range hdbp.profiles {
+		profile.LastUpdated = height
+	}
+}
+
+// Duplicates returns the names of all hostdb profiles that have the same
+// settings as another hostdb profile. Of each group of identical profiles one
+// is kept, preferring the default profile and otherwise the alphabetically
+// first one, and is not part of the returned names.
+func (hdbp *HostDBProfiles) Duplicates() (duplicates []string) {
+	hdbp.mu.Lock()
+	defer hdbp.mu.Unlock()
+
+	// Sort the names so that the result is deterministic, with the default
+	// profile always being kept.
+	var names []string
+	for name := range hdbp.profiles {
+		if name != "default" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	if _, exists := hdbp.profiles["default"]; exists {
+		names = append([]string{"default"}, names...)
+	}
+
+	seen := make(map[string]struct{})
+	for _, name := range names {
+		key := hdbp.profiles[name].settingsKey()
+		if _, exists := seen[key]; exists {
+			duplicates = append(duplicates, name)
+			continue
+		}
+		seen[key] = struct{}{}
+	}
+	return duplicates
+}
+
+// Validate checks all hostdb profiles for validity. It returns an error if the
+// default profile is missing or disabled or if any profile has an invalid
+// storage tier or location.
+func (hdbp *HostDBProfiles) Validate() error {
+	hdbp.mu.Lock()
+	defer hdbp.mu.Unlock()
+	return validateProfiles(hdbp.profiles)
+}
+
+// ReplaceAll replaces all hostdb profiles with a deep copy of the provided
+// profiles, e.g. when importing them. The default profile is added if it is
+// missing. All profiles are validated like by Validate before any of them is
+// replaced, if one of them is invalid the profiles are left untouched.
+func (hdbp *HostDBProfiles) ReplaceAll(profiles map[string]*HostDBProfile) error {
+	replacement := cloneProfiles(profiles)
+	if _, exists := replacement["default"]; !exists {
+		replacement["default"] = &HostDBProfile{
+			Storagetier: "warm",
+			Location:    nil,
+			Enabled:     true,
+		}
+	}
+	if err := validateProfiles(replacement); err != nil {
+		return err
+	}
+
+	hdbp.mu.Lock()
+	defer hdbp.mu.Unlock()
+	hdbp.profiles = replacement
+	return nil
+}
+
+// validateProfiles is a helper function that checks the provided hostdb
+// profiles for validity, see Validate.
+func validateProfiles(profiles map[string]*HostDBProfile) error {
+	if profile, exists := profiles["default"]; !exists {
+		return fmt.Errorf("%w: %q", errNoSuchHostdbProfile, "default")
+	} else if profile != nil && !profile.Enabled {
+		return errDisableDefaultProfile
+	}
+	for name, profile := range profiles {
+		if profile == nil {
+			return fmt.Errorf("hostdb profile %q is empty", name)
+		}
+		if !storagetierValid(profile.Storagetier) {
+			return fmt.Errorf("hostdb profile %q: %w: %q", name, errNoSuchStorageTier, profile.Storagetier)
+		}
+		for _, l := range profile.Location {
+			if !locationValid(l) {
+				return fmt.Errorf("hostdb profile %q: %w: %q", name, errNoSuchLocation, l)
+			}
+		}
+		for _, pk := range profile.Whitelist {
+			if hostIndex(profile.Blacklist, pk) >= 0 {
+				return fmt.Errorf("hostdb profile %q: %w: %q", name, errHostBlacklisted, pk.String())
+			}
+		}
+		if !noteValid(profile.Note) {
+			return fmt.Errorf("hostdb profile %q: %w: %q", name, errInvalidNote, profile.Note)
+		}
+	}
+	return nil
+}
+
+// Repair brings all hostdb profiles into a valid state. Empty profiles are
+// removed, storage tiers and locations are normalized, invalid storage tiers
+// are reset to "warm", invalid or duplicate locations and invalid notes are
+// dropped and the default profile is restored if it is missing or enabled if
+// it is disabled.
+func (hdbp *HostDBProfiles) Repair() {
+	hdbp.mu.Lock()
+	defer hdbp.mu.Unlock()
+
+	for name, profile := range hdbp.profiles {
+		if profile == nil {
+			delete(hdbp.profiles, name)
+			continue
+		}
+		profile.Storagetier = normalizeStoragetier(profile.Storagetier)
+		if !storagetierValid(profile.Storagetier) {
+			profile.Storagetier = "warm"
+		}
+		var locations []string
+		seen := make(map[string]struct{})
+		for _, l := range profile.Location {
+			l = normalizeLocation(l)
+			if _, exists := seen[l]; exists || !locationValid(l) {
+				continue
+			}
+			seen[l] = struct{}{}
+			locations = append(locations, l)
+		}
+		profile.Location = locations
+
+		// Blacklisting takes precedence over pinning.
+		var whitelist []types.SiaPublicKey
+		for _, pk := range profile.Whitelist {
+			if hostIndex(profile.Blacklist, pk) < 0 {
+				whitelist = append(whitelist, pk)
+			}
+		}
+		profile.Whitelist = whitelist
+
+		if !noteValid(profile.Note) {
+			profile.Note = ""
+		}
+	}
+	if profile, exists := hdbp.profiles["default"]; exists {
+		profile.Enabled = true
+	} else {
+		hdbp.profiles["default"] = &HostDBProfile{
+			Storagetier: "warm",
+			Location:    nil,
+			Enabled:     true,
+		}
+	}
+}
+
+// cloneProfiles is a helper function that returns a deep copy of the provided
+// hostdb profiles. Nil profiles are kept so that they can be repaired.
+func cloneProfiles(profiles map[string]*HostDBProfile) map[string]*HostDBProfile {
+	c := make(map[string]*HostDBProfile, len(profiles))
+	for name, profile := range profiles {
+		if profile == nil {
+			c[name] = nil
+			continue
+		}
+		c[name] = profile.clone()
+	}
+	return c
+}
+
+// normalizeStoragetier is a helper function that returns the canonical name of
+// the provided storage tier. The storage tier is lowercased and aliases are
+// resolved, e.g. "Fast" becomes "hot".
+func normalizeStoragetier(storagetier string) string {
+	storagetier = strings.ToLower(strings.TrimSpace(storagetier))
+	if canonical, exists := storagetierAliases[storagetier]; exists {
+		return canonical
+	}
+	return storagetier
+}
+
+// normalizeLocation is a helper function that returns the canonical name of
+// the provided location, e.g. "Germany" becomes "germany", so that locations
+// are accepted regardless of the case a client sends them in.
+func normalizeLocation(location string) string {
+	return strings.ToLower(strings.TrimSpace(location))
 }
 
 // storageTierValid is a helper function that returns true if the provided storage tier is valid,
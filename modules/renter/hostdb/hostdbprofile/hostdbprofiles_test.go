@@ -0,0 +1,614 @@
+package hostdbprofile
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/pachisi456/sia-hostdb-profiles/types"
+)
+
+// TestHostDBProfilesErrorContext checks that the errors returned by the hostdb
+// profile operations name the offending input while still matching the
+// sentinel errors.
+func TestHostDBProfilesErrorContext(t *testing.T) {
+	hdbp := NewHostDBProfiles()
+	if err := hdbp.AddHostDBProfile("archive", "cold"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		err      error
+		sentinel error
+		context  string
+	}{
+		{hdbp.AddHostDBProfile("archive", "cold"), errHostdbProfileExists, `"archive"`},
+		{hdbp.AddHostDBProfile("media", "lukewarm"), errNoSuchStorageTier, `"lukewarm"`},
+		{hdbp.ConfigHostDBProfiles("missing", "storagetier", "hot"), errNoSuchHostdbProfile, `"missing"`},
+		{hdbp.ConfigHostDBProfiles("archive", "storagetier", "cold"), errStoragetierAlreadySet, `"cold"`},
+		{hdbp.ConfigHostDBProfiles("archive", "storagetier", "lukewarm"), errNoSuchStorageTier, `"lukewarm"`},
+		{hdbp.ConfigHostDBProfiles("archive", "addlocation", "atlantis"), errNoSuchLocation, `"atlantis"`},
+		{hdbp.ConfigHostDBProfiles("archive", "removelocation", "germany"), errLocationNotSet, `"germany"`},
+		{hdbp.ConfigHostDBProfiles("archive", "color", "blue"), errNoSuchSetting, `"color"`},
+	}
+	for i, test := range tests {
+		if !errors.Is(test.err, test.sentinel) {
+			t.Errorf("%v: expected error to match %v, got %v", i, test.sentinel, test.err)
+			continue
+		}
+		if !strings.Contains(test.err.Error(), test.context) {
+			t.Errorf("%v: expected error %q to contain %v", i, test.err.Error(), test.context)
+		}
+	}
+
+	// Adding a location twice should name the location.
+	if err := hdbp.ConfigHostDBProfiles("archive", "addlocation", "germany"); err != nil {
+		t.Fatal(err)
+	}
+	err := hdbp.ConfigHostDBProfiles("archive", "addlocation", "germany")
+	if !errors.Is(err, errLocationAlreadySet) || !strings.Contains(err.Error(), `"germany"`) {
+		t.Fatal("unexpected error when adding a location twice:", err)
+	}
+}
+
+// TestHostDBProfilesValidateRepair checks that invalid hostdb profiles, as
+// they might be loaded from a corrupted persist file, are detected and
+// repaired.
+func TestHostDBProfilesValidateRepair(t *testing.T) {
+	hdbp := NewHostDBProfiles()
+	if err := hdbp.Validate(); err != nil {
+		t.Fatal("fresh hostdb profiles should be valid:", err)
+	}
+
+	// Load a set of profiles with a bogus tier, a bogus location and no
+	// default profile.
+	hdbp.SetHostDBProfiles(map[string]*HostDBProfile{
+		"archive": {Storagetier: "lukewarm", Location: []string{"germany", "atlantis"}},
+		"broken":  nil,
+	})
+	if err := hdbp.Validate(); !errors.Is(err, errNoSuchHostdbProfile) {
+		t.Fatal("expected missing default profile to be reported, got", err)
+	}
+	hdbp.Repair()
+	if err := hdbp.Validate(); err != nil {
+		t.Fatal("repaired hostdb profiles should be valid:", err)
+	}
+
+	profiles := hdbp.HostDBProfiles()
+	if _, exists := profiles["broken"]; exists {
+		t.Error("empty profile was not removed")
+	}
+	archive, exists := profiles["archive"]
+	if !exists {
+		t.Fatal("archive profile was removed")
+	}
+	if archive.Storagetier != "warm" {
+		t.Error("invalid storage tier was not reset:", archive.Storagetier)
+	}
+	if len(archive.Location) != 1 || archive.Location[0] != "germany" {
+		t.Error("invalid location was not dropped:", archive.Location)
+	}
+}
+
+// TestHostDBProfilesReplaceAll checks that replacing all hostdb profiles
+// validates the new profiles first, keeps a default profile and doesn't share
+// the profiles with the caller.
+func TestHostDBProfilesReplaceAll(t *testing.T) {
+	hdbp := NewHostDBProfiles()
+	if err := hdbp.AddHostDBProfile("old", "hot"); err != nil {
+		t.Fatal(err)
+	}
+
+	// An invalid profile leaves the profiles untouched.
+	for _, profiles := range []map[string]*HostDBProfile{
+		{"archive": {Storagetier: "lukewarm", Enabled: true}},
+		{"archive": {Storagetier: "cold", Location: []string{"atlantis"}, Enabled: true}},
+		{"default": {Storagetier: "warm"}},
+		{"broken": nil},
+	} {
+		if err := hdbp.ReplaceAll(profiles); err == nil {
+			t.Fatal("expected the invalid profiles to be rejected:", profiles)
+		}
+		if names := hdbp.Names(); !reflect.DeepEqual(names, []string{"default", "old"}) {
+			t.Fatal("expected the profiles to be untouched, got", names)
+		}
+	}
+
+	// A missing default profile is added.
+	profiles := map[string]*HostDBProfile{
+		"archive": {Storagetier: "cold", Location: []string{"germany"}, Enabled: true},
+	}
+	if err := hdbp.ReplaceAll(profiles); err != nil {
+		t.Fatal(err)
+	}
+	if names := hdbp.Names(); !reflect.DeepEqual(names, []string{"archive", "default"}) {
+		t.Fatal("expected the archive and the default profile, got", names)
+	}
+	if def := hdbp.GetProfile("default"); def.Storagetier != "warm" || !def.Enabled {
+		t.Fatal("expected an enabled warm default profile, got", def)
+	}
+	if _, exists := profiles["default"]; exists {
+		t.Fatal("the default profile was added to the caller's profiles")
+	}
+	profiles["archive"].Location[0] = "china"
+	if l := hdbp.GetProfile("archive").Location; l[0] != "germany" {
+		t.Fatal("the profiles are shared with the caller, got location", l[0])
+	}
+
+	// A provided default profile replaces the old one.
+	err := hdbp.ReplaceAll(map[string]*HostDBProfile{
+		"default": {Storagetier: "hot", Enabled: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := hdbp.Names(); !reflect.DeepEqual(names, []string{"default"}) {
+		t.Fatal("expected only the default profile, got", names)
+	}
+	if st := hdbp.GetProfile("default").Storagetier; st != "hot" {
+		t.Fatal("expected the default profile to be replaced, got storage tier", st)
+	}
+}
+
+// TestNewHostDBProfilesWithDefault checks that the default hostdb profile can
+// be configured at construction and that invalid settings are rejected.
+func TestNewHostDBProfilesWithDefault(t *testing.T) {
+	hdbp, err := NewHostDBProfilesWithDefault("cold", []string{"germany", "eu"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	def := hdbp.GetProfile("default")
+	if def.Storagetier != "cold" {
+		t.Error("default profile has wrong storage tier:", def.Storagetier)
+	}
+	if len(def.Location) != 2 || def.Location[0] != "germany" || def.Location[1] != "eu" {
+		t.Error("default profile has wrong locations:", def.Location)
+	}
+
+	if _, err := NewHostDBProfilesWithDefault("lukewarm", nil); !errors.Is(err, errNoSuchStorageTier) {
+		t.Error("expected invalid storage tier to be rejected, got", err)
+	}
+	if _, err := NewHostDBProfilesWithDefault("warm", []string{"atlantis"}); !errors.Is(err, errNoSuchLocation) {
+		t.Error("expected invalid location to be rejected, got", err)
+	}
+	if _, err := NewHostDBProfilesWithDefault("warm", []string{"eu", "eu"}); !errors.Is(err, errLocationAlreadySet) {
+		t.Error("expected duplicate location to be rejected, got", err)
+	}
+}
+
+// TestHostDBProfilesDuplicates checks that profiles with identical settings are
+// reported as duplicates while the first of them is kept.
+func TestHostDBProfilesDuplicates(t *testing.T) {
+	hdbp := NewHostDBProfiles()
+	if dups := hdbp.Duplicates(); len(dups) != 0 {
+		t.Fatal("expected no duplicates, got", dups)
+	}
+
+	// Create two identical profiles with locations added in different orders
+	// and a third one that differs.
+	for _, name := range []string{"media", "backup", "archive"} {
+		if err := hdbp.AddHostDBProfile(name, "cold"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, c := range []struct{ name, location string }{
+		{"media", "germany"}, {"media", "eu"},
+		{"backup", "eu"}, {"backup", "germany"},
+		{"archive", "china"},
+	} {
+		if err := hdbp.ConfigHostDBProfiles(c.name, "addlocation", c.location); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dups := hdbp.Duplicates()
+	if len(dups) != 1 || dups[0] != "media" {
+		t.Fatal("expected media to be reported as duplicate, got", dups)
+	}
+
+	// A profile identical to the default profile should be reported, the
+	// default profile itself never.
+	if err := hdbp.AddHostDBProfile("plain", "warm"); err != nil {
+		t.Fatal(err)
+	}
+	dups = hdbp.Duplicates()
+	if len(dups) != 2 || dups[0] != "media" || dups[1] != "plain" {
+		t.Fatal("expected media and plain to be reported as duplicates, got", dups)
+	}
+}
+
+// TestHostDBProfilesBlacklist checks that hosts can be added to and removed
+// from the blacklist of a hostdb profile.
+func TestHostDBProfilesBlacklist(t *testing.T) {
+	hdbp := NewHostDBProfiles()
+	host := "ed25519:" + strings.Repeat("ab", 32)
+
+	if err := hdbp.ConfigHostDBProfiles("default", "addhost", "notakey"); !errors.Is(err, errInvalidHostKey) {
+		t.Fatal("expected invalid key to be rejected, got", err)
+	}
+	if err := hdbp.ConfigHostDBProfiles("default", "removehost", host); !errors.Is(err, errHostNotBlacklisted) {
+		t.Fatal("expected removing an unknown host to fail, got", err)
+	}
+	if err := hdbp.ConfigHostDBProfiles("default", "addhost", host); err != nil {
+		t.Fatal(err)
+	}
+	bl := hdbp.GetProfile("default").Blacklist
+	if len(bl) != 1 || bl[0].String() != host {
+		t.Fatal("host was not blacklisted:", bl)
+	}
+	if err := hdbp.ConfigHostDBProfiles("default", "addhost", host); !errors.Is(err, errHostAlreadyBlacklisted) {
+		t.Fatal("expected blacklisting a host twice to fail, got", err)
+	}
+	if err := hdbp.ConfigHostDBProfiles("default", "removehost", host); err != nil {
+		t.Fatal(err)
+	}
+	if bl := hdbp.GetProfile("default").Blacklist; len(bl) != 0 {
+		t.Fatal("host was not removed from the blacklist:", bl)
+	}
+}
+
+// TestHostDBProfilesWhitelist checks that hosts can be pinned to and unpinned
+// from a hostdb profile and that a host cannot be both pinned and blacklisted.
+func TestHostDBProfilesWhitelist(t *testing.T) {
+	hdbp := NewHostDBProfiles()
+	host1 := "ed25519:" + strings.Repeat("ab", 32)
+	host2 := "ed25519:" + strings.Repeat("cd", 32)
+
+	if err := hdbp.ConfigHostDBProfiles("default", "pinhost", host1); err != nil {
+		t.Fatal(err)
+	}
+	if err := hdbp.ConfigHostDBProfiles("default", "pinhost", host1); !errors.Is(err, errHostAlreadyPinned) {
+		t.Fatal("expected pinning a host twice to fail, got", err)
+	}
+	if err := hdbp.ConfigHostDBProfiles("default", "addhost", host1); !errors.Is(err, errHostPinned) {
+		t.Fatal("expected blacklisting a pinned host to fail, got", err)
+	}
+	if err := hdbp.ConfigHostDBProfiles("default", "addhost", host2); err != nil {
+		t.Fatal(err)
+	}
+	if err := hdbp.ConfigHostDBProfiles("default", "pinhost", host2); !errors.Is(err, errHostBlacklisted) {
+		t.Fatal("expected pinning a blacklisted host to fail, got", err)
+	}
+	if err := hdbp.ConfigHostDBProfiles("default", "unpinhost", host2); !errors.Is(err, errHostNotPinned) {
+		t.Fatal("expected unpinning an unknown host to fail, got", err)
+	}
+	if err := hdbp.ConfigHostDBProfiles("default", "unpinhost", host1); err != nil {
+		t.Fatal(err)
+	}
+	if wl := hdbp.GetProfile("default").Whitelist; len(wl) != 0 {
+		t.Fatal("host was not unpinned:", wl)
+	}
+
+	// Overlapping lists, e.g. from an edited persist file, are invalid and
+	// repaired by dropping the pinned host.
+	var spk types.SiaPublicKey
+	spk.LoadString(host2)
+	profiles := hdbp.HostDBProfiles()
+	profiles["default"].Whitelist = append(profiles["default"].Whitelist, spk)
+	hdbp.SetHostDBProfiles(profiles)
+	if err := hdbp.Validate(); !errors.Is(err, errHostBlacklisted) {
+		t.Fatal("expected overlapping lists to be invalid, got", err)
+	}
+	hdbp.Repair()
+	if wl := hdbp.GetProfile("default").Whitelist; len(wl) != 0 {
+		t.Fatal("overlapping host was not unpinned:", wl)
+	}
+}
+
+// TestHostDBProfilesStoragetierAliases checks that storage tiers are accepted
+// case-insensitively and by their aliases, and stored by their canonical name.
+func TestHostDBProfilesStoragetierAliases(t *testing.T) {
+	hdbp := NewHostDBProfiles()
+	for _, tier := range []string{"Fast", "fast", "HOT"} {
+		name := "profile-" + tier
+		if err := hdbp.AddHostDBProfile(name, tier); err != nil {
+			t.Fatal(err)
+		}
+		if st := hdbp.GetProfile(name).Storagetier; st != "hot" {
+			t.Errorf("%v: expected storage tier hot, got %v", tier, st)
+		}
+	}
+
+	if err := hdbp.ConfigHostDBProfiles("default", "storagetier", "Cheap"); err != nil {
+		t.Fatal(err)
+	}
+	if st := hdbp.GetProfile("default").Storagetier; st != "cold" {
+		t.Error("expected storage tier cold, got", st)
+	}
+	err := hdbp.ConfigHostDBProfiles("default", "storagetier", "cold")
+	if !errors.Is(err, errStoragetierAlreadySet) {
+		t.Error("expected alias and canonical tier to be treated as equal, got", err)
+	}
+	if err := hdbp.ConfigHostDBProfiles("default", "storagetier", "Balanced"); err != nil {
+		t.Fatal(err)
+	}
+	if st := hdbp.GetProfile("default").Storagetier; st != "warm" {
+		t.Error("expected storage tier warm, got", st)
+	}
+}
+
+// TestHostDBProfilesLocationCase checks that locations and storage tiers are
+// accepted regardless of their case when the package methods are called
+// directly, and that they are stored lowercased.
+func TestHostDBProfilesLocationCase(t *testing.T) {
+	hdbp := NewHostDBProfiles()
+	if err := hdbp.AddHostDBProfile("germany", "Cold"); err != nil {
+		t.Fatal(err)
+	}
+	if err := hdbp.ConfigHostDBProfiles("germany", "addlocation", "Germany"); err != nil {
+		t.Fatal(err)
+	}
+	if err := hdbp.ConfigHostDBProfiles("germany", "addlocation", " EU "); err != nil {
+		t.Fatal(err)
+	}
+	if err := hdbp.ConfigHostDBProfiles("germany", "addlocation", "GERMANY"); !errors.Is(err, errLocationAlreadySet) {
+		t.Fatal("expected locations differing in case to be treated as equal, got", err)
+	}
+	if err := hdbp.ConfigHostDBProfiles("germany", "storagetier", "HOT"); err != nil {
+		t.Fatal(err)
+	}
+	profile := hdbp.GetProfile("germany")
+	if profile.Storagetier != "hot" || !reflect.DeepEqual(profile.Location, []string{"germany", "eu"}) {
+		t.Fatalf("expected lowercased settings, got %v %v", profile.Storagetier, profile.Location)
+	}
+	if err := hdbp.ConfigHostDBProfiles("germany", "removelocation", "Eu"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Batches and persisted profiles are normalized as well.
+	err := hdbp.AddHostDBProfiles([]ProfileSpec{{Name: "us", Storagetier: "Warm", Locations: []string{"United States"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l := hdbp.GetProfile("us").Location; len(l) != 1 || l[0] != "united states" {
+		t.Fatal("expected the batch location to be lowercased, got", l)
+	}
+	hdbp.SetHostDBProfiles(map[string]*HostDBProfile{
+		"default": {Storagetier: "warm", Enabled: true},
+		"edited":  {Storagetier: "Cold", Location: []string{"China", "china"}, Enabled: true},
+	})
+	hdbp.Repair()
+	if err := hdbp.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if edited := hdbp.GetProfile("edited"); edited.Storagetier != "cold" || !reflect.DeepEqual(edited.Location, []string{"china"}) {
+		t.Fatalf("expected the persisted profile to be normalized, got %v %v", edited.Storagetier, edited.Location)
+	}
+}
+
+// TestHostDBProfilesCopy checks that the profiles returned by HostDBProfiles
+// are a deep copy which can be modified while the hostdb profiles are used
+// concurrently without affecting them. Run with -race to detect shared memory.
+func TestHostDBProfilesCopy(t *testing.T) {
+	host := "ed25519:" + strings.Repeat("ab", 32)
+	hdbp := NewHostDBProfiles()
+	if err := hdbp.AddHostDBProfile("archive", "cold"); err != nil {
+		t.Fatal(err)
+	}
+	if err := hdbp.ConfigHostDBProfiles("archive", "addlocation", "germany"); err != nil {
+		t.Fatal(err)
+	}
+	if err := hdbp.ConfigHostDBProfiles("archive", "addhost", host); err != nil {
+		t.Fatal(err)
+	}
+	if n := hdbp.Len(); n != 2 {
+		t.Fatal("expected 2 profiles, got", n)
+	}
+	if names := hdbp.Names(); strings.Join(names, ",") != "archive,default" {
+		t.Fatal("unexpected profile names:", names)
+	}
+
+	// Modify the returned profiles while the profiles are configured.
+	profiles := hdbp.HostDBProfiles()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			hdbp.ConfigHostDBProfiles("archive", "minage", "10")
+			hdbp.GetProfile("archive")
+		}
+	}()
+	archive := profiles["archive"]
+	for i := 0; i < 100; i++ {
+		archive.Storagetier = "hot"
+		archive.Location[0] = "china"
+		archive.Blacklist[0].Key[0]++
+		archive.MinAge++
+	}
+	delete(profiles, "default")
+	<-done
+
+	profile := hdbp.GetProfile("archive")
+	if profile.Storagetier != "cold" || profile.Location[0] != "germany" || profile.MinAge != 10 {
+		t.Fatal("modifying the returned profile changed the hostdb profile:", profile.String())
+	}
+	if profile.Blacklist[0].String() != host {
+		t.Fatal("modifying the returned blacklist changed the hostdb profile:", profile.Blacklist[0].String())
+	}
+	if n := hdbp.Len(); n != 2 {
+		t.Fatal("deleting from the returned map removed a profile, got", n)
+	}
+}
+
+// TestHostDBProfilesUnknown checks that looking up a profile that doesn't
+// exist returns the zero profile, respectively an error, instead of panicking.
+func TestHostDBProfilesUnknown(t *testing.T) {
+	hdbp := NewHostDBProfiles()
+	if profile := hdbp.GetProfile("missing"); profile.Storagetier != "" || profile.Enabled {
+		t.Fatal("expected the zero profile, got", profile.String())
+	}
+	if _, err := hdbp.Profile("missing"); !errors.Is(err, errNoSuchHostdbProfile) {
+		t.Fatal("expected errNoSuchHostdbProfile, got", err)
+	}
+}
+
+// TestHostDBProfilesNote checks that a note can be set, retrieved and removed,
+// that invalid notes are rejected and that the note survives a persist round
+// trip without being part of the profile's settings.
+func TestHostDBProfilesNote(t *testing.T) {
+	hdbp := NewHostDBProfiles()
+	note := "hosts for EU customers, paid in EUR"
+	if err := hdbp.ConfigHostDBProfiles("default", "note", note); err != nil {
+		t.Fatal(err)
+	}
+	if n := hdbp.GetProfile("default").Note; n != note {
+		t.Fatalf("expected note %q, got %q", note, n)
+	}
+
+	// Too long notes and control characters are rejected.
+	for _, invalid := range []string{strings.Repeat("a", maxNoteLen+1), "two\nlines", "\xff"} {
+		if err := hdbp.ConfigHostDBProfiles("default", "note", invalid); !errors.Is(err, errInvalidNote) {
+			t.Errorf("expected note %q to be rejected, got %v", invalid, err)
+		}
+	}
+	if err := hdbp.ConfigHostDBProfiles("default", "note", strings.Repeat("ä", maxNoteLen)); err != nil {
+		t.Fatal("expected a note of maxNoteLen characters to be accepted:", err)
+	}
+
+	// The note is persisted but doesn't make profiles differ.
+	if err := hdbp.ConfigHostDBProfiles("default", "note", note); err != nil {
+		t.Fatal(err)
+	}
+	if err := hdbp.AddHostDBProfile("copy", "warm"); err != nil {
+		t.Fatal(err)
+	}
+	if d := hdbp.Duplicates(); len(d) != 1 || d[0] != "copy" {
+		t.Fatal("expected profiles differing only in their note to be duplicates, got", d)
+	}
+	profile := hdbp.GetProfile("default")
+	if s := profile.String(); strings.Contains(s, "EUR") {
+		t.Fatal("note should not be part of the settings:", s)
+	}
+	b, err := json.Marshal(hdbp.HostDBProfiles())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var loaded map[string]*HostDBProfile
+	if err := json.Unmarshal(b, &loaded); err != nil {
+		t.Fatal(err)
+	}
+	if loaded["default"].Note != note {
+		t.Fatalf("expected note %q after loading, got %q", note, loaded["default"].Note)
+	}
+
+	// An invalid note in a loaded profile is dropped on repair.
+	loaded["copy"].Note = "bad\x00note"
+	hdbp.SetHostDBProfiles(loaded)
+	if err := hdbp.Validate(); !errors.Is(err, errInvalidNote) {
+		t.Fatal("expected an invalid note to be reported, got", err)
+	}
+	hdbp.Repair()
+	if n := hdbp.GetProfile("copy").Note; n != "" {
+		t.Fatal("expected the invalid note to be dropped, got", n)
+	}
+	if n := hdbp.GetProfile("default").Note; n != note {
+		t.Fatal("expected the valid note to be kept, got", n)
+	}
+
+	// An empty value removes the note.
+	if err := hdbp.ConfigHostDBProfiles("default", "note", ""); err != nil {
+		t.Fatal(err)
+	}
+	if n := hdbp.GetProfile("default").Note; n != "" {
+		t.Fatal("expected the note to be removed, got", n)
+	}
+}
+
+// TestHostDBProfilesUnset checks that single-valued settings can be reset to
+// their defaults while list settings cannot be unset.
+func TestHostDBProfilesUnset(t *testing.T) {
+	hdbp := NewHostDBProfiles()
+	if err := hdbp.AddHostDBProfile("custom", "hot"); err != nil {
+		t.Fatal(err)
+	}
+	settings := map[string]string{
+		"enforceipdiversity": "true",
+		"minage":             "100",
+		"minstorage":         "1000",
+		"minbandwidth":       "1000000",
+		"minhostmaxduration": "4320",
+		"minscans":           "3",
+		"maxsettingsage":     "12h",
+		"maxprice":           "1000",
+		"renewwindow":        "1008",
+		"note":               "temporary",
+		"enabled":            "false",
+		"addlocation":        "eu",
+	}
+	for setting, value := range settings {
+		if err := hdbp.ConfigHostDBProfiles("custom", setting, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for setting := range settings {
+		if setting == "addlocation" {
+			continue
+		}
+		if err := hdbp.ConfigHostDBProfiles("custom", "unset", setting); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := hdbp.ConfigHostDBProfiles("custom", "unset", "storagetier"); err != nil {
+		t.Fatal(err)
+	}
+
+	profile := hdbp.GetProfile("custom")
+	if s := profile.String(); s != "tier=warm;locations=eu" {
+		t.Fatal("expected all single-valued settings to be reset, got", s)
+	}
+	if profile.Note != "" {
+		t.Fatal("expected the note to be removed, got", profile.Note)
+	}
+	if !profile.Enabled {
+		t.Fatal("expected the profile to be enabled again")
+	}
+	for _, setting := range []string{"addlocation", "location", "blacklist", "bogus"} {
+		if err := hdbp.ConfigHostDBProfiles("custom", "unset", setting); !errors.Is(err, errNotUnsettable) {
+			t.Errorf("expected %q not to be unsettable, got %v", setting, err)
+		}
+	}
+}
+
+// TestHostDBProfilesDisable checks that profiles can be disabled and enabled
+// again while the default profile always stays enabled.
+func TestHostDBProfilesDisable(t *testing.T) {
+	hdbp := NewHostDBProfiles()
+	if err := hdbp.AddHostDBProfile("archive", "cold"); err != nil {
+		t.Fatal(err)
+	}
+	if !hdbp.GetProfile("archive").Enabled {
+		t.Fatal("new profiles should be enabled")
+	}
+	if err := hdbp.ConfigHostDBProfiles("archive", "enabled", "false"); err != nil {
+		t.Fatal(err)
+	}
+	if profile := hdbp.GetProfile("archive"); profile.Enabled || profile.Storagetier != "cold" {
+		t.Fatalf("expected the profile to be disabled with its settings kept: %+v", profile)
+	}
+	if err := hdbp.ConfigHostDBProfiles("archive", "enabled", "maybe"); !errors.Is(err, errInvalidBool) {
+		t.Fatal("expected invalid value to be rejected, got", err)
+	}
+	if err := hdbp.ConfigHostDBProfiles("archive", "enabled", "true"); err != nil {
+		t.Fatal(err)
+	}
+	if !hdbp.GetProfile("archive").Enabled {
+		t.Fatal("expected the profile to be enabled again")
+	}
+
+	// The default profile cannot be disabled, a disabled default profile
+	// loaded from disk is invalid and enabled by Repair.
+	if err := hdbp.ConfigHostDBProfiles("default", "enabled", "false"); !errors.Is(err, errDisableDefaultProfile) {
+		t.Fatal("expected disabling the default profile to fail, got", err)
+	}
+	hdbp.SetHostDBProfiles(map[string]*HostDBProfile{
+		"default": {Storagetier: "warm"},
+	})
+	if err := hdbp.Validate(); !errors.Is(err, errDisableDefaultProfile) {
+		t.Fatal("expected disabled default profile to be reported, got", err)
+	}
+	hdbp.Repair()
+	if err := hdbp.Validate(); err != nil {
+		t.Fatal("repaired hostdb profiles should be valid:", err)
+	}
+}
@@ -1,7 +1,12 @@
 package hostdb
 
 import (
+	"fmt"
 	"math"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/pachisi456/sia-hostdb-profiles/modules"
 	"github.com/pachisi456/sia-hostdb-profiles/types"
@@ -112,3 +117,53 @@ func (hdb *HostDB) IncrementFailedInteractions(key types.SiaPublicKey) {
 	host.RecentFailedInteractions++
 	hdb.hostTrees.Modify(host)
 }
+
+// SetHostTags sets the tags annotating the host with the provided public key,
+// e.g. "flaky" or "known-good", replacing its previous tags. The tags are
+// trimmed, deduplicated and sorted, an empty list removes all tags. Tags are
+// persisted with the host but don't affect the host selection.
+func (hdb *HostDB) SetHostTags(spk types.SiaPublicKey, tags []string) error {
+	tags, err := normalizeHostTags(tags)
+	if err != nil {
+		return err
+	}
+
+	hdb.mu.Lock()
+	host, exists := hdb.hostTrees.Select(spk)
+	if !exists {
+		hdb.mu.Unlock()
+		return errUnknownHost
+	}
+	host.Tags = tags
+	err = hdb.hostTrees.Modify(host)
+	hdb.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return hdb.managedSaveSyncRetry()
+}
+
+// normalizeHostTags is a helper function that trims the provided host tags,
+// drops duplicates and sorts them. It returns an error if a tag is empty, too
+// long or contains commas or control characters, or if there are too many tags.
+func normalizeHostTags(tags []string) ([]string, error) {
+	seen := make(map[string]struct{}, len(tags))
+	var normalized []string
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" || !utf8.ValidString(tag) || utf8.RuneCountInString(tag) > maxHostTagLen ||
+			strings.ContainsRune(tag, ',') || strings.IndexFunc(tag, unicode.IsControl) >= 0 {
+			return nil, fmt.Errorf("%w: %q", errInvalidHostTag, tag)
+		}
+		if _, exists := seen[tag]; exists {
+			continue
+		}
+		seen[tag] = struct{}{}
+		normalized = append(normalized, tag)
+	}
+	if len(normalized) > maxHostTags {
+		return nil, errTooManyHostTags
+	}
+	sort.Strings(normalized)
+	return normalized, nil
+}
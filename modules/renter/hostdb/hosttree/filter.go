@@ -0,0 +1,41 @@
+package hosttree
+
+import (
+	"github.com/pachisi456/sia-hostdb-profiles/modules"
+)
+
+type (
+	// HostFilter is a predicate that decides whether a host may be selected.
+	// Filters are passed to SelectRandom, so new selection criteria can be
+	// added without changing the host tree.
+	// Name returns a short name of the filter, e.g. "location", which is
+	// used to report why a host was filtered.
+	HostFilter interface {
+		Matches(modules.HostDBEntry) bool
+		Name() string
+	}
+
+	// HostFilterFunc is an adapter to allow the use of ordinary functions as
+	// a HostFilter.
+	HostFilterFunc func(modules.HostDBEntry) bool
+)
+
+// Matches returns the result of calling f(entry).
+func (f HostFilterFunc) Matches(entry modules.HostDBEntry) bool {
+	return f(entry)
+}
+
+// Name returns "func", an ordinary function carries no name.
+func (f HostFilterFunc) Name() string {
+	return "func"
+}
+
+// matchesAll returns true if the entry matches all of the provided filters.
+func matchesAll(entry modules.HostDBEntry, filters []HostFilter) bool {
+	for _, filter := range filters {
+		if !filter.Matches(entry) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,131 @@
+package hosttree
+
+import (
+	"testing"
+
+	"github.com/pachisi456/sia-hostdb-profiles/modules"
+	"github.com/pachisi456/sia-hostdb-profiles/types"
+)
+
+// TestSelectRandomFilters checks that SelectRandom only returns hosts that
+// match all of the provided filters.
+func TestSelectRandomFilters(t *testing.T) {
+	hts := newTestHostTrees("default")
+	for i := 0; i < 40; i++ {
+		entry := makeHostDBEntry()
+		entry.Country = []string{"Germany", "France"}[i%2]
+		entry.RemainingStorage = uint64(i)
+		if err := hts.Insert(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	german := HostFilterFunc(func(entry modules.HostDBEntry) bool {
+		return entry.Country == "Germany"
+	})
+	large := HostFilterFunc(func(entry modules.HostDBEntry) bool {
+		return entry.RemainingStorage >= 20
+	})
+
+	tests := []struct {
+		filters []HostFilter
+		hosts   int
+	}{
+		{nil, 40},
+		{[]HostFilter{german}, 20},
+		{[]HostFilter{large}, 20},
+		{[]HostFilter{german, large}, 10},
+		{[]HostFilter{large, german}, 10},
+	}
+	for _, test := range tests {
+		hosts := hts.SelectRandom("default", 40, nil, test.filters...)
+		if len(hosts) != test.hosts {
+			t.Errorf("expected %v hosts with %v filters, got %v", test.hosts, len(test.filters), len(hosts))
+		}
+		for _, host := range hosts {
+			for _, filter := range test.filters {
+				if !filter.Matches(host) {
+					t.Error("selected host does not match the filters:", host.Country, host.RemainingStorage)
+				}
+			}
+		}
+	}
+
+	// Filtered hosts are not removed from the tree.
+	if hosts := hts.SelectRandom("default", 40, nil); len(hosts) != 40 {
+		t.Fatal("expected all hosts to remain selectable, got", len(hosts))
+	}
+}
+
+// TestModifyFilteredTree checks that modifying a host re-evaluates the filters
+// of each tree, dropping a host that moved out of a location-restricted tree
+// and adding it again once it moves back.
+func TestModifyFilteredTree(t *testing.T) {
+	hts := newTestHostTrees("default")
+	german := HostFilterFunc(func(entry modules.HostDBEntry) bool {
+		return entry.Country == "Germany"
+	})
+	tree := NewHostTree(func(modules.HostDBEntry, string) types.Currency {
+		return types.NewCurrency64(20)
+	}, "germany", german)
+	if err := hts.AddHostTree("germany", tree); err != nil {
+		t.Fatal(err)
+	}
+	inTree := func(name string, entry modules.HostDBEntry) bool {
+		_, exists := hts.trees[name].Select(entry.PublicKey)
+		return exists
+	}
+
+	entry := makeHostDBEntry()
+	entry.Country = "Germany"
+	if err := hts.Insert(entry); err != nil {
+		t.Fatal(err)
+	}
+	if !inTree("default", entry) || !inTree("germany", entry) {
+		t.Fatal("expected German host in both trees")
+	}
+
+	// Moving the host to France drops it from the German tree only.
+	entry.Country = "France"
+	if err := hts.Modify(entry); err != nil {
+		t.Fatal(err)
+	}
+	if !inTree("default", entry) || inTree("germany", entry) {
+		t.Fatal("expected French host only in the default tree")
+	}
+	if hosts := hts.SelectRandom("germany", 1, nil); len(hosts) != 0 {
+		t.Fatal("French host selected from the German tree")
+	}
+	if weight := hts.trees["germany"].root.weight; !weight.IsZero() {
+		t.Fatal("expected empty German tree to have no weight, got", weight)
+	}
+
+	// Moving it back inserts it again.
+	entry.Country = "Germany"
+	if err := hts.Modify(entry); err != nil {
+		t.Fatal(err)
+	}
+	if !inTree("germany", entry) {
+		t.Fatal("expected host to be back in the German tree")
+	}
+
+	// Unknown hosts are not inserted into filtered trees by Modify, and a host
+	// that was filtered out of a tree can still be removed.
+	unknown := makeHostDBEntry()
+	unknown.Country = "Germany"
+	if err := hts.Modify(unknown); err != errNoSuchHost {
+		t.Fatal("expected errNoSuchHost, got", err)
+	}
+	if inTree("germany", unknown) {
+		t.Fatal("unknown host was inserted by Modify")
+	}
+	entry.Country = "France"
+	if err := hts.Modify(entry); err != nil {
+		t.Fatal(err)
+	}
+	if err := hts.Remove(entry.PublicKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := hts.Remove(entry.PublicKey); err != errNoSuchHost {
+		t.Fatal("expected errNoSuchHost, got", err)
+	}
+}
@@ -1,6 +1,7 @@
 package hosttree
 
 import (
+	"bytes"
 	"errors"
 	"sort"
 	"sync"
@@ -12,6 +13,10 @@ import (
 )
 
 var (
+	// ErrInsufficientHosts is returned from a SelectRandomAtLeast() call if the
+	// tree does not contain enough selectable hosts.
+	ErrInsufficientHosts = errors.New("not enough hosts available in the tree")
+
 	// errHostExists is returned if an Insert is called with a public key that
 	// already exists in the tree.
 	errHostExists = errors.New("host already exists in the tree")
@@ -29,6 +34,10 @@ var (
 	// should always have a non-nil entry, unless they have been Delete()ed.
 	errNilEntry = errors.New("node has a nil entry")
 
+	// errNoSuchTree is returned if RemoveHostTree is called with a name for
+	// which no tree exists.
+	errNoSuchTree = errors.New("no tree with specified name")
+
 	// errNoSuchHost is returned if Remove is called with a public key that does
 	// not exist in the tree.
 	errNoSuchHost = errors.New("no host with specified public key")
@@ -40,7 +49,7 @@ var (
 
 type (
 	// WeightFunc is a function used to weight a given HostDBEntry in the tree.
-	WeightFunc func(modules.HostDBEntry, string) (types.Currency, bool)
+	WeightFunc func(modules.HostDBEntry, string) types.Currency
 
 	// HostTree is used to store and select host database entries. Each HostTree
 	// is initialized with a weighting func that is able to assign a weight to
@@ -59,9 +68,9 @@ type (
 		// weightFn calculates the weight of a hostEntry
 		weightFn WeightFunc
 
-		// blacklist cointains public keys of all hosts that are in other
-		// locations than specified in the hostdb profile.
-		blacklist []types.SiaPublicKey
+		// filters decide which hosts belong to the tree. Hosts that don't
+		// match all of them are kept out of the tree.
+		filters []HostFilter
 
 		mu sync.Mutex
 	}
@@ -101,13 +110,15 @@ func createNode(parent *node, entry *hostEntry) *node {
 // NewHostTree creates a new, empty, HostTree. It takes as arguments a `WeightFunc`,
 // which is used to determine the weight of a node on Insert and the name for the tree
 // which should equal the name of the hostdb profile this tree is created for.
-func NewHostTree(wf WeightFunc, name string) *HostTree {
+// Only hosts matching all of the provided filters are kept in the tree.
+func NewHostTree(wf WeightFunc, name string, filters ...HostFilter) *HostTree {
 	return &HostTree{
 		name: name,
 		root: &node{
 			count: 1,
 		},
 		weightFn: wf,
+		filters:  filters,
 		hosts:    make(map[string]*node),
 	}
 }
@@ -199,13 +210,20 @@ func (n *node) remove() {
 	}
 }
 
-// All returns all of the hosts in the host tree, sorted by weight.
+// All returns all of the hosts in the host tree, sorted by ascending weight.
+// Hosts of equal weight are sorted by their public key, so that the order
+// doesn't change between calls.
 func (ht *HostTree) All() []modules.HostDBEntry {
 	var he []hostEntry
 	for _, node := range ht.hosts {
 		he = append(he, *node.entry)
 	}
-	sort.Sort(byWeight(he))
+	sort.SliceStable(he, func(i, j int) bool {
+		if cmp := he[i].weight.Cmp(he[j].weight); cmp != 0 {
+			return cmp < 0
+		}
+		return bytes.Compare(he[i].PublicKey.Key, he[j].PublicKey.Key) < 0
+	})
 
 	var entries []modules.HostDBEntry
 	for _, entry := range he {
@@ -215,12 +233,15 @@ func (ht *HostTree) All() []modules.HostDBEntry {
 }
 
 // Insert inserts the entry provided to `entry` into the host tree. Insert will
-// return an error if the input host already exists.
+// return an error if the input host already exists. Hosts that don't match the
+// filters of the tree are silently left out.
 func (ht *HostTree) Insert(hdbe modules.HostDBEntry) error {
-	score, blacklist := ht.weightFn(hdbe, ht.name)
+	if !matchesAll(hdbe, ht.filters) {
+		return nil
+	}
 	entry := &hostEntry{
 		HostDBEntry: hdbe,
-		weight:      score,
+		weight:      ht.weightFn(hdbe, ht.name),
 	}
 
 	if _, exists := ht.hosts[string(entry.PublicKey.Key)]; exists {
@@ -229,10 +250,6 @@ func (ht *HostTree) Insert(hdbe modules.HostDBEntry) error {
 
 	_, node := ht.root.recursiveInsert(entry)
 
-	if blacklist {
-		ht.insertIntoBlacklist(entry.PublicKey)
-	}
-
 	ht.hosts[string(entry.PublicKey.Key)] = node
 	return nil
 }
@@ -245,67 +262,38 @@ func (ht *HostTree) Remove(pk types.SiaPublicKey) error {
 	}
 	node.remove()
 	delete(ht.hosts, string(pk.Key))
-	ht.removeFromBlacklist(pk)
 
 	return nil
 }
 
-// insertIntoBlacklist checks whether the host with the provided public key is
-// in the blacklist and inserts it if it is not the case.
-func (ht *HostTree) insertIntoBlacklist(spk types.SiaPublicKey) {
-	// Check if host is already in blacklist.
-	for _, v := range ht.blacklist {
-		if string(v.Key) == string(spk.Key) {
-			// Host is already in blacklist.
-			return
-		}
-	}
-	// Insert the host into the blacklist.
-	ht.blacklist = append(ht.blacklist, spk)
-}
-
-// removeFromBlacklist checks whether the host with the provided public key is
-// in the blacklist and removes it if it is the case.
-func (ht *HostTree) removeFromBlacklist(spk types.SiaPublicKey) {
-	// Find host in blacklist (if existent).
-	index := -1
-	for i, v := range ht.blacklist {
-		if string(v.Key) == string(spk.Key) {
-			index = i
-			break
-		}
-	}
-	// Remove the host from blacklist (if existent).
-	if index >= 0 {
-		ht.blacklist = append(ht.blacklist[:index], ht.blacklist[index+1:]...)
-	}
-}
-
 // Modify updates a host entry at the given public key, replacing the old entry
-// with the entry provided by `newEntry`.
+// with the entry provided by `newEntry`. The filters of the tree are evaluated
+// again, a host that no longer matches them is removed from the tree and a
+// host that matches them now is inserted.
 func (ht *HostTree) Modify(hdbe modules.HostDBEntry) error {
 	node, exists := ht.hosts[string(hdbe.PublicKey.Key)]
-	if !exists {
+	matches := matchesAll(hdbe, ht.filters)
+	if !exists && len(ht.filters) == 0 {
 		return errNoSuchHost
+	} else if !exists && !matches {
+		return nil
+	} else if !exists {
+		return ht.Insert(hdbe)
 	}
 
-	score, blacklist := ht.weightFn(hdbe, ht.name)
-
 	node.remove()
+	if !matches {
+		delete(ht.hosts, string(hdbe.PublicKey.Key))
+		return nil
+	}
 
 	entry := &hostEntry{
 		HostDBEntry: hdbe,
-		weight:      score,
+		weight:      ht.weightFn(hdbe, ht.name),
 	}
 
 	_, node = ht.root.recursiveInsert(entry)
 
-	if blacklist {
-		ht.insertIntoBlacklist(entry.PublicKey)
-	} else {
-		ht.removeFromBlacklist(entry.PublicKey)
-	}
-
 	ht.hosts[string(entry.PublicKey.Key)] = node
 	return nil
 }
@@ -322,14 +310,12 @@ func (ht *HostTree) Select(spk types.SiaPublicKey) (modules.HostDBEntry, bool) {
 // SelectRandom grabs a random n hosts from the tree. There will be no repeats, but
 // the length of the slice returned may be less than n, and may even be zero.
 // The hosts that are returned first have the higher priority. Hosts passed to
-// 'ignore' will not be considered; pass `nil` if no blacklist is desired.
-func (ht *HostTree) SelectRandom(n int, ignore []types.SiaPublicKey) []modules.HostDBEntry {
+// 'ignore' will not be considered; pass `nil` if no blacklist is desired. Only
+// hosts that match all of the provided filters are returned.
+func (ht *HostTree) SelectRandom(n int, ignore []types.SiaPublicKey, filters ...HostFilter) []modules.HostDBEntry {
 	var hosts []modules.HostDBEntry
 	var removedEntries []*hostEntry
 
-	// Merge ignore with the host tree's blacklist.
-	ignore = append(ignore, ht.blacklist...)
-
 	for _, pubkey := range ignore {
 		node, exists := ht.hosts[string(pubkey.Key)]
 		if !exists {
@@ -340,15 +326,15 @@ func (ht *HostTree) SelectRandom(n int, ignore []types.SiaPublicKey) []modules.H
 		removedEntries = append(removedEntries, node.entry)
 	}
 
-	for len(hosts) < n && len(ht.hosts) > 0 {
+	// Hosts with a zero weight are never selected, stop once only they are
+	// left.
+	for len(hosts) < n && len(ht.hosts) > 0 && !ht.root.weight.IsZero() {
 		randWeight := fastrand.BigIntn(ht.root.weight.Big())
 		node := ht.root.nodeAtWeight(types.NewCurrency(randWeight))
 
-		if node.entry.AcceptingContracts &&
-			len(node.entry.ScanHistory) > 0 &&
-			node.entry.ScanHistory[len(node.entry.ScanHistory)-1].Success {
-			// The host must be online and accepting contracts to be returned
-			// by the random function.
+		if node.entry.AcceptingContracts && node.entry.LastScanSuccessful() && matchesAll(node.entry.HostDBEntry, filters) {
+			// The host must be online, accepting contracts and match the
+			// filters to be returned by the random function.
 			hosts = append(hosts, node.entry.HostDBEntry)
 		}
 
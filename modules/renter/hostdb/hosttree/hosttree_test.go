@@ -89,9 +89,9 @@ func makeHostDBEntry() modules.HostDBEntry {
 }
 
 func TestHostTree(t *testing.T) {
-	tree := NewHostTree(func(hdbe modules.HostDBEntry) types.Currency {
+	tree := NewHostTree(func(modules.HostDBEntry, string) types.Currency {
 		return types.NewCurrency64(20)
-	})
+	}, "default")
 
 	// Create a bunch of host entries of equal weight.
 	firstInsertions := 64
@@ -139,15 +139,20 @@ func TestHostTree(t *testing.T) {
 }
 
 // Verify that inserting, fetching, deleting, and modifying in parallel from
-// the hosttree does not cause inconsistency.
+// the hosttree does not cause inconsistency. The tree itself isn't safe for
+// concurrent use, so it is accessed through the HostTrees holding it.
 func TestHostTreeParallel(t *testing.T) {
 	if testing.Short() {
 		t.SkipNow()
 	}
 
-	tree := NewHostTree(func(dbe modules.HostDBEntry) types.Currency {
+	tree := NewHostTree(func(modules.HostDBEntry, string) types.Currency {
 		return types.NewCurrency64(10)
-	})
+	}, "default")
+	hts := NewHostTrees()
+	if err := hts.AddHostTree("default", tree); err != nil {
+		t.Fatal(err)
+	}
 
 	// spin up 100 goroutines all randomly inserting, removing, modifying, and
 	// fetching nodes from the tree.
@@ -178,7 +183,7 @@ func TestHostTreeParallel(t *testing.T) {
 					// INSERT
 					case 0:
 						entry := makeHostDBEntry()
-						err := tree.Insert(entry)
+						err := hts.Insert(entry)
 						if err != nil {
 							t.Error(err)
 						}
@@ -194,7 +199,7 @@ func TestHostTreeParallel(t *testing.T) {
 						if entry == nil {
 							continue
 						}
-						err := tree.Remove(entry.PublicKey)
+						err := hts.Remove(entry.PublicKey)
 						if err != nil {
 							t.Error(err)
 						}
@@ -214,7 +219,7 @@ func TestHostTreeParallel(t *testing.T) {
 						newentry.PublicKey = entry.PublicKey
 						newentry.NetAddress = "127.0.0.1:31337"
 
-						err := tree.Modify(newentry)
+						err := hts.Modify(newentry)
 						if err != nil {
 							t.Error(err)
 						}
@@ -222,7 +227,7 @@ func TestHostTreeParallel(t *testing.T) {
 
 					// FETCH
 					case 3:
-						tree.SelectRandom(3, nil)
+						hts.SelectRandom("default", 3, nil)
 					}
 				}
 			}
@@ -242,10 +247,42 @@ func TestHostTreeParallel(t *testing.T) {
 	}
 }
 
+// TestHostTreeAllOrder checks that All sorts the hosts by ascending weight and
+// that hosts of equal weight are always returned in the same order.
+func TestHostTreeAllOrder(t *testing.T) {
+	weights := make(map[string]types.Currency)
+	tree := NewHostTree(func(entry modules.HostDBEntry, _ string) types.Currency {
+		return weights[string(entry.PublicKey.Key)]
+	}, "default")
+	for i := 0; i < 20; i++ {
+		entry := makeHostDBEntry()
+		weights[string(entry.PublicKey.Key)] = types.NewCurrency64(uint64(i%3 + 1))
+		if err := tree.Insert(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	all := tree.All()
+	for i := 1; i < len(all); i++ {
+		prev, cur := weights[string(all[i-1].PublicKey.Key)], weights[string(all[i].PublicKey.Key)]
+		if prev.Cmp(cur) > 0 {
+			t.Fatal("hosts are not sorted by ascending weight")
+		}
+	}
+	for i := 0; i < 10; i++ {
+		again := tree.All()
+		for j := range all {
+			if all[j].PublicKey.String() != again[j].PublicKey.String() {
+				t.Fatal("order of hosts changed between calls")
+			}
+		}
+	}
+}
+
 func TestHostTreeModify(t *testing.T) {
-	tree := NewHostTree(func(dbe modules.HostDBEntry) types.Currency {
+	tree := NewHostTree(func(modules.HostDBEntry, string) types.Currency {
 		return types.NewCurrency64(10)
-	})
+	}, "default")
 
 	treeSize := 100
 	var keys []types.SiaPublicKey
@@ -293,9 +330,9 @@ func TestVariedWeights(t *testing.T) {
 	// will be tallied up as hosts are created.
 	i := 0
 
-	tree := NewHostTree(func(dbe modules.HostDBEntry) types.Currency {
+	tree := NewHostTree(func(modules.HostDBEntry, string) types.Currency {
 		return types.NewCurrency64(uint64(i))
-	})
+	}, "default")
 
 	hostCount := 5
 	expectedPerWeight := int(10e3)
@@ -345,9 +382,9 @@ func TestRepeatInsert(t *testing.T) {
 		t.SkipNow()
 	}
 
-	tree := NewHostTree(func(dbe modules.HostDBEntry) types.Currency {
+	tree := NewHostTree(func(modules.HostDBEntry, string) types.Currency {
 		return types.NewCurrency64(10)
-	})
+	}, "default")
 
 	entry1 := makeHostDBEntry()
 	entry2 := entry1
@@ -363,9 +400,9 @@ func TestRepeatInsert(t *testing.T) {
 func TestNodeAtWeight(t *testing.T) {
 	weight := types.NewCurrency64(10)
 	// create hostTree
-	tree := NewHostTree(func(dbe modules.HostDBEntry) types.Currency {
+	tree := NewHostTree(func(modules.HostDBEntry, string) types.Currency {
 		return weight
-	})
+	}, "default")
 
 	entry := makeHostDBEntry()
 	err := tree.Insert(entry)
@@ -383,10 +420,10 @@ func TestNodeAtWeight(t *testing.T) {
 func TestRandomHosts(t *testing.T) {
 	calls := 0
 	// Create the tree.
-	tree := NewHostTree(func(dbe modules.HostDBEntry) types.Currency {
+	tree := NewHostTree(func(modules.HostDBEntry, string) types.Currency {
 		calls++
 		return types.NewCurrency64(uint64(calls))
-	})
+	}, "default")
 
 	// Empty.
 	hosts := tree.SelectRandom(1, nil)
@@ -1,42 +1,116 @@
 package hosttree
 
 import (
+	"fmt"
+	"sort"
 	"sync"
+
 	"github.com/pachisi456/sia-hostdb-profiles/modules"
 	"github.com/pachisi456/sia-hostdb-profiles/types"
+
+	"github.com/NebulousLabs/errors"
 )
 
 // HostTrees holds the map of all host trees (one tree for each hostdb profile)
 // mapped by the respective hostdb profile name.
 type HostTrees struct {
 	trees map[string]*HostTree
-	mu    sync.Mutex
+
+	// membership is incremented whenever the set of hosts held by any of the
+	// trees changes, i.e. a tree is added, replaced or removed, a host is
+	// inserted or removed, or a modification moves a host into or out of a
+	// filtered tree. It allows callers to cache data derived from the trees
+	// and detect when it has become stale. Weight updates don't affect it.
+	membership uint64
+
+	mu sync.Mutex
 }
 
 // NewHostTrees creates a new, empty HostTrees object.
 func NewHostTrees() HostTrees {
-	ht := HostTrees{
+	return HostTrees{
 		trees: make(map[string]*HostTree),
 	}
-	return ht
 }
 
 // AddHostTree adds a host tree to the map of trees at the given name.
-func (ht *HostTrees) AddHostTree(name string, tree HostTree) error {
+func (ht *HostTrees) AddHostTree(name string, tree *HostTree) error {
 	ht.mu.Lock()
 	defer ht.mu.Unlock()
 	if _, exists := ht.trees[name]; exists {
 		return errTreeExists
 	}
-	ht.trees[name] = &tree
+	ht.trees[name] = tree
+	ht.membership++
 	return nil
 }
 
-// All returns all of the hosts in the host tree with the provided name, sorted by weight.
+// AddOrReplaceHostTree adds a host tree to the map of trees at the given name,
+// replacing the tree that already exists at that name, if any.
+func (ht *HostTrees) AddOrReplaceHostTree(name string, tree *HostTree) {
+	ht.mu.Lock()
+	defer ht.mu.Unlock()
+	ht.trees[name] = tree
+	ht.membership++
+}
+
+// RemoveHostTree removes the host tree with the provided name.
+func (ht *HostTrees) RemoveHostTree(name string) error {
+	ht.mu.Lock()
+	defer ht.mu.Unlock()
+	if _, exists := ht.trees[name]; !exists {
+		return errNoSuchTree
+	}
+	delete(ht.trees, name)
+	ht.membership++
+	return nil
+}
+
+// Names returns the sorted names of all host trees.
+func (ht *HostTrees) Names() []string {
+	ht.mu.Lock()
+	defer ht.mu.Unlock()
+	names := make([]string, 0, len(ht.trees))
+	for name := range ht.trees {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// All returns all of the hosts in the host tree with the provided name, sorted
+// by ascending weight. If there is no tree with that name, nil is returned.
 func (ht *HostTrees) All(tree string) []modules.HostDBEntry {
 	ht.mu.Lock()
 	defer ht.mu.Unlock()
-	return ht.trees[tree].All()
+	t, exists := ht.trees[tree]
+	if !exists {
+		return nil
+	}
+	return t.All()
+}
+
+// Sizes returns the number of hosts in each host tree, mapped by the name of
+// the tree.
+func (ht *HostTrees) Sizes() map[string]int {
+	ht.mu.Lock()
+	defer ht.mu.Unlock()
+	sizes := make(map[string]int)
+	for name, tree := range ht.trees {
+		tree.mu.Lock()
+		sizes[name] = len(tree.hosts)
+		tree.mu.Unlock()
+	}
+	return sizes
+}
+
+// Membership returns the current membership version of the host trees. It
+// changes whenever hosts are added to or removed from any of the trees, but
+// not when only the weight or settings of a host are updated.
+func (ht *HostTrees) Membership() uint64 {
+	ht.mu.Lock()
+	defer ht.mu.Unlock()
+	return ht.membership
 }
 
 // Insert inserts the entry provided to `entry` into all existing host trees. Insert will
@@ -45,6 +119,7 @@ func (ht *HostTrees) All(tree string) []modules.HostDBEntry {
 func (ht *HostTrees) Insert(hdbe modules.HostDBEntry) error {
 	ht.mu.Lock()
 	defer ht.mu.Unlock()
+	ht.membership++
 	for _, tree := range ht.trees {
 		err := tree.Insert(hdbe)
 		if err != nil {
@@ -54,13 +129,44 @@ func (ht *HostTrees) Insert(hdbe modules.HostDBEntry) error {
 	return nil
 }
 
+// InsertBatch inserts all provided entries into all existing host trees. Unlike
+// calling Insert for each entry, the lock is only acquired once. An entry that
+// fails to be inserted into a tree does not prevent the remaining entries
+// from being inserted, all errors are collected and returned together.
+func (ht *HostTrees) InsertBatch(entries []modules.HostDBEntry) error {
+	ht.mu.Lock()
+	defer ht.mu.Unlock()
+	ht.membership++
+	var errs []error
+	for _, hdbe := range entries {
+		for name, tree := range ht.trees {
+			if err := tree.Insert(hdbe); err != nil {
+				errs = append(errs, errors.AddContext(err, "unable to insert "+hdbe.PublicKey.String()+" into tree "+name))
+			}
+		}
+	}
+	return errors.Compose(errs...)
+}
+
 // Modify updates a host entry at the given public key, replacing the old entry
-// in each of the host trees.
+// in each of the host trees. Trees with filters are reconciled with the new
+// entry, the host is inserted into or removed from them as needed.
 func (ht *HostTrees) Modify(hdbe modules.HostDBEntry) error {
 	ht.mu.Lock()
 	defer ht.mu.Unlock()
+	// The default tree holds all known hosts. Check it first so that an
+	// unknown host isn't inserted into any of the filtered trees.
+	if tree, exists := ht.trees["default"]; exists {
+		if _, known := tree.Select(hdbe.PublicKey); !known {
+			return errNoSuchHost
+		}
+	}
 	for _, tree := range ht.trees {
+		size := len(tree.hosts)
 		err := tree.Modify(hdbe)
+		if len(tree.hosts) != size {
+			ht.membership++
+		}
 		if err != nil {
 			return err
 		}
@@ -69,32 +175,74 @@ func (ht *HostTrees) Modify(hdbe modules.HostDBEntry) error {
 }
 
 // Remove removes the host with the public key provided by `pk` from all trees.
+// Trees that filtered the host out are skipped, errNoSuchHost is only returned
+// if none of the trees contained the host.
 func (ht *HostTrees) Remove(pk types.SiaPublicKey) error {
 	ht.mu.Lock()
 	defer ht.mu.Unlock()
+	ht.membership++
+	removed := false
 	for _, tree := range ht.trees {
 		err := tree.Remove(pk)
-		if err != nil {
+		if err == errNoSuchHost {
+			continue
+		} else if err != nil {
 			return err
 		}
+		removed = true
+	}
+	if !removed {
+		return errNoSuchHost
 	}
 	return nil
 }
 
 // Select returns the host with the provided public key, should the host exist.
+// The default tree holds all known hosts and is used if it exists. While it is
+// missing, e.g. in the middle of a rebuild, the remaining trees are searched
+// instead, so a host filtered out of all of them is reported as not found.
 func (ht *HostTrees) Select(spk types.SiaPublicKey) (modules.HostDBEntry, bool) {
 	ht.mu.Lock()
 	defer ht.mu.Unlock()
-	// This is nothing hostdb profile specific so the default host tree can be used.
-	return ht.trees["default"].Select(spk)
+	if tree, exists := ht.trees["default"]; exists {
+		return tree.Select(spk)
+	}
+	for _, tree := range ht.trees {
+		if entry, exists := tree.Select(spk); exists {
+			return entry, true
+		}
+	}
+	return modules.HostDBEntry{}, false
 }
 
 // SelectRandom grabs a random n hosts from the provided tree. There will be no repeats,
 // but the length of the slice returned may be less than n, and may even be zero.
 // The hosts that are returned first have the higher priority. Hosts passed to
-// 'ignore' will not be considered; pass `nil` if no blacklist is desired.
-func (ht *HostTrees) SelectRandom(tree string, n int, ignore []types.SiaPublicKey) []modules.HostDBEntry {
+// 'ignore' will not be considered; pass `nil` if no blacklist is desired. Only
+// hosts that match all of the provided filters are returned. If n is zero or
+// negative no hosts are returned and the tree is left untouched. If no tree
+// with the provided name exists, e.g. because it is still being built, no hosts
+// are returned either.
+func (ht *HostTrees) SelectRandom(tree string, n int, ignore []types.SiaPublicKey, filters ...HostFilter) []modules.HostDBEntry {
+	if n <= 0 {
+		return nil
+	}
 	ht.mu.Lock()
 	defer ht.mu.Unlock()
-	return ht.trees[tree].SelectRandom(n, ignore)
+	t, exists := ht.trees[tree]
+	if !exists {
+		return nil
+	}
+	return t.SelectRandom(n, ignore, filters...)
+}
+
+// SelectRandomAtLeast works like SelectRandom but returns ErrInsufficientHosts
+// if fewer than n hosts are available, for callers that need a minimum number of
+// hosts such as contract formation.
+func (ht *HostTrees) SelectRandomAtLeast(tree string, n int, ignore []types.SiaPublicKey, filters ...HostFilter) ([]modules.HostDBEntry, error) {
+	hosts := ht.SelectRandom(tree, n, ignore, filters...)
+	if len(hosts) < n {
+		return nil, fmt.Errorf("%w: requested %v, got %v", ErrInsufficientHosts, n, len(hosts))
+	}
+	return hosts, nil
 }
@@ -0,0 +1,292 @@
+package hosttree
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/pachisi456/sia-hostdb-profiles/modules"
+	"github.com/pachisi456/sia-hostdb-profiles/types"
+)
+
+// newTestHostTrees returns a HostTrees object with a tree for each of the
+// provided names, weighting all hosts equally.
+func newTestHostTrees(names ...string) *HostTrees {
+	hts := NewHostTrees()
+	for _, name := range names {
+		tree := NewHostTree(func(modules.HostDBEntry, string) types.Currency {
+			return types.NewCurrency64(20)
+		}, name)
+		hts.AddHostTree(name, tree)
+	}
+	return &hts
+}
+
+// TestHostTreesInsertBatch checks that inserting hosts in a batch results in
+// the same trees as inserting them one by one.
+func TestHostTreesInsertBatch(t *testing.T) {
+	var entries []modules.HostDBEntry
+	for i := 0; i < 50; i++ {
+		entries = append(entries, makeHostDBEntry())
+	}
+
+	single := newTestHostTrees("default", "cold", "hot")
+	for _, entry := range entries {
+		if err := single.Insert(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	batch := newTestHostTrees("default", "cold", "hot")
+	if err := batch.InsertBatch(entries); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"default", "cold", "hot"} {
+		s, b := single.trees[name], batch.trees[name]
+		if len(s.hosts) != len(entries) || len(b.hosts) != len(entries) {
+			t.Fatalf("%v: expected %v hosts, got %v and %v", name, len(entries), len(s.hosts), len(b.hosts))
+		}
+		if s.root.weight.Cmp(b.root.weight) != 0 {
+			t.Errorf("%v: tree weights differ: %v and %v", name, s.root.weight, b.root.weight)
+		}
+		for key := range s.hosts {
+			if _, exists := b.hosts[key]; !exists {
+				t.Errorf("%v: host missing after batch insert", name)
+			}
+		}
+	}
+
+	// Inserting the same hosts again should fail for every entry and tree, but
+	// new hosts in the same batch should still be inserted.
+	newEntry := makeHostDBEntry()
+	if err := batch.InsertBatch(append(entries[:2:2], newEntry)); err == nil {
+		t.Fatal("expected inserting existing hosts to fail")
+	}
+	if _, exists := batch.Select(newEntry.PublicKey); !exists {
+		t.Fatal("new host was not inserted alongside failing ones")
+	}
+}
+
+// BenchmarkHostTreesInsert benchmarks inserting hosts into multiple trees one
+// by one.
+func BenchmarkHostTreesInsert(b *testing.B) {
+	var entries []modules.HostDBEntry
+	for i := 0; i < 1000; i++ {
+		entries = append(entries, makeHostDBEntry())
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		hts := newTestHostTrees("default", "cold", "hot")
+		for _, entry := range entries {
+			hts.Insert(entry)
+		}
+	}
+}
+
+// BenchmarkHostTreesInsertBatch benchmarks inserting hosts into multiple trees
+// in a single batch.
+func BenchmarkHostTreesInsertBatch(b *testing.B) {
+	var entries []modules.HostDBEntry
+	for i := 0; i < 1000; i++ {
+		entries = append(entries, makeHostDBEntry())
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		hts := newTestHostTrees("default", "cold", "hot")
+		hts.InsertBatch(entries)
+	}
+}
+
+// TestHostTreesAddOrReplace checks that AddOrReplaceHostTree swaps the contents
+// of an existing tree while AddHostTree refuses to do so.
+func TestHostTreesAddOrReplace(t *testing.T) {
+	hts := newTestHostTrees("default")
+	old := makeHostDBEntry()
+	if err := hts.Insert(old); err != nil {
+		t.Fatal(err)
+	}
+
+	// Build a replacement tree containing a different host.
+	replacement := newTestHostTrees("default")
+	entry := makeHostDBEntry()
+	if err := replacement.Insert(entry); err != nil {
+		t.Fatal(err)
+	}
+	tree := replacement.trees["default"]
+
+	if err := hts.AddHostTree("default", tree); err != errTreeExists {
+		t.Fatalf("expected %v, got %v", errTreeExists, err)
+	}
+	if _, exists := hts.Select(old.PublicKey); !exists {
+		t.Fatal("strict add replaced the existing tree")
+	}
+
+	hts.AddOrReplaceHostTree("default", tree)
+	if _, exists := hts.Select(old.PublicKey); exists {
+		t.Error("old host still present after replacing the tree")
+	}
+	if _, exists := hts.Select(entry.PublicKey); !exists {
+		t.Error("new host missing after replacing the tree")
+	}
+
+	// Replacing a tree that does not exist yet adds it.
+	hts.AddOrReplaceHostTree("cold", tree)
+	if hosts := hts.All("cold"); len(hosts) != 1 {
+		t.Errorf("expected 1 host in the added tree, got %v", len(hosts))
+	}
+}
+
+// TestHostTreesSelectRandomAtLeast checks that SelectRandomAtLeast fails if the
+// tree does not contain enough hosts.
+func TestHostTreesSelectRandomAtLeast(t *testing.T) {
+	hts := newTestHostTrees("default")
+	for i := 0; i < 2; i++ {
+		if err := hts.Insert(makeHostDBEntry()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := hts.SelectRandomAtLeast("default", 5, nil); !errors.Is(err, ErrInsufficientHosts) {
+		t.Fatal("expected ErrInsufficientHosts, got", err)
+	}
+	hosts, err := hts.SelectRandomAtLeast("default", 2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hosts) != 2 {
+		t.Fatal("expected 2 hosts, got", len(hosts))
+	}
+	if _, err := hts.SelectRandomAtLeast("default", 2, []types.SiaPublicKey{hosts[0].PublicKey}); !errors.Is(err, ErrInsufficientHosts) {
+		t.Fatal("expected ignored hosts not to count, got", err)
+	}
+}
+
+// TestHostTreesSelectRandomNonPositive checks that SelectRandom returns no
+// hosts if it is asked for zero or a negative number of hosts.
+func TestHostTreesSelectRandomNonPositive(t *testing.T) {
+	hts := newTestHostTrees("default")
+	for i := 0; i < 3; i++ {
+		if err := hts.Insert(makeHostDBEntry()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, n := range []int{0, -1, -100} {
+		if hosts := hts.SelectRandom("default", n, nil); len(hosts) != 0 {
+			t.Errorf("expected no hosts for n = %v, got %v", n, len(hosts))
+		}
+		if hosts, err := hts.SelectRandomAtLeast("default", n, nil); err != nil || len(hosts) != 0 {
+			t.Errorf("expected no hosts and no error for n = %v, got %v (%v)", n, len(hosts), err)
+		}
+	}
+	if hosts := hts.SelectRandom("default", 3, nil); len(hosts) != 3 {
+		t.Fatal("expected all hosts to still be selectable, got", len(hosts))
+	}
+}
+
+// TestHostTreesSelectRandomUnknownTree checks that selecting from a tree that
+// doesn't exist returns no hosts instead of panicking.
+func TestHostTreesSelectRandomUnknownTree(t *testing.T) {
+	hts := newTestHostTrees("default")
+	if err := hts.Insert(makeHostDBEntry()); err != nil {
+		t.Fatal(err)
+	}
+
+	if hosts := hts.SelectRandom("missing", 1, nil); len(hosts) != 0 {
+		t.Fatal("expected no hosts from a missing tree, got", len(hosts))
+	}
+	if _, err := hts.SelectRandomAtLeast("missing", 1, nil); !errors.Is(err, ErrInsufficientHosts) {
+		t.Fatal("expected ErrInsufficientHosts, got", err)
+	}
+	if hosts := hts.SelectRandom("default", 1, nil); len(hosts) != 1 {
+		t.Fatal("expected the default tree to still be selectable, got", len(hosts))
+	}
+}
+
+// TestHostTreesSelectWithoutDefault checks that hosts can still be selected
+// by their public key while the default tree is missing, e.g. while it is
+// being rebuilt.
+func TestHostTreesSelectWithoutDefault(t *testing.T) {
+	hts := newTestHostTrees("default", "cold")
+	entry := makeHostDBEntry()
+	if err := hts.Insert(entry); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a rebuild of the default tree by removing it.
+	if err := hts.RemoveHostTree("default"); err != nil {
+		t.Fatal(err)
+	}
+	if selected, exists := hts.Select(entry.PublicKey); !exists || selected.PublicKey.String() != entry.PublicKey.String() {
+		t.Fatal("expected the host to be selected from the remaining tree")
+	}
+	if _, exists := hts.Select(makeHostDBEntry().PublicKey); exists {
+		t.Fatal("unknown host was selected")
+	}
+
+	// Without any trees no host is found.
+	if err := hts.RemoveHostTree("cold"); err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := hts.Select(entry.PublicKey); exists {
+		t.Fatal("host was selected without any trees")
+	}
+
+	// Once the default tree is back it is used again.
+	hts.AddOrReplaceHostTree("default", NewHostTree(func(modules.HostDBEntry, string) types.Currency {
+		return types.NewCurrency64(20)
+	}, "default"))
+	if err := hts.Insert(entry); err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := hts.Select(entry.PublicKey); !exists {
+		t.Fatal("expected the host to be selected from the rebuilt default tree")
+	}
+}
+
+// TestHostTreesMembership checks that the membership version only changes if
+// hosts are added to or removed from a tree, not if only their settings are
+// updated.
+func TestHostTreesMembership(t *testing.T) {
+	hts := newTestHostTrees("default")
+	hts.AddHostTree("accepting", NewHostTree(func(modules.HostDBEntry, string) types.Currency {
+		return types.NewCurrency64(20)
+	}, "accepting", HostFilterFunc(func(entry modules.HostDBEntry) bool {
+		return entry.AcceptingContracts
+	})))
+	entry := makeHostDBEntry()
+
+	membership := hts.Membership()
+	if err := hts.Insert(entry); err != nil {
+		t.Fatal(err)
+	}
+	if hts.Membership() == membership {
+		t.Fatal("membership didn't change when inserting a host")
+	}
+
+	// Updating the settings of a host doesn't change the membership.
+	membership = hts.Membership()
+	entry.RemainingStorage++
+	if err := hts.Modify(entry); err != nil {
+		t.Fatal(err)
+	}
+	if hts.Membership() != membership {
+		t.Fatal("membership changed when updating the settings of a host")
+	}
+
+	// Moving a host out of a filtered tree does.
+	entry.AcceptingContracts = false
+	if err := hts.Modify(entry); err != nil {
+		t.Fatal(err)
+	}
+	if hts.Membership() == membership {
+		t.Fatal("membership didn't change when a host was filtered out of a tree")
+	}
+
+	membership = hts.Membership()
+	if err := hts.Remove(entry.PublicKey); err != nil {
+		t.Fatal(err)
+	}
+	if hts.Membership() == membership {
+		t.Fatal("membership didn't change when removing a host")
+	}
+}
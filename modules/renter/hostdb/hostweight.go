@@ -1,13 +1,16 @@
 package hostdb
 
 import (
+	"fmt"
 	"math"
 	"math/big"
+	"sort"
 
 	"github.com/pachisi456/sia-hostdb-profiles/build"
 	"github.com/pachisi456/sia-hostdb-profiles/modules"
+	"github.com/pachisi456/sia-hostdb-profiles/modules/renter/hostdb/hostdbprofile"
+	"github.com/pachisi456/sia-hostdb-profiles/modules/renter/hostdb/hosttree"
 	"github.com/pachisi456/sia-hostdb-profiles/types"
-	"strings"
 )
 
 var (
@@ -55,28 +58,52 @@ var (
 	tbMonth = uint64(4032) * uint64(1e12)
 )
 
-// blacklistHost returns false if the provided host's country is accepted by the provided
-// hostdb profile or no location is specified in the hostdb profile, otherwise true.
+// blacklistHost returns false if the provided host matches all filters of the
+// provided hostdb profile, otherwise true.
 func (hdb *HostDB) blacklistHost(entry modules.HostDBEntry, hostdbprofile string) bool {
-	// Blacklist host if it does not have any location information.
-	if entry.Country == "" {
-		return true
-	}
-	// Accept hosts from all locations if no location is specified in hostdb profile.
-	hdbp := hdb.HostDBProfile(hostdbprofile)
-	if len(hdbp.Location) < 1 {
+	profile, err := hdb.hostdbProfiles.Profile(hostdbprofile)
+	if err != nil {
 		return false
 	}
-	// Check if host's location is among the locations specified in the hostdb profile.
-	for _, l := range hdbp.Location {
-		if l == "eu" && entry.EUhost {
-			return false
+	return hdb.failedFilter(entry, profile) != ""
+}
+
+// failedFilter returns the name of the first filter of the provided hostdb
+// profile the provided host doesn't match, or an empty string if the host
+// matches all of them.
+func (hdb *HostDB) failedFilter(entry modules.HostDBEntry, profile hostdbprofile.HostDBProfile) string {
+	for _, filter := range hdb.profileFilters(profile, hdb.blockHeight) {
+		if !filter.Matches(entry) {
+			return filter.Name()
 		}
-		if l == strings.ToLower(entry.Country) {
-			return false
+	}
+	return ""
+}
+
+// filterReason returns why the provided host is not selected by the provided
+// hostdb profile: "blacklist" if the host is on the profile's blacklist, "not
+// pinned" if the profile is pinned to other hosts and otherwise the name of the
+// first filter the host doesn't match. An empty string is returned if the host
+// can be selected.
+func (hdb *HostDB) filterReason(entry modules.HostDBEntry, profile hostdbprofile.HostDBProfile) string {
+	for _, pk := range profile.Blacklist {
+		if pk.String() == entry.PublicKey.String() {
+			return "blacklist"
 		}
 	}
-	return true
+	if len(profile.Whitelist) > 0 {
+		pinned := false
+		for _, pk := range profile.Whitelist {
+			if pk.String() == entry.PublicKey.String() {
+				pinned = true
+				break
+			}
+		}
+		if !pinned {
+			return "not pinned"
+		}
+	}
+	return hdb.failedFilter(entry, profile)
 }
 
 // collateralAdjustments improves the host's weight according to the amount of
@@ -154,7 +181,7 @@ func (hdb *HostDB) interactionAdjustments(entry modules.HostDBEntry) float64 {
 
 // priceAdjustments will adjust the weight of the entry according to the prices
 // that it has set and the storage tier defined in the hostdb profile.
-func (hdb *HostDB) priceAdjustments(entry modules.HostDBEntry, hostdbprofile string) float64 {
+func (hdb *HostDB) priceAdjustments(entry modules.HostDBEntry, hdbp hostdbprofile.HostDBProfile) float64 {
 	// Sanity checks - the constants values need to have certain relationships
 	// to eachother
 	if build.DEBUG {
@@ -185,19 +212,12 @@ func (hdb *HostDB) priceAdjustments(entry modules.HostDBEntry, hostdbprofile str
 	adjustedDownloadPrice := entry.DownloadBandwidthPrice.Div64(12096).Div64(3) // Adjust download price to match one download over 12 weeks, 1 redundancy.
 	siafundFee := adjustedContractPrice.Add(adjustedUploadPrice).Add(adjustedDownloadPrice).Add(entry.Collateral).MulTax()
 
-	// Weigh prices, depending on the storage tier.
-	hdbp := hdb.hostdbProfiles.GetProfile(hostdbprofile)
-	switch hdbp.Storagetier {
-	case "cold":
-		// Prefer hosts with cheap storage.
-		adjustedContractPrice = adjustedContractPrice.Mul64(5)
-	case "warm":
-		// Weigh prices equally.
-	case "hot":
-		// Prefer hosts with cheap bandwidth.
-		adjustedUploadPrice = adjustedUploadPrice.Mul64(5)
-		adjustedDownloadPrice = adjustedDownloadPrice.Mul64(5)
-	}
+	// Weigh prices, depending on the storage tier. The prices of an unknown
+	// profile are weighed equally.
+	contractMul, uploadMul, downloadMul := storagetierPriceMultipliers(hdbp.Storagetier)
+	adjustedContractPrice = adjustedContractPrice.Mul64(contractMul)
+	adjustedUploadPrice = adjustedUploadPrice.Mul64(uploadMul)
+	adjustedDownloadPrice = adjustedDownloadPrice.Mul64(downloadMul)
 
 	totalPrice := entry.StoragePrice.Add(adjustedContractPrice).Add(adjustedUploadPrice).Add(adjustedDownloadPrice).Add(siafundFee)
 
@@ -223,9 +243,47 @@ func (hdb *HostDB) priceAdjustments(entry modules.HostDBEntry, hostdbprofile str
 	return weight
 }
 
+// storagetierPriceMultipliers returns the factors by which the contract, upload
+// and download prices of a host are weighed for the provided storage tier.
+func storagetierPriceMultipliers(storagetier string) (contract, upload, download uint64) {
+	switch storagetier {
+	case "cold":
+		// Prefer hosts with cheap storage.
+		return 5, 1, 1
+	case "hot":
+		// Prefer hosts with cheap bandwidth.
+		return 1, 5, 5
+	default:
+		// Weigh prices equally.
+		return 1, 1, 1
+	}
+}
+
+// storagetierStorageExponent returns the exponent the storage remaining
+// adjustment of a host is raised to for the provided storage tier.
+func storagetierStorageExponent(storagetier string) float64 {
+	switch storagetier {
+	case "cold":
+		// Penalize nearly full hosts less, cheap storage matters more.
+		return 0.5
+	case "hot":
+		// Prefer hosts with ample free storage so that uploads don't fail.
+		return 2
+	default:
+		return 1
+	}
+}
+
 // storageRemainingAdjustments adjusts the weight of the entry according to how
-// much storage it has remaining.
-func storageRemainingAdjustments(entry modules.HostDBEntry) float64 {
+// much storage it has remaining. The adjustment is scaled by the storage tier
+// of the hostdb profile, an unknown profile is not scaled.
+func (hdb *HostDB) storageRemainingAdjustments(entry modules.HostDBEntry, hdbp hostdbprofile.HostDBProfile) float64 {
+	return math.Pow(storageRemainingBase(entry), storagetierStorageExponent(hdbp.Storagetier))
+}
+
+// storageRemainingBase returns the storage remaining adjustment of the entry
+// before it is scaled by the storage tier.
+func storageRemainingBase(entry modules.HostDBEntry) float64 {
 	base := float64(1)
 	if entry.RemainingStorage < 200*requiredStorage {
 		base = base / 2 // 2x total penalty
@@ -344,37 +402,22 @@ func (hdb *HostDB) uptimeAdjustments(entry modules.HostDBEntry) float64 {
 	}
 
 	// Compute the total measured uptime and total measured downtime for this
-	// host.
-	downtime := entry.HistoricDowntime
-	uptime := entry.HistoricUptime
-	recentTime := entry.ScanHistory[0].Timestamp
-	recentSuccess := entry.ScanHistory[0].Success
-	for _, scan := range entry.ScanHistory[1:] {
-		if recentTime.After(scan.Timestamp) {
-			if build.DEBUG {
-				hdb.log.Critical("Host entry scan history not sorted.")
-			} else {
-				hdb.log.Print("WARNING: Host entry scan history not sorted.")
-			}
-			// Ignore the unsorted scan entry.
-			continue
-		}
-		if recentSuccess {
-			uptime += scan.Timestamp.Sub(recentTime)
+	// host. Unsorted scan entries are ignored.
+	if !sort.IsSorted(entry.ScanHistory) {
+		if build.DEBUG {
+			hdb.log.Critical("Host entry scan history not sorted.")
 		} else {
-			downtime += scan.Timestamp.Sub(recentTime)
+			hdb.log.Print("WARNING: Host entry scan history not sorted.")
 		}
-		recentTime = scan.Timestamp
-		recentSuccess = scan.Success
 	}
 	// Sanity check against 0 total time.
-	if uptime == 0 && downtime == 0 {
+	if uptime, downtime := entry.MeasuredUptime(); uptime == 0 && downtime == 0 {
 		return 0.001 // Shouldn't happen.
 	}
 
 	// Compute the uptime ratio, but shift by 0.02 to acknowledge fully that
 	// 98% uptime and 100% uptime is valued the same.
-	uptimeRatio := float64(uptime) / float64(uptime+downtime)
+	uptimeRatio := entry.Uptime()
 	if uptimeRatio > 0.98 {
 		uptimeRatio = 0.98
 	}
@@ -403,16 +446,49 @@ func (hdb *HostDB) uptimeAdjustments(entry modules.HostDBEntry) float64 {
 	return math.Pow(uptimeRatio, exp)
 }
 
-// calculateHostWeight returns the weight of a host as well as a boolean
-// indicating whether that host should be blacklisted according to the settings
-// of the host database entry and the settings set in the hostdb profile.
-func (hdb *HostDB) calculateHostWeight(entry modules.HostDBEntry, hostdbprofile string) (weight types.Currency, blacklist bool) {
+// recentFailureAdjustments temporarily penalizes a host whose most recent
+// failed scan happened recently. Instead of flapping between being selected and
+// not being selected, the host is down-weighted and recovers as time passes and
+// successful scans accumulate. The weight of a host is only calculated when it
+// is inserted or modified, so the decay of the penalty takes effect whenever
+// the host is rescanned.
+func (hdb *HostDB) recentFailureAdjustments(entry modules.HostDBEntry) float64 {
+	now := hdb.deps.Now()
+	successes := 0
+	for i := len(entry.ScanHistory) - 1; i >= 0; i-- {
+		scan := entry.ScanHistory[i]
+		if scan.Success {
+			successes++
+			continue
+		}
+		elapsed := now.Sub(scan.Timestamp)
+		if elapsed < 0 {
+			elapsed = 0
+		}
+		decay := math.Pow(0.5, float64(elapsed)/float64(recentFailureHalfLife)+float64(successes))
+		return 1 - recentFailurePenalty*decay
+	}
+	return 1
+}
+
+// calculateHostWeight returns the weight of a host according to the settings of
+// the host database entry and the settings set in the hostdb profile. Whether
+// the host may be selected at all is decided by the profile's filters.
+func (hdb *HostDB) calculateHostWeight(entry modules.HostDBEntry, hostdbprofile string) types.Currency {
+	hdbp, _ := hdb.hostdbProfiles.Profile(hostdbprofile)
+	return hdb.calculateProfileHostWeight(entry, hostdbprofile, hdbp)
+}
+
+// calculateProfileHostWeight returns the weight of a host in the host tree of
+// the hostdb profile with the provided name, weighing it according to the
+// provided profile settings rather than the ones currently set.
+func (hdb *HostDB) calculateProfileHostWeight(entry modules.HostDBEntry, name string, hdbp hostdbprofile.HostDBProfile) (weight types.Currency) {
 	collateralReward := hdb.collateralAdjustments(entry)
 	interactionPenalty := hdb.interactionAdjustments(entry)
 	lifetimePenalty := hdb.lifetimeAdjustments(entry)
-	pricePenalty := hdb.priceAdjustments(entry, hostdbprofile)
-	storageRemainingPenalty := storageRemainingAdjustments(entry)
-	uptimePenalty := hdb.uptimeAdjustments(entry)
+	pricePenalty := hdb.priceAdjustments(entry, hdbp)
+	storageRemainingPenalty := hdb.storageRemainingAdjustments(entry, hdbp)
+	uptimePenalty := hdb.uptimeAdjustments(entry) * hdb.recentFailureAdjustments(entry)
 	versionPenalty := versionAdjustments(entry)
 
 	// Combine the adjustments.
@@ -426,12 +502,70 @@ func (hdb *HostDB) calculateHostWeight(entry modules.HostDBEntry, hostdbprofile
 		weight = types.NewCurrency64(1)
 	}
 
-	// Blacklist host if location is not among the specified ones in the hostdb profile.
-	blacklist = hdb.blacklistHost(entry, hostdbprofile)
-
+	if hdb.deps.Disrupt("logSelectionDecisions") {
+		reason := hdb.filterReason(entry, hdbp)
+		if reason == "" {
+			reason = "none"
+		}
+		breakdown := fmt.Sprintf("weight %v (collateral %g, interactions %g, lifetime %g, price %g, storage %g, uptime %g, version %g)",
+			weight, collateralReward, interactionPenalty, lifetimePenalty, pricePenalty, storageRemainingPenalty, uptimePenalty, versionPenalty)
+		hdb.logEvent(logEntry{Level: logLevelInfo, Message: breakdown, Host: entry.PublicKey.String(), Profile: name, Reason: reason},
+			"Selection: host %v in profile %q: %v, filtered: %v", entry.PublicKey.String(), name, breakdown, reason)
+	}
 	return
 }
 
+// recoverWeight wraps the provided weight function so that a panic while
+// weighting a host, e.g. because of a malformed host entry, is logged and
+// results in a zero weight instead of taking down the goroutine that scans or
+// selects hosts. Hosts with a zero weight are never selected.
+func (hdb *HostDB) recoverWeight(wf hosttree.WeightFunc) hosttree.WeightFunc {
+	return func(entry modules.HostDBEntry, hostdbprofile string) (weight types.Currency) {
+		defer func() {
+			if r := recover(); r != nil {
+				hdb.log.Printf("ERROR: could not calculate the weight of host %v in profile %q: %v", entry.PublicKey.String(), hostdbprofile, r)
+				weight = types.ZeroCurrency
+			}
+		}()
+		return wf(entry, hostdbprofile)
+	}
+}
+
+// EffectiveFilters returns the effective filters the hostdb profile with the
+// provided name applies when selecting hosts. Nothing is modified.
+func (hdb *HostDB) EffectiveFilters(name string) (modules.HostDBProfileFilters, error) {
+	hdbp, err := hdb.hostdbProfiles.Profile(name)
+	if err != nil {
+		return modules.HostDBProfileFilters{}, err
+	}
+	contractMul, uploadMul, downloadMul := storagetierPriceMultipliers(hdbp.Storagetier)
+	return modules.HostDBProfileFilters{
+		Storagetier: hdbp.Storagetier,
+
+		ContractPriceMultiplier: contractMul,
+		UploadPriceMultiplier:   uploadMul,
+		DownloadPriceMultiplier: downloadMul,
+		MinTotalPrice:           minTotalPrice,
+
+		RemainingStorageExponent: storagetierStorageExponent(hdbp.Storagetier),
+
+		Locations:   append([]string(nil), hdbp.Location...),
+		AnyLocation: len(hdbp.Location) == 0,
+
+		BlacklistedHosts: append([]types.SiaPublicKey(nil), hdbp.Blacklist...),
+		PinnedHosts:      append([]types.SiaPublicKey(nil), hdbp.Whitelist...),
+
+		EnforceIPDiversity: hdbp.EnforceIPDiversity,
+		MinAge:             hdbp.MinAge,
+		MinStorage:         hdbp.MinStorage,
+		MinBandwidth:       hdbp.MinBandwidth,
+		MinHostMaxDuration: hdbp.MinHostMaxDuration,
+		MinScans:           hdbp.MinScans,
+		MaxSettingsAge:     hdbp.MaxSettingsAge,
+		MaxPrice:           hdbp.MaxPrice,
+	}, nil
+}
+
 // calculateConversionRate calculates the conversion rate of the provided
 // host score, comparing it to the hosts in the database and returning what
 // percentage of contracts it is likely to participate in.
@@ -440,7 +574,7 @@ func (hdb *HostDB) calculateConversionRate(score types.Currency) float64 {
 	//TODO pachisi456: add support for multiple trees
 	//TODO pachisi456: exclude blacklisted hosts?
 	for _, h := range hdb.ActiveHosts("default") {
-		score, _ := hdb.calculateHostWeight(h, "default")
+		score := hdb.calculateHostWeight(h, "default")
 		totalScore = totalScore.Add(score)
 	}
 	if totalScore.IsZero() {
@@ -458,9 +592,10 @@ func (hdb *HostDB) calculateConversionRate(score types.Currency) float64 {
 func (hdb *HostDB) EstimateHostScore(entry modules.HostDBEntry, hostdbprofile string) modules.HostScoreBreakdown {
 	// Grab the adjustments. Age, and uptime penalties are set to '1', to
 	// assume best behavior from the host.
+	hdbp, _ := hdb.hostdbProfiles.Profile(hostdbprofile)
 	collateralReward := hdb.collateralAdjustments(entry)
-	pricePenalty := hdb.priceAdjustments(entry, hostdbprofile)
-	storageRemainingPenalty := storageRemainingAdjustments(entry)
+	pricePenalty := hdb.priceAdjustments(entry, hdbp)
+	storageRemainingPenalty := hdb.storageRemainingAdjustments(entry, hdbp)
 	versionPenalty := versionAdjustments(entry)
 
 	// Combine into a full penalty, then determine the resulting estimated
@@ -488,23 +623,36 @@ func (hdb *HostDB) EstimateHostScore(entry modules.HostDBEntry, hostdbprofile st
 
 // ScoreBreakdown provides a detailed set of scalars and bools indicating elements of the
 // host's overall score. As arguments the HostDBEntry and the name of the hostdb profile are given.
-func (hdb *HostDB) ScoreBreakdown(entry modules.HostDBEntry, hostdbprofile string) modules.HostScoreBreakdown {
+// An error is returned if no hostdb profile with that name exists.
+func (hdb *HostDB) ScoreBreakdown(entry modules.HostDBEntry, hostdbprofile string) (modules.HostScoreBreakdown, error) {
+	hdbp, err := hdb.hostdbProfiles.Profile(hostdbprofile)
+	if err != nil {
+		return modules.HostScoreBreakdown{}, err
+	}
 	hdb.mu.Lock()
 	defer hdb.mu.Unlock()
 
-	score, blacklist := hdb.calculateHostWeight(entry, hostdbprofile)
+	score := hdb.calculateProfileHostWeight(entry, hostdbprofile, hdbp)
 	return modules.HostScoreBreakdown{
 		Score:          score,
 		ConversionRate: hdb.calculateConversionRate(score),
-		Blacklisted:    blacklist,
+		Blacklisted:    hdb.blacklistHost(entry, hostdbprofile),
 
 		AgeAdjustment:              hdb.lifetimeAdjustments(entry),
 		BurnAdjustment:             1,
 		CollateralAdjustment:       hdb.collateralAdjustments(entry),
 		InteractionAdjustment:      hdb.interactionAdjustments(entry),
-		PriceAdjustment:            hdb.priceAdjustments(entry, hostdbprofile),
-		StorageRemainingAdjustment: storageRemainingAdjustments(entry),
-		UptimeAdjustment:           hdb.uptimeAdjustments(entry),
+		PriceAdjustment:            hdb.priceAdjustments(entry, hdbp),
+		StorageRemainingAdjustment: hdb.storageRemainingAdjustments(entry, hdbp),
+		UptimeAdjustment:           hdb.uptimeAdjustments(entry) * hdb.recentFailureAdjustments(entry),
 		VersionAdjustment:          versionAdjustments(entry),
-	}
+	}, nil
+}
+
+// HostWeight returns the weight the host would receive in the host tree of the
+// provided hostdb profile.
+func (hdb *HostDB) HostWeight(entry modules.HostDBEntry, hostdbprofile string) types.Currency {
+	hdb.mu.RLock()
+	defer hdb.mu.RUnlock()
+	return hdb.calculateHostWeight(entry, hostdbprofile)
 }
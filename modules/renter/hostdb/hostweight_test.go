@@ -1,11 +1,13 @@
 package hostdb
 
 import (
+	"math"
 	"testing"
 	"time"
 
 	"github.com/pachisi456/sia-hostdb-profiles/build"
 	"github.com/pachisi456/sia-hostdb-profiles/modules"
+	"github.com/pachisi456/sia-hostdb-profiles/modules/renter/hostdb/hosttree"
 	"github.com/pachisi456/sia-hostdb-profiles/types"
 )
 
@@ -16,7 +18,7 @@ func calculateWeightFromUInt64Price(price uint64) (weight types.Currency) {
 	entry.Version = build.Version
 	entry.RemainingStorage = 250e3
 	entry.StoragePrice = types.NewCurrency64(price).Mul(types.SiacoinPrecision).Div64(4032).Div64(1e9)
-	return hdb.calculateHostWeight(entry)
+	return hdb.calculateHostWeight(entry, "default")
 }
 
 func TestHostWeightDistinctPrices(t *testing.T) {
@@ -77,8 +79,8 @@ func TestHostWeightCollateralDifferences(t *testing.T) {
 	entry2 := entry
 	entry2.Collateral = types.NewCurrency64(500).Mul(types.SiacoinPrecision)
 
-	w1 := hdb.calculateHostWeight(entry)
-	w2 := hdb.calculateHostWeight(entry2)
+	w1 := hdb.calculateHostWeight(entry, "default")
+	w2 := hdb.calculateHostWeight(entry2, "default")
 	if w1.Cmp(w2) < 0 {
 		t.Error("Larger collateral should have more weight")
 	}
@@ -96,8 +98,8 @@ func TestHostWeightStorageRemainingDifferences(t *testing.T) {
 
 	entry2 := entry
 	entry2.RemainingStorage = 50e3
-	w1 := hdb.calculateHostWeight(entry)
-	w2 := hdb.calculateHostWeight(entry2)
+	w1 := hdb.calculateHostWeight(entry, "default")
+	w2 := hdb.calculateHostWeight(entry2, "default")
 
 	if w1.Cmp(w2) < 0 {
 		t.Error("Larger storage remaining should have more weight")
@@ -117,8 +119,8 @@ func TestHostWeightVersionDifferences(t *testing.T) {
 
 	entry2 := entry
 	entry2.Version = "v1.0.3"
-	w1 := hdb.calculateHostWeight(entry)
-	w2 := hdb.calculateHostWeight(entry2)
+	w1 := hdb.calculateHostWeight(entry, "default")
+	w2 := hdb.calculateHostWeight(entry2, "default")
 
 	if w1.Cmp(w2) < 0 {
 		t.Error("Higher version should have more weight")
@@ -139,8 +141,8 @@ func TestHostWeightLifetimeDifferences(t *testing.T) {
 
 	entry2 := entry
 	entry2.FirstSeen = 8100
-	w1 := hdb.calculateHostWeight(entry)
-	w2 := hdb.calculateHostWeight(entry2)
+	w1 := hdb.calculateHostWeight(entry, "default")
+	w2 := hdb.calculateHostWeight(entry2, "default")
 
 	if w1.Cmp(w2) < 0 {
 		t.Error("Been around longer should have more weight")
@@ -174,8 +176,8 @@ func TestHostWeightUptimeDifferences(t *testing.T) {
 		{Timestamp: time.Now().Add(time.Hour * -40), Success: true},
 		{Timestamp: time.Now().Add(time.Hour * -20), Success: false},
 	}
-	w1 := hdb.calculateHostWeight(entry)
-	w2 := hdb.calculateHostWeight(entry2)
+	w1 := hdb.calculateHostWeight(entry, "default")
+	w2 := hdb.calculateHostWeight(entry2, "default")
 
 	if w1.Cmp(w2) < 0 {
 		t.Error("Been around longer should have more weight")
@@ -209,8 +211,8 @@ func TestHostWeightUptimeDifferences2(t *testing.T) {
 		{Timestamp: time.Now().Add(time.Hour * -40), Success: false},
 		{Timestamp: time.Now().Add(time.Hour * -20), Success: true},
 	}
-	w1 := hdb.calculateHostWeight(entry)
-	w2 := hdb.calculateHostWeight(entry2)
+	w1 := hdb.calculateHostWeight(entry, "default")
+	w2 := hdb.calculateHostWeight(entry2, "default")
 
 	if w1.Cmp(w2) < 0 {
 		t.Errorf("Been around longer should have more weight\n\t%v\n\t%v", w1, w2)
@@ -244,8 +246,8 @@ func TestHostWeightUptimeDifferences3(t *testing.T) {
 		{Timestamp: time.Now().Add(time.Hour * -40), Success: true},
 		{Timestamp: time.Now().Add(time.Hour * -20), Success: true},
 	}
-	w1 := hdb.calculateHostWeight(entry)
-	w2 := hdb.calculateHostWeight(entry2)
+	w1 := hdb.calculateHostWeight(entry, "default")
+	w2 := hdb.calculateHostWeight(entry2, "default")
 
 	if w1.Cmp(w2) < 0 {
 		t.Error("Been around longer should have more weight")
@@ -279,10 +281,125 @@ func TestHostWeightUptimeDifferences4(t *testing.T) {
 		{Timestamp: time.Now().Add(time.Hour * -40), Success: false},
 		{Timestamp: time.Now().Add(time.Hour * -20), Success: false},
 	}
-	w1 := hdb.calculateHostWeight(entry)
-	w2 := hdb.calculateHostWeight(entry2)
+	w1 := hdb.calculateHostWeight(entry, "default")
+	w2 := hdb.calculateHostWeight(entry2, "default")
 
 	if w1.Cmp(w2) < 0 {
 		t.Error("Been around longer should have more weight")
 	}
 }
+
+// TestHostWeightRecentFailure checks that a host which just failed a scan is
+// down-weighted but still selectable, and that it recovers as successful scans
+// accumulate.
+func TestHostWeightRecentFailure(t *testing.T) {
+	hdb, err := newProfileHostDB(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdb.blockHeight = 10000
+	var entry modules.HostDBEntry
+	entry.RemainingStorage = 250e3
+	entry.StoragePrice = types.NewCurrency64(1000).Mul(types.SiacoinPrecision)
+	entry.Collateral = types.NewCurrency64(1000).Mul(types.SiacoinPrecision)
+	entry.Version = build.Version
+	entry.ScanHistory = modules.HostDBScans{
+		{Timestamp: time.Now().Add(time.Hour * -100), Success: true},
+		{Timestamp: time.Now().Add(time.Hour * -80), Success: true},
+		{Timestamp: time.Now().Add(time.Hour * -60), Success: true},
+		{Timestamp: time.Now().Add(time.Hour * -40), Success: true},
+		{Timestamp: time.Now().Add(time.Hour * -20), Success: true},
+	}
+
+	// The host fails its latest scan. The penalty for the recent failure comes
+	// on top of the reduced uptime.
+	failed := entry
+	failed.ScanHistory = append(modules.HostDBScans{}, entry.ScanHistory...)
+	failed.ScanHistory = append(failed.ScanHistory, modules.HostDBScan{Timestamp: time.Now().Add(-time.Minute), Success: false})
+
+	w := hdb.calculateHostWeight(failed, "default")
+	if w.IsZero() || w.Cmp(types.NewCurrency64(1)) == 0 {
+		t.Fatal("recently failed host should keep a non-zero weight")
+	}
+	breakdown := scoreBreakdown(t, hdb, failed, "default")
+	if breakdown.UptimeAdjustment >= hdb.uptimeAdjustments(failed) {
+		t.Fatal("recently failed host should be penalized beyond its uptime:", breakdown.UptimeAdjustment)
+	}
+	if adj := hdb.recentFailureAdjustments(failed); adj < 1-recentFailurePenalty || adj >= 1 {
+		t.Fatal("unexpected penalty right after a failure:", adj)
+	}
+
+	// Successful scans after the failure reduce the penalty.
+	recovered := failed
+	recovered.ScanHistory = append(append(modules.HostDBScans{}, failed.ScanHistory...),
+		modules.HostDBScan{Timestamp: time.Now(), Success: true})
+	if hdb.recentFailureAdjustments(recovered) <= hdb.recentFailureAdjustments(failed) {
+		t.Fatal("successful scans after a failure should reduce the penalty")
+	}
+	if adj := hdb.recentFailureAdjustments(entry); adj != 1 {
+		t.Fatal("host without failures should not be penalized:", adj)
+	}
+
+	// The penalty halves every recentFailureHalfLife.
+	deps := &fakeClockDeps{now: time.Now()}
+	hdb.deps = deps
+	failed.ScanHistory[len(failed.ScanHistory)-1].Timestamp = deps.now
+	if adj := hdb.recentFailureAdjustments(failed); adj != 1-recentFailurePenalty {
+		t.Fatal("unexpected penalty at the time of the failure:", adj)
+	}
+	deps.advance(recentFailureHalfLife)
+	if adj := hdb.recentFailureAdjustments(failed); math.Abs(adj-(1-recentFailurePenalty/2)) > 1e-9 {
+		t.Fatal("penalty did not halve after one half-life:", adj)
+	}
+}
+
+// TestHostWeightPanicRecovery checks that a host whose weight can't be
+// calculated gets a zero weight instead of crashing the selection, and that the
+// other hosts of the tree can still be selected through the hostdb.
+func TestHostWeightPanicRecovery(t *testing.T) {
+	hdb, err := newProfileHostDB(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdb.initialScanComplete = true
+	bad := makeHostDBEntry()
+	bad.Country = "Germany"
+	wf := hdb.recoverWeight(func(entry modules.HostDBEntry, _ string) types.Currency {
+		if entry.PublicKey.String() == bad.PublicKey.String() {
+			var scans []modules.HostDBScan
+			_ = scans[len(entry.ScanHistory)] // index out of range
+		}
+		return types.NewCurrency64(10)
+	})
+	if w := wf(bad, "default"); !w.IsZero() {
+		t.Fatal("expected a zero weight for the malformed host, got", w)
+	}
+
+	hdb.hostTrees.AddOrReplaceHostTree("default", hosttree.NewHostTree(wf, "default"))
+	if err := hdb.hostTrees.Insert(bad); err != nil {
+		t.Fatal(err)
+	}
+	good := make(map[string]struct{})
+	for i := 0; i < 3; i++ {
+		host := makeHostDBEntry()
+		host.Country = "Germany"
+		if err := hdb.hostTrees.Insert(host); err != nil {
+			t.Fatal(err)
+		}
+		good[host.PublicKey.String()] = struct{}{}
+	}
+
+	// Request more hosts than the tree has, only the good hosts are returned.
+	hosts, err := hdb.RandomHosts("default", 4, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hosts) != len(good) {
+		t.Fatalf("expected the %v good hosts to be selected, got %v", len(good), len(hosts))
+	}
+	for _, host := range hosts {
+		if _, exists := good[host.PublicKey.String()]; !exists {
+			t.Fatal("malformed host was selected")
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package hostdb
+
+import (
+	"net"
+
+	"github.com/pachisi456/sia-hostdb-profiles/modules"
+	"github.com/pachisi456/sia-hostdb-profiles/modules/renter/hostdb/hosttree"
+	"github.com/pachisi456/sia-hostdb-profiles/types"
+)
+
+const (
+	// ipv4FilterRange is the number of leading bits that make up the subnet
+	// of an IPv4 address.
+	ipv4FilterRange = 24
+
+	// ipv6FilterRange is the number of leading bits that make up the subnet
+	// of an IPv6 address.
+	ipv6FilterRange = 54
+)
+
+// ipNets returns the subnets of the provided IP addresses.
+func ipNets(ips []net.IP) []string {
+	var subnets []string
+	for _, ip := range ips {
+		mask := net.CIDRMask(ipv6FilterRange, 8*net.IPv6len)
+		if ip.To4() != nil {
+			mask = net.CIDRMask(ipv4FilterRange, 8*net.IPv4len)
+			ip = ip.To4()
+		}
+		subnets = append(subnets, (&net.IPNet{IP: ip.Mask(mask), Mask: mask}).String())
+	}
+	return subnets
+}
+
+// hostSubnets returns the subnets of the host as recorded by its last scan.
+// If the host hasn't been scanned yet and its address is an IP address, the
+// subnet is derived from the address, the address is never resolved through
+// DNS as hosts are selected while serving requests.
+func hostSubnets(host modules.HostDBEntry) []string {
+	if len(host.IPNets) > 0 {
+		return host.IPNets
+	}
+	if ip := net.ParseIP(host.NetAddress.Host()); ip != nil {
+		return ipNets([]net.IP{ip})
+	}
+	return nil
+}
+
+// selectDiverseHosts selects up to n random hosts from the provided tree like
+// SelectRandom, but never selects two hosts which share a subnet. Hosts whose
+// subnet is unknown, i.e. whose address couldn't be resolved by any scan, are
+// not selected.
+func (hdb *HostDB) selectDiverseHosts(tree string, n int, ignore []types.SiaPublicKey, filters []hosttree.HostFilter) []modules.HostDBEntry {
+	ignore = append([]types.SiaPublicKey(nil), ignore...)
+	usedSubnets := make(map[string]struct{})
+	var hosts []modules.HostDBEntry
+	for len(hosts) < n {
+		// Every candidate is ignored in the following draws, so the loop ends
+		// once all hosts have been considered.
+		candidates := hdb.hostTrees.SelectRandom(tree, n-len(hosts), ignore, filters...)
+		if len(candidates) == 0 {
+			break
+		}
+		for _, host := range candidates {
+			ignore = append(ignore, host.PublicKey)
+			if len(hosts) == n {
+				continue
+			}
+			subnets := hostSubnets(host)
+			if len(subnets) == 0 {
+				hdb.log.Debugln("Not selecting host with unknown subnet for IP diversity:", host.PublicKey)
+				continue
+			}
+			violation := false
+			for _, subnet := range subnets {
+				if _, exists := usedSubnets[subnet]; exists {
+					violation = true
+					break
+				}
+			}
+			if violation {
+				continue
+			}
+			for _, subnet := range subnets {
+				usedSubnets[subnet] = struct{}{}
+			}
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
@@ -0,0 +1,97 @@
+package hostdb
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/pachisi456/sia-hostdb-profiles/modules"
+)
+
+// TestHostSubnets probes the hostSubnets function.
+func TestHostSubnets(t *testing.T) {
+	tests := []struct {
+		address modules.NetAddress
+		ipnets  []string
+		subnet  string
+	}{
+		{"1.2.3.4:9982", nil, "1.2.3.0/24"},
+		{"1.2.3.250:9982", nil, "1.2.3.0/24"},
+		{"[2001:db8::1]:9982", nil, "2001:db8::/54"},
+		{"host.example.com:9982", ipNets([]net.IP{net.ParseIP("5.6.7.8")}), "5.6.7.0/24"},
+		{"1.2.3.4:9982", []string{"5.6.7.0/24"}, "5.6.7.0/24"},
+	}
+	for _, test := range tests {
+		subnets := hostSubnets(modules.HostDBEntry{HostExternalSettings: modules.HostExternalSettings{NetAddress: test.address}, IPNets: test.ipnets})
+		if len(subnets) != 1 || subnets[0] != test.subnet {
+			t.Errorf("%v: expected subnet %v, got %v", test.address, test.subnet, subnets)
+		}
+	}
+
+	// The subnet of a host name is unknown until the host is scanned, it is
+	// never resolved during selection.
+	host := modules.HostDBEntry{HostExternalSettings: modules.HostExternalSettings{NetAddress: "host.example.com:9982"}}
+	if subnets := hostSubnets(host); len(subnets) != 0 {
+		t.Error("expected no subnets for an unscanned host name, got", subnets)
+	}
+}
+
+// TestRandomHostsIPDiversity checks that a profile enforcing IP diversity never
+// selects two hosts of the same subnet.
+func TestRandomHostsIPDiversity(t *testing.T) {
+	hdb, err := newProfileHostDB(t.Name(), "diverse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdb.initialScanComplete = true
+	if err := hdb.hostdbProfiles.ConfigHostDBProfiles("diverse", "enforceipdiversity", "true"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Insert several hosts in one subnet and one host in another subnet.
+	for i := 0; i < 5; i++ {
+		entry := makeHostDBEntry()
+		entry.Country = "Germany"
+		entry.NetAddress = modules.NetAddress(fmt.Sprintf("10.0.0.%d:9982", i+1))
+		if err := hdb.hostTrees.Insert(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	other := makeHostDBEntry()
+	other.Country = "Germany"
+	other.NetAddress = "other.example.com:9982"
+	other.IPNets = []string{"10.0.1.0/24"}
+	if err := hdb.hostTrees.Insert(other); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only one host per subnet is counted as selectable.
+	if n := hdb.selectableHosts("diverse"); n != 2 {
+		t.Fatal("expected one selectable host per subnet, got", n)
+	}
+	if n := hdb.selectableHosts("default"); n != 6 {
+		t.Fatal("expected all hosts to be selectable by the default profile, got", n)
+	}
+
+	for i := 0; i < 10; i++ {
+		hosts, err := hdb.RandomHosts("diverse", 6, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(hosts) != 2 {
+			t.Fatal("expected one host per subnet, got", len(hosts))
+		}
+		if hostSubnets(hosts[0])[0] == hostSubnets(hosts[1])[0] {
+			t.Fatal("selected two hosts of the same subnet:", hosts[0].NetAddress, hosts[1].NetAddress)
+		}
+	}
+
+	// Without IP diversity all hosts are selected.
+	hosts, err := hdb.RandomHosts("default", 6, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hosts) != 6 {
+		t.Fatal("expected all hosts to be selected by the default profile, got", len(hosts))
+	}
+}
@@ -0,0 +1,49 @@
+package hostdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/pachisi456/sia-hostdb-profiles/build"
+)
+
+// Levels of the structured hostdb log entries.
+const (
+	logLevelDebug = "debug"
+	logLevelInfo  = "info"
+	logLevelWarn  = "warn"
+	logLevelError = "error"
+)
+
+// logEntry is a structured entry of the hostdb log. It describes a selection,
+// scan or save event. Fields that don't apply to an event are left empty.
+type logEntry struct {
+	Time    time.Time `json:"time"`
+	Level   string    `json:"level"`
+	Message string    `json:"message"`
+	Host    string    `json:"host,omitempty"`
+	Profile string    `json:"profile,omitempty"`
+	Reason  string    `json:"reason,omitempty"`
+}
+
+// logEvent logs a selection, scan or save event of the hostdb. If JSON logging
+// is enabled in the scan settings the entry is written as a single line JSON
+// object, otherwise the plain text line described by format is logged. Debug
+// events are only logged if build.DEBUG is true.
+func (hdb *HostDB) logEvent(entry logEntry, format string, v ...interface{}) {
+	if entry.Level == logLevelDebug && !build.DEBUG {
+		return
+	}
+	if !hdb.scanSettings.JSONLog {
+		hdb.log.Output(2, fmt.Sprintf(format, v...))
+		return
+	}
+	entry.Time = hdb.deps.Now().UTC()
+	b, err := json.Marshal(entry)
+	if err != nil {
+		hdb.log.Output(2, fmt.Sprintf(format, v...))
+		return
+	}
+	hdb.log.Writer().Write(append(b, '\n'))
+}
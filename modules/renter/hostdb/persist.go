@@ -1,9 +1,11 @@
 package hostdb
 
 import (
+	"errors"
+	"fmt"
 	"path/filepath"
-	"time"
 
+	"github.com/pachisi456/sia-hostdb-profiles/build"
 	"github.com/pachisi456/sia-hostdb-profiles/modules"
 	"github.com/pachisi456/sia-hostdb-profiles/persist"
 	"github.com/pachisi456/sia-hostdb-profiles/types"
@@ -11,6 +13,10 @@ import (
 )
 
 var (
+	// errPersistVersionTooNew is returned when the hostdb persistence file was
+	// written by a newer version of siad than the one running.
+	errPersistVersionTooNew = errors.New("hostdb persistence file was written by a newer version of siad")
+
 	// persistFilename defines the name of the file that holds the hostdb's
 	// persistence.
 	persistFilename = "hostdb.json"
@@ -25,15 +31,17 @@ var (
 
 // hdbPersist defines what HostDB data persists across sessions.
 type hdbPersist struct {
-	Profiles    map[string]*hostdbprofile.HostDBProfile
-	AllHosts    []modules.HostDBEntry
-	BlockHeight types.BlockHeight
-	LastChange  modules.ConsensusChangeID
+	Profiles      map[string]*hostdbprofile.HostDBProfile
+	ActiveProfile string
+	AllHosts      []modules.HostDBEntry
+	BlockHeight   types.BlockHeight
+	LastChange    modules.ConsensusChangeID
 }
 
 // persistData returns the data in the hostdb that will be saved to disk.
 func (hdb *HostDB) persistData() (data hdbPersist) {
 	data.Profiles = hdb.HostDBProfiles()
+	data.ActiveProfile = hdb.activeProfile
 
 	// This is nothing hostdb profile specific so the default host tree can be used.
 	data.AllHosts = hdb.hostTrees.All("default")
@@ -48,13 +56,47 @@ func (hdb *HostDB) saveSync() error {
 	return hdb.deps.SaveFileSync(persistMetadata, hdb.persistData(), filepath.Join(hdb.persistDir, persistFilename))
 }
 
+// managedSaveSyncRetry saves the hostdb persistence data like saveSync,
+// retrying failed saves with an increasing backoff so that transient disk
+// errors don't lose changes to the hostdb profiles until the next periodic
+// save. The error of the last attempt is returned.
+func (hdb *HostDB) managedSaveSyncRetry() error {
+	backoff := saveBackoff
+	var err error
+	for attempt := 1; attempt <= saveAttempts; attempt++ {
+		hdb.mu.Lock()
+		err = hdb.saveSync()
+		hdb.mu.Unlock()
+		if err == nil || attempt == saveAttempts {
+			break
+		}
+		hdb.logEvent(logEntry{Level: logLevelWarn, Message: fmt.Sprintf("saving the hostdb failed (attempt %v of %v)", attempt, saveAttempts), Reason: err.Error()},
+			"Saving the hostdb failed (attempt %v of %v): %v", attempt, saveAttempts, err)
+		select {
+		case <-hdb.tg.StopChan():
+			return err
+		case <-hdb.deps.After(backoff):
+		}
+		backoff *= 2
+	}
+	return err
+}
+
 // load loads the hostdb persistence data from disk and returns all hosts found
-// in the hostdb persistence data.
+// in the hostdb persistence data. A file written by a newer version of siad,
+// e.g. before a downgrade, results in errPersistVersionTooNew. The hostdb fails
+// to start in that case, so the file is never overwritten.
 func (hdb *HostDB) load() (error, []modules.HostDBEntry) {
 	// Fetch the data from the file.
 	var data hdbPersist
-	err := hdb.deps.LoadFile(persistMetadata, &data, filepath.Join(hdb.persistDir, persistFilename))
+	filename := filepath.Join(hdb.persistDir, persistFilename)
+	err := hdb.deps.LoadFile(persistMetadata, &data, filename)
 	if err != nil {
+		if meta, metaErr := persist.ReadMetadata(filename); metaErr == nil && meta.Header == persistMetadata.Header &&
+			build.IsVersion(meta.Version) && build.VersionCmp(meta.Version, persistMetadata.Version) > 0 {
+			return fmt.Errorf("%w: %v has version %v but only version %v is supported, upgrade siad or move the file away to start with an empty hostdb",
+				errPersistVersionTooNew, filename, meta.Version, persistMetadata.Version), nil
+		}
 		return err, nil
 	}
 
@@ -63,25 +105,73 @@ func (hdb *HostDB) load() (error, []modules.HostDBEntry) {
 		// if no hostdb profile data could be loaded the calling function will add
 		// the default profile
 		hdb.hostdbProfiles.SetHostDBProfiles(data.Profiles)
+
+		// The persist file might have been edited by hand or written by an
+		// incompatible version, repair any invalid profiles.
+		if err := hdb.hostdbProfiles.Validate(); err != nil {
+			hdb.log.Println("WARN: repairing invalid hostdb profiles:", err)
+			hdb.hostdbProfiles.Repair()
+		}
+	}
+	// Fall back to the default profile if the active profile no longer exists.
+	hdb.activeProfile = data.ActiveProfile
+	if _, err := hdb.hostdbProfiles.Profile(hdb.activeProfile); hdb.activeProfile != "" && err != nil {
+		hdb.log.Println("WARN: resetting the active hostdb profile:", err)
+		hdb.activeProfile = ""
 	}
 	hdb.blockHeight = data.BlockHeight
 	hdb.lastChange = data.LastChange
 	return nil, data.AllHosts
 }
 
-// threadedSaveLoop saves the hostdb to disk every 2 minutes, also saving when
-// given the shutdown signal.
+// PersistInfo returns the metadata of the hostdb persistence file on disk. If
+// the metadata matches the current persist version, the block height, last
+// consensus change and number of profiles in the file are returned as well.
+func (hdb *HostDB) PersistInfo() (modules.HostDBPersistInfo, error) {
+	// Hold the lock so that the file isn't saved while it is read.
+	hdb.mu.Lock()
+	defer hdb.mu.Unlock()
+
+	filename := filepath.Join(hdb.persistDir, persistFilename)
+	meta, err := persist.ReadMetadata(filename)
+	if err != nil {
+		return modules.HostDBPersistInfo{}, err
+	}
+	info := modules.HostDBPersistInfo{
+		Header:  meta.Header,
+		Version: meta.Version,
+	}
+	if meta != persistMetadata {
+		return info, nil
+	}
+	var data hdbPersist
+	if err := hdb.deps.LoadFile(persistMetadata, &data, filename); err != nil {
+		return modules.HostDBPersistInfo{}, err
+	}
+	info.BlockHeight = data.BlockHeight
+	info.LastChange = data.LastChange
+	info.Profiles = len(data.Profiles)
+	return info, nil
+}
+
+// threadedSaveLoop saves the hostdb to disk every SaveFrequency, also saving
+// when given the shutdown signal. Before each save hosts exceeding the maximum
+// size of the hostdb are evicted.
 func (hdb *HostDB) threadedSaveLoop() {
 	for {
 		select {
 		case <-hdb.tg.StopChan():
 			return
-		case <-time.After(saveFrequency):
+		case <-hdb.deps.After(hdb.scanSettings.SaveFrequency):
+			if evicted := hdb.managedEvictHosts(); evicted > 0 {
+				hdb.log.Println("Evicted hosts from the hostdb:", evicted)
+			}
 			hdb.mu.Lock()
 			err := hdb.saveSync()
 			hdb.mu.Unlock()
 			if err != nil {
-				hdb.log.Println("Difficulties saving the hostdb:", err)
+				hdb.logEvent(logEntry{Level: logLevelError, Message: "difficulties saving the hostdb", Reason: err.Error()},
+					"Difficulties saving the hostdb: %v", err)
 			}
 		}
 	}
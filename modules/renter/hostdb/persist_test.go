@@ -1,10 +1,23 @@
 package hostdb
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/pachisi456/sia-hostdb-profiles/build"
 	"github.com/pachisi456/sia-hostdb-profiles/modules"
+	"github.com/pachisi456/sia-hostdb-profiles/modules/renter/hostdb/hostdbprofile"
+	"github.com/pachisi456/sia-hostdb-profiles/modules/renter/hostdb/hosttree"
+	"github.com/pachisi456/sia-hostdb-profiles/persist"
 )
 
 // quitAfterLoadDeps will quit startup in newHostDB
@@ -88,8 +101,8 @@ func TestSaveLoad(t *testing.T) {
 	h1, ok0 := hdbt.hdb.hostTrees.Select(host1.PublicKey)
 	h2, ok1 := hdbt.hdb.hostTrees.Select(host2.PublicKey)
 	h3, ok2 := hdbt.hdb.hostTrees.Select(host3.PublicKey)
-	if !ok0 || !ok1 || !ok2 || len(hdbt.hdb.hostTrees.All()) != 3 {
-		t.Error("allHosts was not restored properly", ok0, ok1, ok2, len(hdbt.hdb.hostTrees.All()))
+	if !ok0 || !ok1 || !ok2 || len(hdbt.hdb.hostTrees.All("default")) != 3 {
+		t.Error("allHosts was not restored properly", ok0, ok1, ok2, len(hdbt.hdb.hostTrees.All("default")))
 	}
 	if h1.FirstSeen != 1 {
 		t.Error("h1 block height loaded incorrectly")
@@ -115,3 +128,535 @@ func TestRescan(t *testing.T) {
 
 	t.Skip("create two consensus sets with blocks + announcements")
 }
+
+// TestLoadCachedCountry checks that the countries of the hosts are persisted and
+// used for location filtering if the geolocation database is unavailable.
+func TestLoadCachedCountry(t *testing.T) {
+	hdb, err := newProfileHostDB(t.Name(), "german")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := hdb.hostdbProfiles.ConfigHostDBProfiles("german", "addlocation", "germany"); err != nil {
+		t.Fatal(err)
+	}
+	german := makeHostDBEntry()
+	german.Country = "Germany"
+	chinese := makeHostDBEntry()
+	chinese.Country = "China"
+	for _, entry := range []modules.HostDBEntry{german, chinese} {
+		if err := hdb.hostTrees.Insert(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := hdb.saveSync(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Load the hosts into a new hostdb without geolocation database.
+	hdb2 := &HostDB{
+		deps:                modules.ProdDependencies,
+		log:                 hdb.log,
+		persistDir:          hdb.persistDir,
+		hostdbProfiles:      hostdbprofile.NewHostDBProfiles(),
+		hostTrees:           hosttree.NewHostTrees(),
+		scanMap:             make(map[string]struct{}),
+		scanSettings:        DefaultScanSettings(),
+		initialScanComplete: true,
+	}
+	// Stop the thread group so that loading the hosts doesn't start scans.
+	if err := hdb2.tg.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	err, allHosts := hdb2.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := hdb2.loadHostTrees(allHosts); err != nil {
+		t.Fatal(err)
+	}
+	host, exists := hdb2.hostTrees.Select(german.PublicKey)
+	if !exists || host.Country != "Germany" {
+		t.Fatal("country of host was not persisted:", host.Country)
+	}
+
+	// A scan without geolocation database should keep the cached country.
+	rescanned := german
+	rescanned.Country = ""
+	hdb2.updateEntry(rescanned, nil)
+	if host, _ := hdb2.hostTrees.Select(german.PublicKey); host.Country != "Germany" {
+		t.Fatal("cached country was dropped by scan:", host.Country)
+	}
+
+	hosts, err := hdb2.RandomHosts("german", 5, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hosts) != 1 || hosts[0].PublicKey.String() != german.PublicKey.String() {
+		t.Fatal("expected only the german host to be selected, got", len(hosts), "hosts")
+	}
+}
+
+// fakeClockDeps replaces the clock with one that only advances when told to.
+type fakeClockDeps struct {
+	modules.ProductionDependencies
+	now    time.Time
+	timers []fakeTimer
+	mu     sync.Mutex
+}
+
+// fakeTimer is a timer of the fakeClockDeps which fires at its deadline.
+type fakeTimer struct {
+	deadline time.Time
+	c        chan time.Time
+}
+
+// After returns a channel which receives the time once the clock has been
+// advanced by at least d.
+func (d *fakeClockDeps) After(dur time.Duration) <-chan time.Time {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	c := make(chan time.Time, 1)
+	d.timers = append(d.timers, fakeTimer{deadline: d.now.Add(dur), c: c})
+	return c
+}
+
+// Now returns the current time of the clock.
+func (d *fakeClockDeps) Now() time.Time {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.now
+}
+
+// advance moves the clock forward by dur, firing all timers that are due.
+func (d *fakeClockDeps) advance(dur time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.now = d.now.Add(dur)
+	var pending []fakeTimer
+	for _, timer := range d.timers {
+		if timer.deadline.After(d.now) {
+			pending = append(pending, timer)
+			continue
+		}
+		timer.c <- d.now
+	}
+	d.timers = pending
+}
+
+// numTimers returns the number of timers that haven't fired yet.
+func (d *fakeClockDeps) numTimers() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.timers)
+}
+
+// TestSaveLoopClock checks that the save loop saves the hostdb once the save
+// frequency has passed, and not before.
+func TestSaveLoopClock(t *testing.T) {
+	hdb, err := newProfileHostDB(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	deps := &fakeClockDeps{now: time.Now()}
+	hdb.deps = deps
+	persistFile := filepath.Join(hdb.persistDir, persistFilename)
+	if err := os.Remove(persistFile); err != nil {
+		t.Fatal(err)
+	}
+
+	go hdb.threadedSaveLoop()
+	defer hdb.tg.Stop()
+	waitForTimer := func() {
+		err := build.Retry(100, 10*time.Millisecond, func() error {
+			if deps.numTimers() == 0 {
+				return errors.New("save loop is not waiting")
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitForTimer()
+
+	// Nothing is saved before the save frequency has passed.
+	deps.advance(hdb.scanSettings.SaveFrequency - time.Second)
+	if _, err := os.Stat(persistFile); !os.IsNotExist(err) {
+		t.Fatal("hostdb was saved too early:", err)
+	}
+
+	// Once it has passed the hostdb is saved and the loop waits again.
+	deps.advance(time.Second)
+	err = build.Retry(100, 10*time.Millisecond, func() error {
+		_, err := os.Stat(persistFile)
+		return err
+	})
+	if err != nil {
+		t.Fatal("hostdb was not saved:", err)
+	}
+	waitForTimer()
+}
+
+// TestActiveProfile checks that the active hostdb profile can be set and is
+// persisted.
+func TestActiveProfile(t *testing.T) {
+	hdb, err := newProfileHostDB(t.Name(), "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if profile := hdb.ActiveProfile(); profile != "default" {
+		t.Fatal("expected default profile to be active, got", profile)
+	}
+	if err := hdb.SetActiveProfile("missing"); err == nil {
+		t.Fatal("expected error setting an unknown profile active")
+	}
+	if err := hdb.SetActiveProfile("archive"); err != nil {
+		t.Fatal(err)
+	}
+	if profile := hdb.ActiveProfile(); profile != "archive" {
+		t.Fatal("expected archive profile to be active, got", profile)
+	}
+
+	// Read the active profile back from disk.
+	hdb2 := &HostDB{
+		deps:           modules.ProdDependencies,
+		log:            hdb.log,
+		persistDir:     hdb.persistDir,
+		hostdbProfiles: hostdbprofile.NewHostDBProfiles(),
+	}
+	if err, _ := hdb2.load(); err != nil {
+		t.Fatal(err)
+	}
+	if profile := hdb2.ActiveProfile(); profile != "archive" {
+		t.Fatal("expected archive profile to be active after loading, got", profile)
+	}
+}
+
+// TestHostTags checks that the tags of a host are normalized and survive
+// reloading the hostdb.
+func TestHostTags(t *testing.T) {
+	hdb, err := newProfileHostDB(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	host := makeHostDBEntry()
+	if err := hdb.hostTrees.Insert(host); err != nil {
+		t.Fatal(err)
+	}
+	if err := hdb.SetHostTags(host.PublicKey, []string{" known-good", "cheap", "known-good"}); err != nil {
+		t.Fatal(err)
+	}
+	if entry, _ := hdb.Host(host.PublicKey); !reflect.DeepEqual(entry.Tags, []string{"cheap", "known-good"}) {
+		t.Fatal("unexpected tags:", entry.Tags)
+	}
+
+	// Invalid tags and unknown hosts are rejected without changing the tags.
+	for _, tags := range [][]string{{""}, {"flaky,cheap"}, {"bad\ttag"}, {strings.Repeat("a", maxHostTagLen+1)}} {
+		if err := hdb.SetHostTags(host.PublicKey, tags); !errors.Is(err, errInvalidHostTag) {
+			t.Errorf("expected %q to be rejected, got %v", tags, err)
+		}
+	}
+	tooMany := make([]string, maxHostTags+1)
+	for i := range tooMany {
+		tooMany[i] = fmt.Sprint("tag", i)
+	}
+	if err := hdb.SetHostTags(host.PublicKey, tooMany); !errors.Is(err, errTooManyHostTags) {
+		t.Error("expected too many tags to be rejected, got", err)
+	}
+	if err := hdb.SetHostTags(makeHostDBEntry().PublicKey, []string{"flaky"}); !errors.Is(err, errUnknownHost) {
+		t.Error("expected tagging an unknown host to fail, got", err)
+	}
+
+	// Read the tags back from disk.
+	hdb2 := &HostDB{
+		deps:           modules.ProdDependencies,
+		log:            hdb.log,
+		persistDir:     hdb.persistDir,
+		hostdbProfiles: hostdbprofile.NewHostDBProfiles(),
+	}
+	err, hosts := hdb2.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hosts) != 1 || !reflect.DeepEqual(hosts[0].Tags, []string{"cheap", "known-good"}) {
+		t.Fatal("tags were not persisted:", hosts)
+	}
+
+	// An empty list removes the tags.
+	if err := hdb.SetHostTags(host.PublicKey, nil); err != nil {
+		t.Fatal(err)
+	}
+	if entry, _ := hdb.Host(host.PublicKey); len(entry.Tags) != 0 {
+		t.Fatal("expected the tags to be removed, got", entry.Tags)
+	}
+}
+
+// TestPersistInfo checks that the persist info reports the metadata and
+// contents of the hostdb persistence file on disk.
+func TestPersistInfo(t *testing.T) {
+	hdb, err := newProfileHostDB(t.Name(), "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdb.blockHeight = 42
+	if err := hdb.saveSync(); err != nil {
+		t.Fatal(err)
+	}
+	info, err := hdb.PersistInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Header != persistMetadata.Header || info.Version != persistMetadata.Version {
+		t.Fatalf("expected metadata %v, got %q %q", persistMetadata, info.Header, info.Version)
+	}
+	if info.BlockHeight != 42 || info.Profiles != 2 {
+		t.Fatal("wrong persist info:", info)
+	}
+
+	// A file written by another version only reports its metadata.
+	oldMetadata := persist.Metadata{Header: persistMetadata.Header, Version: "0.4"}
+	if err := persist.SaveJSON(oldMetadata, hdb.persistData(), filepath.Join(hdb.persistDir, persistFilename)); err != nil {
+		t.Fatal(err)
+	}
+	info, err = hdb.PersistInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Version != "0.4" || info.BlockHeight != 0 || info.Profiles != 0 {
+		t.Fatal("wrong persist info for an old version:", info)
+	}
+}
+
+// TestLoadNewerVersion checks that a hostdb persistence file written by a newer
+// version of siad is reported with a clear error and isn't overwritten.
+func TestLoadNewerVersion(t *testing.T) {
+	hdb, err := newProfileHostDB(t.Name(), "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(hdb.persistDir, persistFilename)
+	futureMetadata := persist.Metadata{Header: persistMetadata.Header, Version: "9.0"}
+	if err := persist.SaveJSON(futureMetadata, hdb.persistData(), filename); err != nil {
+		t.Fatal(err)
+	}
+	before, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err, _ := hdb.load(); !errors.Is(err, errPersistVersionTooNew) {
+		t.Fatal("expected errPersistVersionTooNew, got", err)
+	}
+
+	// Starting a hostdb on the file fails the same way and leaves the file
+	// untouched.
+	_, err = newCustomHostDB(onlineGateway{}, nil, hdb.persistDir, modules.ProdDependencies, "warm", nil, ScanSettings{}, false)
+	if !errors.Is(err, errPersistVersionTooNew) {
+		t.Fatal("expected errPersistVersionTooNew, got", err)
+	}
+	after, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Fatal("persistence file was modified")
+	}
+
+	// Files of an older version still fail with the generic error.
+	oldMetadata := persist.Metadata{Header: persistMetadata.Header, Version: "0.4"}
+	if err := persist.SaveJSON(oldMetadata, hdb.persistData(), filename); err != nil {
+		t.Fatal(err)
+	}
+	if err, _ := hdb.load(); err == nil || errors.Is(err, errPersistVersionTooNew) {
+		t.Fatal("expected a generic load error, got", err)
+	}
+}
+
+// TestDeleteHostDBProfile checks that deleting the active hostdb profile fails
+// unless the fallback to the default profile is requested.
+func TestDeleteHostDBProfile(t *testing.T) {
+	hdb, err := newProfileHostDB(t.Name(), "archive", "scratch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := hdb.DeleteHostDBProfile("default", true); err == nil {
+		t.Fatal("expected error deleting the default profile")
+	}
+	if _, err := hdb.DeleteHostDBProfile("missing", false); err == nil {
+		t.Fatal("expected error deleting an unknown profile")
+	}
+
+	// A profile that is not active can be deleted without falling back.
+	fellBack, err := hdb.DeleteHostDBProfile("scratch", false)
+	if err != nil {
+		t.Fatal(err)
+	} else if fellBack {
+		t.Fatal("deleting an inactive profile should not fall back")
+	}
+
+	// Deleting the active profile fails without the fallback.
+	if err := hdb.SetActiveProfile("archive"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := hdb.DeleteHostDBProfile("archive", false); !errors.Is(err, errProfileInUse) {
+		t.Fatal("expected errProfileInUse, got", err)
+	}
+	if profile := hdb.ActiveProfile(); profile != "archive" {
+		t.Fatal("expected archive profile to stay active, got", profile)
+	}
+
+	// With the fallback the default profile becomes active.
+	fellBack, err = hdb.DeleteHostDBProfile("archive", true)
+	if err != nil {
+		t.Fatal(err)
+	} else if !fellBack {
+		t.Fatal("expected deleting the active profile to fall back")
+	}
+	if profile := hdb.ActiveProfile(); profile != "default" {
+		t.Fatal("expected default profile to be active, got", profile)
+	}
+	if _, exists := hdb.HostDBProfiles()["archive"]; exists {
+		t.Fatal("archive profile was not deleted")
+	}
+	if names := hdb.hostTrees.Names(); !reflect.DeepEqual(names, []string{"default"}) {
+		t.Fatal("expected only the default tree to remain, got", names)
+	}
+}
+
+// TestReconcileProfilesAndTrees checks that a host tree is created for a
+// persisted hostdb profile that lacks one and that trees without a profile are
+// removed.
+func TestReconcileProfilesAndTrees(t *testing.T) {
+	hdb, err := newProfileHostDB(t.Name(), "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	host := makeHostDBEntry()
+	host.Country = "Germany"
+	if err := hdb.hostTrees.Insert(host); err != nil {
+		t.Fatal(err)
+	}
+	if err := hdb.saveSync(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Load the persistence file, but only create the default tree and an empty
+	// tree that doesn't belong to any profile.
+	hdb2 := &HostDB{
+		deps:           modules.ProdDependencies,
+		log:            hdb.log,
+		persistDir:     hdb.persistDir,
+		hostdbProfiles: hostdbprofile.NewHostDBProfiles(),
+		hostTrees:      hosttree.NewHostTrees(),
+	}
+	err, allHosts := hdb2.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := hdb2.hostTrees.AddHostTree("default", hosttree.NewHostTree(hdb2.calculateHostWeight, "default")); err != nil {
+		t.Fatal(err)
+	}
+	if err := hdb2.hostTrees.InsertBatch(allHosts); err != nil {
+		t.Fatal(err)
+	}
+	if err := hdb2.hostTrees.AddHostTree("orphan", hosttree.NewHostTree(hdb2.calculateHostWeight, "orphan")); err != nil {
+		t.Fatal(err)
+	}
+
+	hdb2.reconcileProfilesAndTrees()
+	if names := hdb2.hostTrees.Names(); !reflect.DeepEqual(names, []string{"archive", "default"}) {
+		t.Fatal("expected a tree for each profile, got", names)
+	}
+	if hosts := hdb2.hostTrees.All("archive"); len(hosts) != 1 || hosts[0].PublicKey.String() != host.PublicKey.String() {
+		t.Fatal("created tree does not contain the known hosts:", hosts)
+	}
+}
+
+// failingSaveDeps fails the next failures calls to SaveFileSync.
+type failingSaveDeps struct {
+	modules.ProductionDependencies
+	failures int
+	attempts int
+	mu       sync.Mutex
+}
+
+// errSaveFailed is returned by failingSaveDeps for a failed save.
+var errSaveFailed = errors.New("save failed")
+
+// SaveFileSync fails if there are failures left and saves the data otherwise.
+func (d *failingSaveDeps) SaveFileSync(meta persist.Metadata, data interface{}, filename string) error {
+	d.mu.Lock()
+	d.attempts++
+	fail := d.failures > 0
+	if fail {
+		d.failures--
+	}
+	d.mu.Unlock()
+	if fail {
+		return errSaveFailed
+	}
+	return d.ProductionDependencies.SaveFileSync(meta, data, filename)
+}
+
+// fail makes the next n saves fail and resets the number of attempts.
+func (d *failingSaveDeps) fail(n int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.failures = n
+	d.attempts = 0
+}
+
+// numAttempts returns the number of saves attempted since the last call to
+// fail.
+func (d *failingSaveDeps) numAttempts() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.attempts
+}
+
+// TestSaveRetry checks that transient failures to save changes to the hostdb
+// profiles are retried and that the error is returned once all attempts have
+// failed.
+func TestSaveRetry(t *testing.T) {
+	hdb, err := newProfileHostDB(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdb.initialScanComplete = true
+	deps := &failingSaveDeps{}
+	hdb.deps = deps
+
+	// A transient failure is retried and the change is saved.
+	deps.fail(saveAttempts - 1)
+	if err := hdb.AddHostDBProfiles("archive", "cold"); err != nil {
+		t.Fatal(err)
+	}
+	if n := deps.numAttempts(); n != saveAttempts {
+		t.Fatalf("expected %v attempts, got %v", saveAttempts, n)
+	}
+	hdb2 := &HostDB{
+		deps:           modules.ProdDependencies,
+		log:            hdb.log,
+		persistDir:     hdb.persistDir,
+		hostdbProfiles: hostdbprofile.NewHostDBProfiles(),
+	}
+	if err, _ := hdb2.load(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := hdb2.Profile("archive"); err != nil {
+		t.Fatal("added profile was not saved:", err)
+	}
+
+	// Once all attempts fail the error is returned.
+	deps.fail(saveAttempts)
+	if _, err := hdb.ConfigHostDBProfile("archive", "note", "tapes"); !errors.Is(err, errSaveFailed) {
+		t.Fatal("expected errSaveFailed, got", err)
+	}
+	if n := deps.numAttempts(); n != saveAttempts {
+		t.Fatalf("expected %v attempts, got %v", saveAttempts, n)
+	}
+	deps.fail(saveAttempts)
+	if _, err := hdb.DeleteHostDBProfile("archive", false); !errors.Is(err, errSaveFailed) {
+		t.Fatal("expected errSaveFailed, got", err)
+	}
+}
@@ -5,6 +5,8 @@ package hostdb
 // settings of the hosts.
 
 import (
+	"fmt"
+	"io"
 	"net"
 	"sort"
 	"time"
@@ -14,6 +16,7 @@ import (
 	"github.com/pachisi456/sia-hostdb-profiles/encoding"
 	"github.com/pachisi456/sia-hostdb-profiles/modules"
 	"github.com/NebulousLabs/fastrand"
+	"github.com/oschwald/geoip2-golang"
 )
 
 // queueScan will add a host to the queue to be scanned. The host will be added
@@ -34,6 +37,54 @@ func (hdb *HostDB) queueScan(entry modules.HostDBEntry) {
 		j := fastrand.Intn(i)
 		hdb.scanList[i], hdb.scanList[j] = hdb.scanList[j], hdb.scanList[i]
 	}
+	hdb.spawnScanThread()
+}
+
+// queuePriorityScan works like queueScan, but the host is scanned before all
+// hosts queued by queueScan. Prioritized hosts are scanned in the order they
+// were queued. A host that is already waiting in the regular scan list is
+// moved to the priority scan list.
+func (hdb *HostDB) queuePriorityScan(entry modules.HostDBEntry) {
+	key := entry.PublicKey.String()
+	if _, exists := hdb.scanMap[key]; exists {
+		for i, queued := range hdb.scanList {
+			if queued.PublicKey.String() == key {
+				hdb.scanList = append(hdb.scanList[:i], hdb.scanList[i+1:]...)
+				hdb.priorityScanList = append(hdb.priorityScanList, queued)
+				break
+			}
+		}
+		return
+	}
+	hdb.scanMap[key] = struct{}{}
+	hdb.priorityScanList = append(hdb.priorityScanList, entry)
+	hdb.spawnScanThread()
+}
+
+// queuedScans returns the number of hosts waiting to be sent to a scanning
+// thread.
+func (hdb *HostDB) queuedScans() int {
+	return len(hdb.priorityScanList) + len(hdb.scanList)
+}
+
+// nextScan removes the next host to be scanned from the scan lists and returns
+// it. Prioritized hosts are returned first. The scan lists must not be empty.
+func (hdb *HostDB) nextScan() modules.HostDBEntry {
+	var entry modules.HostDBEntry
+	if len(hdb.priorityScanList) > 0 {
+		entry = hdb.priorityScanList[0]
+		hdb.priorityScanList = hdb.priorityScanList[1:]
+	} else {
+		entry = hdb.scanList[0]
+		hdb.scanList = hdb.scanList[1:]
+	}
+	delete(hdb.scanMap, entry.PublicKey.String())
+	return entry
+}
+
+// spawnScanThread spawns a thread emptying the scan lists unless one is
+// running already. The hostdb's lock must be held by the caller.
+func (hdb *HostDB) spawnScanThread() {
 	// Check if any thread is currently emptying the waitlist. If not, spawn a
 	// thread to empty the waitlist.
 	if hdb.scanWait {
@@ -43,8 +94,8 @@ func (hdb *HostDB) queueScan(entry modules.HostDBEntry) {
 
 	// Sanity check - the scan map and the scan list should have the same
 	// length.
-	if build.DEBUG && len(hdb.scanMap) > len(hdb.scanList)+maxScanningThreads {
-		hdb.log.Critical("The hostdb scan map has seemingly grown too large:", len(hdb.scanMap), len(hdb.scanList), maxScanningThreads)
+	if build.DEBUG && len(hdb.scanMap) > hdb.queuedScans()+hdb.scanSettings.ScanningThreads {
+		hdb.log.Critical("The hostdb scan map has seemingly grown too large:", len(hdb.scanMap), hdb.queuedScans(), hdb.scanSettings.ScanningThreads)
 	}
 
 	hdb.scanWait = true
@@ -71,9 +122,9 @@ func (hdb *HostDB) queueScan(entry modules.HostDBEntry) {
 		// deadlock.
 		starterThread := false
 		for {
-			// If the scanList is empty, this thread can spin down.
+			// If the scan lists are empty, this thread can spin down.
 			hdb.mu.Lock()
-			if len(hdb.scanList) == 0 {
+			if hdb.queuedScans() == 0 {
 				// Scan list is empty, can exit. Let the world know that nobody
 				// is emptying the scan list anymore.
 				hdb.scanWait = false
@@ -81,11 +132,9 @@ func (hdb *HostDB) queueScan(entry modules.HostDBEntry) {
 				return
 			}
 
-			// Get the next host, shrink the scan list.
-			entry := hdb.scanList[0]
-			hdb.scanList = hdb.scanList[1:]
-			delete(hdb.scanMap, entry.PublicKey.String())
-			scansRemaining := len(hdb.scanList)
+			// Get the next host, shrink the scan lists.
+			entry := hdb.nextScan()
+			scansRemaining := hdb.queuedScans()
 
 			// Grab the most recent entry for this host.
 			recentEntry, exists := hdb.hostTrees.Select(entry.PublicKey)
@@ -103,7 +152,7 @@ func (hdb *HostDB) queueScan(entry modules.HostDBEntry) {
 			}
 
 			// Create new worker thread.
-			if hdb.scanningThreads < maxScanningThreads || !starterThread {
+			if hdb.scanningThreads < hdb.scanSettings.ScanningThreads || !starterThread {
 				starterThread = true
 				hdb.scanningThreads++
 				go func() {
@@ -144,6 +193,8 @@ func (hdb *HostDB) updateEntry(entry modules.HostDBEntry, netErr error) {
 	newEntry, exists := hdb.hostTrees.Select(entry.PublicKey)
 	if exists {
 		newEntry.HostExternalSettings = entry.HostExternalSettings
+		newEntry.Latency = entry.Latency
+		newEntry.Bandwidth = entry.Bandwidth
 	} else {
 		newEntry = entry
 	}
@@ -171,7 +222,8 @@ func (hdb *HostDB) updateEntry(entry modules.HostDBEntry, netErr error) {
 		}
 	} else {
 		if newEntry.ScanHistory[len(newEntry.ScanHistory)-1].Success && netErr != nil {
-			hdb.log.Debugf("Host %v is being downgraded from an online host to an offline host: %v\n", newEntry.PublicKey.String(), netErr)
+			hdb.logEvent(logEntry{Level: logLevelDebug, Message: "host downgraded from online to offline", Host: newEntry.PublicKey.String(), Reason: netErr.Error()},
+				"Host %v is being downgraded from an online host to an offline host: %v", newEntry.PublicKey.String(), netErr)
 		}
 
 		// Make sure that the current time is after the timestamp of the
@@ -224,18 +276,8 @@ func (hdb *HostDB) updateEntry(entry modules.HostDBEntry, netErr error) {
 		newEntry.ScanHistory = newEntry.ScanHistory[1:]
 	}
 
-	// Determine host location (country).
-	ip, err := net.LookupIP(newEntry.NetAddress.Host())
-	if err != nil || ip[0] == nil {
-		hdb.log.Println("ERROR: could not identify IP address of host:", err)
-	} else {
-		record, err := hdb.ipdb.Country(ip[0])
-		if err != nil {
-			hdb.log.Println("ERROR: Could not determine host location:", err)
-		}
-		newEntry.Country = record.Country.Names["en"]
-		newEntry.EUhost = record.Country.IsInEuropeanUnion
-	}
+	// Determine host subnets and location (country).
+	hdb.updateHostLocation(&newEntry)
 
 	// Add the updated entry
 	if !exists {
@@ -255,6 +297,139 @@ func (hdb *HostDB) updateEntry(entry modules.HostDBEntry, netErr error) {
 	}
 }
 
+// locationResolver can be implemented by the dependencies of the hostdb to
+// resolve the location of hosts without the geolocation database, e.g. to
+// place hosts running on localhost in different countries during testing.
+type locationResolver interface {
+	ResolveLocation(modules.NetAddress) (country string, eu bool, ok bool)
+}
+
+// ipGeolocator can be implemented by the dependencies of the hostdb to replace
+// the GeoLite2 geolocation database with a custom geo-IP source. If the
+// dependencies implement it, the database is never downloaded and all IP
+// addresses are located through GeolocateIP instead.
+type ipGeolocator interface {
+	GeolocateIP(net.IP) (country string, eu bool, err error)
+}
+
+// bandwidthMeasurer can be implemented by the dependencies of the hostdb to
+// replace the bandwidth measured while scanning a host, e.g. to simulate slow
+// hosts. MeasureBandwidth returns the bandwidth of the host at the provided
+// address in bytes per second.
+type bandwidthMeasurer interface {
+	MeasureBandwidth(modules.NetAddress) uint64
+}
+
+// countingReader counts the bytes read from the underlying reader.
+type countingReader struct {
+	r io.Reader
+	n uint64
+}
+
+// Read implements io.Reader.
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += uint64(n)
+	return n, err
+}
+
+// measuredBandwidth returns the bandwidth in bytes per second at which n bytes
+// were transferred in the provided time. The settings of a host are small, so
+// the result is a rough estimate that is dominated by the latency of the host.
+func measuredBandwidth(n uint64, elapsed time.Duration) uint64 {
+	if elapsed <= 0 {
+		elapsed = time.Nanosecond
+	}
+	return uint64(float64(n) / elapsed.Seconds())
+}
+
+// geoLite2Locate returns a function that looks up the location of an IP
+// address in the provided GeoLite2 database.
+func geoLite2Locate(db *geoip2.Reader) func(net.IP) (string, bool, error) {
+	return func(ip net.IP) (string, bool, error) {
+		record, err := db.Country(ip)
+		if err != nil {
+			return "", false, err
+		}
+		return record.Country.Names["en"], record.Country.IsInEuropeanUnion, nil
+	}
+}
+
+// locateGeoLite2 looks up the location of an IP address in the GeoLite2
+// database of the hostdb. The database is held while it is read so that a
+// refresh can't close it in the meantime.
+func (hdb *HostDB) locateGeoLite2(ip net.IP) (string, bool, error) {
+	hdb.ipdbMu.RLock()
+	defer hdb.ipdbMu.RUnlock()
+	return geoLite2Locate(hdb.ipdb)(ip)
+}
+
+// updateHostLocation resolves the address of the host, records the subnets of
+// its IP addresses and sets the country of the host according to the geo-IP
+// source of the hostdb. If the address can't be resolved, the subnets known
+// from a previous scan are kept. If the source is unavailable or the lookup
+// fails, the location known from a previous scan or session is kept.
+func (hdb *HostDB) updateHostLocation(entry *modules.HostDBEntry) {
+	ips, err := net.LookupIP(entry.NetAddress.Host())
+	if err == nil && len(ips) > 0 {
+		entry.IPNets = ipNets(ips)
+	}
+	if hdb.resolveLocation(entry) || hdb.geolocate == nil {
+		return
+	}
+	if err != nil || len(ips) == 0 {
+		hdb.log.Println("ERROR: could not identify IP address of host:", err)
+		return
+	}
+	hdb.locateIP(entry, ips[0])
+}
+
+// updateHostLocationLocal works like updateHostLocation but never resolves the
+// address of the host through DNS. The subnet and location are only determined
+// if the address is an IP address, which makes it a local database lookup that
+// is cheap enough to be done while processing consensus changes.
+func (hdb *HostDB) updateHostLocationLocal(entry *modules.HostDBEntry) {
+	ip := net.ParseIP(entry.NetAddress.Host())
+	if ip != nil {
+		entry.IPNets = ipNets([]net.IP{ip})
+	}
+	if hdb.resolveLocation(entry) || hdb.geolocate == nil {
+		return
+	}
+	if ip != nil {
+		hdb.locateIP(entry, ip)
+	}
+}
+
+// resolveLocation sets the location of the host using the dependencies of the
+// hostdb if they implement locationResolver. It returns false if the location
+// could not be resolved that way.
+func (hdb *HostDB) resolveLocation(entry *modules.HostDBEntry) bool {
+	resolver, ok := hdb.deps.(locationResolver)
+	if !ok {
+		return false
+	}
+	country, eu, ok := resolver.ResolveLocation(entry.NetAddress)
+	if !ok {
+		return false
+	}
+	entry.Country = country
+	entry.EUhost = eu
+	return true
+}
+
+// locateIP sets the location of the host to the location of the provided IP
+// address according to the geo-IP source of the hostdb.
+func (hdb *HostDB) locateIP(entry *modules.HostDBEntry, ip net.IP) {
+	country, eu, err := hdb.geolocate(ip)
+	if err != nil {
+		hdb.log.Println("ERROR: Could not determine host location:", err)
+		return
+	}
+	entry.Country = country
+	entry.EUhost = eu
+}
+
 // managedScanHost will connect to a host and grab the settings, verifying
 // uptime and updating to the host's preferences.
 func (hdb *HostDB) managedScanHost(entry modules.HostDBEntry) {
@@ -270,8 +445,13 @@ func (hdb *HostDB) managedScanHost(entry modules.HostDBEntry) {
 
 	var settings modules.HostExternalSettings
 	var latency time.Duration
+	var bandwidth uint64
 	err := func() error {
-		timeout := hostRequestTimeout
+		// The whole scan has to complete within the scan timeout, the dial
+		// may be limited further during the initial scan.
+		start := time.Now()
+		deadline := start.Add(hdb.scanSettings.ScanTimeout)
+		timeout := hdb.scanSettings.ScanTimeout
 		hdb.mu.RLock()
 		if len(hdb.initialScanLatencies) > minScansForSpeedup {
 			build.Critical("initialScanLatencies should never be greater than minScansForSpeedup")
@@ -279,22 +459,17 @@ func (hdb *HostDB) managedScanHost(entry modules.HostDBEntry) {
 		if !hdb.initialScanComplete && len(hdb.initialScanLatencies) == minScansForSpeedup {
 			// During an initial scan, when we have at least minScansForSpeedup
 			// active scans in initialScanLatencies, we use
-			// 5*median(initialScanLatencies) as the new hostRequestTimeout to
+			// 5*median(initialScanLatencies) as the new dial timeout to
 			// speedup the scanning process.
 			timeout = hdb.initialScanLatencies[len(hdb.initialScanLatencies)/2]
 			timeout *= scanSpeedupMedianMultiplier
-			if hostRequestTimeout < timeout {
-				timeout = hostRequestTimeout
+			if hdb.scanSettings.ScanTimeout < timeout {
+				timeout = hdb.scanSettings.ScanTimeout
 			}
 		}
 		hdb.mu.RUnlock()
 
-		dialer := &net.Dialer{
-			Cancel:  hdb.tg.StopChan(),
-			Timeout: timeout,
-		}
-		start := time.Now()
-		conn, err := dialer.Dial("tcp", string(netAddr))
+		conn, err := hdb.deps.DialTimeout(netAddr, timeout, hdb.tg.StopChan())
 		latency = time.Since(start)
 		if err != nil {
 			return err
@@ -308,7 +483,7 @@ func (hdb *HostDB) managedScanHost(entry modules.HostDBEntry) {
 			conn.Close()
 		}()
 		defer close(connCloseChan)
-		conn.SetDeadline(time.Now().Add(hostScanDeadline))
+		conn.SetDeadline(deadline)
 
 		err = encoding.WriteObject(conn, modules.RPCSettings)
 		if err != nil {
@@ -316,14 +491,26 @@ func (hdb *HostDB) managedScanHost(entry modules.HostDBEntry) {
 		}
 		var pubkey crypto.PublicKey
 		copy(pubkey[:], pubKey.Key)
-		return crypto.ReadSignedObject(conn, &settings, maxSettingsLen, pubkey)
+		cr := &countingReader{r: conn}
+		readStart := time.Now()
+		if err := crypto.ReadSignedObject(cr, &settings, maxSettingsLen, pubkey); err != nil {
+			return err
+		}
+		bandwidth = measuredBandwidth(cr.n, time.Since(readStart))
+		if measurer, ok := hdb.deps.(bandwidthMeasurer); ok {
+			bandwidth = measurer.MeasureBandwidth(netAddr)
+		}
+		return nil
 	}()
 	if err != nil {
-		hdb.log.Debugf("Scan of host at %v failed: %v", netAddr, err)
-
+		hdb.logEvent(logEntry{Level: logLevelDebug, Message: "scan failed", Host: pubKey.String(), Reason: err.Error()},
+			"Scan of host at %v failed: %v", netAddr, err)
 	} else {
-		hdb.log.Debugf("Scan of host at %v succeeded.", netAddr)
+		hdb.logEvent(logEntry{Level: logLevelDebug, Message: "scan succeeded", Host: pubKey.String()},
+			"Scan of host at %v succeeded.", netAddr)
 		entry.HostExternalSettings = settings
+		entry.Latency = latency
+		entry.Bandwidth = bandwidth
 	}
 	success := err == nil
 
@@ -345,19 +532,19 @@ func (hdb *HostDB) managedScanHost(entry modules.HostDBEntry) {
 	}
 }
 
-// waitForScans is a helper function that blocks until the hostDB's scanList is
-// empty.
+// waitForScans is a helper function that blocks until the hostDB's scan lists
+// are empty.
 func (hdb *HostDB) managedWaitForScans() {
 	for {
 		hdb.mu.Lock()
-		length := len(hdb.scanList)
+		length := hdb.queuedScans()
 		hdb.mu.Unlock()
 		if length == 0 {
 			break
 		}
 		select {
 		case <-hdb.tg.StopChan():
-		case <-time.After(scanCheckInterval):
+		case <-hdb.deps.After(scanCheckInterval):
 		}
 	}
 }
@@ -379,7 +566,7 @@ func (hdb *HostDB) threadedProbeHosts(scanPool <-chan modules.HostDBEntry) {
 				break
 			}
 			select {
-			case <-time.After(time.Second * 30):
+			case <-hdb.deps.After(time.Second * 30):
 				continue
 			case <-hdb.tg.StopChan():
 				return
@@ -410,7 +597,7 @@ func (hdb *HostDB) threadedScan() {
 		select {
 		case <-hdb.tg.StopChan():
 			return
-		case <-time.After(scanCheckInterval):
+		case <-hdb.deps.After(scanCheckInterval):
 		}
 	}
 
@@ -453,7 +640,7 @@ func (hdb *HostDB) threadedScan() {
 
 			// Figure out if the host is online or offline.
 			host := allHosts[i]
-			online := len(host.ScanHistory) > 0 && host.ScanHistory[len(host.ScanHistory)-1].Success
+			online := host.LastScanSuccessful()
 			if online && len(onlineHosts) < hostCheckupQuantity {
 				onlineHosts = append(onlineHosts, host)
 			} else if !online && len(offlineHosts) < hostCheckupQuantity {
@@ -461,9 +648,22 @@ func (hdb *HostDB) threadedScan() {
 			}
 		}
 
+		// The hosts the renter has contracts with are scanned first to keep
+		// the contract health decisions fresh.
+		var contractedHosts []modules.HostDBEntry
+		for _, pk := range hdb.managedProtectedHosts() {
+			if host, exists := hdb.hostTrees.Select(pk); exists {
+				contractedHosts = append(contractedHosts, host)
+			}
+		}
+
 		// Queue the scans for each host.
-		hdb.log.Println("Performing scan on", len(onlineHosts), "online hosts and", len(offlineHosts), "offline hosts.")
+		message := fmt.Sprintf("Performing scan on %v online hosts, %v offline hosts and %v contracted hosts.", len(onlineHosts), len(offlineHosts), len(contractedHosts))
+		hdb.logEvent(logEntry{Level: logLevelInfo, Message: message}, "%v", message)
 		hdb.mu.Lock()
+		for _, host := range contractedHosts {
+			hdb.queuePriorityScan(host)
+		}
 		for _, host := range onlineHosts {
 			hdb.queueScan(host)
 		}
@@ -476,14 +676,14 @@ func (hdb *HostDB) threadedScan() {
 		// scanning. The minimums and maximums keep the scan time reasonable,
 		// while the randomness prevents the scanning from always happening at
 		// the same time of day or week.
-		sleepRange := uint64(maxScanSleep - minScanSleep)
-		sleepTime := minScanSleep + time.Duration(fastrand.Uint64n(sleepRange))
+		sleepRange := uint64(hdb.scanSettings.MaxScanSleep - hdb.scanSettings.MinScanSleep)
+		sleepTime := hdb.scanSettings.MinScanSleep + time.Duration(fastrand.Uint64n(sleepRange))
 
 		// Sleep until it's time for the next scan cycle.
 		select {
 		case <-hdb.tg.StopChan():
 			return
-		case <-time.After(sleepTime):
+		case <-hdb.deps.After(sleepTime):
 		}
 	}
 }
@@ -2,9 +2,14 @@ package hostdb
 
 import (
 	"errors"
+	"io"
+	"io/ioutil"
+	"net"
 	"testing"
 	"time"
 
+	"github.com/pachisi456/sia-hostdb-profiles/crypto"
+	"github.com/pachisi456/sia-hostdb-profiles/encoding"
 	"github.com/pachisi456/sia-hostdb-profiles/modules"
 	"github.com/pachisi456/sia-hostdb-profiles/types"
 )
@@ -182,3 +187,232 @@ func TestUpdateEntry(t *testing.T) {
 		t.Error("host not reporting historic uptime?")
 	}
 }
+
+// hangingHostDeps simulates a host that never completes a scan. If hangDial is
+// set the dial hangs until it times out, otherwise the connection succeeds but
+// the host never responds to the settings RPC.
+type hangingHostDeps struct {
+	modules.ProductionDependencies
+	hangDial bool
+}
+
+// DialTimeout returns a connection to a host that never responds.
+func (d *hangingHostDeps) DialTimeout(addr modules.NetAddress, timeout time.Duration, cancel <-chan struct{}) (net.Conn, error) {
+	if d.hangDial {
+		select {
+		case <-time.After(timeout):
+			return nil, errors.New("dial timed out")
+		case <-cancel:
+			return nil, errors.New("dial cancelled")
+		}
+	}
+	conn, host := net.Pipe()
+	go io.Copy(ioutil.Discard, host)
+	return conn, nil
+}
+
+// onlineGateway is a gateway that always reports to be online, so that failed
+// scans are recorded without a real gateway.
+type onlineGateway struct {
+	modules.Gateway
+}
+
+// Online implements modules.Gateway.
+func (onlineGateway) Online() bool { return true }
+
+// TestScanTimeout checks that the scan of a hanging host is recorded as a
+// failure once the scan timeout expires, both if the dial and if the settings
+// RPC hang.
+func TestScanTimeout(t *testing.T) {
+	hdb, err := newProfileHostDB(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdb.gateway = onlineGateway{}
+	hdb.scanSettings.ScanTimeout = 100 * time.Millisecond
+
+	for _, hangDial := range []bool{true, false} {
+		hdb.deps = &hangingHostDeps{hangDial: hangDial}
+		host := makeHostDBEntry()
+		host.NetAddress = "127.0.0.1:9982"
+		hdb.mu.Lock()
+		err := hdb.hostTrees.Insert(host)
+		hdb.mu.Unlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		start := time.Now()
+		hdb.managedScanHost(host)
+		if elapsed := time.Since(start); elapsed > 10*hdb.scanSettings.ScanTimeout {
+			t.Errorf("hangDial %v: scan took %v despite a timeout of %v", hangDial, elapsed, hdb.scanSettings.ScanTimeout)
+		}
+		entry, exists := hdb.Host(host.PublicKey)
+		if !exists {
+			t.Fatal("scanned host is not in the hostdb")
+		}
+		if entry.LastScanSuccessful() {
+			t.Errorf("hangDial %v: expected the scan to be recorded as a failure", hangDial)
+		}
+	}
+}
+
+// TestScanStopCancelsDial checks that stopping the hostdb aborts a dial that is
+// still in progress instead of waiting for the scan timeout.
+func TestScanStopCancelsDial(t *testing.T) {
+	hdb, err := newProfileHostDB(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdb.gateway = onlineGateway{}
+	hdb.scanSettings.ScanTimeout = time.Minute
+	hdb.deps = &hangingHostDeps{hangDial: true}
+	host := makeHostDBEntry()
+	host.NetAddress = "127.0.0.1:9982"
+	if err := hdb.hostTrees.Insert(host); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		hdb.managedScanHost(host)
+		close(done)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if err := hdb.tg.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("stopping the hostdb did not abort the dial")
+	}
+}
+
+// measuredHostDeps simulates hosts that answer the settings RPC with their
+// settings signed by the secret key of their address, and replaces the
+// bandwidth measured during their scans with the bandwidth of their address.
+type measuredHostDeps struct {
+	modules.ProductionDependencies
+	keys       map[modules.NetAddress]crypto.SecretKey
+	bandwidths map[modules.NetAddress]uint64
+}
+
+// DialTimeout returns a connection to a host that sends its settings.
+func (d *measuredHostDeps) DialTimeout(addr modules.NetAddress, timeout time.Duration, cancel <-chan struct{}) (net.Conn, error) {
+	conn, host := net.Pipe()
+	go func() {
+		defer host.Close()
+		var rpc types.Specifier
+		if err := encoding.ReadObject(host, &rpc, 16); err != nil {
+			return
+		}
+		settings := modules.HostExternalSettings{AcceptingContracts: true, NetAddress: addr}
+		crypto.WriteSignedObject(host, settings, d.keys[addr])
+	}()
+	return conn, nil
+}
+
+// MeasureBandwidth implements bandwidthMeasurer.
+func (d *measuredHostDeps) MeasureBandwidth(addr modules.NetAddress) uint64 {
+	return d.bandwidths[addr]
+}
+
+// TestScanBandwidth checks that the bandwidth measured during a scan is stored
+// on the host entry and that hosts below the minimum bandwidth of a profile
+// are not selected.
+func TestScanBandwidth(t *testing.T) {
+	hdb, err := newProfileHostDB(t.Name(), "fast")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdb.gateway = onlineGateway{}
+	hdb.geolocationDisabled = true
+	hdb.initialScanComplete = true
+
+	deps := &measuredHostDeps{
+		keys: make(map[modules.NetAddress]crypto.SecretKey),
+		bandwidths: map[modules.NetAddress]uint64{
+			"127.0.0.1:9982": 100e3,
+			"127.0.0.2:9982": 10e6,
+		},
+	}
+	hdb.deps = deps
+	for addr := range deps.bandwidths {
+		sk, pk := crypto.GenerateKeyPair()
+		deps.keys[addr] = sk
+		host := makeHostDBEntry()
+		host.NetAddress = addr
+		host.PublicKey = types.Ed25519PublicKey(pk)
+		hdb.mu.Lock()
+		err := hdb.hostTrees.Insert(host)
+		hdb.mu.Unlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+		hdb.managedScanHost(host)
+
+		entry, exists := hdb.Host(host.PublicKey)
+		if !exists {
+			t.Fatal("scanned host is not in the hostdb")
+		}
+		if !entry.LastScanSuccessful() {
+			t.Fatalf("%v: expected the scan to succeed", addr)
+		}
+		if entry.Bandwidth != deps.bandwidths[addr] {
+			t.Errorf("%v: expected a bandwidth of %v, got %v", addr, deps.bandwidths[addr], entry.Bandwidth)
+		}
+	}
+
+	// Only the fast host is selected once a minimum bandwidth is set.
+	if _, err := hdb.ConfigHostDBProfile("fast", "minbandwidth", "1000000"); err != nil {
+		t.Fatal(err)
+	}
+	hosts, err := hdb.RandomHosts("fast", 2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hosts) != 1 || hosts[0].NetAddress != "127.0.0.2:9982" {
+		t.Fatal("expected only the fast host to be selected, got", hosts)
+	}
+}
+
+// TestQueuePriorityScan checks that prioritized hosts are sent to the scanning
+// threads before the other queued hosts, including hosts that were already
+// queued before being prioritized.
+func TestQueuePriorityScan(t *testing.T) {
+	hdb, err := newProfileHostDB(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Pretend that a scan is in progress so that queueing a scan doesn't spawn
+	// a scanning thread that would drain the scan lists.
+	hdb.scanWait = true
+
+	hosts := make([]modules.HostDBEntry, 5)
+	for i := range hosts {
+		hosts[i] = makeHostDBEntry()
+		hdb.queueScan(hosts[i])
+	}
+	contracted := makeHostDBEntry()
+	hdb.queuePriorityScan(contracted)
+	hdb.queuePriorityScan(hosts[2])
+	if n := hdb.queuedScans(); n != 6 {
+		t.Fatal("expected 6 queued scans, got", n)
+	}
+
+	expected := []string{contracted.PublicKey.String(), hosts[2].PublicKey.String()}
+	for i, key := range expected {
+		if next := hdb.nextScan(); next.PublicKey.String() != key {
+			t.Fatalf("expected prioritized host %v to be scanned next, got %v", i, next.PublicKey.String())
+		}
+	}
+	for hdb.queuedScans() > 0 {
+		if next := hdb.nextScan(); next.PublicKey.String() == hosts[2].PublicKey.String() {
+			t.Fatal("prioritized host was scanned twice")
+		}
+	}
+	if len(hdb.scanMap) != 0 {
+		t.Fatal("expected the scan map to be empty, got", len(hdb.scanMap))
+	}
+}
@@ -1,11 +1,21 @@
 package hostdb
 
 import (
+	"errors"
+	"time"
+
 	"github.com/pachisi456/sia-hostdb-profiles/build"
+	"github.com/pachisi456/sia-hostdb-profiles/crypto"
 	"github.com/pachisi456/sia-hostdb-profiles/modules"
 	"github.com/pachisi456/sia-hostdb-profiles/types"
 )
 
+var (
+	// errInjectionDisabled is returned by InjectHost if the scan loop is
+	// running, as it would mark the injected hosts as offline.
+	errInjectionDisabled = errors.New("hosts can only be injected while the scan loop is disabled")
+)
+
 // findHostAnnouncements returns a list of the host announcements found within
 // a given block. No check is made to see that the ip address found in the
 // announcement is actually a valid ip address.
@@ -52,16 +62,36 @@ func (hdb *HostDB) insertBlockchainHost(host modules.HostDBEntry) {
 		// the first seen value has been set to zero (no hosts actually have a
 		// first seen height of zero, but due to rescans hosts can end up with
 		// a zero-value FirstSeen field.
-		oldEntry.NetAddress = host.NetAddress
+		//
+		// Hosts are keyed by their public key, so a reannouncement from a new
+		// address updates the existing entry instead of adding a second one.
+		// The location and subnets of the old address no longer apply and are
+		// resolved again for the new address. Reannouncing the same address leaves the
+		// entry untouched.
+		changed := false
+		if oldEntry.NetAddress != host.NetAddress {
+			oldEntry.NetAddress = host.NetAddress
+			oldEntry.Country = ""
+			oldEntry.EUhost = false
+			oldEntry.IPNets = nil
+			hdb.updateHostLocationLocal(&oldEntry)
+			changed = true
+		}
 		if oldEntry.FirstSeen == 0 {
 			oldEntry.FirstSeen = hdb.blockHeight
+			changed = true
 		}
-		err := hdb.hostTrees.Modify(oldEntry)
-		if err != nil {
-			hdb.log.Println("ERROR: unable to modify host entry of host tree after a blockchain scan:", err)
+		if changed {
+			err := hdb.hostTrees.Modify(oldEntry)
+			if err != nil {
+				hdb.log.Println("ERROR: unable to modify host entry of host tree after a blockchain scan:", err)
+			}
 		}
 	} else {
+		// Resolve the location right away so that it is known before the
+		// first scan of the host completes.
 		host.FirstSeen = hdb.blockHeight
+		hdb.updateHostLocationLocal(&host)
 		err := hdb.hostTrees.Insert(host)
 		if err != nil {
 			hdb.log.Println("ERROR: unable to insert host entry into host tree after a blockchain scan:", err)
@@ -72,6 +102,47 @@ func (hdb *HostDB) insertBlockchainHost(host modules.HostDBEntry) {
 	hdb.queueScan(host)
 }
 
+// InjectHost adds a host with the provided net address to the hostdb without
+// an announcement and without scanning it. The host is marked as online and
+// accepting contracts. If country is not empty the location of the host is
+// forced to that country, otherwise it is resolved like for any other host.
+// InjectHost is meant for testing only and returns an error unless the scan
+// loop has been disabled through the disableScanLoop disruption.
+func (hdb *HostDB) InjectHost(addr modules.NetAddress, country string, eu bool) (modules.HostDBEntry, error) {
+	if !hdb.deps.Disrupt("disableScanLoop") {
+		return modules.HostDBEntry{}, errInjectionDisabled
+	}
+	if err := addr.IsValid(); err != nil {
+		return modules.HostDBEntry{}, err
+	}
+
+	_, pk := crypto.GenerateKeyPair()
+	host := modules.HostDBEntry{
+		PublicKey: types.Ed25519PublicKey(pk),
+	}
+	host.NetAddress = addr
+	host.AcceptingContracts = true
+	host.Version = build.Version
+	host.ScanHistory = modules.HostDBScans{{
+		Timestamp: time.Now(),
+		Success:   true,
+	}}
+	if country != "" {
+		host.Country = country
+		host.EUhost = eu
+	} else {
+		hdb.updateHostLocation(&host)
+	}
+
+	hdb.mu.Lock()
+	defer hdb.mu.Unlock()
+	host.FirstSeen = hdb.blockHeight
+	if err := hdb.hostTrees.Insert(host); err != nil {
+		return modules.HostDBEntry{}, err
+	}
+	return host, nil
+}
+
 // ProcessConsensusChange will be called by the consensus set every time there
 // is a change in the blockchain. Updates will always be called in order.
 func (hdb *HostDB) ProcessConsensusChange(cc modules.ConsensusChange) {
@@ -112,5 +183,8 @@ func (hdb *HostDB) ProcessConsensusChange(cc modules.ConsensusChange) {
 		}
 	}
 
+	// All host trees have been brought up to date with the consensus change.
+	hdb.hostdbProfiles.SetAllLastUpdated(hdb.blockHeight)
+
 	hdb.lastChange = cc.ID
 }
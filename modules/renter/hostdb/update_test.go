@@ -52,3 +52,263 @@ func TestFindHostAnnouncements(t *testing.T) {
 		t.Error("host announcement found when there was an invalid encoding of a host announcement")
 	}
 }
+
+// TestProcessConsensusChangeLastUpdated checks that the LastUpdated field of
+// the hostdb profiles advances when a consensus change is processed.
+func TestProcessConsensusChangeLastUpdated(t *testing.T) {
+	hdb, err := newProfileHostDB(t.Name(), "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"default", "archive"} {
+		if lu := hdb.HostDBProfile(name).LastUpdated; lu != 0 {
+			t.Fatalf("%v: expected LastUpdated to be 0, got %v", name, lu)
+		}
+	}
+
+	// Apply two blocks, the profiles should have been updated at height 2.
+	hdb.ProcessConsensusChange(modules.ConsensusChange{
+		AppliedBlocks: []types.Block{{Timestamp: 1}, {Timestamp: 2}},
+	})
+	for _, name := range []string{"default", "archive"} {
+		if lu := hdb.HostDBProfile(name).LastUpdated; lu != 2 {
+			t.Errorf("%v: expected LastUpdated to be 2, got %v", name, lu)
+		}
+	}
+}
+
+// TestInjectHost checks that hosts can be injected with a forced country while
+// the scan loop is disabled and that location filtering applies to them.
+func TestInjectHost(t *testing.T) {
+	hdb, err := newProfileHostDB(t.Name(), "german")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdb.initialScanComplete = true
+
+	// Injection is refused while the scan loop is running.
+	if _, err := hdb.InjectHost("127.0.0.1:9982", "Germany", true); err != errInjectionDisabled {
+		t.Fatal("expected errInjectionDisabled, got", err)
+	}
+	hdb.deps = &disableScanLoopDeps{}
+	if _, err := hdb.InjectHost("not an address", "Germany", true); err == nil {
+		t.Fatal("expected an invalid net address to be rejected")
+	}
+
+	// Inject hosts in three countries.
+	countries := []struct {
+		addr    modules.NetAddress
+		country string
+		eu      bool
+	}{
+		{"127.0.0.1:9982", "Germany", true},
+		{"127.0.0.2:9982", "China", false},
+		{"127.0.0.3:9982", "United States", false},
+	}
+	var german modules.HostDBEntry
+	for _, c := range countries {
+		host, err := hdb.InjectHost(c.addr, c.country, c.eu)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry, exists := hdb.Host(host.PublicKey); !exists || entry.NetAddress != c.addr || entry.Country != c.country {
+			t.Fatal("injected host was not found in the hostdb:", entry, exists)
+		}
+		if c.country == "Germany" {
+			german = host
+		}
+	}
+
+	// Without a location every injected host is selected.
+	hosts, err := hdb.RandomHosts("german", 3, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hosts) != 3 {
+		t.Fatal("expected all injected hosts to be selected, got", len(hosts))
+	}
+
+	// Restricted to Germany only the German host is selected.
+	if _, err := hdb.ConfigHostDBProfile("german", "addlocation", "germany"); err != nil {
+		t.Fatal(err)
+	}
+	hosts, err = hdb.RandomHosts("german", 3, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hosts) != 1 || hosts[0].PublicKey.String() != german.PublicKey.String() {
+		t.Fatal("expected only the German host to be selected, got", hosts)
+	}
+}
+
+// locationDeps resolves the location of hosts from a fixed map of addresses.
+type locationDeps struct {
+	modules.ProductionDependencies
+	locations map[modules.NetAddress]string
+}
+
+// ResolveLocation implements the locationResolver interface.
+func (d *locationDeps) ResolveLocation(addr modules.NetAddress) (string, bool, bool) {
+	country, ok := d.locations[addr]
+	return country, country == "Germany", ok
+}
+
+// TestReannounceHost checks that a host reannouncing itself from a new address
+// updates its existing entry, including its location, instead of being added
+// to the hostdb a second time.
+func TestReannounceHost(t *testing.T) {
+	hdb, err := newProfileHostDB(t.Name(), "german")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdb.initialScanComplete = true
+	hdb.deps = &locationDeps{locations: map[modules.NetAddress]string{
+		"127.0.0.1:9982": "Germany",
+		"127.0.0.2:9982": "China",
+	}}
+	if _, err := hdb.ConfigHostDBProfile("german", "addlocation", "germany"); err != nil {
+		t.Fatal(err)
+	}
+	// Keep the announced hosts from being scanned.
+	hdb.scanWait = true
+
+	sk, pk := crypto.GenerateKeyPair()
+	spk := types.Ed25519PublicKey(pk)
+	announce := func(addr modules.NetAddress) {
+		ann, err := modules.CreateAnnouncement(addr, spk, sk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hdb.ProcessConsensusChange(modules.ConsensusChange{
+			AppliedBlocks: []types.Block{{Transactions: []types.Transaction{{ArbitraryData: [][]byte{ann}}}}},
+		})
+	}
+
+	// The first announcement adds the host.
+	announce("127.0.0.1:9982")
+	if _, exists := hdb.Host(spk); !exists {
+		t.Fatal("announced host was not added to the hostdb")
+	}
+	if len(hdb.AllHosts("german")) != 1 {
+		t.Fatal("expected the German host to be in the german tree")
+	}
+
+	// Reannounce the host from China.
+	announce("127.0.0.2:9982")
+	all := hdb.AllHosts("default")
+	if len(all) != 1 {
+		t.Fatal("expected a single host after the reannouncement, got", len(all))
+	}
+	if all[0].NetAddress != "127.0.0.2:9982" || all[0].Country != "China" || all[0].EUhost {
+		t.Fatalf("reannounced host was not updated: %v %v %v", all[0].NetAddress, all[0].Country, all[0].EUhost)
+	}
+	if all[0].FirstSeen != 1 {
+		t.Fatal("expected FirstSeen to be kept, got", all[0].FirstSeen)
+	}
+	if len(hdb.AllHosts("german")) != 0 {
+		t.Fatal("expected the reannounced host to have left the german tree")
+	}
+}
+
+// TestReannounceSameAddress checks that reannouncing a host from its current
+// address doesn't touch its entry, the location is only resolved again once
+// the address actually changes.
+func TestReannounceSameAddress(t *testing.T) {
+	hdb, err := newProfileHostDB(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	deps := &locationDeps{locations: map[modules.NetAddress]string{
+		"127.0.0.1:9982": "Germany",
+		"127.0.0.2:9982": "China",
+	}}
+	hdb.deps = deps
+	// Keep the announced hosts from being scanned.
+	hdb.scanWait = true
+
+	sk, pk := crypto.GenerateKeyPair()
+	spk := types.Ed25519PublicKey(pk)
+	announce := func(addr modules.NetAddress) modules.HostDBEntry {
+		ann, err := modules.CreateAnnouncement(addr, spk, sk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hdb.ProcessConsensusChange(modules.ConsensusChange{
+			AppliedBlocks: []types.Block{{Transactions: []types.Transaction{{ArbitraryData: [][]byte{ann}}}}},
+		})
+		host, exists := hdb.Host(spk)
+		if !exists {
+			t.Fatal("announced host is not in the hostdb")
+		}
+		return host
+	}
+
+	announce("127.0.0.1:9982")
+
+	// Change the location the address resolves to and reannounce the same
+	// address twice, the entry must stay the same.
+	deps.locations["127.0.0.1:9982"] = "France"
+	for i := 0; i < 2; i++ {
+		host := announce("127.0.0.1:9982")
+		if host.Country != "Germany" || !host.EUhost || host.FirstSeen != 1 {
+			t.Fatalf("reannouncing the same address changed the host: %v %v %v", host.Country, host.EUhost, host.FirstSeen)
+		}
+	}
+	if len(hdb.AllHosts("default")) != 1 {
+		t.Fatal("expected a single host, got", len(hdb.AllHosts("default")))
+	}
+
+	// Only an actual change of the address resolves the location again.
+	host := announce("127.0.0.2:9982")
+	if host.Country != "China" || host.EUhost {
+		t.Fatalf("reannounced host was not updated: %v %v", host.Country, host.EUhost)
+	}
+}
+
+// TestAnnouncementLocation checks that the location of a host is known right
+// after its announcement is processed, before the host has been scanned.
+func TestAnnouncementLocation(t *testing.T) {
+	hdb, err := newProfileHostDB(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdb.deps = &locationDeps{locations: map[modules.NetAddress]string{
+		"127.0.0.1:9982": "Germany",
+	}}
+	// Keep the announced hosts from being scanned.
+	hdb.scanWait = true
+
+	var anns [][]byte
+	for _, addr := range []modules.NetAddress{"127.0.0.1:9982", "127.0.0.2:9982"} {
+		ann, err := makeSignedAnnouncement(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		anns = append(anns, ann)
+	}
+	hdb.ProcessConsensusChange(modules.ConsensusChange{
+		AppliedBlocks: []types.Block{{Transactions: []types.Transaction{{ArbitraryData: anns}}}},
+	})
+
+	hosts := hdb.AllHosts("default")
+	if len(hosts) != 2 {
+		t.Fatal("expected both announced hosts in the hostdb, got", len(hosts))
+	}
+	for _, host := range hosts {
+		if len(host.ScanHistory) != 0 {
+			t.Fatal("host should not have been scanned yet")
+		}
+		switch host.NetAddress {
+		case "127.0.0.1:9982":
+			if host.Country != "Germany" || !host.EUhost {
+				t.Errorf("expected the host to be located in Germany, got %q", host.Country)
+			}
+		default:
+			// Without a known location the host stays unlocated until it is
+			// scanned.
+			if host.Country != "" {
+				t.Errorf("expected the host to have no location, got %q", host.Country)
+			}
+		}
+	}
+}
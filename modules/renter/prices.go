@@ -0,0 +1,87 @@
+package renter
+
+import (
+	"sync"
+
+	"github.com/pachisi456/sia-hostdb-profiles/modules"
+)
+
+type (
+	// priceEstimationCache caches the price estimations of the renter, mapped
+	// by the name of the hostdb profile they were computed for. An estimation
+	// is only valid for the set of hosts and the allowance it was computed
+	// with.
+	priceEstimationCache struct {
+		entries map[string]priceEstimationCacheEntry
+		mu      sync.Mutex
+	}
+
+	// priceEstimationCacheEntry is a cached price estimation together with
+	// the allowance and the membership version of the hosts it was computed
+	// with.
+	priceEstimationCacheEntry struct {
+		estimation modules.RenterPriceEstimation
+		allowance  modules.Allowance
+		membership uint64
+	}
+)
+
+// allowancesEqual returns true if both allowances have the same parameters,
+// including the weights of their hostdb profiles.
+func allowancesEqual(a, b modules.Allowance) bool {
+	if !a.Funds.Equals(b.Funds) || a.Hosts != b.Hosts || a.Period != b.Period || a.RenewWindow != b.RenewWindow || a.MaxHostsPerCountry != b.MaxHostsPerCountry {
+		return false
+	}
+	if len(a.ProfileWeights) != len(b.ProfileWeights) {
+		return false
+	}
+	for name, weight := range a.ProfileWeights {
+		if w, exists := b.ProfileWeights[name]; !exists || w != weight {
+			return false
+		}
+	}
+	return true
+}
+
+// get returns the cached price estimation of the provided profile, if there
+// is one computed with the provided allowance and membership version.
+func (pec *priceEstimationCache) get(profile string, allowance modules.Allowance, membership uint64) (modules.RenterPriceEstimation, bool) {
+	pec.mu.Lock()
+	defer pec.mu.Unlock()
+	entry, exists := pec.entries[profile]
+	if !exists || entry.membership != membership || !allowancesEqual(entry.allowance, allowance) {
+		return modules.RenterPriceEstimation{}, false
+	}
+	return entry.estimation, true
+}
+
+// set caches the price estimation of the provided profile, replacing any
+// estimation computed with a different allowance or membership version.
+func (pec *priceEstimationCache) set(profile string, allowance modules.Allowance, membership uint64, est modules.RenterPriceEstimation) {
+	pec.mu.Lock()
+	defer pec.mu.Unlock()
+	if pec.entries == nil {
+		pec.entries = make(map[string]priceEstimationCacheEntry)
+	}
+	// Copy the profile weights so that the caller can't modify the cached
+	// allowance.
+	if allowance.ProfileWeights != nil {
+		weights := make(map[string]uint64, len(allowance.ProfileWeights))
+		for name, weight := range allowance.ProfileWeights {
+			weights[name] = weight
+		}
+		allowance.ProfileWeights = weights
+	}
+	pec.entries[profile] = priceEstimationCacheEntry{
+		estimation: est,
+		allowance:  allowance,
+		membership: membership,
+	}
+}
+
+// clear removes all cached price estimations.
+func (pec *priceEstimationCache) clear() {
+	pec.mu.Lock()
+	defer pec.mu.Unlock()
+	pec.entries = nil
+}
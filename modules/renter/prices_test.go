@@ -0,0 +1,115 @@
+package renter
+
+import (
+	"testing"
+
+	"github.com/pachisi456/sia-hostdb-profiles/crypto"
+	"github.com/pachisi456/sia-hostdb-profiles/modules"
+	"github.com/pachisi456/sia-hostdb-profiles/modules/renter/hostdb/hosttree"
+	"github.com/pachisi456/sia-hostdb-profiles/types"
+)
+
+// TestPriceEstimationCache checks that cached price estimations are returned
+// per profile and invalidated when a host is added or the allowance differs,
+// but not when the settings of a known host are updated.
+func TestPriceEstimationCache(t *testing.T) {
+	trees := hosttree.NewHostTrees()
+	if err := trees.AddHostTree("default", hosttree.NewHostTree(func(modules.HostDBEntry, string) types.Currency {
+		return types.NewCurrency64(1)
+	}, "default")); err != nil {
+		t.Fatal(err)
+	}
+	allowance := modules.Allowance{
+		Funds:  types.SiacoinPrecision.Mul64(100),
+		Hosts:  10,
+		Period: 100,
+	}
+	est := modules.RenterPriceEstimation{FormContracts: types.SiacoinPrecision}
+
+	var cache priceEstimationCache
+	if _, ok := cache.get("default", allowance, trees.Membership()); ok {
+		t.Fatal("empty cache returned an estimation")
+	}
+	cache.set("default", allowance, trees.Membership(), est)
+	cached, ok := cache.get("default", allowance, trees.Membership())
+	if !ok || !cached.FormContracts.Equals(est.FormContracts) {
+		t.Fatal("expected the cached estimation, got", cached, ok)
+	}
+
+	// Estimations are cached per profile.
+	if _, ok := cache.get("archive", allowance, trees.Membership()); ok {
+		t.Fatal("estimation of another profile was returned")
+	}
+
+	// The cache is bypassed if the allowance differs.
+	other := allowance
+	other.Hosts = 20
+	if _, ok := cache.get("default", other, trees.Membership()); ok {
+		t.Fatal("estimation of a different allowance was returned")
+	}
+	other = allowance
+	other.Funds = allowance.Funds.Mul64(2)
+	if _, ok := cache.get("default", other, trees.Membership()); ok {
+		t.Fatal("estimation of different allowance funds was returned")
+	}
+	other = allowance
+	other.ProfileWeights = map[string]uint64{"default": 1, "archive": 1}
+	if _, ok := cache.get("default", other, trees.Membership()); ok {
+		t.Fatal("estimation of different profile weights was returned")
+	}
+	cache.set("default", other, trees.Membership(), est)
+	other.ProfileWeights["archive"] = 2
+	if _, ok := cache.get("default", other, trees.Membership()); ok {
+		t.Fatal("modifying the profile weights modified the cached allowance")
+	}
+	cache.set("default", allowance, trees.Membership(), est)
+
+	// Adding a host invalidates the cache.
+	_, pk := crypto.GenerateKeyPair()
+	var entry modules.HostDBEntry
+	entry.PublicKey = types.Ed25519PublicKey(pk)
+	if err := trees.Insert(entry); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cache.get("default", allowance, trees.Membership()); ok {
+		t.Fatal("cache was not invalidated by adding a host")
+	}
+
+	// Updating the settings of a known host, as every scan does, keeps the
+	// cache.
+	cache.set("default", allowance, trees.Membership(), est)
+	entry.StoragePrice = types.SiacoinPrecision
+	if err := trees.Modify(entry); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cache.get("default", allowance, trees.Membership()); !ok {
+		t.Fatal("cache was invalidated by updating a host")
+	}
+
+	// Clearing the cache removes all estimations.
+	cache.set("default", allowance, trees.Membership(), est)
+	cache.clear()
+	if _, ok := cache.get("default", allowance, trees.Membership()); ok {
+		t.Fatal("cache was not cleared")
+	}
+}
+
+// BenchmarkPriceEstimationCache benchmarks looking up a cached price
+// estimation.
+func BenchmarkPriceEstimationCache(b *testing.B) {
+	allowance := modules.Allowance{
+		Funds:  types.SiacoinPrecision.Mul64(100),
+		Hosts:  50,
+		Period: 100,
+	}
+	var cache priceEstimationCache
+	for _, profile := range []string{"default", "archive", "streaming"} {
+		cache.set(profile, allowance, 1, modules.RenterPriceEstimation{FormContracts: types.SiacoinPrecision})
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, ok := cache.get("archive", allowance, 1); !ok {
+			b.Fatal("cache miss")
+		}
+	}
+}
@@ -17,7 +17,6 @@ package renter
 
 import (
 	"errors"
-	"reflect"
 	"strings"
 	"sync"
 
@@ -57,12 +56,83 @@ var (
 // to upload to, and download from.
 type hostDB interface {
 	// ActiveHosts returns the list of hosts that are actively being selected
-	// from.
+	// from, sorted by descending weight.
 	ActiveHosts(string) []modules.HostDBEntry
 
+	// ActiveHostsN returns at most n of the hosts that are actively being
+	// selected from, sorted by descending weight.
+	ActiveHostsN(string, int) []modules.HostDBEntry
+
+	// ActiveHostCounts returns the number of active hosts of every hostdb
+	// profile.
+	ActiveHostCounts() (map[string]int, error)
+
+	// RescanHost queues an immediate scan of the host with the provided
+	// public key.
+	RescanHost(types.SiaPublicKey) error
+
+	// SetHostTags sets the tags annotating the host with the provided public
+	// key.
+	SetHostTags(types.SiaPublicKey, []string) error
+
+	// InjectHost adds a host to the hostdb without an announcement. It is
+	// only available during testing.
+	InjectHost(addr modules.NetAddress, country string, eu bool) (modules.HostDBEntry, error)
+
+	// Metrics returns a snapshot of the health of the hostdb.
+	Metrics() modules.HostDBMetrics
+
+	// HostsMembership returns a number that changes whenever hosts are added
+	// to or removed from the hostdb.
+	HostsMembership() uint64
+
+	// SetProtectedHosts sets the function returning the hosts that must
+	// never be evicted from the hostdb.
+	SetProtectedHosts(func() []types.SiaPublicKey)
+
+	// PersistInfo returns information about the hostdb persistence file on
+	// disk.
+	PersistInfo() (modules.HostDBPersistInfo, error)
+
+	// RefreshGeolocation downloads the geolocation database again and
+	// recomputes the location of every host in the background.
+	RefreshGeolocation() error
+
+	// GeolocationRefresh returns the progress of the last refresh of the host
+	// locations.
+	GeolocationRefresh() modules.HostDBGeolocationRefresh
+
+	// ActiveProfile returns the name of the hostdb profile that is used if no
+	// profile is specified.
+	ActiveProfile() string
+
+	// SetActiveProfile sets the hostdb profile that is used if no profile is
+	// specified.
+	SetActiveProfile(name string) error
+
+	// DeleteHostDBProfile deletes a hostdb profile. If the profile is the
+	// active profile the deletion fails unless fallback is set, in which case
+	// the active profile falls back to the default profile.
+	DeleteHostDBProfile(name string, fallback bool) (bool, error)
+
+	// EffectiveFilters returns the effective filters the hostdb profile with
+	// the provided name applies when selecting hosts.
+	EffectiveFilters(name string) (modules.HostDBProfileFilters, error)
+
+	// Profile returns the hostdb profile with the provided name.
+	Profile(name string) (hostdbprofile.HostDBProfile, error)
+
+	// ValidateHostDBProfile checks the proposed hostdb profile settings
+	// without saving them and returns the number of active hosts they match.
+	ValidateHostDBProfile(profile string) (int, error)
+
 	// AddHostDBProfile adds a new hostdb profile.
 	AddHostDBProfiles(string, string) error
 
+	// AddHostDBProfilesBatch adds all of the described hostdb profiles or,
+	// if any of them is invalid, none of them.
+	AddHostDBProfilesBatch(specs []hostdbprofile.ProfileSpec) error
+
 	// AllHosts returns the full list of hosts known to the hostdb, sorted in
 	// order of preference.
 	AllHosts(string) []modules.HostDBEntry
@@ -75,7 +145,7 @@ type hostDB interface {
 
 	// ConfigHostDBProfile updates the provided setting of the hostdb profile with the
 	// provided name to the provided value. All parameters are checked for validity.
-	ConfigHostDBProfile(name, setting, value string) (err error)
+	ConfigHostDBProfile(name, setting, value string) (warning string, err error)
 
 	// Host returns the HostDBEntry for a given host.
 	Host(types.SiaPublicKey) (modules.HostDBEntry, bool)
@@ -88,9 +158,19 @@ type hostDB interface {
 	// any offline or inactive hosts.
 	RandomHosts(string, int, []types.SiaPublicKey) ([]modules.HostDBEntry, error)
 
+	// RandomHostsWithWeights works like RandomHosts, but returns the hosts
+	// together with their weights, ordered by descending weight. Hosts
+	// sharing an address with a host of the address blacklist are excluded,
+	// penalized hosts are only returned if there are too few other hosts.
+	RandomHostsWithWeights(tree string, n int, blacklist, addressBlacklist, penalized []types.SiaPublicKey) ([]modules.WeightedHostDBEntry, error)
+
 	// ScoreBreakdown returns a detailed explanation of the various properties
-	// of the host.
-	ScoreBreakdown(modules.HostDBEntry, string) modules.HostScoreBreakdown
+	// of the host, failing if the hostdb profile doesn't exist.
+	ScoreBreakdown(modules.HostDBEntry, string) (modules.HostScoreBreakdown, error)
+
+	// HostWeight returns the weight of a host in the host tree of the provided
+	// hostdb profile.
+	HostWeight(modules.HostDBEntry, string) types.Currency
 
 	// EstimateHostScore returns the estimated score breakdown of a host with the
 	// provided settings.
@@ -196,8 +276,8 @@ type Renter struct {
 	memoryManager *memoryManager
 	workerPool    map[types.FileContractID]*worker
 
-	// Cache the last price estimation result.
-	lastEstimation modules.RenterPriceEstimation
+	// Cache the price estimation results of each hostdb profile.
+	priceEstimations priceEstimationCache
 
 	// Utilities.
 	chunkCache     map[string]*cacheData
@@ -222,29 +302,42 @@ func (r *Renter) Close() error {
 }
 
 // PriceEstimation estimates the cost in siacoins of performing various storage
-// and data operations.
+// and data operations using the hosts of the active hostdb profile.
 //
-// TODO: Make this function line up with the actual settings and different profiles
-// in the renter (right now it just uses the default host tree).
-// Perhaps even make it so it uses the renter's actual contracts if it has any.
+// TODO: Perhaps make it so it uses the renter's actual contracts if it has any.
 func (r *Renter) PriceEstimation() modules.RenterPriceEstimation {
-	id := r.mu.RLock()
-	lastEstimation := r.lastEstimation
-	r.mu.RUnlock(id)
-	if !reflect.DeepEqual(lastEstimation, modules.RenterPriceEstimation{}) {
-		return lastEstimation
+	profile := r.hostDB.ActiveProfile()
+	est, err := r.ProfilePriceEstimation(profile)
+	if err != nil {
+		r.log.Printf("Unable to estimate the prices of hostdb profile %q: %v", profile, err)
+	}
+	return est
+}
+
+// ProfilePriceEstimation estimates the cost in siacoins of performing various
+// storage and data operations using the hosts of the provided hostdb profile.
+// Estimations are cached until hosts are added or removed, the allowance
+// changes or a new block arrives. Price updates of known hosts are picked up
+// with the next block.
+func (r *Renter) ProfilePriceEstimation(profile string) (modules.RenterPriceEstimation, error) {
+	if _, err := r.hostDB.EffectiveFilters(profile); err != nil {
+		return modules.RenterPriceEstimation{}, err
+	}
+	allowance := r.hostContractor.Allowance()
+	membership := r.hostDB.HostsMembership()
+	if est, ok := r.priceEstimations.get(profile, allowance, membership); ok {
+		return est, nil
 	}
 
 	// Grab hosts to perform the estimation.
-	//TODO this uses just the default host tree
-	hosts, err := r.hostDB.RandomHosts("default", priceEstimationScope, nil)
+	hosts, err := r.hostDB.RandomHosts(profile, priceEstimationScope, nil)
 	if err != nil {
-		return modules.RenterPriceEstimation{}
+		return modules.RenterPriceEstimation{}, err
 	}
 
 	// Check if there are zero hosts, which means no estimation can be made.
 	if len(hosts) == 0 {
-		return modules.RenterPriceEstimation{}
+		return modules.RenterPriceEstimation{}, nil
 	}
 
 	// Add up the costs for each host.
@@ -289,11 +382,8 @@ func (r *Renter) PriceEstimation() modules.RenterPriceEstimation {
 		UploadTerabyte:       totalUploadCost,
 	}
 
-	id = r.mu.Lock()
-	r.lastEstimation = est
-	r.mu.Unlock(id)
-
-	return est
+	r.priceEstimations.set(profile, allowance, membership, est)
+	return est, nil
 }
 
 // SetSettings will update the settings for the renter.
@@ -323,11 +413,102 @@ func (r *Renter) SetSettings(s modules.RenterSettings) error {
 // ActiveHosts returns an array of hostDB's active hosts
 func (r *Renter) ActiveHosts(tree string) []modules.HostDBEntry { return r.hostDB.ActiveHosts(tree) }
 
+// ActiveHostsN returns at most n of hostDB's active hosts
+func (r *Renter) ActiveHostsN(tree string, n int) []modules.HostDBEntry {
+	return r.hostDB.ActiveHostsN(tree, n)
+}
+
+// ActiveHostCounts returns the number of active hosts of every hostdb profile.
+func (r *Renter) ActiveHostCounts() (map[string]int, error) { return r.hostDB.ActiveHostCounts() }
+
+// RescanHost queues an immediate scan of the host with the provided public key.
+func (r *Renter) RescanHost(spk types.SiaPublicKey) error { return r.hostDB.RescanHost(spk) }
+
+// SetHostTags sets the tags annotating the host with the provided public key.
+func (r *Renter) SetHostTags(spk types.SiaPublicKey, tags []string) error {
+	return r.hostDB.SetHostTags(spk, tags)
+}
+
+// InjectHost adds a host to the hostdb without an announcement. It is only
+// available during testing.
+func (r *Renter) InjectHost(addr modules.NetAddress, country string, eu bool) (modules.HostDBEntry, error) {
+	return r.hostDB.InjectHost(addr, country, eu)
+}
+
+// HostDBMetrics returns a snapshot of the health of the hostdb.
+func (r *Renter) HostDBMetrics() modules.HostDBMetrics { return r.hostDB.Metrics() }
+
+// HostDBPersistInfo returns information about the hostdb persistence file on
+// disk.
+func (r *Renter) HostDBPersistInfo() (modules.HostDBPersistInfo, error) { return r.hostDB.PersistInfo() }
+
+// RefreshHostDBGeolocation downloads the geolocation database again and
+// recomputes the location of every host in the background.
+func (r *Renter) RefreshHostDBGeolocation() error { return r.hostDB.RefreshGeolocation() }
+
+// HostDBGeolocationRefresh returns the progress of the last refresh of the host
+// locations.
+func (r *Renter) HostDBGeolocationRefresh() modules.HostDBGeolocationRefresh {
+	return r.hostDB.GeolocationRefresh()
+}
+
+// ActiveHostDBProfile returns the name of the hostdb profile that is used if no
+// profile is specified.
+func (r *Renter) ActiveHostDBProfile() string { return r.hostDB.ActiveProfile() }
+
+// SetActiveHostDBProfile sets the hostdb profile that is used if no profile is
+// specified.
+func (r *Renter) SetActiveHostDBProfile(name string) error { return r.hostDB.SetActiveProfile(name) }
+
+// DeleteHostDBProfile deletes the hostdb profile with the provided name. It
+// reports whether the active profile fell back to the default profile.
+func (r *Renter) DeleteHostDBProfile(name string, fallback bool) (bool, error) {
+	return r.hostDB.DeleteHostDBProfile(name, fallback)
+}
+
+// HostDBProfile returns the hostdb profile with the provided name.
+func (r *Renter) HostDBProfile(name string) (hostdbprofile.HostDBProfile, error) {
+	return r.hostDB.Profile(name)
+}
+
+// HostDBProfileFilters returns the effective filters the hostdb profile with
+// the provided name applies when selecting hosts.
+func (r *Renter) HostDBProfileFilters(name string) (modules.HostDBProfileFilters, error) {
+	return r.hostDB.EffectiveFilters(name)
+}
+
+// ValidateHostDBProfile checks the proposed hostdb profile settings without
+// creating or modifying any profile and returns the number of active hosts a
+// profile with these settings would select from.
+func (r *Renter) ValidateHostDBProfile(profile string) (int, error) {
+	return r.hostDB.ValidateHostDBProfile(profile)
+}
+
+// RandomHostsWithWeights returns a set of random hosts of the provided hostdb
+// profile together with their weights, ordered by descending weight. If
+// preferUncontracted is set, hosts the renter has active contracts with are
+// only returned if there are too few other hosts.
+func (r *Renter) RandomHostsWithWeights(profile string, n int, blacklist, addressBlacklist []types.SiaPublicKey, preferUncontracted bool) ([]modules.WeightedHostDBEntry, error) {
+	var contracted []types.SiaPublicKey
+	if preferUncontracted {
+		for _, contract := range r.hostContractor.Contracts() {
+			contracted = append(contracted, contract.HostPublicKey)
+		}
+	}
+	return r.hostDB.RandomHostsWithWeights(profile, n, blacklist, addressBlacklist, contracted)
+}
+
 // AddHostDBProfile adds a new hostdb profile.
 func (r *Renter) AddHostDBProfiles(name string, storagetier string) (err error) {
 	return r.hostDB.AddHostDBProfiles(name, storagetier)
 }
 
+// AddHostDBProfilesBatch adds all of the described hostdb profiles or, if any
+// of them is invalid, none of them.
+func (r *Renter) AddHostDBProfilesBatch(specs []hostdbprofile.ProfileSpec) error {
+	return r.hostDB.AddHostDBProfilesBatch(specs)
+}
+
 // AllHosts returns an array of all hosts
 func (r *Renter) AllHosts(tree string) []modules.HostDBEntry { return r.hostDB.AllHosts(tree) }
 
@@ -339,15 +520,20 @@ func (r *Renter) HostDBProfiles() map[string]*hostdbprofile.HostDBProfile { retu
 
 // ConfigHostDBProfiles updates the provided setting of the hostdb profile with the
 // provided name to the provided value. All parameters are checked for validity.
-func (r *Renter) ConfigHostDBProfiles(name, setting, value string) (err error) {
+func (r *Renter) ConfigHostDBProfiles(name, setting, value string) (warning string, err error) {
 	return r.hostDB.ConfigHostDBProfile(name, setting, value)
 }
 
 // ScoreBreakdown returns the score breakdown
-func (r *Renter) ScoreBreakdown(e modules.HostDBEntry, hostdbprofile string) modules.HostScoreBreakdown {
+func (r *Renter) ScoreBreakdown(e modules.HostDBEntry, hostdbprofile string) (modules.HostScoreBreakdown, error) {
 	return r.hostDB.ScoreBreakdown(e, hostdbprofile)
 }
 
+// HostWeight returns the weight of a host in the host tree of a hostdb profile
+func (r *Renter) HostWeight(e modules.HostDBEntry, hostdbprofile string) types.Currency {
+	return r.hostDB.HostWeight(e, hostdbprofile)
+}
+
 // EstimateHostScore returns the estimated host score
 func (r *Renter) EstimateHostScore(e modules.HostDBEntry, hostdbprofile string) modules.HostScoreBreakdown {
 	return r.hostDB.EstimateHostScore(e, hostdbprofile)
@@ -378,7 +564,7 @@ func (r *Renter) Settings() modules.RenterSettings {
 // ProcessConsensusChange returns the process consensus change
 func (r *Renter) ProcessConsensusChange(cc modules.ConsensusChange) {
 	id := r.mu.Lock()
-	r.lastEstimation = modules.RenterPriceEstimation{}
+	r.priceEstimations.clear()
 	r.mu.Unlock(id)
 }
 
@@ -466,6 +652,16 @@ func NewCustomRenter(g modules.Gateway, cs modules.ConsensusSet, tpool modules.T
 	}
 	r.memoryManager = newMemoryManager(defaultMemory, r.tg.StopChan())
 
+	// Never evict hosts the renter has contracts with from the hostdb.
+	if hdb != nil {
+		hdb.SetProtectedHosts(func() (pks []types.SiaPublicKey) {
+			for _, c := range hc.Contracts() {
+				pks = append(pks, c.HostPublicKey)
+			}
+			return pks
+		})
+	}
+
 	// Load all saved data.
 	if err := r.initPersist(); err != nil {
 		return nil, err
@@ -5,6 +5,7 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/pachisi456/sia-hostdb-profiles/build"
 	"github.com/pachisi456/sia-hostdb-profiles/crypto"
@@ -106,6 +107,56 @@ func TestMerkleRootSetCompatibility(t *testing.T) {
 	}
 }
 
+// TestHostDBEntryUptime probes the Uptime and LastScanSuccessful methods of
+// HostDBEntry using crafted scan histories.
+func TestHostDBEntryUptime(t *testing.T) {
+	now := time.Now()
+	scans := func(successes ...bool) HostDBScans {
+		var s HostDBScans
+		for i, success := range successes {
+			s = append(s, HostDBScan{Timestamp: now.Add(time.Duration(i) * time.Hour), Success: success})
+		}
+		return s
+	}
+
+	tests := []struct {
+		entry      HostDBEntry
+		uptime     float64
+		lastScanOK bool
+	}{
+		// No scans at all.
+		{HostDBEntry{}, 0, false},
+		// A single scan doesn't measure any time.
+		{HostDBEntry{ScanHistory: scans(true)}, 0, true},
+		// All scans failed.
+		{HostDBEntry{ScanHistory: scans(false, false, false)}, 0, false},
+		// All scans succeeded.
+		{HostDBEntry{ScanHistory: scans(true, true, true)}, 1, true},
+		// Online for one of four hours, the last scan doesn't count.
+		{HostDBEntry{ScanHistory: scans(false, true, false, false, true)}, 0.25, true},
+		// Historic values are included.
+		{HostDBEntry{ScanHistory: scans(true, false), HistoricDowntime: time.Hour, HistoricUptime: 2 * time.Hour}, 0.75, false},
+	}
+	for i, test := range tests {
+		if uptime := test.entry.Uptime(); uptime != test.uptime {
+			t.Errorf("test %v: expected uptime %v, got %v", i, test.uptime, uptime)
+		}
+		if ok := test.entry.LastScanSuccessful(); ok != test.lastScanOK {
+			t.Errorf("test %v: expected last scan successful to be %v, got %v", i, test.lastScanOK, ok)
+		}
+	}
+
+	// Time is weighted, not the number of scans.
+	entry := HostDBEntry{ScanHistory: HostDBScans{
+		{Timestamp: now, Success: true},
+		{Timestamp: now.Add(3 * time.Hour), Success: false},
+		{Timestamp: now.Add(4 * time.Hour), Success: true},
+	}}
+	if uptime := entry.Uptime(); uptime != 0.75 {
+		t.Error("expected uptime to be weighted by time, got", uptime)
+	}
+}
+
 // BenchmarkMerkleRootSetEncode clocks how fast large MerkleRootSets can be
 // encoded and written to disk.
 func BenchmarkMerkleRootSetEncode(b *testing.B) {
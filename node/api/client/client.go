@@ -2,6 +2,7 @@ package client
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -69,6 +70,17 @@ func readAPIError(r io.Reader) error {
 	return apiErr
 }
 
+// readNotFoundError returns the api.Error accompanying a 404 response of a
+// handler reporting a missing resource, e.g. an unknown hostdb profile. 404
+// responses to unknown routes are reported as unrecognized API calls.
+func readNotFoundError(r io.Reader, resource string) error {
+	var apiErr api.Error
+	if err := json.NewDecoder(r).Decode(&apiErr); err != nil || apiErr.Message == "" || strings.HasPrefix(apiErr.Message, "404 - ") {
+		return errors.New("API call not recognized: " + resource)
+	}
+	return apiErr
+}
+
 // getRawResponse requests the specified resource. The response, if provided,
 // will be returned in a byte slice
 func (c *Client) getRawResponse(resource string) ([]byte, error) {
@@ -83,7 +95,7 @@ func (c *Client) getRawResponse(resource string) ([]byte, error) {
 	defer drainAndClose(res.Body)
 
 	if res.StatusCode == http.StatusNotFound {
-		return nil, errors.New("API call not recognized: " + resource)
+		return nil, readNotFoundError(res.Body, resource)
 	}
 
 	// If the status code is not 2xx, decode and return the accompanying
@@ -99,6 +111,33 @@ func (c *Client) getRawResponse(resource string) ([]byte, error) {
 	return ioutil.ReadAll(res.Body)
 }
 
+// getStream requests the specified resource and returns the body of the
+// response, so that it can be read incrementally. The caller must close the
+// body. Canceling ctx aborts the request, including reading the body.
+func (c *Client) getStream(ctx context.Context, resource string) (io.ReadCloser, error) {
+	req, err := c.NewRequest("GET", resource, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, errors.AddContext(err, "request failed")
+	}
+
+	if res.StatusCode == http.StatusNotFound {
+		defer drainAndClose(res.Body)
+		return nil, readNotFoundError(res.Body, resource)
+	}
+
+	// If the status code is not 2xx, decode and return the accompanying
+	// api.Error.
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		defer drainAndClose(res.Body)
+		return nil, readAPIError(res.Body)
+	}
+	return res.Body, nil
+}
+
 // getRawResponse requests part of the specified resource. The response, if
 // provided, will be returned in a byte slice
 func (c *Client) getRawPartialResponse(resource string, from, to uint64) ([]byte, error) {
@@ -1,29 +1,307 @@
 package client
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
 	"net/url"
 
+	"github.com/pachisi456/sia-hostdb-profiles/modules"
 	"github.com/pachisi456/sia-hostdb-profiles/node/api"
 	"github.com/pachisi456/sia-hostdb-profiles/types"
 	"github.com/pachisi456/sia-hostdb-profiles/modules/renter/hostdb/hostdbprofile"
+	"strconv"
 	"strings"
 )
 
+var (
+	// ErrInitialScanIncomplete is returned by the profile bindings if the
+	// hostdb has not completed its initial scan yet.
+	ErrInitialScanIncomplete = errors.New("initial hostdb scan is not yet completed")
+
+	// ErrInvalidValue is returned by the profile bindings if the provided
+	// value of a setting or storage tier was rejected.
+	ErrInvalidValue = errors.New("invalid hostdb profile value")
+
+	// ErrProfileExists is returned by the profile bindings if a profile with
+	// the provided name already exists.
+	ErrProfileExists = errors.New("hostdb profile already exists")
+
+	// ErrProfileInUse is returned by the profile bindings if the profile is
+	// the active profile and cannot be deleted.
+	ErrProfileInUse = errors.New("hostdb profile is in use")
+
+	// ErrUnknownProfile is returned by the profile bindings if no profile
+	// with the provided name exists.
+	ErrUnknownProfile = errors.New("unknown hostdb profile")
+
+	// ErrUnknownSetting is returned by the profile bindings if the provided
+	// setting is not recognized.
+	ErrUnknownSetting = errors.New("unknown hostdb profile setting")
+)
+
+// profileErrors maps the prefixes of the error messages returned by the
+// hostdb profile endpoints to the errors returned by the profile bindings.
+// More specific prefixes have to come first.
+var profileErrors = []struct {
+	prefix string
+	err    error
+}{
+	{"initial hostdb scan is not yet completed", ErrInitialScanIncomplete},
+	{"hostdb profile with provided name does not exist", ErrUnknownProfile},
+	{"hostdb profile with provided name already exists", ErrProfileExists},
+	{"hostdb profile is the active profile", ErrProfileInUse},
+	{"provided setting not recognized", ErrUnknownSetting},
+	{"no such storage tier", ErrInvalidValue},
+	{"provided ", ErrInvalidValue},
+}
+
+// profileError is an error returned by a hostdb profile endpoint. It keeps the
+// message of the server but can be matched against the exported errors of the
+// client using errors.Is.
+type profileError struct {
+	err     error
+	message string
+}
+
+// Error returns the message of the server.
+func (pe profileError) Error() string { return pe.message }
+
+// Unwrap returns the exported error the message of the server maps to.
+func (pe profileError) Unwrap() error { return pe.err }
+
+// mapProfileError maps an error returned by a hostdb profile endpoint to one
+// of the exported errors of the client. Errors that can't be mapped are
+// returned unchanged.
+func mapProfileError(err error) error {
+	apiErr, ok := err.(api.Error)
+	if !ok {
+		return err
+	}
+	for _, pe := range profileErrors {
+		if strings.HasPrefix(apiErr.Message, pe.prefix) {
+			return profileError{err: pe.err, message: apiErr.Message}
+		}
+	}
+	return err
+}
+
 // HostDbActiveGet requests the /hostdb/active endpoint's resources.
 func (c *Client) HostDbActiveGet() (hdag api.HostdbActiveGET, err error) {
 	err = c.get("/hostdb/active", &hdag)
 	return
 }
 
-// HostDbAllGet requests the /hostdb/all endpoint's resources.
-func (c *Client) HostDbAllGet() (hdag api.HostdbAllGET, err error) {
-	err = c.get("/hostdb/all", &hdag)
+// HostDbActiveProfileGet requests the active hosts in the host tree of the
+// provided hostdb profile from the /hostdb/active endpoint.
+func (c *Client) HostDbActiveProfileGet(profile string) (hdag api.HostdbActiveGET, err error) {
+	values := url.Values{}
+	values.Set("profile", strings.ToLower(profile))
+	err = c.get("/hostdb/active?"+values.Encode(), &hdag)
+	return
+}
+
+// HostDbActiveProfileNGet requests at most numHosts of the active hosts in the
+// host tree of the provided hostdb profile from the /hostdb/active endpoint. An
+// empty profile selects the default profile and a numHosts of zero requests all
+// active hosts.
+func (c *Client) HostDbActiveProfileNGet(profile string, numHosts int) (hdag api.HostdbActiveGET, err error) {
+	values := url.Values{}
+	if profile != "" {
+		values.Set("profile", strings.ToLower(profile))
+	}
+	if numHosts > 0 {
+		values.Set("numhosts", strconv.Itoa(numHosts))
+	}
+	err = c.get("/hostdb/active?"+values.Encode(), &hdag)
+	return
+}
+
+// HostDbActiveAllGet requests the number of active hosts of every hostdb
+// profile from the /hostdb/active/all endpoint.
+func (c *Client) HostDbActiveAllGet() (hdaag api.HostdbActiveAllGET, err error) {
+	err = c.get("/hostdb/active/all", &hdaag)
+	return
+}
+
+// HostDbAllGet requests all hosts from the /hostdb/all endpoint, fetching one
+// page after another. If country is not empty only the hosts located in that
+// country are requested, see HostDbAllPageGet.
+func (c *Client) HostDbAllGet(country string) (hdag api.HostdbAllGET, err error) {
+	for {
+		page, err := c.HostDbAllPageGet(len(hdag.Hosts), 0, country)
+		if err != nil {
+			return api.HostdbAllGET{}, err
+		}
+		hdag.Hosts = append(hdag.Hosts, page.Hosts...)
+		hdag.Total = page.Total
+		if len(page.Hosts) == 0 || len(hdag.Hosts) >= page.Total {
+			return hdag, nil
+		}
+	}
+}
+
+// HostDbAllPageGet requests a page of at most limit hosts starting at offset
+// from the /hostdb/all endpoint. A limit of 0 uses the default page size. If
+// country is not empty only hosts located in that country are returned, the
+// country is given as country code, e.g. "de", as name or as "eu".
+func (c *Client) HostDbAllPageGet(offset, limit int, country string) (hdag api.HostdbAllGET, err error) {
+	values := url.Values{}
+	values.Set("offset", strconv.Itoa(offset))
+	if limit > 0 {
+		values.Set("limit", strconv.Itoa(limit))
+	}
+	if country != "" {
+		values.Set("country", country)
+	}
+	err = c.get("/hostdb/all?"+values.Encode(), &hdag)
+	return
+}
+
+// HostDbAllStreamGet streams all hosts from the /hostdb/all/stream endpoint.
+// The hosts are sent on the returned host channel as they are decoded, so
+// that they don't have to be buffered. The host channel is closed once the
+// stream has ended, after which the error channel yields the error that ended
+// it, if any. Closing cancel stops the stream early without an error. If
+// country is not empty only the hosts located in that country are streamed,
+// see HostDbAllPageGet.
+func (c *Client) HostDbAllStreamGet(country string, cancel <-chan struct{}) (<-chan api.ExtendedHostDBEntry, <-chan error) {
+	hosts := make(chan api.ExtendedHostDBEntry)
+	errc := make(chan error, 1)
+	go func() {
+		defer close(errc)
+		defer close(hosts)
+		errc <- c.streamHosts(country, hosts, cancel)
+	}()
+	return hosts, errc
+}
+
+// streamHosts decodes the hosts streamed by the /hostdb/all/stream endpoint
+// and sends them on hosts until the stream ends or cancel is closed.
+func (c *Client) streamHosts(country string, hosts chan<- api.ExtendedHostDBEntry, cancel <-chan struct{}) error {
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	go func() {
+		select {
+		case <-cancel:
+			stop()
+		case <-ctx.Done():
+		}
+	}()
+
+	values := url.Values{}
+	if country != "" {
+		values.Set("country", country)
+	}
+	// Requests and reads fail once the stream is canceled, which isn't an
+	// error to the caller.
+	body, err := c.getStream(ctx, "/hostdb/all/stream?"+values.Encode())
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return err
+	}
+	defer body.Close()
+	dec := json.NewDecoder(body)
+	for {
+		var host api.ExtendedHostDBEntry
+		if err := dec.Decode(&host); err == io.EOF {
+			return nil
+		} else if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		select {
+		case hosts <- host:
+		case <-cancel:
+			return nil
+		}
+	}
+}
+
+// HostDbHostsGet request the /hostdb/hosts/:pubkey endpoint's resources. The
+// score breakdown is computed for the provided hostdb profile, or for the
+// default profile if profile is empty.
+func (c *Client) HostDbHostsGet(pk types.SiaPublicKey, profile string) (hhg api.HostdbHostsGET, err error) {
+	query := "/hostdb/hosts/" + pk.String()
+	if profile != "" {
+		values := url.Values{}
+		values.Set("profile", strings.ToLower(profile))
+		query += "?" + values.Encode()
+	}
+	err = c.get(query, &hhg)
+	return
+}
+
+// HostDbHostRescanPost requests an immediate scan of a host using the
+// /hostdb/hosts/:pubkey/rescan endpoint.
+func (c *Client) HostDbHostRescanPost(pk types.SiaPublicKey) (err error) {
+	err = c.post("/hostdb/hosts/"+pk.String()+"/rescan", "", nil)
+	return
+}
+
+// HostDbHostTagsPost sets the tags annotating a host using the
+// /hostdb/hosts/:pubkey/tags endpoint. An empty list removes all tags.
+func (c *Client) HostDbHostTagsPost(pk types.SiaPublicKey, tags []string) (err error) {
+	values := url.Values{}
+	values.Set("tags", strings.Join(tags, ","))
+	err = c.post("/hostdb/hosts/"+pk.String()+"/tags", values.Encode(), nil)
+	return
+}
+
+// HostDbInjectPost adds a host with the provided net address to the hostdb
+// without an announcement using the /hostdb/inject endpoint. If country is not
+// empty the location of the host is forced to it. Only available if the
+// hostdb's scan loop is disabled.
+func (c *Client) HostDbInjectPost(addr modules.NetAddress, country string, eu bool) (hip api.HostdbInjectPOST, err error) {
+	values := url.Values{}
+	values.Set("netaddress", string(addr))
+	values.Set("country", country)
+	values.Set("eu", strconv.FormatBool(eu))
+	err = c.post("/hostdb/inject", values.Encode(), &hip)
+	return
+}
+
+// HostDbRandomGet requests numHosts random hosts of the provided hostdb profile
+// together with their weights using the /hostdb/random endpoint. If
+// preferUncontracted is set, hosts the renter has contracts with are only
+// returned if there are too few other hosts.
+func (c *Client) HostDbRandomGet(profile string, numHosts int, preferUncontracted bool) (hrg api.HostdbRandomGET, err error) {
+	values := url.Values{}
+	values.Set("profile", strings.ToLower(profile))
+	values.Set("numhosts", strconv.Itoa(numHosts))
+	values.Set("preferuncontracted", strconv.FormatBool(preferUncontracted))
+	err = c.get("/hostdb/random?"+values.Encode(), &hrg)
+	return
+}
+
+// HostDbMetricsGet requests the /hostdb/metrics endpoint's resources.
+func (c *Client) HostDbMetricsGet() (hdm modules.HostDBMetrics, err error) {
+	err = c.get("/hostdb/metrics", &hdm)
+	return
+}
+
+// HostDbPersistGet requests the /hostdb/persist endpoint's resources.
+func (c *Client) HostDbPersistGet() (hdpi modules.HostDBPersistInfo, err error) {
+	err = c.get("/hostdb/persist", &hdpi)
 	return
 }
 
-// HostDbHostsGet request the /hostdb/hosts/:pubkey endpoint's resources.
-func (c *Client) HostDbHostsGet(pk types.SiaPublicKey) (hhg api.HostdbHostsGET, err error) {
-	err = c.get("/hostdb/hosts/"+pk.String(), &hhg)
+// HostDbGeolocationRefreshPost starts a refresh of the geolocation database
+// and the host locations using the /hostdb/geolocation/refresh endpoint.
+func (c *Client) HostDbGeolocationRefreshPost() (err error) {
+	err = c.post("/hostdb/geolocation/refresh", "", nil)
+	return
+}
+
+// HostDbGeolocationRefreshGet requests the progress of the last refresh of the
+// host locations from the /hostdb/geolocation/refresh endpoint.
+func (c *Client) HostDbGeolocationRefreshGet() (hgr modules.HostDBGeolocationRefresh, err error) {
+	err = c.get("/hostdb/geolocation/refresh", &hgr)
 	return
 }
 
@@ -33,23 +311,88 @@ func (c *Client) HostDbProfilesGet() (hdbp map[string]*hostdbprofile.HostDBProfi
 	return
 }
 
+// HostDbProfileGet requests the hostdb profile with the provided name from the
+// /hostdb/profiles/:name endpoint.
+func (c *Client) HostDbProfileGet(name string) (*hostdbprofile.HostDBProfile, error) {
+	var hdbp hostdbprofile.HostDBProfile
+	if err := mapProfileError(c.get("/hostdb/profiles/"+strings.ToLower(name), &hdbp)); err != nil {
+		return nil, err
+	}
+	return &hdbp, nil
+}
+
+// HostDbProfilesEffectiveGet requests the /hostdb/profiles/:name/effective
+// endpoint's resources.
+func (c *Client) HostDbProfilesEffectiveGet(name string) (hdpf modules.HostDBProfileFilters, err error) {
+	err = mapProfileError(c.get("/hostdb/profiles/"+strings.ToLower(name)+"/effective", &hdpf))
+	return
+}
+
 // HostDbProfilesAddPost posts a new profile to add to the hostdb profiles
 // API route /hostdb/profiles/add
 func (c *Client) HostDbProfilesAddPost(name, storagetier string) (err error) {
 	values := url.Values{}
 	values.Set("name", strings.ToLower(name))
 	values.Set("storagetier", strings.ToLower(storagetier))
-	err = c.post("/hostdb/profiles/add", values.Encode(), nil)
+	err = mapProfileError(c.post("/hostdb/profiles/add", values.Encode(), nil))
+	return
+}
+
+// HostDbProfilesAddBatchPost adds all of the described hostdb profiles at once
+// using the /hostdb/profiles/addbatch endpoint. Either all of the profiles are
+// added or, if any of them is invalid, none of them.
+func (c *Client) HostDbProfilesAddBatchPost(specs []hostdbprofile.ProfileSpec) (err error) {
+	data, err := json.Marshal(specs)
+	if err != nil {
+		return err
+	}
+	err = mapProfileError(c.post("/hostdb/profiles/addbatch", string(data), nil))
 	return
 }
 
 // HostDbProfilesConfigPost posts a config to a hostdb profile. API route
 // /hostdb/profiles/config
-func (c *Client) HostDbProfilesConfigPost(name, setting, value string) (err error) {
+func (c *Client) HostDbProfilesConfigPost(name, setting, value string) (hpcp api.HostdbProfilesConfigPOST, err error) {
 	values := url.Values{}
 	values.Set("name", strings.ToLower(name))
 	values.Set("setting", strings.ToLower(setting))
 	values.Set("value", strings.ToLower(value))
-	err = c.post("/hostdb/profiles/config", values.Encode(), nil)
+	err = mapProfileError(c.post("/hostdb/profiles/config", values.Encode(), &hpcp))
+	return
+}
+
+// HostDbProfilesUnsetPost resets a setting of a hostdb profile to its default.
+// API route /hostdb/profiles/config
+func (c *Client) HostDbProfilesUnsetPost(name, setting string) (hpcp api.HostdbProfilesConfigPOST, err error) {
+	return c.HostDbProfilesConfigPost(name, "unset", setting)
+}
+
+// HostDbProfilesValidatePost checks the proposed hostdb profile settings, e.g.
+// "tier=cold;locations=germany,eu", without saving them. API route
+// /hostdb/profiles/validate
+func (c *Client) HostDbProfilesValidatePost(profile string) (hpvp api.HostdbProfilesValidatePOST, err error) {
+	values := url.Values{}
+	values.Set("profile", profile)
+	err = c.post("/hostdb/profiles/validate", values.Encode(), &hpvp)
+	return
+}
+
+// HostDbProfilesSetDefaultPost sets the hostdb profile that is used if no
+// profile is specified. API route /hostdb/profiles/setdefault
+func (c *Client) HostDbProfilesSetDefaultPost(name string) (err error) {
+	values := url.Values{}
+	values.Set("name", strings.ToLower(name))
+	err = mapProfileError(c.post("/hostdb/profiles/setdefault", values.Encode(), nil))
+	return
+}
+
+// HostDbProfilesDeletePost deletes a hostdb profile. If fallback is set and the
+// profile is the active profile, the active profile falls back to the default
+// profile. API route /hostdb/profiles/delete
+func (c *Client) HostDbProfilesDeletePost(name string, fallback bool) (hpdp api.HostdbProfilesDeletePOST, err error) {
+	values := url.Values{}
+	values.Set("name", strings.ToLower(name))
+	values.Set("fallback", strconv.FormatBool(fallback))
+	err = mapProfileError(c.post("/hostdb/profiles/delete", values.Encode(), &hpdp))
 	return
 }
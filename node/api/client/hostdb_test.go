@@ -0,0 +1,233 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/pachisi456/sia-hostdb-profiles/modules/renter/hostdb/hostdbprofile"
+	"github.com/pachisi456/sia-hostdb-profiles/node/api"
+)
+
+// TestProfileErrors checks that the errors returned by the hostdb profile
+// endpoints are mapped to the exported errors of the client.
+func TestProfileErrors(t *testing.T) {
+	tests := []struct {
+		message string
+		status  int
+		err     error
+	}{
+		{`hostdb profile with provided name does not exist: "archive"`, http.StatusBadRequest, ErrUnknownProfile},
+		{`hostdb profile with provided name already exists: "archive"`, http.StatusBadRequest, ErrProfileExists},
+		{"hostdb profile is the active profile used for the allowance", http.StatusBadRequest, ErrProfileInUse},
+		{`provided setting not recognized: "color"`, http.StatusBadRequest, ErrUnknownSetting},
+		{`provided location not recognized: "atlantis"`, http.StatusBadRequest, ErrInvalidValue},
+		{`no such storage tier, see ...: "lukewarm"`, http.StatusBadRequest, ErrInvalidValue},
+		{"initial hostdb scan is not yet completed", http.StatusServiceUnavailable, ErrInitialScanIncomplete},
+	}
+	for _, test := range tests {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			api.WriteError(w, api.Error{Message: test.message}, test.status)
+		}))
+		c := New(strings.TrimPrefix(srv.URL, "http://"))
+
+		errs := []error{c.HostDbProfilesAddPost("archive", "cold")}
+		_, err := c.HostDbProfilesConfigPost("archive", "addlocation", "germany")
+		errs = append(errs, err)
+		errs = append(errs, c.HostDbProfilesSetDefaultPost("archive"))
+		_, err = c.HostDbProfilesDeletePost("archive", false)
+		errs = append(errs, err)
+		_, err = c.HostDbProfilesEffectiveGet("archive")
+		errs = append(errs, err)
+		for _, err := range errs {
+			if !errors.Is(err, test.err) {
+				t.Errorf("%q: expected %v, got %v", test.message, test.err, err)
+			}
+			if err == nil || err.Error() != test.message {
+				t.Errorf("%q: expected the message of the server to be kept, got %v", test.message, err)
+			}
+		}
+		srv.Close()
+	}
+
+	// Errors that can't be mapped are returned unchanged.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		api.WriteError(w, api.Error{Message: "the default hostdb profile cannot be deleted"}, http.StatusBadRequest)
+	}))
+	defer srv.Close()
+	c := New(strings.TrimPrefix(srv.URL, "http://"))
+	_, err := c.HostDbProfilesDeletePost("default", false)
+	if _, ok := err.(api.Error); !ok {
+		t.Fatal("expected an unmapped api.Error, got", err)
+	}
+}
+
+// TestHostDbAllGetCountry checks that the country passed to HostDbAllGet is
+// sent along with every page request.
+func TestHostDbAllGetCountry(t *testing.T) {
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests++
+		if country := req.URL.Query().Get("country"); country != "de" {
+			t.Errorf("expected country de, got %q", country)
+		}
+		w.Write([]byte(`{"total":0,"hosts":[]}`))
+	}))
+	defer srv.Close()
+
+	c := New(strings.TrimPrefix(srv.URL, "http://"))
+	if _, err := c.HostDbAllGet("de"); err != nil {
+		t.Fatal(err)
+	}
+	if requests != 1 {
+		t.Fatal("expected a single request, got", requests)
+	}
+}
+
+// TestHostDbAllStreamGet checks that the hosts streamed by /hostdb/all/stream
+// are all received and that a stream can be stopped early.
+func TestHostDbAllStreamGet(t *testing.T) {
+	const numHosts = 500
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/hostdb/all/stream" {
+			t.Errorf("unexpected request for %v", req.URL.Path)
+		}
+		if country := req.URL.Query().Get("country"); country != "de" {
+			t.Errorf("expected country de, got %q", country)
+		}
+		enc := json.NewEncoder(w)
+		for i := 0; i < numHosts; i++ {
+			if err := enc.Encode(api.ExtendedHostDBEntry{PublicKeyString: strconv.Itoa(i)}); err != nil {
+				return
+			}
+		}
+	}))
+	defer srv.Close()
+	c := New(strings.TrimPrefix(srv.URL, "http://"))
+
+	// Consume the whole stream.
+	hosts, errc := c.HostDbAllStreamGet("de", nil)
+	n := 0
+	for host := range hosts {
+		if host.PublicKeyString != strconv.Itoa(n) {
+			t.Fatalf("expected host %v, got %v", n, host.PublicKeyString)
+		}
+		n++
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if n != numHosts {
+		t.Fatalf("expected %v hosts, got %v", numHosts, n)
+	}
+
+	// Stop the stream after the first host.
+	cancel := make(chan struct{})
+	hosts, errc = c.HostDbAllStreamGet("de", cancel)
+	<-hosts
+	close(cancel)
+	for range hosts {
+	}
+	if err := <-errc; err != nil {
+		t.Fatal("expected a canceled stream to end without an error, got", err)
+	}
+}
+
+// TestHostDbProfilesAddBatchPost checks that the profile specs are posted as a
+// JSON array and that a rejected batch is mapped to the exported errors.
+func TestHostDbProfilesAddBatchPost(t *testing.T) {
+	var posted []hostdbprofile.ProfileSpec
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/hostdb/profiles/addbatch" {
+			t.Errorf("unexpected request path %q", req.URL.Path)
+		}
+		if err := json.NewDecoder(req.Body).Decode(&posted); err != nil {
+			t.Error(err)
+		}
+		api.WriteError(w, api.Error{Message: `provided location not recognized: "atlantis"`}, http.StatusBadRequest)
+	}))
+	defer srv.Close()
+
+	specs := []hostdbprofile.ProfileSpec{
+		{Name: "archive", Storagetier: "cold"},
+		{Name: "atlantis", Storagetier: "hot", Locations: []string{"atlantis"}},
+	}
+	c := New(strings.TrimPrefix(srv.URL, "http://"))
+	if err := c.HostDbProfilesAddBatchPost(specs); !errors.Is(err, ErrInvalidValue) {
+		t.Fatal("expected ErrInvalidValue, got", err)
+	}
+	if len(posted) != 2 || posted[1].Name != "atlantis" || posted[1].Locations[0] != "atlantis" {
+		t.Fatal("unexpected profile specs posted:", posted)
+	}
+}
+
+// TestHostDbProfileGet checks that a single hostdb profile can be fetched and
+// that a missing profile is reported as ErrUnknownProfile, while unknown routes
+// are still reported as unrecognized API calls.
+func TestHostDbProfileGet(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/hostdb/profiles/archive":
+			api.WriteJSON(w, hostdbprofile.HostDBProfile{Storagetier: "cold", Location: []string{"eu"}})
+		case "/hostdb/profiles/missing":
+			api.WriteError(w, api.Error{Message: `hostdb profile with provided name does not exist: "missing"`}, http.StatusNotFound)
+		default:
+			api.UnrecognizedCallHandler(w, req)
+		}
+	}))
+	defer srv.Close()
+	c := New(strings.TrimPrefix(srv.URL, "http://"))
+
+	profile, err := c.HostDbProfileGet("Archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if profile.Storagetier != "cold" || len(profile.Location) != 1 || profile.Location[0] != "eu" {
+		t.Fatal("unexpected profile:", profile)
+	}
+
+	if _, err := c.HostDbProfileGet("missing"); !errors.Is(err, ErrUnknownProfile) {
+		t.Fatal("expected ErrUnknownProfile, got", err)
+	}
+	if err := c.get("/hostdb/unknown", nil); err == nil || !strings.HasPrefix(err.Error(), "API call not recognized") {
+		t.Fatal("expected an unrecognized API call, got", err)
+	}
+}
+
+// TestHostDbProfilesValidatePost checks that the proposed profile settings are
+// posted unchanged and that valid and invalid settings are both reported in
+// the response.
+func TestHostDbProfilesValidatePost(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/hostdb/profiles/validate" {
+			t.Errorf("unexpected request path %q", req.URL.Path)
+		}
+		switch profile := req.FormValue("profile"); profile {
+		case "tier=cold;locations=Germany":
+			api.WriteJSON(w, api.HostdbProfilesValidatePOST{Valid: true, Hosts: 7})
+		default:
+			api.WriteJSON(w, api.HostdbProfilesValidatePOST{Error: "no such storage tier: " + profile})
+		}
+	}))
+	defer srv.Close()
+	c := New(strings.TrimPrefix(srv.URL, "http://"))
+
+	hpvp, err := c.HostDbProfilesValidatePost("tier=cold;locations=Germany")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hpvp.Valid || hpvp.Hosts != 7 || hpvp.Error != "" {
+		t.Fatal("unexpected response for valid settings:", hpvp)
+	}
+	hpvp, err = c.HostDbProfilesValidatePost("tier=lukewarm;locations=")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hpvp.Valid || hpvp.Hosts != 0 || !strings.Contains(hpvp.Error, "lukewarm") {
+		t.Fatal("unexpected response for invalid settings:", hpvp)
+	}
+}
@@ -3,7 +3,9 @@ package client
 import (
 	"fmt"
 	"net/url"
+	"sort"
 	"strconv"
+	"strings"
 
 	"github.com/pachisi456/sia-hostdb-profiles/modules"
 	"github.com/pachisi456/sia-hostdb-profiles/node/api"
@@ -72,6 +74,13 @@ func (c *Client) RenterPostAllowance(allowance modules.Allowance) (err error) {
 	values.Set("hosts", strconv.FormatUint(allowance.Hosts, 10))
 	values.Set("period", strconv.FormatUint(uint64(allowance.Period), 10))
 	values.Set("renewwindow", strconv.FormatUint(uint64(allowance.RenewWindow), 10))
+	values.Set("maxhostspercountry", strconv.FormatUint(allowance.MaxHostsPerCountry, 10))
+	var weights []string
+	for profile, weight := range allowance.ProfileWeights {
+		weights = append(weights, profile+":"+strconv.FormatUint(weight, 10))
+	}
+	sort.Strings(weights)
+	values.Set("profileweights", strings.Join(weights, ","))
 	err = c.post("/renter", values.Encode(), nil)
 	return
 }
@@ -88,6 +97,15 @@ func (c *Client) RenterPricesGet() (rpg api.RenterPricesGET, err error) {
 	return
 }
 
+// RenterPricesProfileGet requests the /renter/prices endpoint's resources,
+// estimating the prices using the hosts of the provided hostdb profile.
+func (c *Client) RenterPricesProfileGet(profile string) (rpg api.RenterPricesGET, err error) {
+	values := url.Values{}
+	values.Set("profile", strings.ToLower(profile))
+	err = c.get("/renter/prices?"+values.Encode(), &rpg)
+	return
+}
+
 // RenterPostRateLimit uses the /renter endpoint to change the renter's bandwidth rate
 // limit.
 func (c *Client) RenterPostRateLimit(readBPS, writeBPS int64) (err error) {
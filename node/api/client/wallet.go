@@ -67,10 +67,12 @@ func (c *Client) WalletLockPost() (err error) {
 }
 
 // WalletSeedPost uses the /wallet/seed endpoint to add a seed to the wallet's list
-// of seeds.
-func (c *Client) WalletSeedPost(seed, password string) (err error) {
+// of seeds. The dictionary is the mnemonic dictionary of the seed, if left
+// empty the english dictionary is used.
+func (c *Client) WalletSeedPost(seed, dictionary, password string) (err error) {
 	values := url.Values{}
 	values.Set("seed", seed)
+	values.Set("dictionary", dictionary)
 	values.Set("encryptionpassword", password)
 	err = c.post("/wallet/seed", values.Encode(), nil)
 	return
@@ -127,10 +129,12 @@ func (c *Client) WalletSiagKeyPost(keyfiles, password string) (err error) {
 }
 
 // WalletSweepPost uses the /wallet/sweep/seed endpoint to sweep a seed into
-// the current wallet.
-func (c *Client) WalletSweepPost(seed string) (wsp api.WalletSweepPOST, err error) {
+// the current wallet. The dictionary is the mnemonic dictionary of the seed,
+// if left empty the english dictionary is used.
+func (c *Client) WalletSweepPost(seed, dictionary string) (wsp api.WalletSweepPOST, err error) {
 	values := url.Values{}
 	values.Set("seed", seed)
+	values.Set("dictionary", dictionary)
 	err = c.post("/wallet/sweep/seed", values.Encode(), &wsp)
 	return
 }
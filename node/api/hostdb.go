@@ -1,15 +1,48 @@
 package api
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"math"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/pachisi456/sia-hostdb-profiles/modules"
+	"github.com/pachisi456/sia-hostdb-profiles/modules/renter/hostdb"
+	"github.com/pachisi456/sia-hostdb-profiles/modules/renter/hostdb/hostdbprofile"
 	"github.com/pachisi456/sia-hostdb-profiles/types"
 
 	"github.com/julienschmidt/httprouter"
 )
 
+const (
+	// hostdbAllDefaultLimit is the number of hosts returned by /hostdb/all if
+	// no limit is provided.
+	hostdbAllDefaultLimit = 1000
+
+	// hostdbAllMaxLimit is the maximum number of hosts returned by a single
+	// call to /hostdb/all.
+	hostdbAllMaxLimit = 10000
+
+	// hostdbStreamFlushInterval is the number of hosts written by
+	// /hostdb/all/stream between flushes of the response.
+	hostdbStreamFlushInterval = 100
+)
+
+var (
+	// countryCodes maps the ISO 3166-1 alpha-2 codes of the countries known
+	// to the hostdb profiles to the country names stored with the hosts.
+	countryCodes = map[string]string{
+		"cn": "china",
+		"de": "germany",
+		"ru": "russia",
+		"us": "united states",
+	}
+)
+
 type (
 	// ExtendedHostDBEntry is an extension to modules.HostDBEntry that includes
 	// the string representation of the public key, otherwise presented as two
@@ -24,40 +57,99 @@ type (
 		Hosts []ExtendedHostDBEntry `json:"hosts"`
 	}
 
-	// HostdbAllGET lists all hosts that the renter is aware of.
+	// HostdbActiveAllGET lists the number of active hosts of every hostdb
+	// profile, keyed by profile name.
+	HostdbActiveAllGET struct {
+		Profiles map[string]int `json:"profiles"`
+	}
+
+	// HostdbAllGET lists a page of all hosts that the renter is aware of,
+	// together with the total number of hosts.
 	HostdbAllGET struct {
 		Hosts []ExtendedHostDBEntry `json:"hosts"`
+		Total int                   `json:"total"`
+	}
+
+	// HostdbRandomGET lists a set of random hosts of a hostdb profile together
+	// with their weights, ordered by descending weight.
+	HostdbRandomGET struct {
+		Hosts []modules.WeightedHostDBEntry `json:"hosts"`
+	}
+
+	// HostdbInjectPOST is returned after injecting a host into the hostdb. It
+	// contains the public key generated for the host.
+	HostdbInjectPOST struct {
+		PublicKey types.SiaPublicKey `json:"publickey"`
+	}
+
+	// HostdbProfilesConfigPOST is returned after configuring a hostdb profile.
+	// Warning is set if the profile doesn't match any of the active hosts
+	// anymore, the setting has been applied nonetheless.
+	HostdbProfilesConfigPOST struct {
+		Warning string `json:"warning"`
+	}
+
+	// HostdbProfilesValidatePOST is returned after validating proposed hostdb
+	// profile settings. If they are valid Hosts is the number of active hosts
+	// a profile with these settings would select from, otherwise Error
+	// describes why they are invalid.
+	HostdbProfilesValidatePOST struct {
+		Valid bool   `json:"valid"`
+		Error string `json:"error,omitempty"`
+		Hosts int    `json:"hosts"`
+	}
+
+	// HostdbProfilesDeletePOST is returned after deleting a hostdb profile. It
+	// reports the active profile after the deletion and whether it fell back
+	// to the default profile because the deleted profile was active.
+	HostdbProfilesDeletePOST struct {
+		ActiveProfile string `json:"activeprofile"`
+		FellBack      bool   `json:"fellback"`
 	}
 
 	// HostdbHostsGET lists detailed statistics for a particular host, selected
-	// by pubkey.
+	// by pubkey. Weight is the weight of the host in the host tree of the
+	// default profile, ProfileWeight the weight in the host tree of the
+	// requested profile.
 	HostdbHostsGET struct {
 		Entry          ExtendedHostDBEntry        `json:"entry"`
 		ScoreBreakdown modules.HostScoreBreakdown `json:"scorebreakdown"`
+		Weight         types.Currency             `json:"weight"`
+		ProfileWeight  types.Currency             `json:"profileweight"`
 	}
 )
 
 // hostdbActiveHandler handles the API call asking for the list of active
-// hosts.
+// hosts in the host tree of the hostdb profile provided by 'profile', or of the
+// default profile if none is provided.
 func (api *API) hostdbActiveHandler(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
-	var numHosts uint64
-	hosts := api.renter.ActiveHosts("default") //TODO pachisi456: add support for multiple profiles / trees
+	profile := req.FormValue("profile")
+	if profile == "" {
+		profile = "default"
+	}
+	if _, exists := api.renter.HostDBProfiles()[profile]; !exists {
+		WriteError(w, Error{"no hostdb profile with name " + profile}, http.StatusBadRequest)
+		return
+	}
 
+	var hosts []modules.HostDBEntry
 	if req.FormValue("numhosts") == "" {
 		// Default value for 'numhosts' is all of them.
-		numHosts = uint64(len(hosts))
+		hosts = api.renter.ActiveHosts(profile)
 	} else {
 		// Parse the value for 'numhosts'.
+		var numHosts uint64
 		_, err := fmt.Sscan(req.FormValue("numhosts"), &numHosts)
 		if err != nil {
 			WriteError(w, Error{err.Error()}, http.StatusBadRequest)
 			return
 		}
 
-		// Catch any boundary errors.
-		if numHosts > uint64(len(hosts)) {
-			numHosts = uint64(len(hosts))
+		// Only fetch the requested number of hosts. Catch any boundary errors.
+		if numHosts > math.MaxInt32 {
+			numHosts = math.MaxInt32
 		}
+		hosts = api.renter.ActiveHostsN(profile, int(numHosts))
 	}
 
 	// Convert the entries into extended entries.
@@ -70,16 +162,42 @@ func (api *API) hostdbActiveHandler(w http.ResponseWriter, req *http.Request, _
 	}
 
 	WriteJSON(w, HostdbActiveGET{
-		Hosts: extendedHosts[:numHosts],
+		Hosts: extendedHosts,
 	})
 }
 
-// hostdbAllHandler handles the API call asking for the list of all hosts.
+// hostdbActiveAllHandler handles the API call asking for the number of active
+// hosts of every hostdb profile.
+func (api *API) hostdbActiveAllHandler(w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+	counts, err := api.renter.ActiveHostCounts()
+	if errors.Is(err, hostdb.ErrInitialScanIncomplete) {
+		WriteError(w, Error{err.Error()}, http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		WriteError(w, Error{err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	WriteJSON(w, HostdbActiveAllGET{Profiles: counts})
+}
+
+// hostdbAllHandler handles the API call asking for the list of all hosts. The
+// hosts are paginated using the 'offset' and 'limit' query parameters and can
+// be restricted to a country using the 'country' query parameter.
 func (api *API) hostdbAllHandler(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
-	// Get the set of all hosts and convert them into extended hosts.
+	offset, limit, err := parseHostdbAllPage(req)
+	if err != nil {
+		WriteError(w, Error{err.Error()}, http.StatusBadRequest)
+		return
+	}
+
+	// Get the page of all hosts and convert them into extended hosts.
 	hosts := api.renter.AllHosts("default") //TODO pachisi456: add support for multiple profiles / trees
+	if country := req.FormValue("country"); country != "" {
+		hosts = filterHostsByCountry(hosts, country)
+	}
 	var extendedHosts []ExtendedHostDBEntry
-	for _, host := range hosts {
+	for _, host := range paginateHosts(hosts, offset, limit) {
 		extendedHosts = append(extendedHosts, ExtendedHostDBEntry{
 			HostDBEntry:     host,
 			PublicKeyString: host.PublicKey.String(),
@@ -88,22 +206,173 @@ func (api *API) hostdbAllHandler(w http.ResponseWriter, req *http.Request, _ htt
 
 	WriteJSON(w, HostdbAllGET{
 		Hosts: extendedHosts,
+		Total: len(hosts),
+	})
+}
+
+// hostdbAllStreamHandler handles the API call asking for all hosts like
+// hostdbAllHandler, but writes the hosts as newline-delimited JSON, one host
+// per line, so that clients can process them without buffering all hosts. The
+// hosts are not paginated, the 'country' filter is supported.
+func (api *API) hostdbAllStreamHandler(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	hosts := api.renter.AllHosts("default")
+	if country := req.FormValue("country"); country != "" {
+		hosts = filterHostsByCountry(hosts, country)
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	// A failed write means that the client went away, there is no one left
+	// to report the error to.
+	writeHostsStream(w, hosts)
+}
+
+// writeHostsStream writes the hosts to w as newline-delimited JSON, flushing
+// the response every hostdbStreamFlushInterval hosts if w supports it. It
+// stops at the first failed write.
+func writeHostsStream(w io.Writer, hosts []modules.HostDBEntry) error {
+	enc := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	for i, host := range hosts {
+		err := enc.Encode(ExtendedHostDBEntry{
+			HostDBEntry:     host,
+			PublicKeyString: host.PublicKey.String(),
+		})
+		if err != nil {
+			return err
+		}
+		if flusher != nil && (i+1)%hostdbStreamFlushInterval == 0 {
+			flusher.Flush()
+		}
+	}
+	return nil
+}
+
+// parseHostdbAllPage parses the 'offset' and 'limit' query parameters of a
+// call to /hostdb/all. Missing parameters are replaced by their defaults and
+// the limit is capped at hostdbAllMaxLimit.
+func parseHostdbAllPage(req *http.Request) (offset, limit int, err error) {
+	limit = hostdbAllDefaultLimit
+	if req.FormValue("offset") != "" {
+		if _, err := fmt.Sscan(req.FormValue("offset"), &offset); err != nil {
+			return 0, 0, errors.New("unable to parse offset: " + err.Error())
+		}
+		if offset < 0 {
+			return 0, 0, errors.New("offset must not be negative")
+		}
+	}
+	if req.FormValue("limit") != "" {
+		if _, err := fmt.Sscan(req.FormValue("limit"), &limit); err != nil {
+			return 0, 0, errors.New("unable to parse limit: " + err.Error())
+		}
+		if limit < 0 {
+			return 0, 0, errors.New("limit must not be negative")
+		}
+	}
+	if limit > hostdbAllMaxLimit {
+		limit = hostdbAllMaxLimit
+	}
+	return offset, limit, nil
+}
+
+// filterHostsByCountry returns the hosts located in the provided country. The
+// country is either an ISO 3166-1 alpha-2 code, the name of the country or "eu"
+// for all hosts within the european union and is matched case-insensitively.
+func filterHostsByCountry(hosts []modules.HostDBEntry, country string) (filtered []modules.HostDBEntry) {
+	country = strings.ToLower(strings.TrimSpace(country))
+	if name, exists := countryCodes[country]; exists {
+		country = name
+	}
+	for _, host := range hosts {
+		if (country == "eu" && host.EUhost) || strings.ToLower(host.Country) == country {
+			filtered = append(filtered, host)
+		}
+	}
+	return filtered
+}
+
+// paginateHosts returns at most limit hosts starting at offset.
+func paginateHosts(hosts []modules.HostDBEntry, offset, limit int) []modules.HostDBEntry {
+	if offset >= len(hosts) {
+		return nil
+	}
+	hosts = hosts[offset:]
+	if limit < len(hosts) {
+		hosts = hosts[:limit]
+	}
+	return hosts
+}
+
+// hostdbRandomHandler handles the API call asking for a set of random hosts
+// of a hostdb profile together with their weights. If 'preferuncontracted' is
+// true, hosts the renter has contracts with are only returned if there are too
+// few other hosts.
+func (api *API) hostdbRandomHandler(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	profile := req.FormValue("profile")
+	if profile == "" {
+		profile = "default"
+	}
+	var numHosts uint64
+	_, err := fmt.Sscan(req.FormValue("numhosts"), &numHosts)
+	if err != nil {
+		WriteError(w, Error{"unable to parse numhosts: " + err.Error()}, http.StatusBadRequest)
+		return
+	}
+	if numHosts > math.MaxInt32 {
+		numHosts = math.MaxInt32
+	}
+	if _, exists := api.renter.HostDBProfiles()[profile]; !exists {
+		WriteError(w, Error{"no hostdb profile with name " + profile}, http.StatusBadRequest)
+		return
+	}
+	var preferUncontracted bool
+	if req.FormValue("preferuncontracted") != "" {
+		preferUncontracted, err = strconv.ParseBool(req.FormValue("preferuncontracted"))
+		if err != nil {
+			WriteError(w, Error{"unable to parse preferuncontracted: " + err.Error()}, http.StatusBadRequest)
+			return
+		}
+	}
+
+	hosts, err := api.renter.RandomHostsWithWeights(profile, int(numHosts), nil, nil, preferUncontracted)
+	if errors.Is(err, hostdb.ErrInitialScanIncomplete) {
+		WriteError(w, Error{err.Error()}, http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		WriteError(w, Error{err.Error()}, http.StatusBadRequest)
+		return
+	}
+	WriteJSON(w, HostdbRandomGET{
+		Hosts: hosts,
 	})
 }
 
 // hostdbHostsHandler handles the API call asking for a specific host,
-// returning detailed informatino about that host.
+// returning detailed informatino about that host. The score breakdown and the
+// profile weight are computed with the weighting of the hostdb profile provided
+// by 'profile', or of the default profile if none is provided.
 func (api *API) hostdbHostsHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
 	var pk types.SiaPublicKey
 	pk.LoadString(ps.ByName("pubkey"))
 
+	profile := req.FormValue("profile")
+	if profile == "" {
+		profile = "default"
+	}
+	if _, exists := api.renter.HostDBProfiles()[profile]; !exists {
+		WriteError(w, Error{"no hostdb profile with name " + profile}, http.StatusBadRequest)
+		return
+	}
+
 	entry, exists := api.renter.Host(pk)
 	if !exists {
 		WriteError(w, Error{"requested host does not exist"}, http.StatusBadRequest)
 		return
 	}
-	//TODO pachisi456: add support for multiple trees/profiles
-	breakdown := api.renter.ScoreBreakdown(entry, "default")
+	breakdown, err := api.renter.ScoreBreakdown(entry, profile)
+	if err != nil {
+		WriteError(w, Error{err.Error()}, http.StatusBadRequest)
+		return
+	}
 
 	// Extend the hostdb entry  to have the public key string.
 	extendedEntry := ExtendedHostDBEntry{
@@ -113,15 +382,127 @@ func (api *API) hostdbHostsHandler(w http.ResponseWriter, req *http.Request, ps
 	WriteJSON(w, HostdbHostsGET{
 		Entry:          extendedEntry,
 		ScoreBreakdown: breakdown,
+		Weight:         api.renter.HostWeight(entry, "default"),
+		ProfileWeight:  api.renter.HostWeight(entry, profile),
 	})
 }
 
+// hostdbHostsRescanHandler handles the API call to queue an immediate scan of
+// a specific host, selected by pubkey.
+func (api *API) hostdbHostsRescanHandler(w http.ResponseWriter, _ *http.Request, ps httprouter.Params) {
+	var pk types.SiaPublicKey
+	pk.LoadString(ps.ByName("pubkey"))
+
+	err := api.renter.RescanHost(pk)
+	if err != nil {
+		WriteError(w, Error{err.Error()}, http.StatusBadRequest)
+		return
+	}
+	WriteSuccess(w)
+}
+
+// hostdbHostsTagsHandler handles the API call to set the tags annotating a
+// specific host, selected by pubkey. The tags are provided comma separated by
+// 'tags', an empty value removes all tags of the host.
+func (api *API) hostdbHostsTagsHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	var pk types.SiaPublicKey
+	pk.LoadString(ps.ByName("pubkey"))
+
+	var tags []string
+	if value := req.FormValue("tags"); value != "" {
+		tags = strings.Split(value, ",")
+	}
+	err := api.renter.SetHostTags(pk, tags)
+	if err != nil {
+		WriteError(w, Error{err.Error()}, http.StatusBadRequest)
+		return
+	}
+	WriteSuccess(w)
+}
+
+// hostdbInjectHandler handles the API call to add a host to the hostdb without
+// an announcement. It is only available during testing.
+func (api *API) hostdbInjectHandler(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var eu bool
+	if req.FormValue("eu") != "" {
+		var err error
+		eu, err = strconv.ParseBool(req.FormValue("eu"))
+		if err != nil {
+			WriteError(w, Error{"unable to parse eu: " + err.Error()}, http.StatusBadRequest)
+			return
+		}
+	}
+	entry, err := api.renter.InjectHost(modules.NetAddress(req.FormValue("netaddress")), req.FormValue("country"), eu)
+	if err != nil {
+		WriteError(w, Error{err.Error()}, http.StatusBadRequest)
+		return
+	}
+	WriteJSON(w, HostdbInjectPOST{PublicKey: entry.PublicKey})
+}
+
+// hostdbMetricsHandler handles the API call asking for a snapshot of the
+// health of the hostdb.
+func (api *API) hostdbMetricsHandler(w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+	WriteJSON(w, api.renter.HostDBMetrics())
+}
+
+// hostdbPersistHandler handles the API call asking for information about the
+// hostdb persistence file on disk.
+func (api *API) hostdbPersistHandler(w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+	info, err := api.renter.HostDBPersistInfo()
+	if err != nil {
+		WriteError(w, Error{"unable to read the hostdb persistence file: " + err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	WriteJSON(w, info)
+}
+
+// hostdbGeolocationRefreshHandlerPOST handles the API call to download the
+// geolocation database again and recompute the location of every host. The
+// refresh runs in the background.
+func (api *API) hostdbGeolocationRefreshHandlerPOST(w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+	err := api.renter.RefreshHostDBGeolocation()
+	if err != nil {
+		WriteError(w, Error{err.Error()}, http.StatusBadRequest)
+		return
+	}
+	WriteSuccess(w)
+}
+
+// hostdbGeolocationRefreshHandlerGET handles the API call asking for the
+// progress of the last refresh of the host locations.
+func (api *API) hostdbGeolocationRefreshHandlerGET(w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+	WriteJSON(w, api.renter.HostDBGeolocationRefresh())
+}
+
 // hostDBProfilesHandlerGET handles the API call asking for the list of hostdb profiles and returns such.
 func (api *API) hostDBProfilesHandlerGET(w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
 	hdbprofiles := api.renter.HostDBProfiles()
 	WriteJSON(w, hdbprofiles)
 }
 
+// hostDBProfileHandlerGET handles the API call asking for a single hostdb
+// profile. Unknown profiles are reported with 404 Not Found.
+func (api *API) hostDBProfileHandlerGET(w http.ResponseWriter, _ *http.Request, ps httprouter.Params) {
+	profile, err := api.renter.HostDBProfile(ps.ByName("name"))
+	if err != nil {
+		WriteError(w, Error{err.Error()}, http.StatusNotFound)
+		return
+	}
+	WriteJSON(w, profile)
+}
+
+// hostDBProfilesEffectiveHandler handles the API call asking for the effective
+// filters a hostdb profile applies when selecting hosts.
+func (api *API) hostDBProfilesEffectiveHandler(w http.ResponseWriter, _ *http.Request, ps httprouter.Params) {
+	filters, err := api.renter.HostDBProfileFilters(ps.ByName("name"))
+	if err != nil {
+		WriteError(w, Error{err.Error()}, http.StatusBadRequest)
+		return
+	}
+	WriteJSON(w, filters)
+}
+
 // hostDBProfilesAddHandler handles the API call for adding a new hostdb profile
 func (api *API) hostDBProfilesAddHandler(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
 	name := req.FormValue("name")
@@ -134,15 +515,86 @@ func (api *API) hostDBProfilesAddHandler(w http.ResponseWriter, req *http.Reques
 	WriteSuccess(w)
 }
 
+// hostDBProfilesAddBatchHandler handles the API call for adding several hostdb
+// profiles at once. The request body is a JSON array of profile specs. Either
+// all of the profiles are added or, if any of them is invalid, none of them.
+func (api *API) hostDBProfilesAddBatchHandler(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var specs []hostdbprofile.ProfileSpec
+	if err := json.NewDecoder(req.Body).Decode(&specs); err != nil {
+		WriteError(w, Error{"could not decode hostdb profiles: " + err.Error()}, http.StatusBadRequest)
+		return
+	}
+	if err := api.renter.AddHostDBProfilesBatch(specs); err != nil {
+		WriteError(w, Error{err.Error()}, http.StatusBadRequest)
+		return
+	}
+	WriteSuccess(w)
+}
+
 // hostDBProfilesConfigHandler handles the API call to change a setting of a hostdb profile.
 func (api *API) hostDBProfilesConfigHandler(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
 	name := req.FormValue("name")
 	setting := req.FormValue("setting")
 	value := req.FormValue("value")
-	err := api.renter.ConfigHostDBProfiles(name, setting, value)
+	warning, err := api.renter.ConfigHostDBProfiles(name, setting, value)
+	if errors.Is(err, hostdb.ErrInitialScanIncomplete) {
+		WriteError(w, Error{err.Error()}, http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		WriteError(w, Error{err.Error()}, http.StatusBadRequest)
+		return
+	}
+	WriteJSON(w, HostdbProfilesConfigPOST{Warning: warning})
+}
+
+// hostDBProfilesValidateHandler handles the API call to validate proposed
+// hostdb profile settings without saving them. Invalid settings are reported
+// in the response rather than as an error.
+func (api *API) hostDBProfilesValidateHandler(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	hosts, err := api.renter.ValidateHostDBProfile(req.FormValue("profile"))
+	if errors.Is(err, hostdb.ErrInitialScanIncomplete) {
+		WriteError(w, Error{err.Error()}, http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		WriteJSON(w, HostdbProfilesValidatePOST{Error: err.Error()})
+		return
+	}
+	WriteJSON(w, HostdbProfilesValidatePOST{Valid: true, Hosts: hosts})
+}
+
+// hostDBProfilesSetDefaultHandler handles the API call to set the hostdb profile
+// that is used if no profile is specified.
+func (api *API) hostDBProfilesSetDefaultHandler(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	err := api.renter.SetActiveHostDBProfile(req.FormValue("name"))
 	if err != nil {
 		WriteError(w, Error{err.Error()}, http.StatusBadRequest)
 		return
 	}
 	WriteSuccess(w)
 }
+
+// hostDBProfilesDeleteHandler handles the API call to delete a hostdb profile.
+// Deleting the active profile fails unless 'fallback' is true, in which case
+// the active profile falls back to the default profile.
+func (api *API) hostDBProfilesDeleteHandler(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var fallback bool
+	if req.FormValue("fallback") != "" {
+		var err error
+		fallback, err = strconv.ParseBool(req.FormValue("fallback"))
+		if err != nil {
+			WriteError(w, Error{"unable to parse fallback: " + err.Error()}, http.StatusBadRequest)
+			return
+		}
+	}
+	fellBack, err := api.renter.DeleteHostDBProfile(req.FormValue("name"), fallback)
+	if err != nil {
+		WriteError(w, Error{err.Error()}, http.StatusBadRequest)
+		return
+	}
+	WriteJSON(w, HostdbProfilesDeletePOST{
+		ActiveProfile: api.renter.ActiveHostDBProfile(),
+		FellBack:      fellBack,
+	})
+}
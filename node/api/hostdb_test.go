@@ -2,9 +2,11 @@ package api
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net/http/httptest"
 	"net/url"
 	"path/filepath"
 	"testing"
@@ -20,6 +22,7 @@ import (
 	"github.com/pachisi456/sia-hostdb-profiles/modules/renter"
 	"github.com/pachisi456/sia-hostdb-profiles/modules/transactionpool"
 	"github.com/pachisi456/sia-hostdb-profiles/modules/wallet"
+	"github.com/pachisi456/sia-hostdb-profiles/types"
 )
 
 // TestHostDBHostsActiveHandler checks the behavior of the call to
@@ -236,6 +239,63 @@ func TestHostDBHostsHandler(t *testing.T) {
 	}
 }
 
+// TestHostDBHostsRescanHandler checks that a host can be rescanned via the API
+// and that rescanning an unknown host fails.
+func TestHostDBHostsRescanHandler(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	st, err := createServerTester(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.server.panicClose()
+
+	// Announce the host and then get the list of hosts.
+	var ah HostdbActiveGET
+	if err = st.announceHost(); err != nil {
+		t.Fatal(err)
+	}
+	if err = st.getAPI("/hostdb/active", &ah); err != nil {
+		t.Fatal(err)
+	}
+	if len(ah.Hosts) != 1 {
+		t.Fatalf("expected 1 host, got %v", len(ah.Hosts))
+	}
+	query := fmt.Sprintf("/hostdb/hosts/%s", ah.Hosts[0].PublicKeyString)
+	var hh HostdbHostsGET
+	if err = st.getAPI(query, &hh); err != nil {
+		t.Fatal(err)
+	}
+	scans := len(hh.Entry.ScanHistory)
+
+	// Rescan the host and wait for the scan history to grow.
+	if err = st.stdPostAPI(query+"/rescan", url.Values{}); err != nil {
+		t.Fatal(err)
+	}
+	err = retry(50, 100*time.Millisecond, func() error {
+		if err := st.getAPI(query, &hh); err != nil {
+			return err
+		}
+		if len(hh.Entry.ScanHistory) <= scans {
+			return errors.New("scan history did not grow")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Rescanning an unknown host should fail.
+	unknown := types.SiaPublicKey{
+		Algorithm: types.SignatureEd25519,
+		Key:       make([]byte, crypto.PublicKeySize),
+	}
+	if err = st.stdPostAPI("/hostdb/hosts/"+unknown.String()+"/rescan", url.Values{}); err == nil {
+		t.Fatal("expected rescanning an unknown host to fail")
+	}
+}
+
 // assembleHostHostname is assembleServerTester but you can specify which
 // hostname the host should use.
 func assembleHostPort(key crypto.TwofishKey, hostHostname string, testdir string) (*serverTester, error) {
@@ -1291,3 +1351,135 @@ func TestHostDBAndRenterRenewDynamicIPs(t *testing.T) {
 		t.Fatal("data mismatch when downloading a file")
 	}
 }
+
+// TestHostdbAllPagination checks that paging through a large number of hosts
+// returns every host exactly once and that the page parameters are validated.
+func TestHostdbAllPagination(t *testing.T) {
+	var hosts []modules.HostDBEntry
+	for i := 0; i < 2500; i++ {
+		var host modules.HostDBEntry
+		host.PublicKey = types.SiaPublicKey{
+			Algorithm: types.SignatureEd25519,
+			Key:       []byte(fmt.Sprint(i)),
+		}
+		hosts = append(hosts, host)
+	}
+
+	// Page through the hosts using the default limit.
+	seen := make(map[string]struct{})
+	for offset := 0; ; {
+		req := httptest.NewRequest("GET", fmt.Sprintf("/hostdb/all?offset=%v", offset), nil)
+		off, limit, err := parseHostdbAllPage(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if off != offset || limit != hostdbAllDefaultLimit {
+			t.Fatalf("expected offset %v and limit %v, got %v and %v", offset, hostdbAllDefaultLimit, off, limit)
+		}
+		page := paginateHosts(hosts, off, limit)
+		if len(page) == 0 {
+			break
+		}
+		for _, host := range page {
+			if _, exists := seen[host.PublicKey.String()]; exists {
+				t.Fatal("host returned twice:", host.PublicKey.String())
+			}
+			seen[host.PublicKey.String()] = struct{}{}
+		}
+		offset += len(page)
+	}
+	if len(seen) != len(hosts) {
+		t.Fatalf("expected %v hosts, got %v", len(hosts), len(seen))
+	}
+
+	// The limit is capped.
+	req := httptest.NewRequest("GET", "/hostdb/all?limit=1000000", nil)
+	if _, limit, err := parseHostdbAllPage(req); err != nil || limit != hostdbAllMaxLimit {
+		t.Fatal("expected the limit to be capped, got", limit, err)
+	}
+	if page := paginateHosts(hosts, 2400, 500); len(page) != 100 {
+		t.Fatal("expected the last page to contain 100 hosts, got", len(page))
+	}
+
+	// Invalid parameters are rejected.
+	for _, query := range []string{"offset=-1", "limit=-1", "offset=x", "limit=x"} {
+		req := httptest.NewRequest("GET", "/hostdb/all?"+query, nil)
+		if _, _, err := parseHostdbAllPage(req); err == nil {
+			t.Error("expected an error for", query)
+		}
+	}
+}
+
+// TestHostdbAllCountry checks that /hostdb/all only returns the hosts of the
+// requested country and that the country filter is applied before pagination.
+func TestHostdbAllCountry(t *testing.T) {
+	var hosts []modules.HostDBEntry
+	for i, country := range []string{"Germany", "China", "Germany", "", "United States", "Germany"} {
+		var host modules.HostDBEntry
+		host.PublicKey = types.SiaPublicKey{
+			Algorithm: types.SignatureEd25519,
+			Key:       []byte(fmt.Sprint(i)),
+		}
+		host.Country = country
+		host.EUhost = country == "Germany"
+		hosts = append(hosts, host)
+	}
+
+	for _, country := range []string{"de", "DE", "germany", "Germany", "eu"} {
+		german := filterHostsByCountry(hosts, country)
+		if len(german) != 3 {
+			t.Fatalf("%v: expected 3 German hosts, got %v", country, len(german))
+		}
+		for _, host := range german {
+			if host.Country != "Germany" {
+				t.Fatalf("%v: expected only German hosts, got a host from %q", country, host.Country)
+			}
+		}
+	}
+	if us := filterHostsByCountry(hosts, "us"); len(us) != 1 || us[0].Country != "United States" {
+		t.Fatal("expected a single host from the United States, got", us)
+	}
+	if none := filterHostsByCountry(hosts, "fr"); len(none) != 0 {
+		t.Fatal("expected no hosts from an unknown country, got", len(none))
+	}
+
+	// Pagination refers to the filtered hosts.
+	if page := paginateHosts(filterHostsByCountry(hosts, "de"), 1, 1); len(page) != 1 || page[0].PublicKey.String() != hosts[2].PublicKey.String() {
+		t.Fatal("expected the second German host on the second page, got", page)
+	}
+}
+
+// TestHostdbAllStream checks that /hostdb/all/stream writes one JSON host entry
+// per line and flushes the response while writing.
+func TestHostdbAllStream(t *testing.T) {
+	var hosts []modules.HostDBEntry
+	for i := 0; i < 2*hostdbStreamFlushInterval+1; i++ {
+		var host modules.HostDBEntry
+		host.PublicKey = types.SiaPublicKey{
+			Algorithm: types.SignatureEd25519,
+			Key:       []byte(fmt.Sprint(i)),
+		}
+		hosts = append(hosts, host)
+	}
+
+	w := httptest.NewRecorder()
+	if err := writeHostsStream(w, hosts); err != nil {
+		t.Fatal(err)
+	}
+	if !w.Flushed {
+		t.Fatal("expected the response to be flushed while writing")
+	}
+	if lines := bytes.Count(w.Body.Bytes(), []byte("\n")); lines != len(hosts) {
+		t.Fatalf("expected %v lines, got %v", len(hosts), lines)
+	}
+	dec := json.NewDecoder(w.Body)
+	for i := 0; dec.More(); i++ {
+		var entry ExtendedHostDBEntry
+		if err := dec.Decode(&entry); err != nil {
+			t.Fatal(err)
+		}
+		if entry.PublicKeyString != hosts[i].PublicKey.String() {
+			t.Fatalf("expected host %v, got %v", hosts[i].PublicKey.String(), entry.PublicKeyString)
+		}
+	}
+}
@@ -234,6 +234,25 @@ func (api *API) renterHandlerPOST(w http.ResponseWriter, req *http.Request, _ ht
 		// Sane defaults if renew window hasn't been set before.
 		settings.Allowance.RenewWindow = settings.Allowance.Period / 2
 	}
+	// Scan the maximum number of hosts per country. (optional parameter)
+	if m := req.FormValue("maxhostspercountry"); m != "" {
+		var maxHostsPerCountry uint64
+		if _, err := fmt.Sscan(m, &maxHostsPerCountry); err != nil {
+			WriteError(w, Error{"unable to parse maxhostspercountry: " + err.Error()}, http.StatusBadRequest)
+			return
+		}
+		settings.Allowance.MaxHostsPerCountry = maxHostsPerCountry
+	}
+	// Scan the hostdb profile weights. An empty value removes the weights.
+	// (optional parameter)
+	if pw := req.FormValue("profileweights"); pw != "" || req.Form["profileweights"] != nil {
+		weights, err := parseProfileWeights(pw)
+		if err != nil {
+			WriteError(w, Error{"unable to parse profileweights: " + err.Error()}, http.StatusBadRequest)
+			return
+		}
+		settings.Allowance.ProfileWeights = weights
+	}
 	// Scan the download speed limit. (optional parameter)
 	if d := req.FormValue("maxdownloadspeed"); d != "" {
 		var downloadSpeed int64
@@ -403,10 +422,23 @@ func (api *API) renterFilesHandler(w http.ResponseWriter, req *http.Request, _ h
 }
 
 // renterPricesHandler reports the expected costs of various actions given the
-// renter settings and the set of available hosts.
+// renter settings and the set of available hosts. If a profile is provided the
+// hosts of that hostdb profile are used for the estimation.
 func (api *API) renterPricesHandler(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	profile := req.FormValue("profile")
+	if profile == "" {
+		WriteJSON(w, RenterPricesGET{
+			RenterPriceEstimation: api.renter.PriceEstimation(),
+		})
+		return
+	}
+	est, err := api.renter.ProfilePriceEstimation(profile)
+	if err != nil {
+		WriteError(w, Error{err.Error()}, http.StatusBadRequest)
+		return
+	}
 	WriteJSON(w, RenterPricesGET{
-		RenterPriceEstimation: api.renter.PriceEstimation(),
+		RenterPriceEstimation: est,
 	})
 }
 
@@ -469,6 +501,34 @@ func (api *API) renterDownloadAsyncHandler(w http.ResponseWriter, req *http.Requ
 	api.renterDownloadHandler(w, req, ps)
 }
 
+// parseProfileWeights parses hostdb profile weights of the form
+// "profile:weight,profile:weight". An empty string results in no weights.
+func parseProfileWeights(s string) (map[string]uint64, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	weights := make(map[string]uint64)
+	for _, pair := range strings.Split(s, ",") {
+		i := strings.LastIndex(pair, ":")
+		if i == -1 {
+			return nil, fmt.Errorf("expected profile:weight, got %q", pair)
+		}
+		name := strings.TrimSpace(pair[:i])
+		if name == "" {
+			return nil, fmt.Errorf("missing profile name in %q", pair)
+		}
+		if _, exists := weights[name]; exists {
+			return nil, fmt.Errorf("profile %q is weighted twice", name)
+		}
+		var weight uint64
+		if _, err := fmt.Sscan(pair[i+1:], &weight); err != nil {
+			return nil, fmt.Errorf("invalid weight of profile %q: %v", name, err)
+		}
+		weights[name] = weight
+	}
+	return weights, nil
+}
+
 // parseDownloadParameters parses the download parameters passed to the
 // /renter/download endpoint. Validation of these parameters is done by the
 // renter.
@@ -9,6 +9,7 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strconv"
 	"strings"
 	"testing"
@@ -2112,3 +2113,23 @@ func TestAdversarialPriceRenewal(t *testing.T) {
 		time.Sleep(time.Millisecond * 100)
 	}
 }
+
+// TestParseProfileWeights checks the parsing of the profileweights parameter
+// of the /renter endpoint.
+func TestParseProfileWeights(t *testing.T) {
+	weights, err := parseProfileWeights("cold:1, hot:3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(weights, map[string]uint64{"cold": 1, "hot": 3}) {
+		t.Fatal("wrong weights:", weights)
+	}
+	if weights, err := parseProfileWeights(""); err != nil || weights != nil {
+		t.Fatal("expected no weights, got", weights, err)
+	}
+	for _, s := range []string{"cold", ":1", "cold:x", "cold:-1", "cold:1,cold:2"} {
+		if _, err := parseProfileWeights(s); err == nil {
+			t.Errorf("expected error parsing %q", s)
+		}
+	}
+}
@@ -90,11 +90,27 @@ func (api *API) buildHTTPRoutes(requiredUserAgent string, requiredPassword strin
 
 		// HostDB endpoints.
 		router.GET("/hostdb/active", api.hostdbActiveHandler)
+		router.GET("/hostdb/active/all", api.hostdbActiveAllHandler)
 		router.GET("/hostdb/all", api.hostdbAllHandler)
+		router.GET("/hostdb/all/stream", api.hostdbAllStreamHandler)
+		router.GET("/hostdb/geolocation/refresh", api.hostdbGeolocationRefreshHandlerGET)
+		router.POST("/hostdb/geolocation/refresh", api.hostdbGeolocationRefreshHandlerPOST)
 		router.GET("/hostdb/hosts/:pubkey", api.hostdbHostsHandler)
+		router.GET("/hostdb/metrics", api.hostdbMetricsHandler)
+		router.GET("/hostdb/persist", api.hostdbPersistHandler)
+		router.GET("/hostdb/random", api.hostdbRandomHandler)
+		router.POST("/hostdb/hosts/:pubkey/rescan", api.hostdbHostsRescanHandler)
+		router.POST("/hostdb/hosts/:pubkey/tags", api.hostdbHostsTagsHandler)
+		router.POST("/hostdb/inject", api.hostdbInjectHandler)
 		router.GET("/hostdb/profiles", api.hostDBProfilesHandlerGET)
 		router.POST("/hostdb/profiles/add", api.hostDBProfilesAddHandler)
+		router.POST("/hostdb/profiles/addbatch", api.hostDBProfilesAddBatchHandler)
 		router.POST("/hostdb/profiles/config", api.hostDBProfilesConfigHandler)
+		router.POST("/hostdb/profiles/validate", api.hostDBProfilesValidateHandler)
+		router.POST("/hostdb/profiles/setdefault", api.hostDBProfilesSetDefaultHandler)
+		router.POST("/hostdb/profiles/delete", api.hostDBProfilesDeleteHandler)
+		router.GET("/hostdb/profiles/:name", api.hostDBProfileHandlerGET)
+		router.GET("/hostdb/profiles/:name/effective", api.hostDBProfilesEffectiveHandler)
 	}
 
 	// Transaction pool API Calls
@@ -81,6 +81,27 @@ func readJSON(meta Metadata, object interface{}, filename string) error {
 	return json.Unmarshal(remainingBytes, &object)
 }
 
+// ReadMetadata reads the metadata of a persisted json object from disk without
+// checking it against the expected metadata. It is useful to diagnose files
+// that fail to load because of a bad header or version.
+func ReadMetadata(filename string) (Metadata, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return Metadata{}, err
+	}
+	defer file.Close()
+
+	var meta Metadata
+	dec := json.NewDecoder(file)
+	if err := dec.Decode(&meta.Header); err != nil {
+		return Metadata{}, build.ExtendErr("unable to read header from persisted json object file", err)
+	}
+	if err := dec.Decode(&meta.Version); err != nil {
+		return Metadata{}, build.ExtendErr("unable to read version from persisted json object file", err)
+	}
+	return meta, nil
+}
+
 // LoadJSON will load a persisted json object from disk.
 func LoadJSON(meta Metadata, object interface{}, filename string) error {
 	// Verify that the filename does not have the persist temp suffix.
@@ -0,0 +1,95 @@
+package siatest
+
+import (
+	"sync"
+
+	"github.com/pachisi456/sia-hostdb-profiles/modules"
+)
+
+// euCountries are the countries NewDependencyCountryResolver knows to be in
+// the European Union, named like in the geolocation database.
+var euCountries = map[string]bool{
+	"Austria":     true,
+	"Belgium":     true,
+	"France":      true,
+	"Germany":     true,
+	"Italy":       true,
+	"Netherlands": true,
+	"Poland":      true,
+	"Spain":       true,
+	"Sweden":      true,
+}
+
+type (
+	// hostLocation is the location a DependencyCustomResolver resolves a
+	// host's address to.
+	hostLocation struct {
+		country string
+		eu      bool
+	}
+
+	// DependencyCustomResolver is a dependency for the hostdb which resolves
+	// the location of hosts from a custom mapping instead of the geolocation
+	// database. This allows hosts running on localhost to be placed in
+	// different countries. Locations can be set for a specific address or
+	// for all addresses of an IP, the former taking precedence.
+	DependencyCustomResolver struct {
+		modules.ProductionDependencies
+		fallback    hostLocation
+		locations   map[modules.NetAddress]hostLocation
+		ipLocations map[string]hostLocation
+		mu          sync.Mutex
+	}
+)
+
+// NewDependencyCustomResolver creates a new DependencyCustomResolver which
+// resolves all hosts without a custom location to the provided fallback
+// country.
+func NewDependencyCustomResolver(fallbackCountry string, fallbackEU bool) *DependencyCustomResolver {
+	return &DependencyCustomResolver{
+		fallback:    hostLocation{country: fallbackCountry, eu: fallbackEU},
+		locations:   make(map[modules.NetAddress]hostLocation),
+		ipLocations: make(map[string]hostLocation),
+	}
+}
+
+// NewDependencyCountryResolver creates a new DependencyCustomResolver which
+// resolves the hosts of the provided IPs to the mapped countries. The EU flag
+// of a country is looked up in euCountries. Hosts of other IPs are resolved to
+// the fallback country, so every address geolocates deterministically.
+func NewDependencyCountryResolver(fallbackCountry string, countries map[string]string) *DependencyCustomResolver {
+	d := NewDependencyCustomResolver(fallbackCountry, euCountries[fallbackCountry])
+	for ip, country := range countries {
+		d.ipLocations[ip] = hostLocation{country: country, eu: euCountries[country]}
+	}
+	return d
+}
+
+// ResolveLocation returns the location of the host with the provided address.
+func (d *DependencyCustomResolver) ResolveLocation(addr modules.NetAddress) (string, bool, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if location, exists := d.locations[addr]; exists {
+		return location.country, location.eu, true
+	}
+	if location, exists := d.ipLocations[addr.Host()]; exists {
+		return location.country, location.eu, true
+	}
+	return d.fallback.country, d.fallback.eu, true
+}
+
+// SetLocation sets the location the host with the provided address is resolved
+// to. The hosts need to be rescanned for the hostdb to pick up the location.
+func (d *DependencyCustomResolver) SetLocation(addr modules.NetAddress, country string, eu bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.locations[addr] = hostLocation{country: country, eu: eu}
+}
+
+// SetIPLocation sets the location all hosts with the provided IP are resolved
+// to, unless a location has been set for their specific address.
+func (d *DependencyCustomResolver) SetIPLocation(ip string, country string, eu bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.ipLocations[ip] = hostLocation{country: country, eu: eu}
+}
@@ -0,0 +1,45 @@
+package siatest
+
+import (
+	"testing"
+
+	"github.com/pachisi456/sia-hostdb-profiles/modules"
+)
+
+// TestDependencyCountryResolver checks that the addresses of hosts resolve
+// deterministically to the countries mapped to their IPs.
+func TestDependencyCountryResolver(t *testing.T) {
+	resolver := NewDependencyCountryResolver("Germany", map[string]string{
+		"127.0.0.2": "China",
+	})
+	tests := []struct {
+		addr    modules.NetAddress
+		country string
+		eu      bool
+	}{
+		{"127.0.0.1:9982", "Germany", true},
+		{"127.0.0.2:9982", "China", false},
+		{"127.0.0.2:9983", "China", false},
+		{"localhost:9982", "Germany", true},
+	}
+	for _, test := range tests {
+		country, eu, ok := resolver.ResolveLocation(test.addr)
+		if !ok || country != test.country || eu != test.eu {
+			t.Errorf("%v: expected %v (eu: %v), got %v (eu: %v)", test.addr, test.country, test.eu, country, eu)
+		}
+	}
+
+	// A location set for a specific address takes precedence over the
+	// location of its IP.
+	resolver.SetLocation("127.0.0.2:9983", "France", true)
+	if country, eu, _ := resolver.ResolveLocation("127.0.0.2:9983"); country != "France" || !eu {
+		t.Errorf("expected the address to resolve to France, got %v (eu: %v)", country, eu)
+	}
+	if country, _, _ := resolver.ResolveLocation("127.0.0.2:9982"); country != "China" {
+		t.Error("expected the other address of the IP to still resolve to China, got", country)
+	}
+	resolver.SetIPLocation("127.0.0.1", "United States", false)
+	if country, eu, _ := resolver.ResolveLocation("127.0.0.1:9982"); country != "United States" || eu {
+		t.Errorf("expected the IP to resolve to the United States, got %v (eu: %v)", country, eu)
+	}
+}
@@ -292,7 +292,14 @@ func (tn *TestNode) WaitForDecreasingRedundancy(rf *RemoteFile, redundancy float
 // KnowsHost checks if tn has a certain host in its hostdb. This check is
 // performed using the host's public key.
 func (tn *TestNode) KnowsHost(host *TestNode) error {
-	hdag, err := tn.HostDbActiveGet()
+	return tn.KnowsHostInProfile(host, "default")
+}
+
+// KnowsHostInProfile checks if tn has a certain host in the host tree of the
+// provided hostdb profile. This check is performed using the host's public
+// key.
+func (tn *TestNode) KnowsHostInProfile(host *TestNode, profile string) error {
+	hdag, err := tn.HostDbActiveProfileGet(profile)
 	if err != nil {
 		return err
 	}
@@ -305,5 +312,5 @@ func (tn *TestNode) KnowsHost(host *TestNode) error {
 			return nil
 		}
 	}
-	return errors.New("host ist unknown")
+	return fmt.Errorf("host is unknown to hostdb profile %q", profile)
 }
@@ -0,0 +1,717 @@
+package renter
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pachisi456/sia-hostdb-profiles/modules"
+	"github.com/pachisi456/sia-hostdb-profiles/node"
+	"github.com/pachisi456/sia-hostdb-profiles/siatest"
+	"github.com/pachisi456/sia-hostdb-profiles/types"
+)
+
+// TestRenterProfileRenewals checks that contracts are only renewed with hosts
+// that are located in one of the locations of the active hostdb profile.
+func TestRenterProfileRenewals(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	// Create a group whose renter resolves the location of all hosts to
+	// Germany until told otherwise.
+	resolver := siatest.NewDependencyCustomResolver("Germany", true)
+	var params []node.NodeParams
+	for i := 0; i < 4; i++ {
+		dir, err := siatest.TestDir(t.Name(), fmt.Sprintf("host%v", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		params = append(params, node.Host(dir))
+	}
+	renterDir, err := siatest.TestDir(t.Name(), "renter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	renterParams := node.Renter(renterDir)
+	renterParams.HostDBDeps = resolver
+	minerDir, err := siatest.TestDir(t.Name(), "miner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	params = append(params, renterParams, siatest.Miner(minerDir))
+	tg, err := siatest.NewGroup(params...)
+	if err != nil {
+		t.Fatal("Failed to create group: ", err)
+	}
+	defer func() {
+		if err := tg.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	renter := tg.Renters()[0]
+	miner := tg.Miners()[0]
+
+	// Move half of the hosts to France and rescan them.
+	german := make(map[string]struct{})
+	for i, host := range tg.Hosts() {
+		hg, err := host.HostGet()
+		if err != nil {
+			t.Fatal(err)
+		}
+		pk, err := host.HostPublicKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i%2 == 0 {
+			german[pk.String()] = struct{}{}
+			continue
+		}
+		resolver.SetLocation(hg.ExternalSettings.NetAddress, "France", true)
+		if err := renter.HostDbHostRescanPost(pk); err != nil {
+			t.Fatal(err)
+		}
+		err = siatest.Retry(100, 100*time.Millisecond, func() error {
+			hhg, err := renter.HostDbHostsGet(pk, "")
+			if err != nil {
+				return err
+			}
+			if hhg.Entry.Country != "France" {
+				return errors.New("host has not been moved to France yet")
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Restrict the renter to German hosts.
+	if err := renter.HostDbProfilesAddPost("germany", "warm"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := renter.HostDbProfilesConfigPost("germany", "addlocation", "germany"); err != nil {
+		t.Fatal(err)
+	}
+	if err := renter.HostDbProfilesSetDefaultPost("germany"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Mine past the end of the current contracts, giving the contractor the
+	// chance to renew them within the renew window.
+	rc, err := renter.RenterContractsGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var endHeight types.BlockHeight
+	for _, c := range rc.Contracts {
+		if c.EndHeight > endHeight {
+			endHeight = c.EndHeight
+		}
+	}
+	cg, err := miner.ConsensusGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for height := cg.Height; height <= endHeight; height++ {
+		if err := miner.MineBlock(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Only the contracts with the German hosts should have been renewed.
+	err = siatest.Retry(100, 100*time.Millisecond, func() error {
+		rc, err := renter.RenterContractsGet()
+		if err != nil {
+			return err
+		}
+		renewed := make(map[string]struct{})
+		for _, c := range rc.Contracts {
+			if c.EndHeight <= endHeight {
+				return errors.New("contract has not been renewed or expired yet")
+			}
+			if _, exists := german[c.HostPublicKey.String()]; !exists {
+				return fmt.Errorf("contract with host %v outside of the profile's locations", c.HostPublicKey.String())
+			}
+			renewed[c.HostPublicKey.String()] = struct{}{}
+		}
+		if len(renewed) != len(german) {
+			return fmt.Errorf("expected %v renewed contracts, got %v", len(german), len(renewed))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestRenterMaxHostsPerCountry checks that the contractor doesn't form more
+// contracts with hosts in a single country than the allowance permits.
+func TestRenterMaxHostsPerCountry(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	// Create a group whose renter resolves the location of all hosts to
+	// Germany until told otherwise.
+	resolver := siatest.NewDependencyCustomResolver("Germany", true)
+	var params []node.NodeParams
+	for i := 0; i < 5; i++ {
+		dir, err := siatest.TestDir(t.Name(), fmt.Sprintf("host%v", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		params = append(params, node.Host(dir))
+	}
+	renterDir, err := siatest.TestDir(t.Name(), "renter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	renterParams := node.Renter(renterDir)
+	renterParams.HostDBDeps = resolver
+	minerDir, err := siatest.TestDir(t.Name(), "miner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	params = append(params, renterParams, siatest.Miner(minerDir))
+	tg, err := siatest.NewGroup(params...)
+	if err != nil {
+		t.Fatal("Failed to create group: ", err)
+	}
+	defer func() {
+		if err := tg.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	renter := tg.Renters()[0]
+	miner := tg.Miners()[0]
+
+	// Move one of the hosts to France and rescan it.
+	host := tg.Hosts()[0]
+	hg, err := host.HostGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	french, err := host.HostPublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolver.SetLocation(hg.ExternalSettings.NetAddress, "France", true)
+	if err := renter.HostDbHostRescanPost(french); err != nil {
+		t.Fatal(err)
+	}
+	err = siatest.Retry(100, 100*time.Millisecond, func() error {
+		hhg, err := renter.HostDbHostsGet(french, "")
+		if err != nil {
+			return err
+		}
+		if hhg.Entry.Country != "France" {
+			return errors.New("host has not been moved to France yet")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Cancel the allowance to drop the existing contracts and set it again
+	// with a cap of two contracts per country.
+	rg, err := renter.RenterGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	allowance := rg.Settings.Allowance
+	if err := renter.RenterCancelAllowance(); err != nil {
+		t.Fatal(err)
+	}
+	err = siatest.Retry(100, 100*time.Millisecond, func() error {
+		rc, err := renter.RenterContractsGet()
+		if err != nil {
+			return err
+		}
+		if len(rc.Contracts) != 0 {
+			return fmt.Errorf("expected no contracts, got %v", len(rc.Contracts))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	allowance.MaxHostsPerCountry = 2
+	if err := renter.RenterPostAllowance(allowance); err != nil {
+		t.Fatal(err)
+	}
+
+	// The renter should form contracts with two German hosts and the French
+	// host, even though it is looking for five hosts.
+	countContracts := func() (germany, france int, err error) {
+		rc, err := renter.RenterContractsGet()
+		if err != nil {
+			return 0, 0, err
+		}
+		for _, c := range rc.Contracts {
+			if c.HostPublicKey.String() == french.String() {
+				france++
+			} else {
+				germany++
+			}
+		}
+		return germany, france, nil
+	}
+	err = siatest.Retry(100, 100*time.Millisecond, func() error {
+		germany, france, err := countContracts()
+		if err != nil {
+			return err
+		}
+		if germany != 2 || france != 1 {
+			if err := miner.MineBlock(); err != nil {
+				return err
+			}
+			return fmt.Errorf("expected 2 German and 1 French contracts, got %v and %v", germany, france)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Further maintenance shouldn't form any more contracts in Germany.
+	for i := 0; i < 3; i++ {
+		if err := miner.MineBlock(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(time.Second)
+	if germany, _, err := countContracts(); err != nil {
+		t.Fatal(err)
+	} else if germany > 2 {
+		t.Fatalf("expected at most 2 German contracts, got %v", germany)
+	}
+}
+
+// TestRenterProfileWeights checks that the contractor spreads the contracts
+// across the hostdb profiles of the allowance according to their weights.
+func TestRenterProfileWeights(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	// Create a group whose renter resolves the location of all hosts to
+	// Germany until told otherwise.
+	resolver := siatest.NewDependencyCustomResolver("Germany", true)
+	var params []node.NodeParams
+	for i := 0; i < 6; i++ {
+		dir, err := siatest.TestDir(t.Name(), fmt.Sprintf("host%v", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		params = append(params, node.Host(dir))
+	}
+	renterDir, err := siatest.TestDir(t.Name(), "renter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	renterParams := node.Renter(renterDir)
+	renterParams.HostDBDeps = resolver
+	minerDir, err := siatest.TestDir(t.Name(), "miner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	params = append(params, renterParams, siatest.Miner(minerDir))
+	tg, err := siatest.NewGroup(params...)
+	if err != nil {
+		t.Fatal("Failed to create group: ", err)
+	}
+	defer func() {
+		if err := tg.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	renter := tg.Renters()[0]
+	miner := tg.Miners()[0]
+
+	// Move half of the hosts to France and rescan them.
+	french := make(map[string]struct{})
+	for i, host := range tg.Hosts() {
+		if i%2 == 0 {
+			continue
+		}
+		hg, err := host.HostGet()
+		if err != nil {
+			t.Fatal(err)
+		}
+		pk, err := host.HostPublicKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		french[pk.String()] = struct{}{}
+		resolver.SetLocation(hg.ExternalSettings.NetAddress, "France", true)
+		if err := renter.HostDbHostRescanPost(pk); err != nil {
+			t.Fatal(err)
+		}
+		err = siatest.Retry(100, 100*time.Millisecond, func() error {
+			hhg, err := renter.HostDbHostsGet(pk, "")
+			if err != nil {
+				return err
+			}
+			if hhg.Entry.Country != "France" {
+				return errors.New("host has not been moved to France yet")
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Create a profile for each country.
+	for _, country := range []string{"france", "germany"} {
+		if err := renter.HostDbProfilesAddPost(country, "warm"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := renter.HostDbProfilesConfigPost(country, "addlocation", country); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Cancel the allowance to drop the existing contracts.
+	rg, err := renter.RenterGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	allowance := rg.Settings.Allowance
+	if err := renter.RenterCancelAllowance(); err != nil {
+		t.Fatal(err)
+	}
+	err = siatest.Retry(100, 100*time.Millisecond, func() error {
+		rc, err := renter.RenterContractsGet()
+		if err != nil {
+			return err
+		}
+		if len(rc.Contracts) != 0 {
+			return fmt.Errorf("expected no contracts, got %v", len(rc.Contracts))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A weight too small for a single contract is rejected.
+	allowance.Hosts = 3
+	allowance.ProfileWeights = map[string]uint64{"france": 1, "germany": 5}
+	if err := renter.RenterPostAllowance(allowance); err == nil {
+		t.Fatal("expected setting a too small profile weight to fail")
+	}
+
+	// A disabled profile cannot be used by the allowance.
+	allowance.ProfileWeights = map[string]uint64{"france": 1, "germany": 2}
+	if _, err := renter.HostDbProfilesConfigPost("france", "enabled", "false"); err != nil {
+		t.Fatal(err)
+	}
+	if err := renter.RenterPostAllowance(allowance); err == nil {
+		t.Fatal("expected setting an allowance with a disabled profile to fail")
+	}
+	if _, err := renter.HostDbProfilesConfigPost("france", "enabled", "true"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Form one contract with a French host and two with German hosts.
+	if err := renter.RenterPostAllowance(allowance); err != nil {
+		t.Fatal(err)
+	}
+	countContracts := func() (germany, france int, err error) {
+		rc, err := renter.RenterContractsGet()
+		if err != nil {
+			return 0, 0, err
+		}
+		for _, c := range rc.Contracts {
+			if _, exists := french[c.HostPublicKey.String()]; exists {
+				france++
+			} else {
+				germany++
+			}
+		}
+		return germany, france, nil
+	}
+	err = siatest.Retry(100, 100*time.Millisecond, func() error {
+		germany, france, err := countContracts()
+		if err != nil {
+			return err
+		}
+		if germany != 2 || france != 1 {
+			if err := miner.MineBlock(); err != nil {
+				return err
+			}
+			return fmt.Errorf("expected 2 German and 1 French contracts, got %v and %v", germany, france)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The allowance reports the weights.
+	rg, err = renter.RenterGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := rg.Settings.Allowance.ProfileWeights; w["france"] != 1 || w["germany"] != 2 || len(w) != 2 {
+		t.Fatal("wrong profile weights:", w)
+	}
+}
+
+// TestRenterProfileRenewWindow checks that contracts are renewed within the
+// renew window of the active hostdb profile if it overrides the renew window
+// of the allowance.
+func TestRenterProfileRenewWindow(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	// Create a group whose renter resolves the location of all hosts to
+	// Germany.
+	resolver := siatest.NewDependencyCustomResolver("Germany", true)
+	var params []node.NodeParams
+	for i := 0; i < 2; i++ {
+		dir, err := siatest.TestDir(t.Name(), fmt.Sprintf("host%v", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		params = append(params, node.Host(dir))
+	}
+	renterDir, err := siatest.TestDir(t.Name(), "renter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	renterParams := node.Renter(renterDir)
+	renterParams.HostDBDeps = resolver
+	minerDir, err := siatest.TestDir(t.Name(), "miner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	params = append(params, renterParams, siatest.Miner(minerDir))
+	tg, err := siatest.NewGroup(params...)
+	if err != nil {
+		t.Fatal("Failed to create group: ", err)
+	}
+	defer func() {
+		if err := tg.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	renter := tg.Renters()[0]
+	miner := tg.Miners()[0]
+
+	// Switch to a profile renewing contracts three times as early as the
+	// allowance.
+	rg, err := renter.RenterGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	allowance := rg.Settings.Allowance
+	renewWindow := 3 * allowance.RenewWindow
+	if err := renter.HostDbProfilesAddPost("hot", "hot"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := renter.HostDbProfilesConfigPost("hot", "renewwindow", fmt.Sprint(renewWindow)); err != nil {
+		t.Fatal(err)
+	}
+	if err := renter.HostDbProfilesSetDefaultPost("hot"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The profile's renew window has to be less than the period.
+	if _, err := renter.HostDbProfilesConfigPost("hot", "renewwindow", fmt.Sprint(allowance.Period)); err != nil {
+		t.Fatal(err)
+	}
+	invalid := allowance
+	invalid.RenewWindow++
+	if err := renter.RenterPostAllowance(invalid); err == nil {
+		t.Fatal("expected setting an allowance with a too large profile renew window to fail")
+	}
+	if _, err := renter.HostDbProfilesConfigPost("hot", "renewwindow", fmt.Sprint(renewWindow)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Mine into the profile's renew window, but not into the allowance's.
+	rc, err := renter.RenterContractsGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rc.Contracts) == 0 {
+		t.Fatal("expected contracts to be formed")
+	}
+	endHeight := rc.Contracts[0].EndHeight
+	for _, c := range rc.Contracts {
+		if c.EndHeight < endHeight {
+			endHeight = c.EndHeight
+		}
+	}
+	cg, err := miner.ConsensusGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for height := cg.Height; height+renewWindow < endHeight+2; height++ {
+		if err := miner.MineBlock(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The contracts should be renewed before the allowance's renew window is
+	// reached.
+	err = siatest.Retry(100, 100*time.Millisecond, func() error {
+		rc, err := renter.RenterContractsGet()
+		if err != nil {
+			return err
+		}
+		for _, c := range rc.Contracts {
+			if c.EndHeight <= endHeight {
+				return fmt.Errorf("contract with host %v has not been renewed yet", c.HostPublicKey.String())
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cg, err = miner.ConsensusGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cg.Height+allowance.RenewWindow >= endHeight {
+		t.Fatal("contracts were renewed within the allowance's renew window instead of the profile's")
+	}
+}
+
+// TestRenterProfileContractTarget checks that the contractor only forms as
+// many contracts as the hostdb profile of the allowance has hosts available,
+// if the allowance asks for more hosts than that, and warns about it.
+func TestRenterProfileContractTarget(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	// Create a group whose renter resolves the location of all hosts to
+	// Germany.
+	resolver := siatest.NewDependencyCustomResolver("Germany", true)
+	var params []node.NodeParams
+	for i := 0; i < 3; i++ {
+		dir, err := siatest.TestDir(t.Name(), fmt.Sprintf("host%v", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		params = append(params, node.Host(dir))
+	}
+	renterDir, err := siatest.TestDir(t.Name(), "renter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	renterParams := node.Renter(renterDir)
+	renterParams.HostDBDeps = resolver
+	minerDir, err := siatest.TestDir(t.Name(), "miner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	params = append(params, renterParams, siatest.Miner(minerDir))
+	tg, err := siatest.NewGroup(params...)
+	if err != nil {
+		t.Fatal("Failed to create group: ", err)
+	}
+	defer func() {
+		if err := tg.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	renter := tg.Renters()[0]
+	miner := tg.Miners()[0]
+
+	// Create a profile pinned to a single host.
+	pinned, err := tg.Hosts()[0].HostPublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := renter.HostDbProfilesAddPost("pinned", "warm"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := renter.HostDbProfilesConfigPost("pinned", "pinhost", pinned.String()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Cancel the allowance to drop the existing contracts.
+	rg, err := renter.RenterGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	allowance := rg.Settings.Allowance
+	if err := renter.RenterCancelAllowance(); err != nil {
+		t.Fatal(err)
+	}
+	err = siatest.Retry(100, 100*time.Millisecond, func() error {
+		rc, err := renter.RenterContractsGet()
+		if err != nil {
+			return err
+		}
+		if len(rc.Contracts) != 0 {
+			return fmt.Errorf("expected no contracts, got %v", len(rc.Contracts))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Ask for three hosts of the pinned profile, only the pinned host is
+	// available.
+	if err := renter.HostDbProfilesSetDefaultPost("pinned"); err != nil {
+		t.Fatal(err)
+	}
+	allowance.Hosts = 3
+	if err := renter.RenterPostAllowance(allowance); err != nil {
+		t.Fatal(err)
+	}
+	err = siatest.Retry(100, 100*time.Millisecond, func() error {
+		rc, err := renter.RenterContractsGet()
+		if err != nil {
+			return err
+		}
+		if len(rc.Contracts) != 1 || rc.Contracts[0].HostPublicKey.String() != pinned.String() {
+			if err := miner.MineBlock(); err != nil {
+				return err
+			}
+			return fmt.Errorf("expected a single contract with the pinned host, got %v contracts", len(rc.Contracts))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The contractor warns about the capped target.
+	log, err := ioutil.ReadFile(filepath.Join(renterDir, modules.RenterDir, "contractor.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(log), `hostdb profile "pinned", but only 1 hosts are available`) {
+		t.Fatal("expected the contractor to warn about the capped contract target")
+	}
+
+	// Further maintenance doesn't form any other contracts.
+	for i := 0; i < 3; i++ {
+		if err := miner.MineBlock(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(time.Second)
+	rc, err := renter.RenterContractsGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rc.Contracts) != 1 {
+		t.Fatal("expected a single contract, got", len(rc.Contracts))
+	}
+}
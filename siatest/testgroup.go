@@ -32,13 +32,18 @@ type (
 		renters map[*TestNode]struct{}
 		miners  map[*TestNode]struct{}
 
+		// allowance is the allowance set for the group's renters, including
+		// the ones added to the group later on.
+		allowance modules.Allowance
+
 		dir string
 	}
 )
 
 var (
-	// defaultAllowance is the allowance used for the group's renters
-	defaultAllowance = modules.Allowance{
+	// DefaultAllowance is the allowance the renters of a new group use. It can
+	// be overridden for a single group with SetAllowance.
+	DefaultAllowance = modules.Allowance{
 		Funds:       types.SiacoinPrecision.Mul64(1e3),
 		Hosts:       5,
 		Period:      50,
@@ -55,6 +60,8 @@ func NewGroup(nodeParams ...node.NodeParams) (*TestGroup, error) {
 		hosts:   make(map[*TestNode]struct{}),
 		renters: make(map[*TestNode]struct{}),
 		miners:  make(map[*TestNode]struct{}),
+
+		allowance: DefaultAllowance,
 	}
 
 	// Create node and add it to the correct groups
@@ -116,11 +123,11 @@ func NewGroup(nodeParams ...node.NodeParams) (*TestGroup, error) {
 		return nil, build.ExtendErr("renter database check failed", err)
 	}
 	// Set renter allowances
-	if err := setRenterAllowances(tg.renters); err != nil {
+	if err := setRenterAllowances(tg.renters, tg.allowance); err != nil {
 		return nil, errors.AddContext(err, "failed to set renter allowance")
 	}
 	// Wait for all the renters to form contracts
-	if err := waitForContracts(miner, tg.renters, tg.hosts); err != nil {
+	if err := waitForContracts(miner, tg.renters, tg.hosts, tg.allowance); err != nil {
 		return nil, errors.AddContext(err, "renters failed to form contracts")
 	}
 	// Make sure all nodes are synced
@@ -309,9 +316,9 @@ func randomDir() string {
 }
 
 // setRenterAllowances sets the allowance of each renter
-func setRenterAllowances(renters map[*TestNode]struct{}) error {
+func setRenterAllowances(renters map[*TestNode]struct{}, allowance modules.Allowance) error {
 	for renter := range renters {
-		if err := renter.RenterPostAllowance(defaultAllowance); err != nil {
+		if err := renter.RenterPostAllowance(allowance); err != nil {
 			return err
 		}
 	}
@@ -362,9 +369,9 @@ func synchronizationCheck(miner *TestNode, nodes map[*TestNode]struct{}) error {
 }
 
 // waitForContracts waits until the renters have formed contracts with the
-// hosts in the group.
-func waitForContracts(miner *TestNode, renters map[*TestNode]struct{}, hosts map[*TestNode]struct{}) error {
-	expectedContracts := defaultAllowance.Hosts
+// hosts in the group as required by the provided allowance.
+func waitForContracts(miner *TestNode, renters map[*TestNode]struct{}, hosts map[*TestNode]struct{}, allowance modules.Allowance) error {
+	expectedContracts := allowance.Hosts
 	if uint64(len(hosts)) < expectedContracts {
 		expectedContracts = uint64(len(hosts))
 	}
@@ -426,6 +433,7 @@ func (tg *TestGroup) AddNodeN(np node.NodeParams, n int) error {
 func (tg *TestGroup) AddNodes(nps ...node.NodeParams) error {
 	newNodes := make(map[*TestNode]struct{})
 	newHosts := make(map[*TestNode]struct{})
+	newRenters := make(map[*TestNode]struct{})
 	for _, np := range nps {
 		// Create the nodes and add them to the group.
 		if np.Dir == "" {
@@ -445,6 +453,7 @@ func (tg *TestGroup) AddNodes(nps ...node.NodeParams) error {
 		// Add node to renters
 		if np.Renter != nil || np.CreateRenter {
 			tg.renters[node] = struct{}{}
+			newRenters[node] = struct{}{}
 		}
 		// Add node to miners
 		if np.Miner != nil || np.CreateMiner {
@@ -483,9 +492,13 @@ func (tg *TestGroup) AddNodes(nps ...node.NodeParams) error {
 	if err := hostsInRenterDBCheck(miner, tg.renters, tg.hosts); err != nil {
 		return build.ExtendErr("renter database check failed", err)
 	}
+	// Set the group's allowance for the new renters
+	if err := setRenterAllowances(newRenters, tg.allowance); err != nil {
+		return build.ExtendErr("failed to set renter allowance", err)
+	}
 	// Wait for all the renters to form contracts if the haven't got enough
 	// contracts already.
-	if err := waitForContracts(miner, tg.renters, tg.hosts); err != nil {
+	if err := waitForContracts(miner, tg.renters, tg.hosts, tg.allowance); err != nil {
 		return build.ExtendErr("renters failed to form contracts", err)
 	}
 	// Make sure all nodes are synced
@@ -495,6 +508,21 @@ func (tg *TestGroup) AddNodes(nps ...node.NodeParams) error {
 	return nil
 }
 
+// Allowance returns the allowance set for the renters of the group.
+func (tg *TestGroup) Allowance() modules.Allowance {
+	return tg.allowance
+}
+
+// SetAllowance overrides the allowance of the group. It is set for all of the
+// group's renters and used for renters added to the group later on.
+func (tg *TestGroup) SetAllowance(allowance modules.Allowance) error {
+	if err := setRenterAllowances(tg.renters, allowance); err != nil {
+		return build.ExtendErr("failed to set renter allowance", err)
+	}
+	tg.allowance = allowance
+	return nil
+}
+
 // Close closes the group and all its nodes. Closing a node is usually a slow
 // process, but we can speed it up a lot by closing each node in a separate
 // goroutine.
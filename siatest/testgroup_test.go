@@ -2,8 +2,10 @@ package siatest
 
 import (
 	"testing"
+	"time"
 
 	"github.com/pachisi456/sia-hostdb-profiles/build"
+	"github.com/pachisi456/sia-hostdb-profiles/node"
 )
 
 // TestCreateTestGroup tests the behavior of NewGroup.
@@ -98,3 +100,92 @@ func TestNewGroupNoRenterHost(t *testing.T) {
 		}
 	}()
 }
+
+// TestKnowsHostInProfile tests that KnowsHostInProfile checks the host tree of
+// the provided hostdb profile.
+func TestKnowsHostInProfile(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	groupParams := GroupParams{
+		Hosts:   1,
+		Renters: 1,
+		Miners:  1,
+	}
+	tg, err := NewGroupFromTemplate(groupParams)
+	if err != nil {
+		t.Fatal("Failed to create group: ", err)
+	}
+	defer func() {
+		if err := tg.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	renter, host := tg.Renters()[0], tg.Hosts()[0]
+
+	// The profile doesn't exist yet.
+	if err := renter.KnowsHostInProfile(host, "archive"); err == nil {
+		t.Fatal("expected error for an unknown hostdb profile")
+	}
+
+	// A newly added profile's tree is filled with the known hosts.
+	if err := renter.HostDbProfilesAddPost("archive", "cold"); err != nil {
+		t.Fatal(err)
+	}
+	err = Retry(100, 100*time.Millisecond, func() error {
+		return renter.KnowsHostInProfile(host, "archive")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := renter.KnowsHost(host); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestGroupSetAllowance checks that an overridden allowance is used for the
+// existing renters of a group and for renters added later on.
+func TestGroupSetAllowance(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	tg, err := NewGroupFromTemplate(GroupParams{
+		Hosts:   2,
+		Renters: 1,
+		Miners:  1,
+	})
+	if err != nil {
+		t.Fatal("Failed to create group: ", err)
+	}
+	defer func() {
+		if err := tg.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	if tg.Allowance().Period != DefaultAllowance.Period {
+		t.Fatal("expected the group to use the default allowance")
+	}
+
+	// Override the allowance and add another renter.
+	allowance := DefaultAllowance
+	allowance.Hosts = 2
+	allowance.Period = 100
+	allowance.RenewWindow = 20
+	if err := tg.SetAllowance(allowance); err != nil {
+		t.Fatal(err)
+	}
+	if err := tg.AddNodes(node.Renter(randomDir())); err != nil {
+		t.Fatal(err)
+	}
+	for _, renter := range tg.Renters() {
+		rg, err := renter.RenterGet()
+		if err != nil {
+			t.Fatal(err)
+		}
+		a := rg.Settings.Allowance
+		if a.Hosts != allowance.Hosts || a.Period != allowance.Period || a.RenewWindow != allowance.RenewWindow {
+			t.Errorf("expected renter allowance %v/%v/%v, got %v/%v/%v", allowance.Hosts, allowance.Period,
+				allowance.RenewWindow, a.Hosts, a.Period, a.RenewWindow)
+		}
+	}
+}
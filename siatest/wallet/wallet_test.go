@@ -6,9 +6,9 @@ import (
 	"testing"
 	"time"
 
-	"github.com/NebulousLabs/Sia/build"
-	"github.com/NebulousLabs/Sia/siatest"
-	"github.com/NebulousLabs/Sia/types"
+	"github.com/pachisi456/sia-hostdb-profiles/build"
+	"github.com/pachisi456/sia-hostdb-profiles/siatest"
+	"github.com/pachisi456/sia-hostdb-profiles/types"
 )
 
 // TestTransactionReorg makes sure that a processedTransaction isn't returned
@@ -110,3 +110,329 @@ func TestTransactionReorg(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+// TestWalletSweepSeed tests sweeping the funds of one node's seed into the
+// wallet of another node using the client's WalletSweepPost binding.
+func TestWalletSweepSeed(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	// Create a group with two funded miners.
+	tg, err := siatest.NewGroupFromTemplate(siatest.GroupParams{Miners: 2})
+	if err != nil {
+		t.Fatal("Failed to create group: ", err)
+	}
+	defer func() {
+		if err := tg.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	source, dest := tg.Miners()[0], tg.Miners()[1]
+
+	// Get the seed of the source node.
+	wsg, err := source.WalletSeedsGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Sweep the source seed into the destination wallet.
+	wsp, err := dest.WalletSweepPost(wsg.PrimarySeed, "english")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wsp.Coins.IsZero() {
+		t.Fatal("expected to sweep a non-zero amount of coins from a funded seed")
+	}
+
+	// Mine a block and make sure the swept coins show up at the destination.
+	if err := dest.MineBlock(); err != nil {
+		t.Fatal(err)
+	}
+	err = build.Retry(100, 100*time.Millisecond, func() error {
+		wg, err := dest.WalletGet()
+		if err != nil {
+			return err
+		}
+		if wg.ConfirmedSiacoinBalance.Cmp(wsp.Coins) < 0 {
+			return errors.New("swept coins are not confirmed yet")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestWalletSiafundsPost tests sending siafunds between two nodes using the
+// client's WalletSiafundsPost binding.
+func TestWalletSiafundsPost(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	// Create a group with two funded miners.
+	tg, err := siatest.NewGroupFromTemplate(siatest.GroupParams{Miners: 2})
+	if err != nil {
+		t.Fatal("Failed to create group: ", err)
+	}
+	defer func() {
+		if err := tg.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	sender, receiver := tg.Miners()[0], tg.Miners()[1]
+
+	// Test nodes only own siafunds if their seed matches one of the genesis
+	// siafund allocations.
+	wg, err := sender.WalletGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wg.SiafundBalance.IsZero() {
+		t.Skip("sending node does not own any siafunds")
+	}
+
+	// Send a single siafund to the receiver.
+	wag, err := receiver.WalletAddressGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wsp, err := sender.WalletSiafundsPost(types.NewCurrency64(1), wag.Address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(wsp.TransactionIDs) == 0 {
+		t.Fatal("expected the siafund transaction ids to be returned")
+	}
+
+	// Mine a block and make sure the siafund arrives.
+	if err := sender.MineBlock(); err != nil {
+		t.Fatal(err)
+	}
+	err = build.Retry(100, 100*time.Millisecond, func() error {
+		wg, err := receiver.WalletGet()
+		if err != nil {
+			return err
+		}
+		if wg.SiafundBalance.Cmp64(1) < 0 {
+			return errors.New("siafund has not arrived yet")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestWalletChangePasswordLockUnlock tests rotating the wallet's password and
+// then going through a lock/unlock cycle using the new password.
+func TestWalletChangePasswordLockUnlock(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	testdir, err := siatest.TestDir(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Create a miner.
+	miner, err := siatest.NewNode(siatest.Miner(filepath.Join(testdir, "miner")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := miner.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	// The wallet of a test node is encrypted using its primary seed.
+	wsg, err := miner.WalletSeedsGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Change the password and lock the wallet.
+	newPassword := "newpassword"
+	if err := miner.WalletChangePasswordPost(wsg.PrimarySeed, newPassword); err != nil {
+		t.Fatal(err)
+	}
+	if err := miner.WalletLockPost(); err != nil {
+		t.Fatal(err)
+	}
+	wg, err := miner.WalletGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wg.Unlocked {
+		t.Fatal("wallet should be locked")
+	}
+
+	// Unlocking with a wrong password should fail while the new password
+	// should unlock the wallet.
+	if err := miner.WalletUnlockPost("wrongpassword"); err == nil {
+		t.Fatal("wallet shouldn't unlock with a wrong password")
+	}
+	if err := miner.WalletUnlockPost(newPassword); err != nil {
+		t.Fatal(err)
+	}
+	wg, err = miner.WalletGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !wg.Unlocked {
+		t.Fatal("wallet should be unlocked")
+	}
+}
+
+// TestWalletSeedPost tests loading an auxiliary seed into a wallet and makes
+// sure it is reported by the /wallet/seeds endpoint.
+func TestWalletSeedPost(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	// Create a group with two funded miners.
+	tg, err := siatest.NewGroupFromTemplate(siatest.GroupParams{Miners: 2})
+	if err != nil {
+		t.Fatal("Failed to create group: ", err)
+	}
+	defer func() {
+		if err := tg.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	node, other := tg.Miners()[0], tg.Miners()[1]
+
+	// Use the primary seed of the other node as the auxiliary seed.
+	otherSeeds, err := other.WalletSeedsGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	auxSeed := otherSeeds.PrimarySeed
+
+	// The wallet of a test node is encrypted using its primary seed.
+	wsg, err := node.WalletSeedsGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := node.WalletSeedPost(auxSeed, "english", wsg.PrimarySeed); err != nil {
+		t.Fatal(err)
+	}
+
+	// The auxiliary seed should show up in AllSeeds now.
+	wsg, err = node.WalletSeedsGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wsg.PrimarySeed == auxSeed {
+		t.Fatal("auxiliary seed shouldn't replace the primary seed")
+	}
+	found := false
+	for _, seed := range wsg.AllSeeds {
+		if seed == auxSeed {
+			found = true
+			break
+		}
+	}
+	if !found {
+		t.Fatal("auxiliary seed is missing from AllSeeds")
+	}
+}
+
+// TestWalletAddressesGet checks that freshly generated addresses are listed by
+// the /wallet/addresses endpoint.
+func TestWalletAddressesGet(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	testdir, err := siatest.TestDir(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Create a miner.
+	miner, err := siatest.NewNode(siatest.Miner(filepath.Join(testdir, "miner")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := miner.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	// Generate a few addresses.
+	generated := make(map[types.UnlockHash]struct{})
+	for i := 0; i < 3; i++ {
+		wag, err := miner.WalletAddressGet()
+		if err != nil {
+			t.Fatal(err)
+		}
+		generated[wag.Address] = struct{}{}
+	}
+
+	// All of them should be listed.
+	wag, err := miner.WalletAddressesGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, addr := range wag.Addresses {
+		delete(generated, addr)
+	}
+	if len(generated) != 0 {
+		t.Fatalf("%v generated addresses are missing from the list of %v addresses", len(generated), len(wag.Addresses))
+	}
+}
+
+// TestTransactionPoolFeeGet checks that the fee estimation of the transaction
+// pool is non-zero after transactions have been sent.
+func TestTransactionPoolFeeGet(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	testdir, err := siatest.TestDir(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Create a miner.
+	miner, err := siatest.NewNode(siatest.Miner(filepath.Join(testdir, "miner")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := miner.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	// Send a few transactions to create some activity.
+	for i := 0; i < 3; i++ {
+		wag, err := miner.WalletAddressGet()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := miner.WalletSiacoinsPost(types.SiacoinPrecision, wag.Address); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := miner.MineBlock(); err != nil {
+		t.Fatal(err)
+	}
+
+	tfg, err := miner.TransactionPoolFeeGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tfg.Maximum.IsZero() {
+		t.Fatal("maximum fee estimation should be non-zero")
+	}
+	if tfg.Minimum.Cmp(tfg.Maximum) > 0 {
+		t.Fatalf("minimum fee %v exceeds maximum fee %v", tfg.Minimum, tfg.Maximum)
+	}
+}